@@ -40,22 +40,22 @@ func BenchmarkCPU(traceFile, conf, folder string) float64 {
 		})
 		fcacheServices = append(fcacheServices, flowstats.Service{
 			Name:    s.Name,
-			Collect: s.Collect,
+			Collect: flowstats.CounterConfigs(s.Collect),
 		})
 	}
 
 	var smap *servicemap.ServiceMap
-	if smap, err = servicemap.NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime); err != nil {
+	if smap, err = servicemap.NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime, c.DNSCache.MaxEntries, uint32(c.DNSCache.ShardsCount)); err != nil {
 		panic(err)
 	}
 	smap.ConfigServiceMap(smapServices)
 
-	slist := []string{}
+	configs := []counters.CounterConfig{}
 	for _, service := range fcacheServices {
-		slist = append(slist, service.Collect...)
+		configs = append(configs, service.Collect...)
 	}
 	counters := counters.AvailableCounters{}
-	nameToID, err := counters.Build(slist)
+	ids, err := counters.BuildConfigs(configs)
 	if err != nil {
 		panic("configuration error")
 	}
@@ -64,11 +64,8 @@ func BenchmarkCPU(traceFile, conf, folder string) float64 {
 
 	for _, service := range fcacheServices {
 		if id, ok := smap.GetId(service.Name); ok {
-			serviceIdToCountersId[id] = []int{}
-			for _, c := range service.Collect {
-				serviceIdToCountersId[id] = append(serviceIdToCountersId[id], nameToID[c])
-				// fmt.Printf("Added service %s:%d with counter %s:%d\n", service.Name, id, c, nameToID[c])
-			}
+			serviceIdToCountersId[id] = ids[:len(service.Collect)]
+			ids = ids[len(service.Collect):]
 		} else {
 			panic("configuration error")
 		}
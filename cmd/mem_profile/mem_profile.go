@@ -36,12 +36,12 @@ func BenchmarkMemory(traceFile, folder, conf string) {
 		})
 		fcacheServices = append(fcacheServices, flowstats.Service{
 			Name:    s.Name,
-			Collect: s.Collect,
+			Collect: flowstats.CounterConfigs(s.Collect),
 		})
 	}
 
 	var smap *servicemap.ServiceMap
-	if smap, err = servicemap.NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime); err == nil {
+	if smap, err = servicemap.NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime, c.DNSCache.MaxEntries, uint32(c.DNSCache.ShardsCount)); err == nil {
 		panic(err)
 	}
 	smap.ConfigServiceMap(smapServices)
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"path"
@@ -16,8 +18,10 @@ import (
 	"runtime/pprof"
 
 	"github.com/traffic-refinery/traffic-refinery/internal/config"
+	"github.com/traffic-refinery/traffic-refinery/internal/counters"
 	"github.com/traffic-refinery/traffic-refinery/internal/flowstats"
 	"github.com/traffic-refinery/traffic-refinery/internal/network"
+	"github.com/traffic-refinery/traffic-refinery/internal/qoe"
 	"github.com/traffic-refinery/traffic-refinery/internal/servicemap"
 	"github.com/traffic-refinery/traffic-refinery/internal/stats"
 )
@@ -28,6 +32,58 @@ const (
 	Version = "2.0"
 )
 
+func fieldPolicy(c config.FieldPrivacyConfig) flowstats.FieldPolicy {
+	return flowstats.FieldPolicy{
+		Action:   c.Action,
+		PrefixV4: c.PrefixV4,
+		PrefixV6: c.PrefixV6,
+		Labels:   c.Labels,
+		Bytes:    c.Bytes,
+	}
+}
+
+// newPrivacyPolicy builds the privacy policy applied to the exported flows.
+// Also returns the anonymizer used by the policy, if any
+func newPrivacyPolicy(conf *config.TrafficRefineryConfig) (*flowstats.PrivacyPolicy, *network.Anonymizer, error) {
+	var err error
+	localIP := conf.Privacy.LocalIP
+	if localIP.Action == "" && conf.FlowCache.Anonymize {
+		localIP.Action = flowstats.PolicyCryptoPAn
+	}
+
+	var anonymizer *network.Anonymizer
+	if localIP.Action == flowstats.PolicyCryptoPAn || conf.Privacy.ServiceIP.Action == flowstats.PolicyCryptoPAn {
+		if anonymizer, err = network.NewAnonymizer(conf.FlowCache.AnonymizeKeyFile, conf.FlowCache.AnonymizeKeyRotation); err != nil {
+			return nil, nil, err
+		}
+	}
+	var hmacKey []byte
+	if conf.Privacy.HMACKeyFile != "" {
+		data, err := os.ReadFile(conf.Privacy.HMACKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The trailing newline left by editors is not part of the key
+		hmacKey = bytes.TrimSpace(data)
+		if len(hmacKey) < flowstats.MinHMACKeySize {
+			return nil, nil, fmt.Errorf("HMAC key in %s is shorter than %d bytes", conf.Privacy.HMACKeyFile, flowstats.MinHMACKeySize)
+		}
+	}
+
+	policy, err := flowstats.NewPrivacyPolicy(anonymizer, hmacKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	policy.LocalIP = fieldPolicy(localIP)
+	policy.ServiceIP = fieldPolicy(conf.Privacy.ServiceIP)
+	policy.LocalPort = fieldPolicy(conf.Privacy.LocalPort)
+	policy.ServicePort = fieldPolicy(conf.Privacy.ServicePort)
+	policy.HwAddr = fieldPolicy(conf.Privacy.HwAddr)
+	policy.DomainName = fieldPolicy(conf.Privacy.DomainName)
+	policy.Payload = fieldPolicy(conf.Privacy.Payload)
+	return policy, anonymizer, nil
+}
+
 func loadConfig() config.TrafficRefineryConfig {
 	fname := flag.String("conf", "", "Configuration file to load. If none is provided it looks for trconfig.json in ./ and /etc/traffic_refinery/")
 	outFolder := flag.String("out", "", "Folder into which store output files. Defaults to /tmp/")
@@ -39,8 +95,15 @@ func loadConfig() config.TrafficRefineryConfig {
 	warn := flag.Bool("warn", false, "Log at warn level")
 	error := flag.Bool("error", false, "Log at error level")
 	fatal := flag.Bool("fatal", false, "Log at fatal level")
+	listCounters := flag.Bool("counters", false, "List the available counters with their output schema and exit")
 	flag.Parse()
 
+	if *listCounters {
+		out, _ := json.MarshalIndent(counters.Registered(), "", "  ")
+		fmt.Println(string(out))
+		os.Exit(0)
+	}
+
 	if *debug {
 		log.SetLevel(log.DebugLevel)
 	} else if *info {
@@ -141,16 +204,19 @@ func main() {
 			Code: servicemap.ServiceID(i),
 		})
 		fcacheServices = append(fcacheServices, flowstats.Service{
-			Name:    s.Name,
-			Collect: s.Collect,
+			Name:          s.Name,
+			Collect:       flowstats.CounterConfigs(s.Collect),
+			ActiveTimeout: s.ActiveTimeout,
+			IdleTimeout:   s.IdleTimeout,
 		})
 	}
 
 	var smap *servicemap.ServiceMap
-	if smap, err = servicemap.NewServiceMap(conf.DNSCache.EvictTime, conf.DNSCache.CleanupTime); err != nil {
+	if smap, err = servicemap.NewServiceMap(conf.DNSCache.EvictTime, conf.DNSCache.CleanupTime, conf.DNSCache.MaxEntries, uint32(conf.DNSCache.ShardsCount)); err != nil {
 		panic(err)
 	}
 	smap.ConfigServiceMap(smapServices)
+	smap.SetPerClient(conf.DNSCache.PerClient)
 
 	log.Infof("Running the DNS parser on interface %s", conf.Parsers.DNSParser.Ifname)
 
@@ -173,6 +239,20 @@ func main() {
 	dp := new(network.DNSParser)
 	dp.NewDNSParser(dnsni, smap)
 
+	var dnsstats *stats.DNSStats
+	if conf.Stats.Run && conf.Sys.DNSStats {
+		dnsstats = stats.NewDNSStats(smap)
+		dp.AddProcessor(dnsstats)
+	}
+
+	var hitters *flowstats.HeavyHitters
+	if conf.HeavyHitters.Run {
+		if hitters, err = flowstats.NewHeavyHitters(conf.HeavyHitters.K, conf.HeavyHitters.Capacity, conf.HeavyHitters.MaxDomains); err != nil {
+			panic(err)
+		}
+		dp.AddProcessor(hitters)
+	}
+
 	stop := make(chan struct{})
 	go dp.Parse(nil, stop)
 
@@ -180,6 +260,47 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	policy, anonymizer, err := newPrivacyPolicy(&conf)
+	if err != nil {
+		panic(err)
+	}
+	if anonymizer != nil {
+		defer anonymizer.Stop()
+	}
+	if err = flowcache.SetPrivacyPolicy(policy); err != nil {
+		panic(err)
+	}
+	if dnsstats != nil {
+		dnsstats.SetPrivacyPolicy(policy)
+	}
+	flowcache.SetTimeouts(conf.FlowCache.ActiveTimeout, conf.FlowCache.IdleTimeout)
+	if err = flowcache.SetLimits(conf.FlowCache.MaxFlows, conf.FlowCache.MaxBytes, conf.FlowCache.AdmissionPolicy, conf.FlowCache.SampleRate); err != nil {
+		panic(err)
+	}
+	flowcache.SetNewFlowRate(conf.FlowCache.NewFlowRate, conf.FlowCache.NewFlowBurst)
+	if !conf.Stats.Run {
+		// No dump collects the terminated flows
+		flowcache.SetMaxClosed(0)
+	} else if conf.FlowCache.MaxClosed > 0 {
+		flowcache.SetMaxClosed(conf.FlowCache.MaxClosed)
+	}
+	if err = flowcache.SetRollups(conf.FlowCache.Rollups, conf.FlowCache.FlowRecords); err != nil {
+		panic(err)
+	}
+	if hitters != nil {
+		flowcache.SetHeavyHitters(hitters)
+	}
+	if conf.VideoQoE.Run {
+		model, err := qoe.LoadModel(conf.VideoQoE.Model)
+		if err != nil {
+			panic(err)
+		}
+		sessions, err := qoe.NewSessions(model, conf.VideoQoE.SessionTimeout)
+		if err != nil {
+			panic(err)
+		}
+		flowcache.SetVideoSessions(sessions)
+	}
 	flowcache.AddServices(fcacheServices)
 
 	log.Debugf("Initializing %d parsers", len(conf.Parsers.TrafficParsers))
@@ -211,7 +332,7 @@ func main() {
 			trafficni.NewNetworkInterface(ifconf)
 			interfaces = append(interfaces, trafficni)
 			tp := new(network.TrafficParser)
-			tp.NewTrafficParser(trafficni, flowcache)
+			tp.NewTrafficParser(trafficni, flowcache.NewWorker())
 			stop2 := make(chan struct{})
 			go tp.Parse(nil, stop2)
 		}
@@ -220,7 +341,6 @@ func main() {
 	var printer *stats.Printer
 
 	if conf.Stats.Run {
-		// TODO refactor to emit times and services
 		if conf.Stats.Mode == "dump" {
 			printer = stats.NewPrinter(conf.Stats.Append, 60*time.Minute, conf.Sys.OutFolder, "tr")
 
@@ -232,14 +352,60 @@ func main() {
 				Collector: &ifcollector,
 			})
 
-			// TODO for the time being we support only a 10 second emit
-			cachedump := stats.CacheDump{
-				Fc: flowcache,
+			if dnsstats != nil {
+				printer.AddCollector(&stats.StatsCollector{
+					Period:    10 * time.Second,
+					Collector: dnsstats,
+				})
+			}
+
+			if conf.Sys.FlowCacheStats {
+				printer.AddCollector(&stats.StatsCollector{
+					Period:    10 * time.Second,
+					Collector: stats.NewFlowCacheStats(flowcache),
+				})
+			}
+
+			if hitters != nil {
+				printer.AddCollector(&stats.StatsCollector{
+					Period:    conf.HeavyHitters.Period,
+					Collector: stats.NewHeavyHittersStats(flowcache),
+				})
+			}
+
+			if conf.VideoQoE.Run {
+				printer.AddCollector(&stats.StatsCollector{
+					Period:    conf.VideoQoE.Period,
+					Collector: stats.NewVideoQoEStats(flowcache),
+				})
+			}
+
+			// Services sharing the same emit interval are dumped together
+			emitServices := make(map[time.Duration][]string)
+			emitPeriods := []time.Duration{}
+			for _, s := range conf.Services {
+				emit := s.Emit
+				if emit == 0 {
+					emit = stats.DefaultCacheDumpPeriod
+				} else if emit < stats.MinCacheDumpPeriod {
+					log.Warnf("Emit interval %s of service %s is too short, using %s", emit, s.Name, stats.MinCacheDumpPeriod)
+					emit = stats.MinCacheDumpPeriod
+				}
+				if _, ok := emitServices[emit]; !ok {
+					emitPeriods = append(emitPeriods, emit)
+				}
+				emitServices[emit] = append(emitServices[emit], s.Name)
+			}
+			for _, emit := range emitPeriods {
+				log.Infof("Dumping services %v every %s", emitServices[emit], emit)
+				printer.AddCollector(&stats.StatsCollector{
+					Period: emit,
+					Collector: &stats.CacheDump{
+						Fc:       flowcache,
+						Services: emitServices[emit],
+					},
+				})
 			}
-			printer.AddCollector(&stats.StatsCollector{
-				Period:    10 * time.Second,
-				Collector: &cachedump,
-			})
 
 			go printer.Run()
 		} else {
@@ -258,6 +424,7 @@ func main() {
 		log.Infof("Captured close signal, waiting for clean up of output...")
 		printer.Stop()
 	}
+	counters.WaitPNGImages()
 
 	if conf.Sys.MemProf {
 		runtime.GC() // get up-to-date heap statistics
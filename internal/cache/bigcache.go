@@ -1,93 +1,812 @@
 package cache
 
-// import (
-// 	"encoding/json"
-// 	"errors"
-// 	"sync"
-// 	"time"
-//
-// 	"github.com/allegro/bigcache"
-// )
-
-// //Wrapper structure around github.com/allegro/bigcache
-// type BigCache struct {
-// 	innerCache *bigcache.BigCache
-// }
-//
-// //Initializes a new BigCache with default config
-// func NewBigCache() (*BigCache, error) {
-// 	config := bigcache.Config{
-// 		// number of shards (must be a power of 2)
-// 		Shards: 1024,
-// 		// time after which entry can be evicted
-// 		LifeWindow: 10 * time.Minute,
-// 		// rps * lifeWindow, used only in initial memory allocation
-// 		MaxEntriesInWindow: 1000 * 10 * 60,
-// 		// max entry size in bytes, used only in initial memory allocation
-// 		MaxEntrySize: 500,
-// 		// prints information about additional memory allocation
-// 		Verbose: false,
-// 		// cache will not allocate more memory than this limit, value in MB
-// 		// if value is reached then the oldest entries can be overridden for the new ones
-// 		// 0 value means no size limit
-// 		HardMaxCacheSize: 8192,
-// 		// callback fired when the oldest entry is removed because of its expiration time or no space left
-// 		// for the new entry, or because delete was called. A bitmask representing the reason will be returned.
-// 		// Default value is nil which means no callback and it prevents from unwrapping the oldest entry.
-// 		OnRemove: nil,
-// 		// OnRemoveWithReason is a callback fired when the oldest entry is removed because of its expiration time or no space left
-// 		// for the new entry, or because delete was called. A constant representing the reason will be passed through.
-// 		// Default value is nil which means no callback and it prevents from unwrapping the oldest entry.
-// 		// Ignored if OnRemove is specified.
-// 		// OnRemoveWithReason: nil,
-// 	}
-// 	cache := &BigCache{}
-// 	innerCache, initErr := bigcache.NewBigCache(config)
-// 	cache.innerCache = innerCache
-//
-// 	return cache, initErr
-// }
-//
-// // BigCache implementation of a cache's Get
-// func (bc *BigCache) Get(key string) (Flow, error) {
-// 	bytesBlob, err := bc.innerCache.Get(key)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-//
-// 	//TODO: Cast should be done dependent on the stored data...
-// 	f := &GeneralFlow{}
-// 	err = json.Unmarshal(bytesBlob, f)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-//
-// 	return f, nil
-// }
-//
-// // BigCache implementation of a cache's Set
-// func (bc *BigCache) Set(key string, f Flow) error {
-// 	bytesBlob, err := f.MarshalBinary()
-// 	if err != nil {
-// 		return err
-// 	}
-//
-// 	bc.innerCache.Set(key, bytesBlob)
-// 	if err != nil {
-// 		return err
-// 	}
-//
-// 	return nil
-// }
-//
-// // BigCache implementation of a cache's Clear
-// func (bc *BigCache) Clear() error {
-// 	return bc.innerCache.Reset()
-// }
-//
-// // BigCache implementation of a cache's PurgeExpired
-// // Always returns an error as no inner function of
-// // BigCache allows its implementation
-// func (bc *BigCache) PurgeExpired() error {
-// 	return errors.New("BigCache: not implemented")
-// }
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// BigCache has been inspired by https://github.com/allegro/bigcache.
+// BigCache implements a sharded cache that stores its elements serialized in
+// byte arenas. Each shard indexes its entries with a map of integers to
+// offsets in the arena, so that neither the index nor the arena contain
+// pointers and the garbage collector does not need to scan them regardless of
+// the number of elements stored. Entries whose keys have the same hash are
+// chained through their headers.
+// Elements are converted to and from bytes by a Codec. The parts of the
+// elements too costly to serialize at every update, such as objects with
+// their own internal state, can be kept outside the arena in a slot of the
+// shard, which the garbage collector scans. Get and GetAndLock return a
+// decoded copy of the element sharing the part kept outside the arena:
+// changes to the copy are only stored in the cache by SetAndUnlock, Set or,
+// during iterations, when moving to the next element. With ReuseLocked,
+// GetAndLock decodes into a value reused by the shard, so that lookups do not
+// allocate.
+
+const (
+	// bigEntryHeaderSize is the size of the header preceding each entry:
+	// expiration (8 bytes), capacity (4 bytes), key length (2 bytes), value
+	// length (4 bytes), next entry with the same hash (4 bytes) and slot of
+	// the part kept outside the arena (4 bytes)
+	bigEntryHeaderSize = 26
+	// bigEntrySlack is the fraction of the value length reserved to let the
+	// value grow in place
+	bigEntrySlack = 4
+	// bigMinCompaction is the amount of garbage in bytes under which shards
+	// are never compacted
+	bigMinCompaction = 1 << 16
+)
+
+// Codec converts the elements stored in a BigCache to and from bytes
+type Codec interface {
+	// Encode appends the serialized form of v to dst. It also returns the
+	// part of v kept outside the arena, nil if none
+	Encode(dst []byte, v interface{}) ([]byte, interface{}, error)
+	// Decode returns the element serialized in data whose part kept outside
+	// the arena is ext. data is only valid until Decode returns
+	Decode(data []byte, ext interface{}) (interface{}, error)
+}
+
+// ReusingCodec is implemented by the codecs able to decode an element into a
+// value returned by a previous call instead of allocating a new one
+type ReusingCodec interface {
+	Codec
+	// DecodeInto is like Decode, restoring the element into v if possible.
+	// v is nil or a value returned by Decode or DecodeInto
+	DecodeInto(data []byte, ext interface{}, v interface{}) (interface{}, error)
+}
+
+// bigShard is a portion of the cache guarded by its own lock.
+// index maps the hash of the keys to the offset of the first of their entries
+// in entries. garbage is the number of bytes of entries no longer in use and
+// count the number of entries in use.
+// ext contains the parts of the elements kept outside the arena, by slot.
+// Slot 0 is never used so that entries without such a part store 0. free
+// lists the slots available. buf is the buffer used to encode the elements
+// and locked the value returned by the last GetAndLock, reused by the next
+// one when enabled by ReuseLocked
+type bigShard struct {
+	index   map[uint64]uint32
+	entries []byte
+	garbage int
+	count   int
+	ext     []interface{}
+	free    []uint32
+	buf     []byte
+	locked  interface{}
+	sync.RWMutex
+}
+
+// BigCache is a cache storing its elements serialized in byte arenas
+type BigCache struct {
+	shards         []*bigShard
+	shardCount     uint32
+	expirationTime time.Duration
+	codec          Codec
+	onEvicted      func(interface{})
+	interval       time.Duration
+	stop           chan bool
+	hash           func(string) uint64
+	reuse          ReusingCodec
+}
+
+// NewBigCache creates a new BigCache. Elements are serialized with codec.
+// Elements not updated for longer than expiration are removed every interval
+// and passed to onEvicted
+func NewBigCache(shardCount uint32, expiration time.Duration, onEvicted func(interface{}), interval time.Duration, codec Codec) *BigCache {
+	m := &BigCache{}
+	if shardCount == 0 {
+		shardCount = 1
+	}
+	m.shardCount = shardCount
+	m.expirationTime = expiration
+	m.shards = make([]*bigShard, shardCount)
+	m.onEvicted = onEvicted
+	m.interval = interval
+	m.codec = codec
+	m.hash = fnv64a
+	m.stop = make(chan bool)
+	for i := uint32(0); i < shardCount; i++ {
+		m.shards[i] = &bigShard{index: make(map[uint64]uint32)}
+	}
+	if m.interval > 0 {
+		m.runCacheTimer()
+	}
+	return m
+}
+
+// SetHashFunc replaces the function used to hash keys. Keys with the same
+// hash are told apart by comparing them, but make lookups slower.
+// Must be called before inserting any element
+func (m *BigCache) SetHashFunc(hash func(string) uint64) {
+	m.hash = hash
+}
+
+// ReuseLocked makes GetAndLock decode the elements into a value owned by their
+// shard, if the codec is a ReusingCodec, instead of allocating a new copy at
+// every call. The value is only valid until the shard is unlocked: callers
+// must copy the parts they keep afterwards. Must be called before inserting
+// any element
+func (m *BigCache) ReuseLocked() {
+	m.reuse, _ = m.codec.(ReusingCodec)
+}
+
+// Returns the hash of the key and the shard it belongs to
+func (m *BigCache) getShard(key string) (uint64, *bigShard) {
+	h := m.hash(key)
+	return h, m.shards[h%uint64(m.shardCount)]
+}
+
+// bigEntry is a view of an entry stored in a shard arena
+type bigEntry []byte
+
+func (e bigEntry) expiration() int64 {
+	return int64(binary.LittleEndian.Uint64(e[0:8]))
+}
+
+func (e bigEntry) setExpiration(exp int64) {
+	binary.LittleEndian.PutUint64(e[0:8], uint64(exp))
+}
+
+func (e bigEntry) capacity() int {
+	return int(binary.LittleEndian.Uint32(e[8:12]))
+}
+
+func (e bigEntry) keyLen() int {
+	return int(binary.LittleEndian.Uint16(e[12:14]))
+}
+
+func (e bigEntry) valLen() int {
+	return int(binary.LittleEndian.Uint32(e[14:18]))
+}
+
+// next returns the offset of the next entry with the same hash, false if
+// this is the last one
+func (e bigEntry) next() (uint32, bool) {
+	n := binary.LittleEndian.Uint32(e[18:22])
+	return n - 1, n != 0
+}
+
+// setNext links the entry at offset off after e, or ends the chain if ok is
+// false
+func (e bigEntry) setNext(off uint32, ok bool) {
+	var n uint32
+	if ok {
+		n = off + 1
+	}
+	binary.LittleEndian.PutUint32(e[18:22], n)
+}
+
+func (e bigEntry) slot() uint32 {
+	return binary.LittleEndian.Uint32(e[22:26])
+}
+
+func (e bigEntry) setSlot(slot uint32) {
+	binary.LittleEndian.PutUint32(e[22:26], slot)
+}
+
+func (e bigEntry) key() []byte {
+	return e[bigEntryHeaderSize : bigEntryHeaderSize+e.keyLen()]
+}
+
+func (e bigEntry) value() []byte {
+	start := bigEntryHeaderSize + e.keyLen()
+	return e[start : start+e.valLen()]
+}
+
+// size returns the number of bytes used by the entry in the arena
+func (e bigEntry) size() int {
+	return bigEntryHeaderSize + e.keyLen() + e.capacity()
+}
+
+func (e bigEntry) expired(now int64) bool {
+	exp := e.expiration()
+	return exp > 0 && now > exp
+}
+
+// entry returns the entry stored at offset off
+func (s *bigShard) entry(off uint32) bigEntry {
+	e := bigEntry(s.entries[off:])
+	return e[:e.size()]
+}
+
+// lookup returns the entry of key, or nil if the key is not in the shard
+func (s *bigShard) lookup(h uint64, key string) bigEntry {
+	off, ok := s.index[h]
+	for ok {
+		e := s.entry(off)
+		if string(e.key()) == key {
+			return e
+		}
+		off, ok = e.next()
+	}
+	return nil
+}
+
+// each calls f on every entry of the shard. f must not add or remove entries
+func (s *bigShard) each(f func(h uint64, e bigEntry)) {
+	for h, off := range s.index {
+		for ok := true; ok; {
+			e := s.entry(off)
+			f(h, e)
+			off, ok = e.next()
+		}
+	}
+}
+
+// extOf returns the part of the element of e kept outside the arena
+func (s *bigShard) extOf(e bigEntry) interface{} {
+	if slot := e.slot(); slot != 0 {
+		return s.ext[slot]
+	}
+	return nil
+}
+
+// setExt stores ext as the part of the element of e kept outside the arena
+func (s *bigShard) setExt(e bigEntry, ext interface{}) {
+	slot := e.slot()
+	if ext == nil {
+		if slot != 0 {
+			s.freeSlot(slot)
+			e.setSlot(0)
+		}
+		return
+	}
+	if slot == 0 {
+		if n := len(s.free); n > 0 {
+			slot = s.free[n-1]
+			s.free = s.free[:n-1]
+		} else {
+			if len(s.ext) == 0 {
+				s.ext = append(s.ext, nil)
+			}
+			slot = uint32(len(s.ext))
+			s.ext = append(s.ext, nil)
+		}
+		e.setSlot(slot)
+	}
+	s.ext[slot] = ext
+}
+
+// freeSlot makes slot available to other entries
+func (s *bigShard) freeSlot(slot uint32) {
+	s.ext[slot] = nil
+	s.free = append(s.free, slot)
+}
+
+// store stores value and ext under key, in place if the value fits in the
+// current entry
+func (s *bigShard) store(h uint64, key string, value []byte, ext interface{}, exp int64) error {
+	if len(key) > math.MaxUint16 {
+		return errors.New("key too long")
+	}
+	if e := s.lookup(h, key); e != nil {
+		if len(value) <= e.capacity() {
+			e.setExpiration(exp)
+			binary.LittleEndian.PutUint32(e[14:18], uint32(len(value)))
+			copy(e[bigEntryHeaderSize+e.keyLen():], value)
+			s.setExt(e, ext)
+			return nil
+		}
+		s.release(h, key)
+		s.maybeCompact()
+	}
+
+	capacity := len(value) + len(value)/bigEntrySlack
+	size := bigEntryHeaderSize + len(key) + capacity
+	if uint64(len(s.entries)+size) >= math.MaxUint32 {
+		s.compact()
+		if uint64(len(s.entries)+size) >= math.MaxUint32 {
+			return errors.New("cache shard is full")
+		}
+	}
+	off := len(s.entries)
+	if cap(s.entries)-off < size {
+		entries := make([]byte, off, 2*cap(s.entries)+size)
+		copy(entries, s.entries)
+		s.entries = entries
+	}
+	s.entries = s.entries[:off+size]
+	e := bigEntry(s.entries[off : off+size])
+	e.setExpiration(exp)
+	binary.LittleEndian.PutUint32(e[8:12], uint32(capacity))
+	binary.LittleEndian.PutUint16(e[12:14], uint16(len(key)))
+	binary.LittleEndian.PutUint32(e[14:18], uint32(len(value)))
+	// New entries go first in the chain of their hash
+	head, ok := s.index[h]
+	e.setNext(head, ok)
+	e.setSlot(0)
+	copy(e[bigEntryHeaderSize:], key)
+	copy(e[bigEntryHeaderSize+len(key):], value)
+	s.setExt(e, ext)
+	s.index[h] = uint32(off)
+	s.count++
+	return nil
+}
+
+// release removes the entry of key from the index, accounts its bytes as
+// garbage and frees its slot
+func (s *bigShard) release(h uint64, key string) {
+	var prev bigEntry
+	off, ok := s.index[h]
+	for ok {
+		e := s.entry(off)
+		next, hasNext := e.next()
+		if string(e.key()) == key {
+			if prev != nil {
+				prev.setNext(next, hasNext)
+			} else if hasNext {
+				s.index[h] = next
+			} else {
+				delete(s.index, h)
+			}
+			if slot := e.slot(); slot != 0 {
+				s.freeSlot(slot)
+			}
+			s.garbage += e.size()
+			s.count--
+			return
+		}
+		prev = e
+		off, ok = next, hasNext
+	}
+}
+
+// maybeCompact compacts the arena when more than half of it is unused.
+// Changes the offsets of the entries, must not be called while iterating
+// over the index
+func (s *bigShard) maybeCompact() {
+	if s.garbage > bigMinCompaction && s.garbage > len(s.entries)/2 {
+		s.compact()
+	}
+}
+
+// compact copies the entries in use to a new arena
+func (s *bigShard) compact() {
+	entries := make([]byte, 0, len(s.entries)-s.garbage)
+	for h, off := range s.index {
+		s.index[h] = uint32(len(entries))
+		for ok := true; ok; {
+			e := s.entry(off)
+			moved := len(entries)
+			entries = append(entries, e...)
+			off, ok = e.next()
+			bigEntry(entries[moved:]).setNext(uint32(len(entries)), ok)
+		}
+	}
+	s.entries = entries
+	s.garbage = 0
+}
+
+// reset empties the shard
+func (s *bigShard) reset() {
+	s.index = make(map[uint64]uint32)
+	s.entries = nil
+	s.garbage = 0
+	s.count = 0
+	s.ext = nil
+	s.free = nil
+}
+
+func (m *BigCache) expiration() int64 {
+	return time.Now().UnixNano() + int64(m.expirationTime)
+}
+
+// set encodes and stores value. Must be called while holding the lock of the
+// shard
+func (m *BigCache) set(h uint64, shard *bigShard, key string, value interface{}, exp int64) error {
+	data, ext, err := m.codec.Encode(shard.buf[:0], value)
+	if err != nil {
+		return err
+	}
+	shard.buf = data
+	return shard.store(h, key, data, ext, exp)
+}
+
+// decode returns the element of the entry e of shard
+func (m *BigCache) decode(shard *bigShard, e bigEntry) (interface{}, error) {
+	return m.codec.Decode(e.value(), shard.extOf(e))
+}
+
+// evicted passes the element v to onEvicted if both are set
+func (m *BigCache) evicted(v interface{}) {
+	if v != nil && m.onEvicted != nil {
+		m.onEvicted(v)
+	}
+}
+
+// Sets the given value under the specified key.
+func (m *BigCache) Set(key string, value interface{}) error {
+	h, shard := m.getShard(key)
+	shard.Lock()
+	err := m.set(h, shard, key, value, m.expiration())
+	shard.Unlock()
+	return err
+}
+
+// Sets the given value under the specified key if not present.
+func (m *BigCache) Add(key string, value interface{}) (bool, error) {
+	h, shard := m.getShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	if shard.lookup(h, key) != nil {
+		return false, nil
+	}
+	return true, m.set(h, shard, key, value, m.expiration())
+}
+
+// Retrieves a copy of the element stored under the given key.
+func (m *BigCache) Get(key string) (interface{}, bool) {
+	h, shard := m.getShard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+	e := shard.lookup(h, key)
+	if e == nil {
+		return nil, false
+	}
+	v, err := m.decode(shard, e)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// Returns the number of elements within the cache.
+func (m *BigCache) Count() int {
+	count := 0
+	for _, shard := range m.shards {
+		shard.RLock()
+		count += shard.count
+		shard.RUnlock()
+	}
+	return count
+}
+
+// Returns a copy of the element stored under the given key, but keeps its
+// shard blocked. Changes to the copy are stored by SetAndUnlock. With
+// ReuseLocked the copy is reused by the next call on the same shard.
+// Risk of deadlock warning: if SetAndUnlock, RemoveAndUnlock or Unlock are not
+// called after this function the shard containing the item will never be
+// unlocked
+func (m *BigCache) GetAndLock(key string) (interface{}, bool) {
+	h, shard := m.getShard(key)
+	shard.Lock()
+	if e := shard.lookup(h, key); e != nil {
+		if m.reuse != nil {
+			if v, err := m.reuse.DecodeInto(e.value(), shard.extOf(e), shard.locked); err == nil {
+				shard.locked = v
+				return v, true
+			}
+		} else if v, err := m.decode(shard, e); err == nil {
+			return v, true
+		}
+	}
+	// In case the object is not found it unlocks
+	shard.Unlock()
+	return nil, false
+}
+
+// Inserts the element into the cache.
+// If an element with the same key exists it replaces it.
+// Finally it unlocks the mutex
+func (m *BigCache) SetAndUnlock(key string, value interface{}) error {
+	h, shard := m.getShard(key)
+	err := m.set(h, shard, key, value, m.expiration())
+	shard.Unlock()
+	return err
+}
+
+// Removes the element from the cache and unlocks the mutex.
+// Must only be called after GetAndLock has found the element
+func (m *BigCache) RemoveAndUnlock(key string) error {
+	h, shard := m.getShard(key)
+	shard.release(h, key)
+	shard.maybeCompact()
+	shard.Unlock()
+	return nil
+}
+
+// Unlocks the mutex associated with a given key
+func (m *BigCache) Unlock(key string) error {
+	_, shard := m.getShard(key)
+	shard.Unlock()
+	return nil
+}
+
+// Removes an element from the cache.
+func (m *BigCache) Remove(key string) {
+	h, shard := m.getShard(key)
+	shard.Lock()
+	shard.release(h, key)
+	shard.maybeCompact()
+	shard.Unlock()
+}
+
+func (m *BigCache) Clear() error {
+	//First locks the entire cache (all shards)
+	for _, shard := range m.shards {
+		shard.Lock()
+	}
+	//Then reomve all elements
+	for _, shard := range m.shards {
+		shard.reset()
+	}
+	// Finally it unlocks the entire cache
+	for _, shard := range m.shards {
+		shard.Unlock()
+	}
+	return nil
+}
+
+func (m *BigCache) PurgeExpired() error {
+	m.DeleteExpired()
+	return nil
+}
+
+// Delete all expired items from the cache. Only the evicted elements are
+// decoded
+func (m *BigCache) DeleteExpired() {
+	now := time.Now().UnixNano()
+	m.deleteIf(func(shard *bigShard, e bigEntry) (interface{}, bool) {
+		if !e.expired(now) {
+			return nil, false
+		}
+		if m.onEvicted == nil {
+			return nil, true
+		}
+		v, err := m.decode(shard, e)
+		if err != nil {
+			return nil, true
+		}
+		return v, true
+	})
+}
+
+// Removes the elements for which expired returns true. expired is called
+// with a decoded copy of each element while holding the lock of the shard
+// containing it
+func (m *BigCache) PurgeFunc(expired func(interface{}) bool) error {
+	m.deleteIf(func(shard *bigShard, e bigEntry) (interface{}, bool) {
+		v, err := m.decode(shard, e)
+		if err != nil {
+			return nil, false
+		}
+		return v, expired(v)
+	})
+	return nil
+}
+
+// Calls f on a decoded copy of the element stored under key while holding the
+// lock of its shard. The copy is stored back, keeping the expiration of the
+// element, unless f returns true, in which case the element is removed and
+// passed to onEvicted
+func (m *BigCache) Visit(key string, f func(interface{}) bool) bool {
+	h, shard := m.getShard(key)
+	shard.Lock()
+	e := shard.lookup(h, key)
+	if e == nil {
+		shard.Unlock()
+		return false
+	}
+	v, err := m.decode(shard, e)
+	if err != nil {
+		shard.Unlock()
+		return false
+	}
+	remove := f(v)
+	if remove {
+		shard.release(h, key)
+		shard.maybeCompact()
+	} else {
+		m.set(h, shard, key, v, e.expiration())
+	}
+	shard.Unlock()
+	if remove {
+		m.evicted(v)
+	}
+	return true
+}
+
+// bigRemoval identifies an entry to remove
+type bigRemoval struct {
+	h   uint64
+	key string
+}
+
+// Removes the entries matching the condition and passes the elements it
+// returns to onEvicted
+func (m *BigCache) deleteIf(condition func(*bigShard, bigEntry) (interface{}, bool)) {
+	var evictedItems []interface{}
+	var removed []bigRemoval
+	for _, shard := range m.shards {
+		shard.Lock()
+		removed = removed[:0]
+		shard.each(func(h uint64, e bigEntry) {
+			if v, ok := condition(shard, e); ok {
+				removed = append(removed, bigRemoval{h: h, key: string(e.key())})
+				if v != nil {
+					evictedItems = append(evictedItems, v)
+				}
+			}
+		})
+		for _, r := range removed {
+			shard.release(r.h, r.key)
+		}
+		shard.maybeCompact()
+		shard.Unlock()
+	}
+	for _, evicted := range evictedItems {
+		m.evicted(evicted)
+	}
+}
+
+// Returns all items as map[string]interface{}
+func (m *BigCache) Dump() map[string]interface{} {
+	tmp := make(map[string]interface{})
+	for _, shard := range m.shards {
+		shard.RLock()
+		shard.each(func(h uint64, e bigEntry) {
+			if v, err := m.decode(shard, e); err == nil {
+				tmp[string(e.key())] = v
+			}
+		})
+		shard.RUnlock()
+	}
+	return tmp
+}
+
+// BigCacheIterator iterates over the elements of a BigCache one shard at a
+// time, keeping the current shard locked. Each element returned is stored
+// back into the cache when moving to the next one, so that changes made
+// during the iteration are preserved
+type BigCacheIterator struct {
+	//
+	init bool
+	//
+	done bool
+	//
+	m *BigCache
+	//
+	currentShard int
+	// keys are the keys of the current shard
+	keys []string
+	//
+	currentKey int
+	// last is the element returned by the previous call and its key
+	last    interface{}
+	lastKey string
+}
+
+// lockNextShard locks the first shard with elements starting from index
+// from and lists its keys. Returns false if there are no more elements
+func (i *BigCacheIterator) lockNextShard(from int) bool {
+	i.currentShard = -1
+	for j := from; j < len(i.m.shards); j++ {
+		shard := i.m.shards[j]
+		shard.Lock()
+		if shard.count > 0 {
+			i.currentShard = j
+			i.keys = make([]string, 0, shard.count)
+			shard.each(func(h uint64, e bigEntry) {
+				i.keys = append(i.keys, string(e.key()))
+			})
+			i.currentKey = 0
+			return true
+		}
+		shard.Unlock()
+	}
+	return false
+}
+
+// storeLast writes back the element returned by the previous call. Must be
+// called while holding the lock of the current shard
+func (i *BigCacheIterator) storeLast() {
+	if i.last == nil {
+		return
+	}
+	shard := i.m.shards[i.currentShard]
+	h := i.m.hash(i.lastKey)
+	if e := shard.lookup(h, i.lastKey); e != nil {
+		i.m.set(h, shard, i.lastKey, i.last, e.expiration())
+	}
+	i.last = nil
+}
+
+func (i *BigCacheIterator) getNextElement() (interface{}, bool) {
+	// If the iteration was completed previously return
+	if i.done {
+		return nil, false
+	}
+	// Initialize if needed
+	if !i.init {
+		i.init = true
+		if !i.lockNextShard(0) {
+			// No items in the cache, it's done
+			i.done = true
+			return nil, false
+		}
+	} else {
+		i.storeLast()
+	}
+
+	for {
+		shard := i.m.shards[i.currentShard]
+		for i.currentKey < len(i.keys) {
+			key := i.keys[i.currentKey]
+			i.currentKey++
+			e := shard.lookup(i.m.hash(key), key)
+			if e == nil {
+				continue
+			}
+			v, err := i.m.decode(shard, e)
+			if err != nil {
+				continue
+			}
+			i.last = v
+			i.lastKey = key
+			return v, true
+		}
+		// Find next shard with items otherwise return done
+		shard.Unlock()
+		if !i.lockNextShard(i.currentShard + 1) {
+			i.done = true
+			return nil, false
+		}
+	}
+}
+
+func (i *BigCacheIterator) clear() {
+	if i.init && !i.done {
+		i.storeLast()
+		i.m.shards[i.currentShard].Unlock()
+	}
+	i.done = true
+}
+
+func (m *BigCache) IterativeDump() (CacheIterator, error) {
+	return &BigCacheIterator{
+		init: false,
+		done: false,
+		m:    m,
+	}, nil
+}
+
+func (m *BigCache) NextElement(i CacheIterator) (interface{}, error) {
+	if iter, ok := i.(*BigCacheIterator); !ok {
+		return nil, errors.New("wrong iterator type")
+	} else if v, ok := iter.getNextElement(); ok {
+		return v, nil
+	} else {
+		return nil, nil
+	}
+}
+
+func (m *BigCache) StopIteration(i CacheIterator) error {
+	if iter, ok := i.(*BigCacheIterator); !ok {
+		return errors.New("wrong iterator type")
+	} else {
+		iter.clear()
+		return nil
+	}
+}
+
+func (m *BigCache) runCacheTimer() {
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		for {
+			select {
+			case <-ticker.C:
+				m.DeleteExpired()
+			case <-m.stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (m *BigCache) stopCacheTimer() {
+	m.stop <- true
+}
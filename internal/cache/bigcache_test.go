@@ -0,0 +1,345 @@
+package cache
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// stringCodec stores strings as their bytes
+type stringCodec struct{}
+
+func (stringCodec) Encode(dst []byte, v interface{}) ([]byte, interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, nil, errors.New("not a string")
+	}
+	return append(dst, s...), nil, nil
+}
+
+func (stringCodec) Decode(data []byte, ext interface{}) (interface{}, error) {
+	return string(data), nil
+}
+
+// intCodec stores pointers to integers as their decimal representation
+type intCodec struct{}
+
+func (intCodec) Encode(dst []byte, v interface{}) ([]byte, interface{}, error) {
+	return strconv.AppendInt(dst, int64(*v.(*int)), 10), nil, nil
+}
+
+func (intCodec) Decode(data []byte, ext interface{}) (interface{}, error) {
+	n, err := strconv.Atoi(string(data))
+	return &n, err
+}
+
+// reusingIntCodec is an intCodec decoding into the integers it returned
+type reusingIntCodec struct {
+	intCodec
+}
+
+func (reusingIntCodec) DecodeInto(data []byte, ext interface{}, v interface{}) (interface{}, error) {
+	n, ok := v.(*int)
+	if !ok {
+		n = new(int)
+	}
+	var err error
+	*n, err = strconv.Atoi(string(data))
+	return n, err
+}
+
+// pairCodec stores the first string of a pair in the arena and keeps the
+// second one outside
+type pairCodec struct{}
+
+type pair struct {
+	in, out string
+}
+
+func (pairCodec) Encode(dst []byte, v interface{}) ([]byte, interface{}, error) {
+	p := v.(pair)
+	if p.out == "" {
+		return append(dst, p.in...), nil, nil
+	}
+	return append(dst, p.in...), p.out, nil
+}
+
+func (pairCodec) Decode(data []byte, ext interface{}) (interface{}, error) {
+	p := pair{in: string(data)}
+	if ext != nil {
+		p.out = ext.(string)
+	}
+	return p, nil
+}
+
+func TestBigCache(t *testing.T) {
+	tc := NewBigCache(DEFAULT_SHARD_COUNT, DEFAULT_EXPIRATION, nil, 0, stringCodec{})
+
+	if v, found := tc.Get("a"); found || v != nil {
+		t.Fatalf("Getting a found value that shouldn't exist: %v", v)
+	}
+
+	tc.Set("a", "x")
+	tc.Set("b", "y")
+	if v, found := tc.Get("a"); !found || v.(string) != "x" {
+		t.Fatalf("Wrong value for a: %v", v)
+	}
+
+	// Values growing beyond their capacity are moved to a new entry
+	tc.Set("a", "a much longer value than before")
+	if v, found := tc.Get("a"); !found || v.(string) != "a much longer value than before" {
+		t.Fatalf("Wrong value for a after update: %v", v)
+	}
+	if v, found := tc.Get("b"); !found || v.(string) != "y" {
+		t.Fatalf("Wrong value for b after update of a: %v", v)
+	}
+
+	if err := tc.Set("c", 1); err == nil {
+		t.Fatalf("Values not supported by the codec should not be stored")
+	}
+	if tc.Count() != 2 {
+		t.Fatalf("Expected 2 elements, found %d", tc.Count())
+	}
+}
+
+func TestBigCacheLock(t *testing.T) {
+	tc := NewBigCache(DEFAULT_SHARD_COUNT, DEFAULT_EXPIRATION, nil, 0, stringCodec{})
+	tc.Set("a", "x")
+
+	v, found := tc.GetAndLock("a")
+	if !found {
+		t.Fatalf("a not found")
+	}
+	tc.SetAndUnlock("a", v.(string)+"z")
+	if v, _ := tc.Get("a"); v.(string) != "xz" {
+		t.Fatalf("Wrong value for a after SetAndUnlock: %v", v)
+	}
+
+	if _, found := tc.GetAndLock("a"); !found {
+		t.Fatalf("a not found")
+	}
+	tc.RemoveAndUnlock("a")
+	if _, found := tc.Get("a"); found {
+		t.Fatalf("a should have been removed")
+	}
+
+	// Missing keys do not keep the shard locked
+	if _, found := tc.GetAndLock("a"); found {
+		t.Fatalf("a should have been removed")
+	}
+	tc.Set("a", "x")
+}
+
+func TestBigCacheReuseLocked(t *testing.T) {
+	tc := NewBigCache(1, DEFAULT_EXPIRATION, nil, 0, reusingIntCodec{})
+	tc.ReuseLocked()
+	a, b := 1, 2
+	tc.Set("a", &a)
+	tc.Set("b", &b)
+
+	// The value returned is reused by the next lookup of the shard
+	v, _ := tc.GetAndLock("a")
+	*v.(*int) = 3
+	tc.SetAndUnlock("a", v)
+	w, _ := tc.GetAndLock("b")
+	tc.Unlock("b")
+	if v != w || *w.(*int) != 2 {
+		t.Fatalf("Value not reused: %v %v", v, w)
+	}
+	if v, _ := tc.Get("a"); *v.(*int) != 3 {
+		t.Fatalf("Wrong value for a after SetAndUnlock: %v", *v.(*int))
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		v, _ := tc.GetAndLock("a")
+		tc.SetAndUnlock("a", v)
+	})
+	if allocs != 0 {
+		t.Fatalf("Lookups allocate %f times", allocs)
+	}
+}
+
+func TestBigCacheCollision(t *testing.T) {
+	evicted := []interface{}{}
+	tc := NewBigCache(1, DEFAULT_EXPIRATION, func(v interface{}) {
+		evicted = append(evicted, v)
+	}, 0, stringCodec{})
+	tc.SetHashFunc(func(string) uint64 { return 1 })
+
+	// Keys with the same hash are chained
+	tc.Set("a", "x")
+	tc.Set("b", "y")
+	tc.Set("c", "z")
+	for k, expected := range map[string]string{"a": "x", "b": "y", "c": "z"} {
+		if v, found := tc.Get(k); !found || v.(string) != expected {
+			t.Fatalf("Wrong value for %s: %v", k, v)
+		}
+	}
+	if tc.Count() != 3 || len(tc.Dump()) != 3 {
+		t.Fatalf("Expected 3 elements, found %d", tc.Count())
+	}
+
+	// Removing the middle of the chain keeps the others reachable, also
+	// after moving them to a new arena
+	tc.Remove("b")
+	tc.Set("a", "a value too long to be updated in place")
+	tc.shards[0].compact()
+	if _, found := tc.Get("b"); found {
+		t.Fatalf("b should have been removed")
+	}
+	if v, found := tc.Get("a"); !found || v.(string) != "a value too long to be updated in place" {
+		t.Fatalf("Wrong value for a: %v", v)
+	}
+	if v, found := tc.Get("c"); !found || v.(string) != "z" {
+		t.Fatalf("Wrong value for c: %v", v)
+	}
+	if len(evicted) != 0 {
+		t.Fatalf("Colliding values should not be evicted: %v", evicted)
+	}
+}
+
+func TestBigCacheExt(t *testing.T) {
+	tc := NewBigCache(1, DEFAULT_EXPIRATION, nil, 0, pairCodec{})
+	tc.Set("a", pair{in: "x", out: "1"})
+	tc.Set("b", pair{in: "y"})
+	if v, _ := tc.Get("a"); v.(pair) != (pair{in: "x", out: "1"}) {
+		t.Fatalf("Wrong value for a: %v", v)
+	}
+	if v, _ := tc.Get("b"); v.(pair) != (pair{in: "y"}) {
+		t.Fatalf("Wrong value for b: %v", v)
+	}
+
+	// Slots are released with their entries and reused
+	tc.Remove("a")
+	tc.Set("c", pair{in: "z", out: "3"})
+	if n := len(tc.shards[0].ext); n != 2 {
+		t.Fatalf("Slot not reused, %d slots allocated", n)
+	}
+	tc.Set("c", pair{in: "z"})
+	if v, _ := tc.Get("c"); v.(pair) != (pair{in: "z"}) {
+		t.Fatalf("Wrong value for c: %v", v)
+	}
+	if n := len(tc.shards[0].free); n != 1 {
+		t.Fatalf("Slot of c not released, %d free slots", n)
+	}
+}
+
+func TestBigCacheIterativeDump(t *testing.T) {
+	tc := NewBigCache(4, DEFAULT_EXPIRATION, nil, 0, intCodec{})
+	n := 100
+	for k := 0; k < n; k++ {
+		v := k
+		tc.Set(strconv.Itoa(k), &v)
+	}
+
+	// Changes to the elements returned by the iterator are stored when
+	// moving to the next element
+	i, _ := tc.IterativeDump()
+	count := 0
+	for {
+		v, err := tc.NextElement(i)
+		if err != nil {
+			t.Fatalf("Iteration failed: %s", err)
+		}
+		if v == nil {
+			break
+		}
+		*v.(*int) += 1000
+		count++
+	}
+	if count != n {
+		t.Fatalf("Iterated over %d elements instead of %d", count, n)
+	}
+	for k, v := range tc.Dump() {
+		if expected, _ := strconv.Atoi(k); *v.(*int) != expected+1000 {
+			t.Fatalf("Wrong value %d for %s after iteration", *v.(*int), k)
+		}
+	}
+
+	// Stopping the iteration stores the last element and unlocks the shard
+	i, _ = tc.IterativeDump()
+	v, _ := tc.NextElement(i)
+	*v.(*int) = -1
+	tc.StopIteration(i)
+	found := false
+	for k := 0; k < n; k++ {
+		if v, _ := tc.Get(strconv.Itoa(k)); *v.(*int) == -1 {
+			found = true
+		}
+		tc.Set(strconv.Itoa(k), &k)
+	}
+	if !found {
+		t.Fatalf("Element changed before stopping the iteration not stored")
+	}
+}
+
+func TestBigCacheExpired(t *testing.T) {
+	evicted := map[interface{}]bool{}
+	tc := NewBigCache(DEFAULT_SHARD_COUNT, 1*time.Millisecond, func(v interface{}) {
+		evicted[v] = true
+	}, 0, stringCodec{})
+	tc.Set("a", "x")
+	tc.Set("b", "y")
+
+	<-time.After(5 * time.Millisecond)
+	tc.DeleteExpired()
+	if len(evicted) != 2 || !evicted["x"] || !evicted["y"] {
+		t.Fatalf("Expired items not passed to onEvicted: %v", evicted)
+	}
+	if tc.Count() != 0 {
+		t.Fatalf("Expired items still in the cache")
+	}
+}
+
+func TestBigCacheVisitExpiration(t *testing.T) {
+	tc := NewBigCache(DEFAULT_SHARD_COUNT, 20*time.Millisecond, nil, 0, stringCodec{})
+	tc.Set("a", "x")
+	<-time.After(10 * time.Millisecond)
+	// Visiting an element does not delay its expiration
+	tc.Visit("a", func(v interface{}) bool { return false })
+	<-time.After(15 * time.Millisecond)
+	tc.DeleteExpired()
+	if tc.Count() != 0 {
+		t.Fatalf("Visited element not expired")
+	}
+}
+
+func TestBigCachePurgeFunc(t *testing.T) {
+	evicted := map[interface{}]bool{}
+	tc := NewBigCache(DEFAULT_SHARD_COUNT, DEFAULT_EXPIRATION, func(v interface{}) {
+		evicted[v] = true
+	}, 0, stringCodec{})
+	tc.Set("a", "x")
+	tc.Set("b", "y")
+	tc.PurgeFunc(func(v interface{}) bool {
+		return v.(string) == "x"
+	})
+	if len(evicted) != 1 || !evicted["x"] {
+		t.Fatalf("Purged items not passed to onEvicted: %v", evicted)
+	}
+	if _, found := tc.Get("b"); !found {
+		t.Fatalf("b should not have been purged")
+	}
+}
+
+func TestBigCacheCompaction(t *testing.T) {
+	tc := NewBigCache(1, DEFAULT_EXPIRATION, nil, 0, stringCodec{})
+	value := string(make([]byte, 1024))
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 256; i++ {
+			tc.Set(strconv.Itoa(i), value)
+		}
+		for i := 0; i < 256; i++ {
+			tc.Remove(strconv.Itoa(i))
+		}
+	}
+	tc.Set("a", "x")
+	shard := tc.shards[0]
+	if shard.garbage > bigMinCompaction || len(shard.entries) > 2*bigMinCompaction {
+		t.Fatalf("Shard not compacted: %d bytes used, %d garbage", len(shard.entries), shard.garbage)
+	}
+	if v, found := tc.Get("a"); !found || v.(string) != "x" {
+		t.Fatalf("Wrong value for a after compaction: %v", v)
+	}
+}
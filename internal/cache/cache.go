@@ -8,16 +8,29 @@ type Cache interface {
 	// Set inserts the element into the cache.
 	// If an element with the same key exists it replaces it.
 	Set(string, interface{}) error
+	// Add inserts the element into the cache if no element with the same key
+	// exists. Returns false, leaving the cache unchanged, otherwise
+	Add(string, interface{}) (bool, error)
 	// SetAndUnlock inserts the element into the cache.
 	// If an element with the same key exists it replaces it.
 	// Finally it unlocks the mutex
 	SetAndUnlock(string, interface{}) error
+	// RemoveAndUnlock removes the element from the cache.
+	// Finally it unlocks the mutex
+	RemoveAndUnlock(string) error
 	// Unlock unlocks the mutex associated with a given key
 	Unlock(string) error
 	// Clear empties the entire cache
 	Clear() error
 	// PurgeExpired removes expired elements from the cache
 	PurgeExpired() error
+	// PurgeFunc removes the elements for which expired returns true
+	PurgeFunc(expired func(interface{}) bool) error
+	// Visit calls f on the element stored under key while holding its lock.
+	// Changes made by f are stored without refreshing the expiration of the
+	// element. If f returns true the element is removed like by PurgeFunc.
+	// Returns false if the key is not in the cache
+	Visit(key string, f func(interface{}) bool) bool
 	// Dump returns a dump of the entire cache
 	Dump() map[string]interface{}
 	//
@@ -42,6 +42,7 @@ type ConcurrentCacheMap struct {
 	onEvicted      func(interface{})
 	interval       time.Duration
 	stop           chan bool
+	hash           func(string) uint64
 }
 
 // A "thread" safe string to anything map.
@@ -68,8 +69,17 @@ func NewConcurrentCacheMap(shardCount uint32, expiration time.Duration, onEvicte
 	return m
 }
 
+// SetHashFunc replaces the function used to select the shard of a key.
+// Must be called before inserting any element
+func (m *ConcurrentCacheMap) SetHashFunc(hash func(string) uint64) {
+	m.hash = hash
+}
+
 // Returns shard under given key
 func (m *ConcurrentCacheMap) getShard(key string) *Shard {
+	if m.hash != nil {
+		return m.shards[m.hash(key)%uint64(m.shardCount)]
+	}
 	return m.shards[uint(fnv32(key))%uint(m.shardCount)]
 }
 
@@ -83,6 +93,18 @@ func (m *ConcurrentCacheMap) Set(key string, value interface{}) error {
 	return nil
 }
 
+// Sets the given value under the specified key if not present.
+func (m *ConcurrentCacheMap) Add(key string, value interface{}) (bool, error) {
+	shard := m.getShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	if _, ok := shard.items[key]; ok {
+		return false, nil
+	}
+	shard.items[key] = Item{Object: value, Expiration: time.Duration(time.Now().UnixNano()) + m.expirationTime}
+	return true, nil
+}
+
 // Retrieves an element from map under given key.
 func (m *ConcurrentCacheMap) Get(key string) (interface{}, bool) {
 	// Get shard
@@ -163,6 +185,15 @@ func (m *ConcurrentCacheMap) SetAndUnlock(key string, value interface{}) error {
 	return nil
 }
 
+// Removes the element from the cache and unlocks the mutex.
+// Must only be called after GetAndLock has found the element
+func (m *ConcurrentCacheMap) RemoveAndUnlock(key string) error {
+	shard := m.getShard(key)
+	delete(shard.items, key)
+	shard.Unlock()
+	return nil
+}
+
 // Unlocks the mutex associated with a given key
 // Risk of deadlock warning: if SetAndUnlock or Unlock are not called after this function
 // the shard containing the item will never be unlocked
@@ -219,13 +250,50 @@ func (m *ConcurrentCacheMap) IsEmpty() bool {
 
 // Delete all expired items from the cache.
 func (m *ConcurrentCacheMap) DeleteExpired() {
-	var evictedItems []interface{}
 	now := time.Duration(time.Now().UnixNano())
+	m.deleteIf(func(v Item) bool {
+		// "Inlining" of expired
+		return v.Expiration > 0 && now > v.Expiration
+	})
+}
+
+// Removes the elements for which expired returns true. expired is called
+// while holding the lock of the shard containing the element
+func (m *ConcurrentCacheMap) PurgeFunc(expired func(interface{}) bool) error {
+	m.deleteIf(func(v Item) bool {
+		return expired(v.Object)
+	})
+	return nil
+}
+
+// Calls f on the element stored under key while holding the lock of its
+// shard, removing it if f returns true
+func (m *ConcurrentCacheMap) Visit(key string, f func(interface{}) bool) bool {
+	shard := m.getShard(key)
+	shard.Lock()
+	v, ok := shard.items[key]
+	if !ok {
+		shard.Unlock()
+		return false
+	}
+	remove := f(v.Object)
+	if remove {
+		delete(shard.items, key)
+	}
+	shard.Unlock()
+	if remove && m.onEvicted != nil {
+		m.onEvicted(v.Object)
+	}
+	return true
+}
+
+// Removes the items matching the condition and passes them to onEvicted
+func (m *ConcurrentCacheMap) deleteIf(condition func(Item) bool) {
+	var evictedItems []interface{}
 	for _, shard := range m.shards {
 		shard.Lock()
 		for k, v := range shard.items {
-			// "Inlining" of expired
-			if v.Expiration > 0 && now > v.Expiration {
+			if condition(v) {
 				evicted := v.Object
 				delete(shard.items, k)
 				evictedItems = append(evictedItems, evicted)
@@ -234,7 +302,7 @@ func (m *ConcurrentCacheMap) DeleteExpired() {
 		shard.Unlock()
 	}
 	if m.onEvicted != nil {
-		for evicted := range evictedItems {
+		for _, evicted := range evictedItems {
 			m.onEvicted(evicted)
 		}
 	}
@@ -67,6 +67,21 @@ func TestCache(t *testing.T) {
 	}
 }
 
+func TestCacheOnEvicted(t *testing.T) {
+	evicted := map[interface{}]bool{}
+	tc := NewConcurrentCacheMap(DEFAULT_SHARD_COUNT, 1*time.Millisecond, func(v interface{}) {
+		evicted[v] = true
+	}, 0)
+	tc.Set("a", "x")
+	tc.Set("b", "y")
+
+	<-time.After(5 * time.Millisecond)
+	tc.DeleteExpired()
+	if len(evicted) != 2 || !evicted["x"] || !evicted["y"] {
+		t.Error("onEvicted was not called with the evicted values:", evicted)
+	}
+}
+
 func TestCacheTimes(t *testing.T) {
 	var found bool
 
@@ -319,3 +334,48 @@ func benchmarkCache1090ManyConcurrent(b *testing.B, exp time.Duration) {
 	}
 	wg.Wait()
 }
+
+func TestCacheAdd(t *testing.T) {
+	for name, tc := range map[string]Cache{
+		"ConcurrentCacheMap": NewConcurrentCacheMap(DEFAULT_SHARD_COUNT, DEFAULT_EXPIRATION, nil, 0),
+		"Map":                NewMap(DEFAULT_EXPIRATION, nil),
+		"BigCache":           NewBigCache(DEFAULT_SHARD_COUNT, DEFAULT_EXPIRATION, nil, 0, stringCodec{}),
+	} {
+		if added, err := tc.Add("a", "x"); !added || err != nil {
+			t.Fatalf("%s: can not add a: %v", name, err)
+		}
+		if added, err := tc.Add("a", "y"); added || err != nil {
+			t.Fatalf("%s: a added twice: %v", name, err)
+		}
+		if v, found := tc.Get("a"); !found || v.(string) != "x" {
+			t.Fatalf("%s: wrong value for a: %v", name, v)
+		}
+	}
+}
+
+func TestCacheVisit(t *testing.T) {
+	for name, tc := range map[string]Cache{
+		"ConcurrentCacheMap": NewConcurrentCacheMap(DEFAULT_SHARD_COUNT, DEFAULT_EXPIRATION, nil, 0),
+		"Map":                NewMap(DEFAULT_EXPIRATION, nil),
+		"BigCache":           NewBigCache(DEFAULT_SHARD_COUNT, DEFAULT_EXPIRATION, nil, 0, pairCodec{}),
+	} {
+		tc.Set("a", pair{in: "x"})
+		tc.Set("b", pair{in: "y"})
+		if tc.Visit("c", func(v interface{}) bool { return false }) {
+			t.Fatalf("%s: visited a missing element", name)
+		}
+		var visited interface{}
+		if !tc.Visit("a", func(v interface{}) bool { visited = v; return false }) || visited.(pair).in != "x" {
+			t.Fatalf("%s: wrong element visited %v", name, visited)
+		}
+		if !tc.Visit("b", func(v interface{}) bool { return true }) {
+			t.Fatalf("%s: b not visited", name)
+		}
+		if _, found := tc.Get("b"); found {
+			t.Fatalf("%s: b not removed", name)
+		}
+		if _, found := tc.Get("a"); !found {
+			t.Fatalf("%s: a removed", name)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"errors"
+	"time"
+)
+
+// Map is a cache with no concurrency support. The lock related functions do
+// not lock anything: the map must only be used by one goroutine at a time,
+// typically the worker owning it. Expired elements are only removed by
+// explicit calls to PurgeExpired
+type Map struct {
+	items          map[string]Item
+	expirationTime time.Duration
+	onEvicted      func(interface{})
+}
+
+// NewMap creates a new Map. Elements not updated for longer than expiration
+// are removed by PurgeExpired and passed to onEvicted
+func NewMap(expiration time.Duration, onEvicted func(interface{})) *Map {
+	return &Map{
+		items:          make(map[string]Item),
+		expirationTime: expiration,
+		onEvicted:      onEvicted,
+	}
+}
+
+// Sets the given value under the specified key.
+func (m *Map) Set(key string, value interface{}) error {
+	m.items[key] = Item{Object: value, Expiration: time.Duration(time.Now().UnixNano()) + m.expirationTime}
+	return nil
+}
+
+// Sets the given value under the specified key if not present.
+func (m *Map) Add(key string, value interface{}) (bool, error) {
+	if _, ok := m.items[key]; ok {
+		return false, nil
+	}
+	return true, m.Set(key, value)
+}
+
+// Retrieves an element from map under given key.
+func (m *Map) Get(key string) (interface{}, bool) {
+	if val, ok := m.items[key]; ok {
+		return val.Object, true
+	}
+	return nil, false
+}
+
+// Returns the number of elements within the map.
+func (m *Map) Count() int {
+	return len(m.items)
+}
+
+// Same as Get, the map has no lock
+func (m *Map) GetAndLock(key string) (interface{}, bool) {
+	return m.Get(key)
+}
+
+// Same as Set, the map has no lock
+func (m *Map) SetAndUnlock(key string, value interface{}) error {
+	return m.Set(key, value)
+}
+
+// Removes the element from the map
+func (m *Map) RemoveAndUnlock(key string) error {
+	delete(m.items, key)
+	return nil
+}
+
+// Does nothing, the map has no lock
+func (m *Map) Unlock(key string) error {
+	return nil
+}
+
+func (m *Map) Clear() error {
+	m.items = make(map[string]Item)
+	return nil
+}
+
+func (m *Map) PurgeExpired() error {
+	now := time.Duration(time.Now().UnixNano())
+	m.deleteIf(func(v Item) bool {
+		return v.Expiration > 0 && now > v.Expiration
+	})
+	return nil
+}
+
+// Removes the elements for which expired returns true
+func (m *Map) PurgeFunc(expired func(interface{}) bool) error {
+	m.deleteIf(func(v Item) bool {
+		return expired(v.Object)
+	})
+	return nil
+}
+
+// Calls f on the element stored under key, removing it if f returns true
+func (m *Map) Visit(key string, f func(interface{}) bool) bool {
+	v, ok := m.items[key]
+	if !ok {
+		return false
+	}
+	if f(v.Object) {
+		delete(m.items, key)
+		if m.onEvicted != nil {
+			m.onEvicted(v.Object)
+		}
+	}
+	return true
+}
+
+// Removes the items matching the condition and passes them to onEvicted
+func (m *Map) deleteIf(condition func(Item) bool) {
+	var evictedItems []interface{}
+	for k, v := range m.items {
+		if condition(v) {
+			delete(m.items, k)
+			evictedItems = append(evictedItems, v.Object)
+		}
+	}
+	if m.onEvicted != nil {
+		for _, evicted := range evictedItems {
+			m.onEvicted(evicted)
+		}
+	}
+}
+
+// Returns all items as map[string]interface{}
+func (m *Map) Dump() map[string]interface{} {
+	tmp := make(map[string]interface{}, len(m.items))
+	for k, v := range m.items {
+		tmp[k] = v.Object
+	}
+	return tmp
+}
+
+// MapIterator iterates over the elements present in a Map when the iteration
+// started. Elements removed during the iteration are skipped
+type MapIterator struct {
+	m          *Map
+	keys       []string
+	currentKey int
+}
+
+func (i *MapIterator) getNextElement() (interface{}, bool) {
+	for i.currentKey < len(i.keys) {
+		i.currentKey++
+		if v, ok := i.m.items[i.keys[i.currentKey-1]]; ok {
+			return v.Object, true
+		}
+	}
+	return nil, false
+}
+
+func (i *MapIterator) clear() {
+	i.currentKey = len(i.keys)
+}
+
+func (m *Map) IterativeDump() (CacheIterator, error) {
+	keys := make([]string, 0, len(m.items))
+	for k := range m.items {
+		keys = append(keys, k)
+	}
+	return &MapIterator{m: m, keys: keys}, nil
+}
+
+func (m *Map) NextElement(i CacheIterator) (interface{}, error) {
+	if iter, ok := i.(*MapIterator); !ok {
+		return nil, errors.New("wrong iterator type")
+	} else if v, ok := iter.getNextElement(); ok {
+		return v, nil
+	} else {
+		return nil, nil
+	}
+}
+
+func (m *Map) StopIteration(i CacheIterator) error {
+	if iter, ok := i.(*MapIterator); !ok {
+		return errors.New("wrong iterator type")
+	} else {
+		iter.clear()
+		return nil
+	}
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMap(t *testing.T) {
+	tc := NewMap(DEFAULT_EXPIRATION, nil)
+	if v, found := tc.GetAndLock("a"); found || v != nil {
+		t.Fatalf("Getting a found value that shouldn't exist: %v", v)
+	}
+	tc.Set("a", 1)
+	tc.Set("b", 2)
+	v, found := tc.GetAndLock("a")
+	if !found || v.(int) != 1 {
+		t.Fatalf("Wrong value for a: %v", v)
+	}
+	tc.SetAndUnlock("a", 3)
+	if v, _ := tc.Get("a"); v.(int) != 3 {
+		t.Fatalf("Wrong value for a after SetAndUnlock: %v", v)
+	}
+
+	// Elements removed during an iteration are skipped
+	i, _ := tc.IterativeDump()
+	count := 0
+	for {
+		v, _ := tc.NextElement(i)
+		if v == nil {
+			break
+		}
+		tc.RemoveAndUnlock("a")
+		tc.RemoveAndUnlock("b")
+		count++
+	}
+	if count != 1 || tc.Count() != 0 {
+		t.Fatalf("Iterated over %d elements, %d left in the map", count, tc.Count())
+	}
+}
+
+func TestMapExpired(t *testing.T) {
+	evicted := map[interface{}]bool{}
+	tc := NewMap(1*time.Millisecond, func(v interface{}) {
+		evicted[v] = true
+	})
+	tc.Set("a", "x")
+	tc.Set("b", "y")
+
+	<-time.After(5 * time.Millisecond)
+	tc.PurgeExpired()
+	if len(evicted) != 2 || !evicted["x"] || !evicted["y"] {
+		t.Fatalf("Expired items not passed to onEvicted: %v", evicted)
+	}
+	if tc.Count() != 0 {
+		t.Fatalf("Expired items still in the map")
+	}
+}
@@ -1,29 +1,79 @@
 package cache
 
 import (
+	"container/list"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	DEFAULT_TIME_CACHE_MAX_ENTRIES int    = 1 << 20
+	DEFAULT_TIME_CACHE_SHARD_COUNT uint32 = 32
+)
+
 type TimeItem struct {
+	Key        string
 	Object     interface{}
 	Expiration int64
 	LastUsed   int64
 }
 
+// SimpleTimeCacheStats contains the counters describing the cache usage
+type SimpleTimeCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Expired   uint64
+	Size      uint64
+}
+
+// timeShard is a portion of the cache guarded by its own lock.
+// lru keeps the entries ordered from the most to the least recently used
+type timeShard struct {
+	items map[string]*list.Element
+	lru   *list.List
+	sync.Mutex
+}
+
+// SimpleTimeCache is a cache of entries with an optional time to live.
+// Entries are spread across shards to limit lock contention. When a maximum
+// number of entries is set, each shard evicts its least recently used entries
+// to make room for new ones.
 type SimpleTimeCache struct {
-	items       map[string]TimeItem
+	shards      []*timeShard
+	shardCount  uint32
+	maxPerShard int
 	cleanupTime time.Duration
 	evictTime   time.Duration
 	stop        chan bool
-	sync.RWMutex
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	expired   uint64
+	size      int64
 }
 
-func NewSimpleTimeCache(cleanupTime, evictTime time.Duration) *SimpleTimeCache {
+// NewSimpleTimeCache creates a new SimpleTimeCache.
+// maxEntries is the maximum number of entries stored across all shards, a
+// value of 0 disables the limit
+func NewSimpleTimeCache(cleanupTime, evictTime time.Duration, maxEntries int, shardCount uint32) *SimpleTimeCache {
 	sc := &SimpleTimeCache{}
-	sc.items = make(map[string]TimeItem)
+	if shardCount == 0 {
+		shardCount = 1
+	}
+	sc.shardCount = shardCount
+	sc.shards = make([]*timeShard, shardCount)
+	for i := uint32(0); i < shardCount; i++ {
+		sc.shards[i] = &timeShard{items: make(map[string]*list.Element), lru: list.New()}
+	}
+	if maxEntries > 0 {
+		sc.maxPerShard = (maxEntries + int(shardCount) - 1) / int(shardCount)
+	}
 	sc.cleanupTime = cleanupTime
 	sc.evictTime = evictTime
+	sc.stop = make(chan bool)
 
 	if sc.cleanupTime > 0 {
 		sc.runCacheTimer()
@@ -31,52 +81,106 @@ func NewSimpleTimeCache(cleanupTime, evictTime time.Duration) *SimpleTimeCache {
 	return sc
 }
 
+// Returns shard under given key
+func (sc *SimpleTimeCache) getShard(key string) *timeShard {
+	return sc.shards[uint(fnv32(key))%uint(sc.shardCount)]
+}
+
 // Insert new entry in the IPCache
 func (sc *SimpleTimeCache) Insert(key string, value interface{}, ttl int64) error {
 	var expireTime int64
+	now := time.Now().Unix()
 	if ttl == 0 {
 		expireTime = 0
 	} else {
-		expireTime = time.Now().Unix() + ttl
+		expireTime = now + ttl
 	}
-	item := TimeItem{
-		Object:     value,
-		Expiration: expireTime,
-		LastUsed:   time.Now().Unix(),
+	shard := sc.getShard(key)
+	shard.Lock()
+	if e, ok := shard.items[key]; ok {
+		item := e.Value.(*TimeItem)
+		item.Object = value
+		item.Expiration = expireTime
+		item.LastUsed = now
+		shard.lru.MoveToFront(e)
+	} else {
+		// Make room for the new entry removing the least recently used one
+		if sc.maxPerShard > 0 && shard.lru.Len() >= sc.maxPerShard {
+			if oldest := shard.lru.Back(); oldest != nil {
+				shard.lru.Remove(oldest)
+				delete(shard.items, oldest.Value.(*TimeItem).Key)
+				atomic.AddUint64(&sc.evictions, 1)
+				atomic.AddInt64(&sc.size, -1)
+			}
+		}
+		shard.items[key] = shard.lru.PushFront(&TimeItem{
+			Key:        key,
+			Object:     value,
+			Expiration: expireTime,
+			LastUsed:   now,
+		})
+		atomic.AddInt64(&sc.size, 1)
 	}
-	sc.Lock()
-	sc.items[key] = item
-	sc.Unlock()
+	shard.Unlock()
 	return nil
 }
 
 // Lookup allows to lookup entries in the cache map
 func (sc *SimpleTimeCache) Lookup(key string) (value interface{}, found bool) {
 	now := time.Now().Unix()
-	sc.Lock()
-	defer sc.Unlock()
-	if entry, ok := sc.items[key]; ok {
-		if entry.Expiration > 0 && entry.Expiration < now {
-			delete(sc.items, key)
-			return nil, false
+	shard := sc.getShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	if e, ok := shard.items[key]; ok {
+		item := e.Value.(*TimeItem)
+		if item.Expiration > 0 && item.Expiration < now {
+			shard.lru.Remove(e)
+			delete(shard.items, key)
+			atomic.AddUint64(&sc.expired, 1)
+			atomic.AddInt64(&sc.size, -1)
 		} else {
-			entry.LastUsed = now
-			return entry.Object, true
+			item.LastUsed = now
+			shard.lru.MoveToFront(e)
+			atomic.AddUint64(&sc.hits, 1)
+			return item.Object, true
 		}
 	}
+	atomic.AddUint64(&sc.misses, 1)
 	return nil, false
 }
 
+// Len returns the number of entries in the cache
+func (sc *SimpleTimeCache) Len() int {
+	return int(atomic.LoadInt64(&sc.size))
+}
+
+// Stats returns the counters describing the cache usage
+func (sc *SimpleTimeCache) Stats() SimpleTimeCacheStats {
+	return SimpleTimeCacheStats{
+		Hits:      atomic.LoadUint64(&sc.hits),
+		Misses:    atomic.LoadUint64(&sc.misses),
+		Evictions: atomic.LoadUint64(&sc.evictions),
+		Expired:   atomic.LoadUint64(&sc.expired),
+		Size:      uint64(sc.Len()),
+	}
+}
+
 // Removes unused DNS mappings form the local cache. It uses a default 600s (10m) expiry time
 func (sc *SimpleTimeCache) ClearCache() {
 	now := time.Now().Unix()
-	sc.Lock()
-	for i, d := range sc.items {
-		if d.Expiration < now && d.LastUsed+int64(sc.evictTime/time.Second) < now { // delete only if expired AND the IP hasn't been seen in 10 min
-			delete(sc.items, i)
+	for _, shard := range sc.shards {
+		shard.Lock()
+		for k, e := range shard.items {
+			d := e.Value.(*TimeItem)
+			if d.Expiration < now && d.LastUsed+int64(sc.evictTime/time.Second) < now { // delete only if expired AND the IP hasn't been seen in 10 min
+				shard.lru.Remove(e)
+				delete(shard.items, k)
+				atomic.AddUint64(&sc.expired, 1)
+				atomic.AddInt64(&sc.size, -1)
+			}
 		}
+		shard.Unlock()
 	}
-	sc.Unlock()
 }
 
 func (sc *SimpleTimeCache) runCacheTimer() {
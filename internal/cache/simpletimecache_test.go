@@ -1 +1,75 @@
 package cache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSimpleTimeCacheInsertLookup(t *testing.T) {
+	sc := NewSimpleTimeCache(0, DEFAULT_EXPIRATION, 0, DEFAULT_TIME_CACHE_SHARD_COUNT)
+	sc.Insert("a", 1, 0)
+	if v, found := sc.Lookup("a"); !found || v.(int) != 1 {
+		t.Fatalf("Entry a not found or with wrong value %v", v)
+	}
+	if _, found := sc.Lookup("b"); found {
+		t.Fatalf("Entry b should not be in the cache")
+	}
+	s := sc.Stats()
+	if s.Hits != 1 || s.Misses != 1 || s.Size != 1 {
+		t.Fatalf("Wrong cache stats %+v", s)
+	}
+}
+
+func TestSimpleTimeCacheExpire(t *testing.T) {
+	sc := NewSimpleTimeCache(0, DEFAULT_EXPIRATION, 0, DEFAULT_TIME_CACHE_SHARD_COUNT)
+	sc.Insert("a", 1, 1)
+	time.Sleep(2 * time.Second)
+	if _, found := sc.Lookup("a"); found {
+		t.Fatalf("Entry a should be expired")
+	}
+	if s := sc.Stats(); s.Expired != 1 || s.Size != 0 {
+		t.Fatalf("Wrong cache stats %+v", s)
+	}
+}
+
+func TestSimpleTimeCacheLRU(t *testing.T) {
+	// A single shard makes the eviction order deterministic
+	sc := NewSimpleTimeCache(0, DEFAULT_EXPIRATION, 3, 1)
+	sc.Insert("a", 1, 0)
+	sc.Insert("b", 2, 0)
+	sc.Insert("c", 3, 0)
+	// Using a makes b the least recently used entry
+	sc.Lookup("a")
+	sc.Insert("d", 4, 0)
+	if _, found := sc.Lookup("b"); found {
+		t.Fatalf("Entry b should have been evicted")
+	}
+	for _, k := range []string{"a", "c", "d"} {
+		if _, found := sc.Lookup(k); !found {
+			t.Fatalf("Entry %s should be in the cache", k)
+		}
+	}
+	if s := sc.Stats(); s.Evictions != 1 || s.Size != 3 {
+		t.Fatalf("Wrong cache stats %+v", s)
+	}
+}
+
+func TestSimpleTimeCacheBounded(t *testing.T) {
+	sc := NewSimpleTimeCache(0, DEFAULT_EXPIRATION, 1000, DEFAULT_TIME_CACHE_SHARD_COUNT)
+	for i := 0; i < 100000; i++ {
+		sc.Insert(strconv.Itoa(i), i, 0)
+	}
+	// Each shard holds at most its share of the maximum entries
+	if sc.Len() > 1000+int(DEFAULT_TIME_CACHE_SHARD_COUNT) {
+		t.Fatalf("Cache size %d exceeds the limit %d", sc.Len(), 1000)
+	}
+}
+
+func BenchmarkSimpleTimeCacheInsert(b *testing.B) {
+	sc := NewSimpleTimeCache(0, DEFAULT_EXPIRATION, DEFAULT_TIME_CACHE_MAX_ENTRIES, DEFAULT_TIME_CACHE_SHARD_COUNT)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sc.Insert(strconv.Itoa(i), i, 0)
+	}
+}
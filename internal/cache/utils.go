@@ -42,3 +42,14 @@ func djb33(seed uint32, k string) uint32 {
 	}
 	return d ^ (d >> 16)
 }
+
+// fnv64a is the 64 bits version of the FNV-1a hashing function
+func fnv64a(key string) uint64 {
+	hash := uint64(14695981039346656037)
+	const prime64 = uint64(1099511628211)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= prime64
+	}
+	return hash
+}
@@ -3,9 +3,11 @@ package config
 
 import (
 	"path/filepath"
+	"reflect"
 	"strings"
 	"time"
 
+	"github.com/mitchellh/mapstructure"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
@@ -19,6 +21,11 @@ type SysConfig struct {
 	// InterfacesStats is a boolean determing whether to print out interface
 	// statistics
 	InterfacesStats bool
+	// DNSStats is a boolean determining whether to print out DNS analytics
+	DNSStats bool
+	// FlowCacheStats is a boolean determining whether to print out the flow
+	// cache usage counters
+	FlowCacheStats bool
 	// OutFolder is the path where to store the output files
 	OutFolder string
 }
@@ -61,11 +68,20 @@ type DNSCacheConfig struct {
 	EvictTime time.Duration
 	// Length of the garbage collection period.
 	CleanupTime time.Duration
+	// Maximum number of entries in the cache. Least recently used entries are
+	// evicted when full. 0 means no limit
+	MaxEntries int
+	// Number of shards used for concurrency
+	ShardsCount int
+	// Whether to also key cached DNS answers by the IP of the client that
+	// issued the query. Allows attributing server IPs shared by multiple
+	// services based on what each client actually resolved
+	PerClient bool
 }
 
 // FlowCacheConfig provides configurations used by the FlowCache
 type FlowCacheConfig struct {
-	// Cache type. Currently only supports "ConcurrentCacheMap"
+	// Cache type. One of "ConcurrentCacheMap", "BigCache" or "PerWorker"
 	CacheType string
 	// Time before eviction from the cache
 	EvictTime time.Duration
@@ -73,8 +89,115 @@ type FlowCacheConfig struct {
 	ShardsCount int
 	// Length of the garbage collection period.
 	CleanupTime time.Duration
-	// Whether to anonymize IP addresses or not
+	// Whether to anonymize local IP addresses or not. Shorthand for a
+	// "cryptopan" privacy policy on LocalIP, ignored if the Privacy section
+	// sets a policy for LocalIP
 	Anonymize bool
+	// Path of the file containing the Crypto-PAn key used for anonymization,
+	// either raw or hex encoded. If empty a random key is generated at startup
+	AnonymizeKeyFile string
+	// Period after which the anonymization key is replaced with a newly
+	// generated one. Addresses are anonymized when the records are exported,
+	// so all the records exported after a rotation use the new key. 0
+	// disables the rotation
+	AnonymizeKeyRotation time.Duration
+	// Maximum duration of a flow record. Longer flows are exported and
+	// restarted. 0 disables the timeout
+	ActiveTimeout time.Duration
+	// Time without packets after which a flow is terminated and exported.
+	// 0 disables the timeout
+	IdleTimeout time.Duration
+	// Maximum number of flows in the cache. 0 means no limit
+	MaxFlows int
+	// Maximum estimated memory in bytes used by the flows in the cache.
+	// 0 means no limit
+	MaxBytes int64
+	// Policy applied to new flows when the cache is full. Either "drop"
+	// (reject new flows), "oldest" (evict the oldest flows), "idle" (evict
+	// the least active flows) or "sample" (admit a sample of new flows)
+	AdmissionPolicy string
+	// Fraction of new flows admitted by the "sample" admission policy
+	SampleRate float64
+	// Maximum number of terminated flows kept until the next dump. 0 uses
+	// the default of 100000. Terminated flows are dropped when the stats
+	// are not running
+	MaxClosed int
+	// Maximum number of new flows created per second. 0 means no limit
+	NewFlowRate float64
+	// Maximum burst of new flows allowed above NewFlowRate
+	NewFlowBurst int
+	// Aggregation levels exported at each dump as "Rollup" records. Any of
+	// "service_client", "service_subnet", "service" and "device". The
+	// services with different emit intervals are dumped separately, each
+	// dump reporting the rollups of its own services only
+	Rollups []string
+	// Whether to export the per flow records. Disable to only export the
+	// rollups
+	FlowRecords bool
+}
+
+// FieldPrivacyConfig contains the privacy policy of an output field
+type FieldPrivacyConfig struct {
+	// Action is one of "keep", "truncate", "cryptopan", "hmac" or "drop".
+	// Empty means "keep"
+	Action string
+	// PrefixV4 and PrefixV6 are the prefix lengths kept when truncating IP
+	// addresses. Default to 24 and 48
+	PrefixV4 int
+	PrefixV6 int
+	// Labels is the number of labels kept when truncating domain names.
+	// Defaults to 2
+	Labels int
+	// Bytes is the number of bytes kept when truncating payloads. Defaults
+	// to 64
+	Bytes int
+}
+
+// PrivacyConfig contains the privacy policies applied to the output fields.
+// Addresses support all actions, ports only "hmac" and "drop", MAC
+// addresses, domain names and payloads all but "cryptopan"
+type PrivacyConfig struct {
+	LocalIP     FieldPrivacyConfig
+	ServiceIP   FieldPrivacyConfig
+	LocalPort   FieldPrivacyConfig
+	ServicePort FieldPrivacyConfig
+	HwAddr      FieldPrivacyConfig
+	DomainName  FieldPrivacyConfig
+	Payload     FieldPrivacyConfig
+	// Path of the file containing the key used by the "hmac" action, at
+	// least 32 bytes long once the surrounding whitespace is trimmed. If
+	// empty a random key is generated at startup
+	HMACKeyFile string
+}
+
+// HeavyHittersConfig configures the tracking of the heaviest destinations,
+// domains and clients of all the traffic and of the unclassified traffic
+type HeavyHittersConfig struct {
+	// Run determines whether to track the heavy hitters
+	Run bool
+	// K is the number of heavy hitters reported for each dimension
+	K int
+	// Capacity is the number of counters of each sketch. 0 uses 10 times K
+	Capacity int
+	// MaxDomains is the maximum number of IP to domain mappings kept to
+	// attribute the traffic to domains
+	MaxDomains int
+	// Period is the length of the interval over which the heavy hitters are
+	// computed and printed
+	Period time.Duration
+}
+
+// VideoQoEConfig configures the inference of the QoE of the video sessions
+// from the segments of the flows with VideoCounters
+type VideoQoEConfig struct {
+	// Run determines whether to infer the QoE of the video sessions
+	Run bool
+	// Model is the path of the JSON file with the inference model
+	Model string
+	// SessionTimeout is the time without downloads ending a session
+	SessionTimeout time.Duration
+	// Period is the interval at which the ended sessions are printed
+	Period time.Duration
 }
 
 // StatsConfig contains basic configurations on how to print statistics
@@ -99,6 +222,24 @@ type ServiceFilterConfig struct {
 	Prefixes []string
 }
 
+// CounterConfig selects a counter to collect. In the configuration files it
+// is either the name of the counter or an object with the name of the counter
+// and its parameters, e.g. {"Name": "ByteCopyCounters", "ToCopy": 512}
+type CounterConfig struct {
+	// Name of the counter
+	Name string
+	// Params contains the parameters of the counter
+	Params map[string]interface{} `mapstructure:",remain"`
+}
+
+// counterConfigHook decodes the counters given by name
+func counterConfigHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(CounterConfig{}) || from.Kind() != reflect.String {
+		return data, nil
+	}
+	return map[string]interface{}{"Name": data}, nil
+}
+
 // ServiceConfig contains the details of a service to track
 type ServiceConfig struct {
 	// Name of the service
@@ -106,25 +247,35 @@ type ServiceConfig struct {
 	// Filter of the service
 	Filter ServiceFilterConfig
 	// Collect is the list of features to collect for the service
-	Collect []string
-	// Emit is the cycle length for stats printouts in ms
+	Collect []CounterConfig
+	// Emit is the cycle length for the printouts of the service flows, given
+	// as a duration such as "10s". 0 uses the default 10 seconds period
 	Emit time.Duration
+	// ActiveTimeout overrides the flow cache active timeout for the service
+	ActiveTimeout time.Duration
+	// IdleTimeout overrides the flow cache idle timeout for the service
+	IdleTimeout time.Duration
 }
 
 // TrafficRefineryConfig contains all configuration structures required by traffic refinery
 type TrafficRefineryConfig struct {
-	Sys       SysConfig
-	Parsers   ParsersConfig
-	DNSCache  DNSCacheConfig
-	FlowCache FlowCacheConfig
-	Stats     StatsOutConfig
-	Services  []ServiceConfig
+	Sys          SysConfig
+	Parsers      ParsersConfig
+	DNSCache     DNSCacheConfig
+	FlowCache    FlowCacheConfig
+	Stats        StatsOutConfig
+	Privacy      PrivacyConfig
+	Services     []ServiceConfig
+	HeavyHitters HeavyHittersConfig
+	VideoQoE     VideoQoEConfig
 }
 
 func (conf *TrafficRefineryConfig) setDefaults() {
 	viper.SetDefault("Sys.CPUProf", false)
 	viper.SetDefault("Sys.MemProf", false)
 	viper.SetDefault("Sys.InterfaceStats", false)
+	viper.SetDefault("Sys.DNSStats", false)
+	viper.SetDefault("Sys.FlowCacheStats", false)
 	viper.SetDefault("Sys.OutFolder", "/tmp/")
 
 	viper.SetDefault("Parsers.DNSParser", ParserConfig{})
@@ -132,17 +283,46 @@ func (conf *TrafficRefineryConfig) setDefaults() {
 
 	viper.SetDefault("DnsCache.CleanupTime", 5*time.Minute)
 	viper.SetDefault("DnsCache.EvictTime", 10*time.Minute)
+	viper.SetDefault("DnsCache.MaxEntries", 1<<20)
+	viper.SetDefault("DnsCache.ShardsCount", 32)
+	viper.SetDefault("DnsCache.PerClient", false)
 
 	viper.SetDefault("FlowCache.CacheType", "ConcurrentCacheMap")
 	viper.SetDefault("FlowCache.EvictTime", 10*time.Minute)
 	viper.SetDefault("FlowCache.CleanupTime", 5*time.Minute)
 	viper.SetDefault("FlowCache.ShardsCount", 32)
 	viper.SetDefault("FlowCache.Anonymize", true)
+	viper.SetDefault("FlowCache.AnonymizeKeyFile", "")
+	viper.SetDefault("FlowCache.AnonymizeKeyRotation", 0)
+	viper.SetDefault("FlowCache.ActiveTimeout", 0)
+	viper.SetDefault("FlowCache.IdleTimeout", 0)
+	viper.SetDefault("FlowCache.MaxFlows", 0)
+	viper.SetDefault("FlowCache.MaxBytes", 0)
+	viper.SetDefault("FlowCache.AdmissionPolicy", "drop")
+	viper.SetDefault("FlowCache.SampleRate", 0.1)
+	viper.SetDefault("FlowCache.MaxClosed", 0)
+	viper.SetDefault("FlowCache.NewFlowRate", 0)
+	viper.SetDefault("FlowCache.NewFlowBurst", 0)
+	viper.SetDefault("FlowCache.Rollups", []string{})
+	viper.SetDefault("FlowCache.FlowRecords", true)
+
+	viper.SetDefault("HeavyHitters.Run", false)
+	viper.SetDefault("HeavyHitters.K", 50)
+	viper.SetDefault("HeavyHitters.Capacity", 0)
+	viper.SetDefault("HeavyHitters.MaxDomains", 1<<16)
+	viper.SetDefault("HeavyHitters.Period", time.Hour)
+
+	viper.SetDefault("VideoQoE.Run", false)
+	viper.SetDefault("VideoQoE.Model", "")
+	viper.SetDefault("VideoQoE.SessionTimeout", time.Minute)
+	viper.SetDefault("VideoQoE.Period", time.Minute)
 
 	viper.SetDefault("Stats.Run", false)
 	viper.SetDefault("Stats.Mode", "dump")
 	viper.SetDefault("Stats.Append", false)
 
+	viper.SetDefault("Privacy", PrivacyConfig{})
+
 	viper.SetDefault("Services", []ServiceConfig{})
 }
 
@@ -160,7 +340,10 @@ func (conf *TrafficRefineryConfig) ImportConfig() {
 	conf.loadParsersConfig()
 	conf.loadDNSCacheConfig()
 	conf.loadFlowCacheConfig()
+	conf.loadHeavyHittersConfig()
+	conf.loadVideoQoEConfig()
 	conf.loadStatsConfig()
+	conf.loadPrivacyConfig()
 	conf.loadServiceConfig()
 }
 
@@ -183,7 +366,10 @@ func (conf *TrafficRefineryConfig) ImportConfigFromFile(fileName string) {
 	conf.loadParsersConfig()
 	conf.loadDNSCacheConfig()
 	conf.loadFlowCacheConfig()
+	conf.loadHeavyHittersConfig()
+	conf.loadVideoQoEConfig()
 	conf.loadStatsConfig()
+	conf.loadPrivacyConfig()
 	conf.loadServiceConfig()
 }
 
@@ -196,6 +382,8 @@ func (conf *TrafficRefineryConfig) PrintConfig() {
 func (conf *TrafficRefineryConfig) loadSystemConfig() {
 	conf.Sys.CPUProf = viper.GetBool("Sys.CPUProf")
 	conf.Sys.MemProf = viper.GetBool("Sys.MemProf")
+	conf.Sys.DNSStats = viper.GetBool("Sys.DNSStats")
+	conf.Sys.FlowCacheStats = viper.GetBool("Sys.FlowCacheStats")
 	conf.Sys.OutFolder = viper.GetString("Sys.OutFolder")
 }
 
@@ -217,6 +405,9 @@ func (conf *TrafficRefineryConfig) loadParsersConfig() {
 func (conf *TrafficRefineryConfig) loadDNSCacheConfig() {
 	conf.DNSCache.CleanupTime = viper.GetDuration("DNSCache.CleanupTime")
 	conf.DNSCache.EvictTime = viper.GetDuration("DNSCache.EvictTime")
+	conf.DNSCache.MaxEntries = viper.GetInt("DNSCache.MaxEntries")
+	conf.DNSCache.ShardsCount = viper.GetInt("DNSCache.ShardsCount")
+	conf.DNSCache.PerClient = viper.GetBool("DNSCache.PerClient")
 
 }
 
@@ -226,6 +417,34 @@ func (conf *TrafficRefineryConfig) loadFlowCacheConfig() {
 	conf.FlowCache.CleanupTime = viper.GetDuration("FlowCache.CleanupTime")
 	conf.FlowCache.ShardsCount = viper.GetInt("FlowCache.ShardsCount")
 	conf.FlowCache.Anonymize = viper.GetBool("FlowCache.Anonymize")
+	conf.FlowCache.AnonymizeKeyFile = viper.GetString("FlowCache.AnonymizeKeyFile")
+	conf.FlowCache.AnonymizeKeyRotation = viper.GetDuration("FlowCache.AnonymizeKeyRotation")
+	conf.FlowCache.ActiveTimeout = viper.GetDuration("FlowCache.ActiveTimeout")
+	conf.FlowCache.IdleTimeout = viper.GetDuration("FlowCache.IdleTimeout")
+	conf.FlowCache.MaxFlows = viper.GetInt("FlowCache.MaxFlows")
+	conf.FlowCache.MaxBytes = viper.GetInt64("FlowCache.MaxBytes")
+	conf.FlowCache.AdmissionPolicy = viper.GetString("FlowCache.AdmissionPolicy")
+	conf.FlowCache.SampleRate = viper.GetFloat64("FlowCache.SampleRate")
+	conf.FlowCache.MaxClosed = viper.GetInt("FlowCache.MaxClosed")
+	conf.FlowCache.NewFlowRate = viper.GetFloat64("FlowCache.NewFlowRate")
+	conf.FlowCache.NewFlowBurst = viper.GetInt("FlowCache.NewFlowBurst")
+	conf.FlowCache.Rollups = viper.GetStringSlice("FlowCache.Rollups")
+	conf.FlowCache.FlowRecords = viper.GetBool("FlowCache.FlowRecords")
+}
+
+func (conf *TrafficRefineryConfig) loadHeavyHittersConfig() {
+	conf.HeavyHitters.Run = viper.GetBool("HeavyHitters.Run")
+	conf.HeavyHitters.K = viper.GetInt("HeavyHitters.K")
+	conf.HeavyHitters.Capacity = viper.GetInt("HeavyHitters.Capacity")
+	conf.HeavyHitters.MaxDomains = viper.GetInt("HeavyHitters.MaxDomains")
+	conf.HeavyHitters.Period = viper.GetDuration("HeavyHitters.Period")
+}
+
+func (conf *TrafficRefineryConfig) loadVideoQoEConfig() {
+	conf.VideoQoE.Run = viper.GetBool("VideoQoE.Run")
+	conf.VideoQoE.Model = viper.GetString("VideoQoE.Model")
+	conf.VideoQoE.SessionTimeout = viper.GetDuration("VideoQoE.SessionTimeout")
+	conf.VideoQoE.Period = viper.GetDuration("VideoQoE.Period")
 }
 
 func (conf *TrafficRefineryConfig) loadStatsConfig() {
@@ -234,8 +453,61 @@ func (conf *TrafficRefineryConfig) loadStatsConfig() {
 	conf.Stats.Append = viper.GetBool("Stats.Append")
 }
 
+func (conf *TrafficRefineryConfig) loadPrivacyConfig() {
+	if err := viper.UnmarshalKey("Privacy", &conf.Privacy); err != nil {
+		panic(err)
+	}
+}
+
+// legacyServiceEmit returns the positions of the services whose emit interval
+// is given as a bare number. Such values used to be documented in
+// milliseconds while being read as nanoseconds, so their meaning is
+// ambiguous. 0 still selects the default period and is not reported
+func legacyServiceEmit(services interface{}) []int {
+	var legacy []int
+	list, _ := services.([]interface{})
+	for i, s := range list {
+		service, _ := s.(map[string]interface{})
+		for k, v := range service {
+			if !strings.EqualFold(k, "Emit") {
+				continue
+			}
+			switch n := v.(type) {
+			case float64:
+				if n != 0 {
+					legacy = append(legacy, i)
+				}
+			case int:
+				if n != 0 {
+					legacy = append(legacy, i)
+				}
+			case int64:
+				if n != 0 {
+					legacy = append(legacy, i)
+				}
+			}
+		}
+	}
+	return legacy
+}
+
 func (conf *TrafficRefineryConfig) loadServiceConfig() {
-	if err := viper.UnmarshalKey("Services", &conf.Services); err != nil {
+	legacy := legacyServiceEmit(viper.Get("Services"))
+	hook := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		counterConfigHook,
+	))
+	if err := viper.UnmarshalKey("Services", &conf.Services, hook); err != nil {
 		panic(err)
 	}
+	// Legacy emit intervals fall back to the default period
+	if len(legacy) > 0 {
+		names := make([]string, 0, len(legacy))
+		for _, i := range legacy {
+			names = append(names, conf.Services[i].Name)
+			conf.Services[i].Emit = 0
+		}
+		log.Warnf("Emit intervals of services %s given as bare numbers, using the default period. Use a duration such as \"10s\" instead", strings.Join(names, ", "))
+	}
 }
@@ -3,6 +3,7 @@ package config
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/traffic-refinery/traffic-refinery/internal/utils"
 )
@@ -20,6 +21,16 @@ func TestDefaultConfig(t *testing.T) {
 	t.Logf("Loaded config: %s", out)
 }
 
+func TestServiceEmit(t *testing.T) {
+	conf := TrafficRefineryConfig{}
+	conf.ImportConfigFromFile(utils.GetRepoPath() + "/test/config/trconfig_default.json")
+	for _, s := range conf.Services {
+		if s.Emit != 10*time.Second {
+			t.Fatalf("Service %s has emit interval %s instead of 10s", s.Name, s.Emit)
+		}
+	}
+}
+
 func TestVideoConfig(t *testing.T) {
 	conf := TrafficRefineryConfig{}
 	conf.ImportConfigFromFile(utils.GetRepoPath() + "/test/config/configs/trconfig_video.json")
@@ -47,3 +58,48 @@ func TestVoipConfig(t *testing.T) {
 	out, _ := json.Marshal(conf)
 	t.Logf("Loaded config: %s", out)
 }
+
+func TestCounterParams(t *testing.T) {
+	conf := TrafficRefineryConfig{}
+	conf.ImportConfigFromFile(utils.GetRepoPath() + "/test/config/trconfig_params.json")
+	if len(conf.Services) != 1 || len(conf.Services[0].Collect) != 2 {
+		t.Fatalf("Wrong services loaded %+v", conf.Services)
+	}
+	s := conf.Services[0]
+	if s.Emit != 10*time.Second {
+		t.Fatalf("Service %s has emit interval %s instead of 10s", s.Name, s.Emit)
+	}
+	if c := s.Collect[0]; c.Name != "PacketCounters" || len(c.Params) != 0 {
+		t.Fatalf("Wrong counter without parameters %+v", c)
+	}
+	c := s.Collect[1]
+	if c.Name != "ByteCopyCounters" || len(c.Params) != 2 {
+		t.Fatalf("Wrong counter with parameters %+v", c)
+	}
+	if c.Params["tocopy"] != float64(512) || c.Params["layers"] != "PayloadOnly" {
+		t.Fatalf("Wrong counter parameters %+v", c.Params)
+	}
+}
+
+func TestVideoQoEConfig(t *testing.T) {
+	conf := TrafficRefineryConfig{}
+	conf.ImportConfigFromFile(utils.GetRepoPath() + "/test/config/trconfig_video.json")
+	q := conf.VideoQoE
+	if q.Run || q.Model != "/etc/traffic_refinery/video_qoe_model.json" || q.SessionTimeout != 2*time.Minute || q.Period != time.Minute {
+		t.Fatalf("Wrong video QoE configuration %+v", q)
+	}
+}
+
+func TestServiceEmitLegacy(t *testing.T) {
+	conf := TrafficRefineryConfig{}
+	conf.ImportConfigFromFile(utils.GetRepoPath() + "/test/config/trconfig_legacy.json")
+	if len(conf.Services) != 2 {
+		t.Fatalf("Wrong number of services %d", len(conf.Services))
+	}
+	if conf.Services[0].Name != "Legacy" || conf.Services[0].Emit != 0 {
+		t.Fatalf("Legacy emit interval not replaced by the default %+v", conf.Services[0])
+	}
+	if conf.Services[1].Name != "Duration" || conf.Services[1].Emit != 30*time.Second {
+		t.Fatalf("Wrong emit interval %+v", conf.Services[1])
+	}
+}
@@ -2,6 +2,8 @@ package counters
 
 import (
 	"encoding/json"
+	"errors"
+	"math"
 
 	"github.com/traffic-refinery/traffic-refinery/internal/network"
 )
@@ -12,74 +14,115 @@ const (
 	PayloadOnly uint8 = 2
 )
 
-// ByteCopy is a data structure to collect packet and byte counters
+// DefaultToCopy is the number of bytes copied by the payload capture counters
+// when not configured
+const DefaultToCopy = 400
+
+const (
+	ethernetHeaderLen = 14
+	ipv6HeaderLen     = 40
+)
+
+// copyPacket copies the layers of pkt selected by layers into dst, up to its
+// length. Returns the number of bytes copied
+func copyPacket(dst []byte, layers uint8, pkt *network.Packet) int32 {
+	// Ethernet, IP and transport headers
+	headerSize := int64(ethernetHeaderLen)
+	if pkt.IsIPv4 {
+		headerSize += int64(4 * uint16(pkt.Ip4.IHL))
+	} else {
+		headerSize += ipv6HeaderLen
+	}
+	headerSize += pkt.Length - pkt.DataLength
+	raw := pkt.RawData
+	if headerSize > int64(len(raw)) {
+		headerSize = int64(len(raw))
+	}
+	copied := 0
+	if layers < PayloadOnly {
+		copied += copy(dst, raw[:headerSize])
+	}
+	if layers > HeadersOnly && pkt.DataLength > 0 {
+		end := headerSize + pkt.DataLength
+		if end > int64(len(raw)) {
+			end = int64(len(raw))
+		}
+		copied += copy(dst[copied:], raw[headerSize:end])
+	}
+	return int32(copied)
+}
+
+// ByteCopyCounters copies the first bytes of a flow, exported in base64
 type ByteCopyCounters struct {
 	CopiedBytes int32
 	StoredBytes int32
 	ToCopy      int32
 	Layers      uint8
 	Data        []byte
+	filter      PayloadFilter
 }
 
-// AddPacket increment the counters based on information contained in pkt
-func (c *ByteCopyCounters) AddPacket(pkt *network.Packet) {
+// AddPacket copies the bytes of pkt until ToCopy bytes are copied
+func (c *ByteCopyCounters) AddPacket(pkt *network.Packet) error {
 	if c.CopiedBytes < c.ToCopy {
-		// Initialize by accounting for the ethernet header
-		headerSize := int64(14)
-		if pkt.IsIPv4 {
-			// Add IPv4 header size
-			headerSize += int64(4 * uint16(pkt.Ip4.IHL))
-		} else {
-			headerSize += int64(pkt.Ip6.Length) - int64(pkt.DataLength)
-		}
-		// Add Transport header size
-		headerSize += int64(pkt.Length) - int64(pkt.DataLength)
-		if c.Layers < 2 {
-			//Copy headers
-			if int64(c.ToCopy-c.CopiedBytes) < headerSize {
-				// Copy just the remaining data
-				copied := int32(copy(c.Data[c.StoredBytes:], pkt.RawData[0:c.ToCopy-c.CopiedBytes]))
-				c.CopiedBytes += copied
-				c.StoredBytes += copied
-			} else {
-				// Copy the entire header size
-				copied := int32(copy(c.Data[c.StoredBytes:], pkt.RawData[0:headerSize]))
-				c.CopiedBytes += copied
-				c.StoredBytes += copied
-			}
-		}
-		if c.Layers > 0 && pkt.DataLength > 0 {
-			// Copy Payload
-			if int64(c.ToCopy-c.CopiedBytes) < pkt.DataLength {
-				// Copy just the remaining data
-				copied := int32(copy(c.Data[c.StoredBytes:], pkt.RawData[headerSize:(headerSize+int64(c.ToCopy-c.CopiedBytes))]))
-				c.CopiedBytes += copied
-				c.StoredBytes += copied
-			} else {
-				// Copy the entire header size
-				copied := int32(copy(c.Data[c.StoredBytes:], pkt.RawData[headerSize:(headerSize+pkt.DataLength)]))
-				c.CopiedBytes += copied
-				c.StoredBytes += copied
-			}
-		}
+		dst := c.Data[c.StoredBytes : c.StoredBytes+c.ToCopy-c.CopiedBytes]
+		copied := copyPacket(dst, c.Layers, pkt)
+		c.CopiedBytes += copied
+		c.StoredBytes += copied
 	}
+	return nil
 }
 
-// Reset resets all counters
-func (c *ByteCopyCounters) Reset() {
+// Configure sets the number of bytes to copy, "ToCopy", and the layers
+// copied, "Layers": one of "HeadersOnly", "AllLayers" and "PayloadOnly"
+func (c *ByteCopyCounters) Configure(params Params) error {
+	if err := params.Check("ToCopy", "Layers"); err != nil {
+		return err
+	}
+	toCopy, err := params.Int("ToCopy", DefaultToCopy)
+	if err != nil {
+		return err
+	}
+	if toCopy <= 0 || toCopy > math.MaxInt32 {
+		return errors.New("ToCopy must be positive")
+	}
+	if c.Layers, err = params.Layers("Layers", HeadersOnly); err != nil {
+		return err
+	}
+	c.ToCopy = int32(toCopy)
+	return nil
+}
+
+// Reset resets all counters. The configured parameters are kept
+func (c *ByteCopyCounters) Reset() error {
 	c.CopiedBytes = 0
 	c.StoredBytes = 0
-	c.ToCopy = 400
-	c.Layers = 0
+	if c.ToCopy == 0 {
+		c.ToCopy = DefaultToCopy
+	}
 	c.Data = make([]byte, c.ToCopy)
+	return nil
 }
 
-// Clear clears all counters
-func (c *ByteCopyCounters) Clear() {
+// Clear drops the bytes already exported. Bytes are only copied once per
+// flow, so the buffer is released once ToCopy bytes are copied
+func (c *ByteCopyCounters) Clear() error {
 	c.StoredBytes = 0
 	if c.CopiedBytes >= c.ToCopy {
 		c.Data = nil
 	}
+	return nil
+}
+
+// SetPayloadFilter sets the filter applied to the exported payload
+func (c *ByteCopyCounters) SetPayloadFilter(filter PayloadFilter) {
+	c.filter = filter
+}
+
+// Size returns the estimated memory footprint of the counter including the
+// bytes to copy
+func (c *ByteCopyCounters) Size() int64 {
+	return DefaultSize + int64(c.ToCopy)
 }
 
 // Type returns a string with the type name of the counter.
@@ -88,15 +131,24 @@ func (c *ByteCopyCounters) Type() string {
 }
 
 type ByteCopyCountersOut struct {
+	// CopiedBytes is the number of bytes copied since the start of the flow
 	CopiedBytes int32
-	Data        []byte
+	// Data contains the bytes copied since the last export, in base64
+	Data []byte
 }
 
 // Collect returns a []byte representation of the counter
 func (c *ByteCopyCounters) Collect() []byte {
+	var data []byte
+	if c.Data != nil {
+		data = c.Data[:c.StoredBytes]
+	}
+	if c.filter != nil {
+		data = c.filter(data)
+	}
 	b, _ := json.Marshal(ByteCopyCountersOut{
 		CopiedBytes: c.CopiedBytes,
-		Data:        c.Data,
+		Data:        data,
 	})
 	return b
 }
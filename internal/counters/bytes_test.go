@@ -1,6 +1,8 @@
 package counters
 
 import (
+	"bytes"
+	"encoding/json"
 	"testing"
 
 	"github.com/traffic-refinery/traffic-refinery/internal/network"
@@ -60,3 +62,44 @@ func TestCollectBytesCopyCounters(t *testing.T) {
 	}
 	t.Logf("Counter representation: %s", c.Collect())
 }
+
+func TestCollectDataBytesCopyCounters(t *testing.T) {
+	trace := network.GetTrace(utils.GetRepoPath() + "/test/traffic_data/short_test.pcap")
+	c := &ByteCopyCounters{}
+	if err := c.Configure(Params{"ToCopy": 1000, "Layers": "AllLayers"}); err != nil {
+		t.Fatalf("Can not configure the counter: %s", err)
+	}
+	c.Reset()
+	c.AddPacket(&trace.Trace[0].Pkt)
+	var out ByteCopyCountersOut
+	if err := json.Unmarshal(c.Collect(), &out); err != nil {
+		t.Fatalf("Can not parse the counter: %s", err)
+	}
+	raw := trace.Trace[0].Pkt.RawData
+	if int(out.CopiedBytes) != len(out.Data) || !bytes.Equal(out.Data, raw[:len(out.Data)]) {
+		t.Fatalf("Wrong bytes exported %d %x", out.CopiedBytes, out.Data)
+	}
+
+	// Only the bytes copied after the previous export are exported
+	c.Clear()
+	out = ByteCopyCountersOut{}
+	json.Unmarshal(c.Collect(), &out)
+	if len(out.Data) != 0 {
+		t.Fatalf("Bytes exported twice")
+	}
+}
+
+func TestBuildPayloadCounters(t *testing.T) {
+	ac := AvailableCounters{}
+	ids, err := ac.BuildConfigs([]CounterConfig{
+		{Name: "ByteCopyCounters", Params: Params{"tocopy": float64(512), "layers": "PayloadOnly"}},
+		{Name: "PNGCopyCounters"},
+	})
+	if err != nil {
+		t.Fatalf("Can not build the payload counters: %s", err)
+	}
+	c, _ := ac.InstantiateById(ids[0])
+	if bc := c.(*ByteCopyCounters); bc.ToCopy != 512 || bc.Layers != PayloadOnly {
+		t.Fatalf("Parameters not applied %+v", bc)
+	}
+}
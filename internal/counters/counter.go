@@ -19,3 +19,46 @@ type Counter interface {
 	// Collect returns a []byte representation of the counter
 	Collect() []byte
 }
+
+// DefaultSize is the estimated memory footprint in bytes of the counters not
+// implementing Sizer
+const DefaultSize = 256
+
+// Sizer is implemented by the counters whose memory footprint depends on
+// their parameters
+type Sizer interface {
+	// Size returns the estimated memory footprint in bytes that the counter
+	// can reach with its parameters
+	Size() int64
+}
+
+// Size returns the estimated memory footprint in bytes of the counter c
+func Size(c Counter) int64 {
+	if s, ok := c.(Sizer); ok {
+		return s.Size()
+	}
+	return DefaultSize
+}
+
+// PayloadFilter transforms the payload bytes copied by a counter before they
+// are exported. A nil result removes the payload from the output
+type PayloadFilter func([]byte) []byte
+
+// PayloadCounter is implemented by the counters exporting copied payload
+// bytes
+type PayloadCounter interface {
+	// SetPayloadFilter sets the filter applied to the exported payload
+	SetPayloadFilter(filter PayloadFilter)
+}
+
+// BinaryCounter is implemented by the counters whose whole state can be
+// serialized without allocating, so that the caches storing flows as bytes
+// can keep them out of the heap
+type BinaryCounter interface {
+	Counter
+	// AppendBinary appends the state of the counter to dst
+	AppendBinary(dst []byte) ([]byte, error)
+	// UnmarshalBinary restores the state appended by AppendBinary, reusing
+	// the memory of the counter
+	UnmarshalBinary(data []byte) error
+}
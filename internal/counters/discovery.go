@@ -2,69 +2,95 @@ package counters
 
 import (
 	"errors"
-	"reflect"
+	"strconv"
 )
 
-var typeRegistry = make(map[string]reflect.Type)
-
-func registerType(typedNil interface{}) {
-	t := reflect.TypeOf(typedNil).Elem()
-	typeRegistry[t.Name()] = t
-}
-
-// AvailableCounters is a structure containing available Counter
-// types
+// AvailableCounters is a structure containing the counters used by the
+// services, each identified by an id
 type AvailableCounters struct {
-	registryByName map[string]reflect.Type
-	registryById   map[int]reflect.Type
-	idToName       map[int]string
-	nameToId       map[string]int
-}
-
-// isCounter checks whether type t implements a counter interface
-func isCounter(t reflect.Type) bool {
-	if _, ok := reflect.New(t).Elem().Addr().Interface().(Counter); !ok {
-		return false
-	} else {
-		return true
-	}
+	registryByName map[string]CounterInfo
+	registryById   map[int]CounterInfo
+	// params contains the parameters of the ids of counters with parameters
+	params   map[int]Params
+	idToName map[int]string
+	nameToId map[string]int
 }
 
 // Build iterates over the counter names that the program plans on using.
 // If no type with such name is found or if the data type is not a counter
 // interface an error is raised
 func (ac *AvailableCounters) Build(counters []string) (map[string]int, error) {
-	ac.registryByName = make(map[string]reflect.Type)
-	ac.registryById = make(map[int]reflect.Type)
+	configs := make([]CounterConfig, 0, len(counters))
+	for _, counter := range counters {
+		configs = append(configs, CounterConfig{Name: counter})
+	}
+	if _, err := ac.BuildConfigs(configs); err != nil {
+		return nil, err
+	}
+	return ac.nameToId, nil
+}
+
+// BuildConfigs is like Build for counters with parameters. Each entry gets
+// its own id, returned in the same order as configs, so that the same counter
+// can be used with different parameters
+func (ac *AvailableCounters) BuildConfigs(configs []CounterConfig) ([]int, error) {
+	ac.registryByName = make(map[string]CounterInfo)
+	ac.registryById = make(map[int]CounterInfo)
+	ac.params = make(map[int]Params)
 	ac.idToName = make(map[int]string)
 	ac.nameToId = make(map[string]int)
+	ids := []int{}
 	lastCode := 0
-	for _, counter := range counters {
-		if val, found := typeRegistry[counter]; found {
-			if !isCounter(typeRegistry[counter]) {
-				return nil, errors.New("counter " + counter + " is not of the correct type " + reflect.New(typeRegistry[counter]).Elem().Type().Name())
+	for _, config := range configs {
+		counter := config.Name
+		if info, found := lookup(counter); found {
+			if len(config.Params) > 0 {
+				// Validate the parameters once, instances are configured
+				// when created
+				c, ok := info.New().(Configurable)
+				if !ok {
+					return nil, errors.New("counter " + counter + " does not accept parameters")
+				}
+				if err := c.Configure(config.Params); err != nil {
+					return nil, errors.New("counter " + counter + ": " + err.Error())
+				}
+				ac.params[lastCode] = config.Params
 			}
 			ac.idToName[lastCode] = counter
 			ac.nameToId[counter] = lastCode
-			ac.registryById[lastCode] = val
-			ac.registryByName[counter] = val
+			ac.registryById[lastCode] = info
+			ac.registryByName[counter] = info
 		} else {
 			return nil, errors.New("counter " + counter + " does not exist")
 		}
+		ids = append(ids, lastCode)
 		lastCode++
 	}
-	return ac.nameToId, nil
+	return ids, nil
 }
 
-// InstantiateByName instantiates a new Counter of type with name counterName
+// InstantiateByName instantiates a new Counter of type with name counterName.
+// The counter has the default parameters
 func (ac *AvailableCounters) InstantiateByName(counterName string) (Counter, error) {
-	v := reflect.New(ac.registryByName[counterName]).Elem().Addr().Interface()
-	return v.(Counter), nil
+	info, ok := ac.registryByName[counterName]
+	if !ok {
+		return nil, errors.New("counter " + counterName + " is not available")
+	}
+	return info.New(), nil
 }
 
 // InstantiateById instantiates a new Counter of the type associated with code
-// counterId
+// counterId, configured with the parameters of the code
 func (ac *AvailableCounters) InstantiateById(counterId int) (Counter, error) {
-	v := reflect.New(ac.registryById[counterId]).Elem().Addr().Interface()
-	return v.(Counter), nil
+	info, ok := ac.registryById[counterId]
+	if !ok {
+		return nil, errors.New("counter id " + strconv.Itoa(counterId) + " is not available")
+	}
+	c := info.New()
+	if params, ok := ac.params[counterId]; ok {
+		if err := c.(Configurable).Configure(params); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
 }
@@ -44,26 +44,118 @@ func TestInitialization(t *testing.T) {
 	}
 }
 
+// configurableCounter is a counter accepting a parameter
+type configurableCounter struct {
+	PacketCounters
+	Size int
+}
+
+func (c *configurableCounter) Configure(params Params) error {
+	if err := params.Check("Size"); err != nil {
+		return err
+	}
+	var err error
+	c.Size, err = params.Int("Size", 1)
+	return err
+}
+
+func (c *configurableCounter) Type() string {
+	return "configurableCounter"
+}
+
+func TestRegister(t *testing.T) {
+	if err := Register(CounterInfo{Name: "PacketCounters", New: func() Counter { return &PacketCounters{} }}); err == nil {
+		t.Fatalf("Counter registered twice")
+	}
+	if err := Register(CounterInfo{Name: "Wrong", New: func() Counter { return &PacketCounters{} }}); err == nil {
+		t.Fatalf("Counter registered with the name of another type")
+	}
+	if err := Register(CounterInfo{Name: "NoConstructor"}); err == nil {
+		t.Fatalf("Counter registered without constructor")
+	}
+	if err := Register(CounterInfo{
+		Name: "configurableCounter",
+		New:  func() Counter { return &configurableCounter{} },
+	}); err != nil {
+		t.Fatalf("Can not register a counter: %s", err)
+	}
+	t.Cleanup(func() {
+		registryLock.Lock()
+		delete(registry, "configurableCounter")
+		registryLock.Unlock()
+	})
+
+	ac := AvailableCounters{}
+	ids, err := ac.BuildConfigs([]CounterConfig{
+		{Name: "configurableCounter"},
+		{Name: "configurableCounter", Params: Params{"size": float64(10)}},
+	})
+	if err != nil {
+		t.Fatalf("Can not build the counters: %s", err)
+	}
+	for i, size := range []int{0, 10} {
+		c, err := ac.InstantiateById(ids[i])
+		if err != nil {
+			t.Fatalf("Can not instantiate counter %d: %s", ids[i], err)
+		}
+		if c.(*configurableCounter).Size != size {
+			t.Fatalf("Counter %d has size %d instead of %d", ids[i], c.(*configurableCounter).Size, size)
+		}
+	}
+	if _, err := ac.BuildConfigs([]CounterConfig{{Name: "configurableCounter", Params: Params{"other": 1}}}); err == nil {
+		t.Fatalf("Unknown parameter accepted")
+	}
+	if _, err := ac.BuildConfigs([]CounterConfig{{Name: "PacketCounters", Params: Params{"size": 1}}}); err == nil {
+		t.Fatalf("Parameters accepted by a counter without parameters")
+	}
+}
+
+func TestRegistered(t *testing.T) {
+	var packets, video *CounterInfo
+	registered := Registered()
+	for i, info := range registered {
+		if i > 0 && registered[i-1].Name >= info.Name {
+			t.Fatalf("Counters not sorted by name")
+		}
+		switch info.Name {
+		case "PacketCounters":
+			packets = &registered[i]
+		case "VideoCounters":
+			video = &registered[i]
+		}
+	}
+	if packets == nil || video == nil {
+		t.Fatalf("Default counters not registered")
+	}
+	if packets.Description == "" || len(packets.Schema) != 4 || packets.Schema[0].Name != "InCounter" || packets.Schema[0].Type != "number" {
+		t.Fatalf("Wrong description of PacketCounters %+v", packets)
+	}
+	segments := video.Schema[0]
+	if segments.Name != "VideoSegments" || segments.Type != "array" || segments.Items == nil || segments.Items.Type != "object" || len(segments.Items.Fields) != 8 {
+		t.Fatalf("Wrong schema of VideoCounters %+v", video.Schema)
+	}
+}
+
 func BenchmarkInitialization(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_ = &PacketCounters{}
 	}
 }
 
-func BenchmarkInitializationReflection(b *testing.B) {
+func BenchmarkInitializationFactory(b *testing.B) {
 	ac := AvailableCounters{}
 	counters := []string{"LatencyJitterCounter", "PacketCounters", "TCPState", "VideoCounters"}
 	if _, err := ac.Build(counters); err != nil {
 		panic(err)
 	}
-	t := ac.registryByName["PacketCounters"]
+	info := ac.registryByName["PacketCounters"]
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = reflect.New(t).Elem().Addr().Interface()
+		_ = info.New()
 	}
 }
 
-func BenchmarkInitializationReflectionWithRegistry(b *testing.B) {
+func BenchmarkInitializationWithRegistry(b *testing.B) {
 	ac := AvailableCounters{}
 	counters := []string{"LatencyJitterCounter", "PacketCounters", "TCPState", "VideoCounters"}
 	if _, err := ac.Build(counters); err != nil {
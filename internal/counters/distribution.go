@@ -0,0 +1,203 @@
+package counters
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+	"github.com/traffic-refinery/traffic-refinery/internal/sketch"
+)
+
+const (
+	// DefaultDistributionAccuracy is the relative accuracy of the quantiles of
+	// PacketDistribution when not configured
+	DefaultDistributionAccuracy = 0.01
+	// DefaultDistributionMaxBins is the maximum number of bins of each sketch
+	// of PacketDistribution when not configured
+	DefaultDistributionMaxBins = 2048
+	// distributionSizeRange and distributionIATRange are the ratios between
+	// the largest and the smallest values of the packet sizes and of the
+	// inter-arrival times in nanoseconds, that bound the bins of the sketches
+	distributionSizeRange = 1 << 16
+	distributionIATRange  = 1e11
+	// distributionBinSize is the estimated memory footprint in bytes of a bin
+	// of the sketches
+	distributionBinSize = 32
+)
+
+var (
+	// SizeBuckets are the upper bounds in bytes of the packet size histograms
+	// of PacketDistribution
+	SizeBuckets = []float64{64, 128, 256, 512, 1024, 1500}
+	// IATBuckets are the upper bounds in nanoseconds of the inter-arrival
+	// time histograms of PacketDistribution
+	IATBuckets = []float64{1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9}
+)
+
+// PacketDistribution keeps the distributions of the packet sizes and
+// inter-arrival times of a flow in each direction using quantile sketches
+type PacketDistribution struct {
+	// Accuracy is the relative accuracy of the quantiles
+	Accuracy float64
+	// MaxBins bounds the memory used by each sketch
+	MaxBins int
+
+	UpSize   *sketch.DDSketch
+	DownSize *sketch.DDSketch
+	UpIAT    *sketch.DDSketch
+	DownIAT  *sketch.DDSketch
+	// LastUp and LastDown are the timestamps of the last packet in each
+	// direction, kept across emit windows
+	LastUp   int64
+	LastDown int64
+}
+
+// AddPacket adds the size of pkt and the time since the previous packet in
+// the same direction to the distributions
+func (c *PacketDistribution) AddPacket(pkt *network.Packet) error {
+	if c.UpSize == nil {
+		return errors.New("packet distribution not initialized")
+	}
+	if pkt.Dir == network.TrafficIn {
+		c.DownSize.Add(float64(pkt.Length))
+		if c.LastDown != 0 {
+			c.DownIAT.Add(float64(pkt.TStamp - c.LastDown))
+		}
+		c.LastDown = pkt.TStamp
+	} else if pkt.Dir == network.TrafficOut {
+		c.UpSize.Add(float64(pkt.Length))
+		if c.LastUp != 0 {
+			c.UpIAT.Add(float64(pkt.TStamp - c.LastUp))
+		}
+		c.LastUp = pkt.TStamp
+	}
+	return nil
+}
+
+// Configure sets the relative accuracy of the quantiles, "Accuracy", and the
+// maximum number of bins of each sketch, "MaxBins"
+func (c *PacketDistribution) Configure(params Params) error {
+	if err := params.Check("Accuracy", "MaxBins"); err != nil {
+		return err
+	}
+	accuracy, err := params.Float("Accuracy", DefaultDistributionAccuracy)
+	if err != nil {
+		return err
+	}
+	if accuracy <= 0 || accuracy >= 1 {
+		return errors.New("Accuracy must be in (0, 1)")
+	}
+	maxBins, err := params.Int("MaxBins", DefaultDistributionMaxBins)
+	if err != nil {
+		return err
+	}
+	if maxBins <= 0 {
+		return errors.New("MaxBins must be positive")
+	}
+	c.Accuracy = accuracy
+	c.MaxBins = maxBins
+	return nil
+}
+
+// Reset creates empty sketches. The configured parameters are kept
+func (c *PacketDistribution) Reset() error {
+	if c.Accuracy == 0 {
+		c.Accuracy = DefaultDistributionAccuracy
+	}
+	if c.MaxBins == 0 {
+		c.MaxBins = DefaultDistributionMaxBins
+	}
+	for _, s := range []**sketch.DDSketch{&c.UpSize, &c.DownSize, &c.UpIAT, &c.DownIAT} {
+		var err error
+		if *s, err = sketch.NewDDSketch(c.Accuracy, c.MaxBins); err != nil {
+			return err
+		}
+	}
+	c.LastUp = 0
+	c.LastDown = 0
+	return nil
+}
+
+// Clear empties the distributions. The timestamps of the last packets are
+// kept to measure the first inter-arrival times of the next window
+func (c *PacketDistribution) Clear() error {
+	for _, s := range []*sketch.DDSketch{c.UpSize, c.DownSize, c.UpIAT, c.DownIAT} {
+		if s != nil {
+			s.Reset()
+		}
+	}
+	return nil
+}
+
+// Size returns the estimated memory footprint of the counter when all the
+// bins of the sketches covering the range of the values are used
+func (c *PacketDistribution) Size() int64 {
+	gamma := (1 + c.Accuracy) / (1 - c.Accuracy)
+	bins := func(ratio float64) int64 {
+		n := int64(math.Ceil(math.Log(ratio) / math.Log(gamma)))
+		if n > int64(c.MaxBins) {
+			n = int64(c.MaxBins)
+		}
+		return n
+	}
+	return DefaultSize + 2*distributionBinSize*(bins(distributionSizeRange)+bins(distributionIATRange))
+}
+
+// Type returns a string with the type name of the counter.
+func (c *PacketDistribution) Type() string {
+	return "PacketDistribution"
+}
+
+// DistributionOut summarizes a distribution. Histogram counts the values up
+// to each of the bucket bounds, plus the values above the last bound
+type DistributionOut struct {
+	Count     int64
+	Min       float64
+	Max       float64
+	Avg       float64
+	P50       float64
+	P90       float64
+	P99       float64
+	Histogram []int64
+}
+
+type PacketDistributionOut struct {
+	// Sizes are in bytes, histograms use SizeBuckets
+	UpSize   DistributionOut
+	DownSize DistributionOut
+	// Inter-arrival times are in nanoseconds, histograms use IATBuckets
+	UpIAT   DistributionOut
+	DownIAT DistributionOut
+}
+
+// distributionOut summarizes the distribution in s
+func distributionOut(s *sketch.DDSketch, buckets []float64) DistributionOut {
+	if s == nil {
+		return DistributionOut{}
+	}
+	out := DistributionOut{
+		Count:     s.Count,
+		Min:       s.Min,
+		Max:       s.Max,
+		P50:       s.Quantile(0.5),
+		P90:       s.Quantile(0.9),
+		P99:       s.Quantile(0.99),
+		Histogram: s.Histogram(buckets),
+	}
+	if s.Count > 0 {
+		out.Avg = s.Sum / float64(s.Count)
+	}
+	return out
+}
+
+// Collect returns a []byte representation of the counter
+func (c *PacketDistribution) Collect() []byte {
+	b, _ := json.Marshal(PacketDistributionOut{
+		UpSize:   distributionOut(c.UpSize, SizeBuckets),
+		DownSize: distributionOut(c.DownSize, SizeBuckets),
+		UpIAT:    distributionOut(c.UpIAT, IATBuckets),
+		DownIAT:  distributionOut(c.DownIAT, IATBuckets),
+	})
+	return b
+}
@@ -0,0 +1,105 @@
+package counters
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+)
+
+func TestPacketDistribution(t *testing.T) {
+	c := &PacketDistribution{}
+	if err := c.Configure(Params{"Accuracy": 0.02}); err != nil {
+		t.Fatalf("Can not configure the counter: %s", err)
+	}
+	c.Reset()
+	ts := int64(time.Second)
+	for i := 0; i < 100; i++ {
+		// Bimodal sizes: full segments and acknowledgements every 10ms
+		ts += int64(10 * time.Millisecond)
+		c.AddPacket(&network.Packet{TStamp: ts, Dir: network.TrafficIn, Length: 1500})
+		c.AddPacket(&network.Packet{TStamp: ts, Dir: network.TrafficOut, Length: 60})
+		if i%2 == 0 {
+			c.AddPacket(&network.Packet{TStamp: ts + 1000, Dir: network.TrafficIn, Length: 100})
+		}
+	}
+
+	var out PacketDistributionOut
+	if err := json.Unmarshal(c.Collect(), &out); err != nil {
+		t.Fatalf("Can not parse the counter: %s", err)
+	}
+	if out.DownSize.Count != 150 || out.UpSize.Count != 100 || out.UpIAT.Count != 99 {
+		t.Fatalf("Wrong counts %+v", out)
+	}
+	if out.DownSize.Min != 100 || out.DownSize.Max != 1500 || out.DownSize.P90 < 1450 {
+		t.Fatalf("Wrong downstream sizes %+v", out.DownSize)
+	}
+	if out.DownSize.Histogram[1] != 50 || out.DownSize.Histogram[5] != 100 {
+		t.Fatalf("Wrong downstream size histogram %v", out.DownSize.Histogram)
+	}
+	if p := out.UpIAT.P50; p < 0.98e7 || p > 1.02e7 {
+		t.Fatalf("Wrong upstream inter-arrival time %f", p)
+	}
+
+	// Counters survive the serialization of the flow cache
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(c); err != nil {
+		t.Fatalf("Can not encode the counter: %s", err)
+	}
+	d := &PacketDistribution{}
+	if err := gob.NewDecoder(&buf).Decode(d); err != nil {
+		t.Fatalf("Can not decode the counter: %s", err)
+	}
+	if string(d.Collect()) != string(c.Collect()) {
+		t.Fatalf("Counter changed by serialization")
+	}
+
+	// The inter-arrival time across windows is kept
+	c.Clear()
+	c.AddPacket(&network.Packet{TStamp: ts + int64(time.Millisecond), Dir: network.TrafficOut, Length: 60})
+	out = PacketDistributionOut{}
+	json.Unmarshal(c.Collect(), &out)
+	if out.UpIAT.Count != 1 || out.DownSize.Count != 0 {
+		t.Fatalf("Wrong counts after clear %+v", out)
+	}
+
+	if err := c.Configure(Params{"Accuracy": 2}); err == nil {
+		t.Fatalf("Wrong accuracy accepted")
+	}
+	if f, err := (Params{"x": "0.5"}).Float("X", 0); err != nil || f != 0.5 {
+		t.Fatalf("Wrong float parameter %f %v", f, err)
+	}
+}
+
+func TestCounterSize(t *testing.T) {
+	series := &ThroughputSeries{}
+	series.Reset()
+	if s := Size(series); s != DefaultSize+4*8*DefaultMaxBins {
+		t.Fatalf("Wrong size of the default throughput series %d", s)
+	}
+	if s := Size(&PacketCounters{}); s != DefaultSize {
+		t.Fatalf("Wrong size of the packet counters %d", s)
+	}
+
+	// Sizes grow with the parameters
+	coarse, fine := &PacketDistribution{}, &PacketDistribution{}
+	coarse.Configure(Params{"Accuracy": 0.05})
+	fine.Configure(Params{"Accuracy": 0.001, "MaxBins": 100000})
+	if Size(coarse) >= Size(fine) {
+		t.Fatalf("Distribution with accuracy 0.05 is larger than with 0.001: %d, %d", Size(coarse), Size(fine))
+	}
+	// The bins used are bounded by MaxBins
+	bounded := &PacketDistribution{}
+	bounded.Configure(Params{"Accuracy": 0.001, "MaxBins": 10})
+	if s := Size(bounded); s != DefaultSize+2*distributionBinSize*20 {
+		t.Fatalf("Wrong size of the distribution bounded to 10 bins %d", s)
+	}
+	copier := &ByteCopyCounters{}
+	copier.Configure(Params{"ToCopy": 4096})
+	if s := Size(copier); s != DefaultSize+4096 {
+		t.Fatalf("Wrong size of the byte copy counters %d", s)
+	}
+}
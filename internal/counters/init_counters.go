@@ -0,0 +1,66 @@
+// Code generated by scripts/create_counters.go. DO NOT EDIT.
+
+package counters
+
+func init() {
+	MustRegister(CounterInfo{
+		Name:        "ByteCopyCounters",
+		Description: "Copies the first bytes of a flow, exported in base64",
+		Output:      ByteCopyCountersOut{},
+		New:         func() Counter { return &ByteCopyCounters{} },
+	})
+	MustRegister(CounterInfo{
+		Name:        "LatencyJitterCounter",
+		Description: "Estimates the RTT and jitter of a TCP flow matching the upstream segments with their acknowledgements",
+		Output:      LatencyJitterCounterOut{},
+		New:         func() Counter { return &LatencyJitterCounter{} },
+	})
+	MustRegister(CounterInfo{
+		Name:        "PNGCopyCounters",
+		Description: "Copies the first bytes of a flow as the pixels of a square grayscale image, written as a PNG file to a side directory",
+		Output:      PNGCopyCountersOut{},
+		New:         func() Counter { return &PNGCopyCounters{} },
+	})
+	MustRegister(CounterInfo{
+		Name:        "PacketCounters",
+		Description: "Counts the packets and bytes of a flow in each direction",
+		Output:      PacketCounters{},
+		New:         func() Counter { return &PacketCounters{} },
+	})
+	MustRegister(CounterInfo{
+		Name:        "PacketDistribution",
+		Description: "Keeps the distributions of the packet sizes and inter-arrival times of a flow in each direction using quantile sketches",
+		Output:      PacketDistributionOut{},
+		New:         func() Counter { return &PacketDistribution{} },
+	})
+	MustRegister(CounterInfo{
+		Name:        "QUICCounters",
+		Description: "Follows the unencrypted parts of the headers of a QUIC connection",
+		Output:      QUICCountersOut{},
+		New:         func() Counter { return &QUICCounters{} },
+	})
+	MustRegister(CounterInfo{
+		Name:        "TCPLatencySplit",
+		Description: "Splits the RTT of a TCP flow at the vantage point into the upstream RTT, towards the service, and the downstream RTT, towards the local hosts",
+		Output:      TCPLatencySplitOut{},
+		New:         func() Counter { return &TCPLatencySplit{} },
+	})
+	MustRegister(CounterInfo{
+		Name:        "TCPState",
+		Description: "Tracks the flags, retransmissions, windows and bytes in flight of a TCP flow",
+		Output:      TCPStateOut{},
+		New:         func() Counter { return &TCPState{} },
+	})
+	MustRegister(CounterInfo{
+		Name:        "ThroughputSeries",
+		Description: "Records the bytes and packets of a flow in each direction in fixed length time bins, exported as series for each emit window",
+		Output:      ThroughputSeriesOut{},
+		New:         func() Counter { return &ThroughputSeries{} },
+	})
+	MustRegister(CounterInfo{
+		Name:        "VideoCounters",
+		Description: "Tracks the video segments downloaded by a flow, delimited by the upstream requests",
+		Output:      VideoCountersOut{},
+		New:         func() Counter { return &VideoCounters{} },
+	})
+}
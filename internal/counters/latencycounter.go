@@ -1,6 +1,8 @@
 package counters
 
 import (
+	"bytes"
+	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"math"
@@ -10,7 +12,8 @@ import (
 	"github.com/traffic-refinery/traffic-refinery/internal/welford"
 )
 
-// LatencyJitterCounter is a data structure to collect packet and byte counters
+// LatencyJitterCounter estimates the RTT and jitter of a TCP flow matching
+// the upstream segments with their acknowledgements
 type LatencyJitterCounter struct {
 	RTT    welford.Welford
 	Jitter welford.Welford
@@ -93,3 +96,43 @@ func (c *LatencyJitterCounter) Collect() []byte {
 	})
 	return b
 }
+
+// latencyJitterGob is the serialized form of LatencyJitterCounter, including
+// the state used to match segments and acknowledgements
+type latencyJitterGob struct {
+	RTT         welford.Welford
+	Jitter      welford.Welford
+	UnAckedUp   map[uint32]int64
+	LastAckDown uint32
+	LastLatency float64
+}
+
+// GobEncode serializes the counter, including its internal state
+func (c *LatencyJitterCounter) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(latencyJitterGob{
+		RTT:         c.RTT,
+		Jitter:      c.Jitter,
+		UnAckedUp:   c.unAckedUp,
+		LastAckDown: c.lastAckDown,
+		LastLatency: c.lastLatency,
+	})
+	return buf.Bytes(), err
+}
+
+// GobDecode restores a counter serialized by GobEncode
+func (c *LatencyJitterCounter) GobDecode(b []byte) error {
+	var g latencyJitterGob
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&g); err != nil {
+		return err
+	}
+	c.RTT = g.RTT
+	c.Jitter = g.Jitter
+	c.unAckedUp = g.UnAckedUp
+	if c.unAckedUp == nil {
+		c.unAckedUp = make(map[uint32]int64)
+	}
+	c.lastAckDown = g.LastAckDown
+	c.lastLatency = g.LastLatency
+	return nil
+}
@@ -1,14 +1,16 @@
 package counters
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/traffic-refinery/traffic-refinery/internal/network"
 )
 
-// PacketCounters is a data structure to collect packet and byte counters
+// PacketCounters counts the packets and bytes of a flow in each direction
 type PacketCounters struct {
 	InCounter  int64
 	OutCounter int64
@@ -57,3 +59,23 @@ func (c *PacketCounters) Collect() []byte {
 	b, _ := json.Marshal(c)
 	return b
 }
+
+// AppendBinary appends the counters to dst
+func (c *PacketCounters) AppendBinary(dst []byte) ([]byte, error) {
+	for _, n := range []int64{c.InCounter, c.OutCounter, c.InBytes, c.OutBytes} {
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(n))
+	}
+	return dst, nil
+}
+
+// UnmarshalBinary restores the counters appended by AppendBinary
+func (c *PacketCounters) UnmarshalBinary(data []byte) error {
+	if len(data) != 4*8 {
+		return errors.New("wrong PacketCounters size")
+	}
+	c.InCounter = int64(binary.LittleEndian.Uint64(data))
+	c.OutCounter = int64(binary.LittleEndian.Uint64(data[8:]))
+	c.InBytes = int64(binary.LittleEndian.Uint64(data[16:]))
+	c.OutBytes = int64(binary.LittleEndian.Uint64(data[24:]))
+	return nil
+}
@@ -60,3 +60,18 @@ func TestCollectPacketCounters(t *testing.T) {
 	}
 	t.Logf("Counter representation: %s", c.Collect())
 }
+
+func TestBinaryPacketCounters(t *testing.T) {
+	c := &PacketCounters{InCounter: 1, OutCounter: 2, InBytes: 100, OutBytes: 200}
+	data, err := c.AppendBinary(nil)
+	if err != nil {
+		t.Fatalf("Can not encode the counter: %s", err)
+	}
+	d := &PacketCounters{InCounter: 5}
+	if err := d.UnmarshalBinary(data); err != nil || *d != *c {
+		t.Fatalf("Decoded counter %+v differs from the original %+v: %v", d, c, err)
+	}
+	if err := d.UnmarshalBinary(data[1:]); err == nil {
+		t.Fatalf("Truncated counter decoded")
+	}
+}
@@ -0,0 +1,164 @@
+package counters
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Params contains the parameters of a counter. Names are matched ignoring
+// the case, as configuration files are loaded with lower case keys
+type Params map[string]interface{}
+
+// CounterConfig selects a counter and the parameters of its instances
+type CounterConfig struct {
+	Name   string
+	Params Params
+}
+
+// Configurable is implemented by the counters accepting parameters
+type Configurable interface {
+	// Configure sets the parameters of the counter. Called on each new
+	// instance, before Reset
+	Configure(params Params) error
+}
+
+// get returns the value of the parameter name
+func (p Params) get(name string) (interface{}, bool) {
+	for k, v := range p {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// Check returns an error if p contains parameters not in names
+func (p Params) Check(names ...string) error {
+	for k := range p {
+		found := false
+		for _, name := range names {
+			if strings.EqualFold(k, name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("unknown parameter " + k)
+		}
+	}
+	return nil
+}
+
+// Int returns the integer parameter name, or def if not set
+func (p Params) Int(name string, def int) (int, error) {
+	v, ok := p.get(name)
+	if !ok {
+		return def, nil
+	}
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case int32:
+		return int(n), nil
+	case int64:
+		return int(n), nil
+	case float64:
+		if n != float64(int(n)) {
+			return 0, fmt.Errorf("parameter %s is not an integer: %v", name, n)
+		}
+		return int(n), nil
+	case string:
+		i, err := strconv.Atoi(n)
+		if err != nil {
+			return 0, fmt.Errorf("parameter %s is not an integer: %s", name, n)
+		}
+		return i, nil
+	}
+	return 0, fmt.Errorf("parameter %s is not an integer: %v", name, v)
+}
+
+// Float returns the numeric parameter name, or def if not set
+func (p Params) Float(name string, def float64) (float64, error) {
+	v, ok := p.get(name)
+	if !ok {
+		return def, nil
+	}
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parameter %s is not a number: %s", name, n)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("parameter %s is not a number: %v", name, v)
+}
+
+// String returns the string parameter name, or def if not set
+func (p Params) String(name string, def string) (string, error) {
+	v, ok := p.get(name)
+	if !ok {
+		return def, nil
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return "", fmt.Errorf("parameter %s is not a string: %v", name, v)
+}
+
+// Duration returns the duration parameter name, either a string parsed by
+// time.ParseDuration or a number of nanoseconds, or def if not set
+func (p Params) Duration(name string, def time.Duration) (time.Duration, error) {
+	v, ok := p.get(name)
+	if !ok {
+		return def, nil
+	}
+	if s, ok := v.(string); ok {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("parameter %s is not a duration: %s", name, s)
+		}
+		return d, nil
+	}
+	n, err := p.Int(name, 0)
+	if err != nil {
+		return 0, fmt.Errorf("parameter %s is not a duration: %v", name, v)
+	}
+	return time.Duration(n), nil
+}
+
+// Layers returns the layers to copy selected by the parameter name, either
+// "HeadersOnly", "AllLayers", "PayloadOnly" or their numeric value, or def if
+// not set
+func (p Params) Layers(name string, def uint8) (uint8, error) {
+	v, ok := p.get(name)
+	if !ok {
+		return def, nil
+	}
+	if s, ok := v.(string); ok {
+		switch strings.ToLower(s) {
+		case "headersonly":
+			return HeadersOnly, nil
+		case "alllayers":
+			return AllLayers, nil
+		case "payloadonly":
+			return PayloadOnly, nil
+		}
+	}
+	n, err := p.Int(name, int(def))
+	if err != nil || n < int(HeadersOnly) || n > int(PayloadOnly) {
+		return 0, fmt.Errorf("parameter %s is not a valid layer selection: %v", name, v)
+	}
+	return uint8(n), nil
+}
@@ -0,0 +1,62 @@
+package counters
+
+import (
+	"testing"
+)
+
+func TestParams(t *testing.T) {
+	p := Params{"tocopy": float64(512), "layers": "PayloadOnly", "name": "test"}
+	if n, err := p.Int("ToCopy", 0); err != nil || n != 512 {
+		t.Fatalf("Wrong integer parameter %d %v", n, err)
+	}
+	if n, err := p.Int("Missing", 7); err != nil || n != 7 {
+		t.Fatalf("Wrong default integer parameter %d %v", n, err)
+	}
+	if _, err := p.Int("Name", 0); err == nil {
+		t.Fatalf("String parameter accepted as integer")
+	}
+	if s, err := p.String("NAME", ""); err != nil || s != "test" {
+		t.Fatalf("Wrong string parameter %s %v", s, err)
+	}
+	if l, err := p.Layers("Layers", HeadersOnly); err != nil || l != PayloadOnly {
+		t.Fatalf("Wrong layers parameter %d %v", l, err)
+	}
+	if _, err := (Params{"layers": "Some"}).Layers("Layers", HeadersOnly); err == nil {
+		t.Fatalf("Unknown layers accepted")
+	}
+	if err := p.Check("ToCopy", "Layers"); err == nil {
+		t.Fatalf("Unknown parameter accepted")
+	}
+	if err := p.Check("ToCopy", "Layers", "Name"); err != nil {
+		t.Fatalf("Known parameters rejected: %s", err)
+	}
+}
+
+func TestConfigureBytesCopyCounters(t *testing.T) {
+	c := &ByteCopyCounters{}
+	if err := c.Configure(Params{"ToCopy": 512, "Layers": "AllLayers"}); err != nil {
+		t.Fatalf("Can not configure the counter: %s", err)
+	}
+	c.Reset()
+	if c.ToCopy != 512 || c.Layers != AllLayers || len(c.Data) != 512 {
+		t.Fatalf("Parameters lost by reset %+v", c)
+	}
+	if err := c.Configure(Params{"ToCopy": -1}); err == nil {
+		t.Fatalf("Negative number of bytes to copy accepted")
+	}
+	if err := c.Configure(Params{"Size": 10}); err == nil {
+		t.Fatalf("Unknown parameter accepted")
+	}
+
+	png := &PNGCopyCounters{}
+	if err := png.Configure(Params{"ToCopy": 500}); err == nil {
+		t.Fatalf("Image size that is not a square accepted")
+	}
+	if err := png.Configure(Params{"ToCopy": 256, "Layers": 2}); err != nil {
+		t.Fatalf("Can not configure the counter: %s", err)
+	}
+	png.Reset()
+	if png.ToCopy != 256 || png.Layers != PayloadOnly || len(png.Image.Pix) != 256 {
+		t.Fatalf("Parameters lost by reset %+v", png)
+	}
+}
@@ -2,97 +2,282 @@ package counters
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"image"
 	"image/png"
-	"log"
 	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
 
 	"github.com/traffic-refinery/traffic-refinery/internal/network"
 )
 
-// ByteCopy is a data structure to collect packet and byte counters
+// DefaultPNGDir is the directory where the images of PNGCopyCounters are
+// written when not configured
+var DefaultPNGDir = filepath.Join(os.TempDir(), "traffic-refinery-png")
+
+const (
+	// DefaultPNGMaxFiles is the default maximum number of images written to
+	// a directory
+	DefaultPNGMaxFiles = 10000
+	// pngQueueLen is the number of images that can wait to be written.
+	// Images completed while the queue is full are dropped
+	pngQueueLen = 1024
+)
+
+// States of the images of PNGCopyCounters
+const (
+	pngPending = iota
+	pngWritten
+	pngDropped
+)
+
+// pngImage is an image waiting to be written by the writer goroutine
+type pngImage struct {
+	dir      string
+	maxFiles int
+	img      *image.Gray
+	// file is the path of the image, set before state becomes pngWritten
+	file  string
+	state int32
+}
+
+// pngWriter writes the images of all the PNGCopyCounters, so that encoding
+// and writing the files does not delay the packet processing
+type pngWriter struct {
+	queue   chan *pngImage
+	pending sync.WaitGroup
+	once    sync.Once
+	// files is the number of images in each directory
+	files map[string]int
+}
+
+var pngImages pngWriter
+
+// add queues the image i, returning false if the queue is full
+func (w *pngWriter) add(i *pngImage) bool {
+	w.once.Do(func() {
+		w.queue = make(chan *pngImage, pngQueueLen)
+		w.files = make(map[string]int)
+		go w.run()
+	})
+	w.pending.Add(1)
+	select {
+	case w.queue <- i:
+		return true
+	default:
+		w.pending.Done()
+		return false
+	}
+}
+
+// run writes the queued images
+func (w *pngWriter) run() {
+	for i := range w.queue {
+		state := int32(pngDropped)
+		if file, err := w.write(i); err != nil {
+			log.Warnf("Can not write image: %s", err)
+		} else if file != "" {
+			i.file = file
+			state = pngWritten
+		}
+		atomic.StoreInt32(&i.state, state)
+		w.pending.Done()
+	}
+}
+
+// write writes the image i to a file of its directory named after its
+// content. Returns an empty path if the directory already holds the maximum
+// number of images
+func (w *pngWriter) write(i *pngImage) (string, error) {
+	n, ok := w.files[i.dir]
+	if !ok {
+		if err := os.MkdirAll(i.dir, 0755); err != nil {
+			return "", err
+		}
+		entries, err := os.ReadDir(i.dir)
+		if err != nil {
+			return "", err
+		}
+		n = len(entries)
+	}
+	if n >= i.maxFiles {
+		w.files[i.dir] = n
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, i.img); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	file := filepath.Join(i.dir, hex.EncodeToString(sum[:])+".png")
+	if _, err := os.Stat(file); err == nil {
+		// Same content as an image already written
+		w.files[i.dir] = n
+		return file, nil
+	}
+	if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	w.files[i.dir] = n + 1
+	return file, nil
+}
+
+// WaitPNGImages waits for the images queued by the PNGCopyCounters to be
+// written
+func WaitPNGImages() {
+	pngImages.pending.Wait()
+}
+
+// PNGCopyCounters copies the first bytes of a flow as the pixels of a square
+// grayscale image, written as a PNG file to a side directory
 type PNGCopyCounters struct {
 	CopiedBytes int32
 	StoredBytes int32
 	ToCopy      int32
 	Layers      uint8
-	Image       *image.Gray
-	Buffer      *bytes.Buffer
-	Created     bool
+	// Dir is the directory where the images are written, holding at most
+	// MaxFiles images
+	Dir      string
+	MaxFiles int
+	Image    *image.Gray
+	// Created is set once the image is complete
+	Created bool
+	// queued is the image being written, until its path is exported.
+	// exported is set once the path is collected
+	queued   *pngImage
+	exported bool
+	filter   PayloadFilter
 }
 
-// AddPacket increment the counters based on information contained in pkt
-func (c *PNGCopyCounters) AddPacket(pkt *network.Packet) {
+// AddPacket copies the bytes of pkt until ToCopy bytes are copied, then
+// queues the image to be written
+func (c *PNGCopyCounters) AddPacket(pkt *network.Packet) error {
 	if c.CopiedBytes < c.ToCopy {
-		// Initialize by accounting for the ethernet header
-		headerSize := int64(14)
-		if pkt.IsIPv4 {
-			// Add IPv4 header size
-			headerSize += int64(4 * uint16(pkt.Ip4.IHL))
-		} else {
-			headerSize += int64(pkt.Ip6.Length) - int64(pkt.DataLength)
-		}
-		// Add Transport header size
-		headerSize += int64(pkt.Length) - int64(pkt.DataLength)
-		if c.Layers < 2 {
-			//Copy headers
-			if int64(c.ToCopy-c.CopiedBytes) < headerSize {
-				// Copy just the remaining data
-				copied := int32(copy(c.Image.Pix[c.StoredBytes:], pkt.RawData[0:(c.ToCopy-c.CopiedBytes)]))
-				c.CopiedBytes += copied
-				c.StoredBytes += copied
-			} else {
-				// Copy the entire header size
-				copied := int32(copy(c.Image.Pix[c.StoredBytes:], pkt.RawData[0:headerSize]))
-				c.CopiedBytes += copied
-				c.StoredBytes += copied
-			}
-		}
-		if c.Layers > 0 {
-			// Copy Payload
-			if int64(c.ToCopy-c.CopiedBytes) < pkt.DataLength {
-				// Copy just the remaining data
-				copied := int32(copy(c.Image.Pix[c.StoredBytes:], pkt.RawData[headerSize:headerSize+int64(c.ToCopy-c.CopiedBytes)]))
-				c.CopiedBytes += copied
-				c.StoredBytes += copied
-			} else {
-				// Copy the entire header size
-				copied := int32(copy(c.Image.Pix[c.StoredBytes:], pkt.RawData[headerSize:headerSize+pkt.DataLength]))
-				c.CopiedBytes += copied
-				c.StoredBytes += copied
-			}
-		}
+		dst := c.Image.Pix[c.StoredBytes : c.StoredBytes+c.ToCopy-c.CopiedBytes]
+		copied := copyPacket(dst, c.Layers, pkt)
+		c.CopiedBytes += copied
+		c.StoredBytes += copied
 	}
 	if !c.Created && c.CopiedBytes >= c.ToCopy {
-		if err := png.Encode(c.Buffer, c.Image); err != nil {
-			log.Fatal(err)
-		} else {
-			c.Created = true
+		c.Created = true
+		c.queueImage()
+	}
+	return nil
+}
+
+// queueImage queues the image to be written by the writer goroutine
+func (c *PNGCopyCounters) queueImage() {
+	if c.filter != nil {
+		// The filtered bytes are used as pixels of the image, an empty
+		// result produces no image
+		pix := c.filter(c.Image.Pix)
+		if pix == nil {
+			return
 		}
+		filtered := make([]byte, len(c.Image.Pix))
+		copy(filtered, pix)
+		c.Image.Pix = filtered
+	}
+	i := &pngImage{dir: c.Dir, maxFiles: c.MaxFiles, img: c.Image}
+	if i.dir == "" {
+		i.dir = DefaultPNGDir
+	}
+	if i.maxFiles == 0 {
+		i.maxFiles = DefaultPNGMaxFiles
+	}
+	if pngImages.add(i) {
+		c.queued = i
+	} else {
+		log.Debugln("Image dropped, too many images waiting to be written")
 	}
 }
 
-// Reset resets all counters
-func (c *PNGCopyCounters) Reset() {
-	c.ToCopy = 400
-	c.Layers = 0
+// file returns the path of the image once written
+func (c *PNGCopyCounters) file() string {
+	if c.queued == nil || atomic.LoadInt32(&c.queued.state) != pngWritten {
+		return ""
+	}
+	return c.queued.file
+}
+
+// Configure sets the number of bytes to copy, "ToCopy", the layers copied,
+// "Layers": one of "HeadersOnly", "AllLayers" and "PayloadOnly", the
+// directory where the images are written, "Dir", and the maximum number of
+// images in the directory, "MaxFiles". Images completed when the directory is
+// full are not written.
+// ToCopy must be a perfect square as the bytes are the pixels of a square
+// image
+func (c *PNGCopyCounters) Configure(params Params) error {
+	if err := params.Check("ToCopy", "Layers", "Dir", "MaxFiles"); err != nil {
+		return err
+	}
+	toCopy, err := params.Int("ToCopy", DefaultToCopy)
+	if err != nil {
+		return err
+	}
+	if side := int(math.Sqrt(float64(toCopy))); toCopy <= 0 || toCopy > math.MaxInt32 || side*side != toCopy {
+		return errors.New("ToCopy must be a positive perfect square")
+	}
+	if c.Layers, err = params.Layers("Layers", HeadersOnly); err != nil {
+		return err
+	}
+	if c.Dir, err = params.String("Dir", ""); err != nil {
+		return err
+	}
+	if c.MaxFiles, err = params.Int("MaxFiles", DefaultPNGMaxFiles); err != nil {
+		return err
+	}
+	if c.MaxFiles <= 0 {
+		return errors.New("MaxFiles must be positive")
+	}
+	c.ToCopy = int32(toCopy)
+	return nil
+}
+
+// Reset resets all counters. The configured parameters are kept
+func (c *PNGCopyCounters) Reset() error {
+	if c.ToCopy == 0 {
+		c.ToCopy = DefaultToCopy
+	}
 	c.CopiedBytes = 0
 	c.StoredBytes = 0
+	c.Created = false
+	c.queued = nil
+	c.exported = false
 	side := int(math.Sqrt(float64(c.ToCopy)))
 	c.Image = image.NewGray(image.Rect(0, 0, side, side))
 	c.Image.Pix = make([]byte, c.ToCopy)
-	c.Buffer = &bytes.Buffer{}
-	c.Buffer.Reset()
+	return nil
 }
 
-// Clear clears all counters
-func (c *PNGCopyCounters) Clear() {
+// Clear drops the image once its path is exported or the image is dropped.
+// Images are only created once per flow
+func (c *PNGCopyCounters) Clear() error {
 	c.StoredBytes = 0
-	if c.CopiedBytes >= c.ToCopy && c.Created {
+	if c.Created && (c.queued == nil || c.exported || atomic.LoadInt32(&c.queued.state) == pngDropped) {
 		c.Image = nil
-		c.Buffer = nil
+		c.queued = nil
 	}
+	return nil
+}
+
+// SetPayloadFilter sets the filter applied to the exported payload
+func (c *PNGCopyCounters) SetPayloadFilter(filter PayloadFilter) {
+	c.filter = filter
+}
+
+// Size returns the estimated memory footprint of the counter including the
+// pixels of the image
+func (c *PNGCopyCounters) Size() int64 {
+	return DefaultSize + int64(c.ToCopy)
 }
 
 // Type returns a string with the type name of the counter.
@@ -101,24 +286,22 @@ func (c *PNGCopyCounters) Type() string {
 }
 
 type PNGCopyCountersOut struct {
+	// CopiedBytes is the number of bytes copied since the start of the flow
 	CopiedBytes int32
-	Data        []byte
+	// File is the path of the image, set in the first export after the
+	// image is written by the writer goroutine
+	File string `json:",omitempty"`
 }
 
 // Collect returns a []byte representation of the counter
 func (c *PNGCopyCounters) Collect() []byte {
-	if c.Created {
-		b, _ := json.Marshal(ByteCopyCountersOut{
-			CopiedBytes: c.CopiedBytes,
-			Data:        c.Buffer.Bytes(),
-		})
-		return b
-	} else {
-		b, _ := json.Marshal(ByteCopyCountersOut{
-			CopiedBytes: c.CopiedBytes,
-			Data:        nil,
-		})
-		return b
+	file := c.file()
+	if file != "" {
+		c.exported = true
 	}
-
+	b, _ := json.Marshal(PNGCopyCountersOut{
+		CopiedBytes: c.CopiedBytes,
+		File:        file,
+	})
+	return b
 }
@@ -1,6 +1,9 @@
 package counters
 
 import (
+	"encoding/json"
+	"image/png"
+	"os"
 	"testing"
 
 	"github.com/traffic-refinery/traffic-refinery/internal/network"
@@ -9,7 +12,7 @@ import (
 
 func TestAddPacketPNGCopyCounters(t *testing.T) {
 	trace := network.GetTrace(utils.GetRepoPath() + "/test/traffic_data/short_test.pcap")
-	c := &PNGCopyCounters{}
+	c := &PNGCopyCounters{Dir: pngTestDir(t)}
 	c.Reset()
 	for _, pkt := range trace.Trace {
 		c.AddPacket(&pkt.Pkt)
@@ -23,7 +26,7 @@ func TestAddPacketPNGCopyCounters(t *testing.T) {
 
 func TestClearPNGCopyCounters(t *testing.T) {
 	trace := network.GetTrace(utils.GetRepoPath() + "/test/traffic_data/short_test.pcap")
-	c := &PNGCopyCounters{}
+	c := &PNGCopyCounters{Dir: pngTestDir(t)}
 	c.Reset()
 	for _, pkt := range trace.Trace {
 		c.AddPacket(&pkt.Pkt)
@@ -38,7 +41,7 @@ func TestClearPNGCopyCounters(t *testing.T) {
 
 func TestResetPNGCopyCounters(t *testing.T) {
 	trace := network.GetTrace(utils.GetRepoPath() + "/test/traffic_data/short_test.pcap")
-	c := &PNGCopyCounters{}
+	c := &PNGCopyCounters{Dir: pngTestDir(t)}
 	c.Reset()
 	for _, pkt := range trace.Trace {
 		c.AddPacket(&pkt.Pkt)
@@ -53,10 +56,79 @@ func TestResetPNGCopyCounters(t *testing.T) {
 
 func TestCollectPNGCopyCounters(t *testing.T) {
 	trace := network.GetTrace(utils.GetRepoPath() + "/test/traffic_data/short_test.pcap")
-	c := &PNGCopyCounters{}
+	c := &PNGCopyCounters{Dir: pngTestDir(t)}
 	c.Reset()
 	for _, pkt := range trace.Trace {
 		c.AddPacket(&pkt.Pkt)
 	}
 	t.Logf("Counter representation: %s", c.Collect())
 }
+
+func TestCollectFilePNGCopyCounters(t *testing.T) {
+	trace := network.GetTrace(utils.GetRepoPath() + "/test/traffic_data/short_test.pcap")
+	c := &PNGCopyCounters{}
+	if err := c.Configure(Params{"ToCopy": 100, "Dir": pngTestDir(t)}); err != nil {
+		t.Fatalf("Can not configure the counter: %s", err)
+	}
+	c.Reset()
+	for _, pkt := range trace.Trace {
+		if err := c.AddPacket(&pkt.Pkt); err != nil {
+			t.Fatalf("Can not add the packet: %s", err)
+		}
+	}
+	WaitPNGImages()
+	var out PNGCopyCountersOut
+	if err := json.Unmarshal(c.Collect(), &out); err != nil {
+		t.Fatalf("Can not parse the counter: %s", err)
+	}
+	if out.CopiedBytes != 100 || out.File == "" {
+		t.Fatalf("Image not exported %+v", out)
+	}
+	f, err := os.Open(out.File)
+	if err != nil {
+		t.Fatalf("Can not open the image: %s", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Can not decode the image: %s", err)
+	}
+	if b := img.Bounds(); b.Dx() != 10 || b.Dy() != 10 {
+		t.Fatalf("Wrong image size %s", b)
+	}
+
+	// The image is only referenced once
+	c.Clear()
+	out = PNGCopyCountersOut{}
+	json.Unmarshal(c.Collect(), &out)
+	if out.File != "" {
+		t.Fatalf("Image exported twice")
+	}
+}
+
+func TestMaxFilesPNGCopyCounters(t *testing.T) {
+	dir := pngTestDir(t)
+	for i := 0; i < 3; i++ {
+		c := &PNGCopyCounters{}
+		if err := c.Configure(Params{"ToCopy": 4, "Dir": dir, "MaxFiles": 2}); err != nil {
+			t.Fatalf("Can not configure the counter: %s", err)
+		}
+		c.Reset()
+		c.AddPacket(&network.Packet{RawData: []byte{byte(i), 1, 2, 3}})
+	}
+	WaitPNGImages()
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Fatalf("Expected 2 images in the directory, found %d: %v", len(entries), err)
+	}
+	if err := (&PNGCopyCounters{}).Configure(Params{"MaxFiles": 0}); err == nil {
+		t.Fatalf("MaxFiles must be positive")
+	}
+}
+
+// pngTestDir returns a temporary directory for the images of a test, removed
+// once the images queued by the test are written
+func pngTestDir(t *testing.T) string {
+	dir := t.TempDir()
+	t.Cleanup(WaitPNGImages)
+	return dir
+}
@@ -0,0 +1,344 @@
+package counters
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+	"github.com/traffic-refinery/traffic-refinery/internal/welford"
+)
+
+const (
+	// QUICVersion1 is the version of RFC 9000
+	QUICVersion1 = 0x00000001
+	// QUICVersion2 is the version of RFC 9369, which renumbers the types of
+	// the long header packets
+	QUICVersion2 = 0x6b3343cf
+)
+
+// Types of the QUIC long header packets
+const (
+	quicInitial = iota
+	quicZeroRTT
+	quicHandshake
+	quicRetry
+)
+
+// QUICCounters follows the unencrypted parts of the headers of a QUIC
+// connection. It counts the long and short header packets, detects the end of
+// the handshake at the first short header packet of the client, estimates
+// the RTT from the edges of the latency spin bit and counts the changes of
+// connection ID. The upstream RTT is the time from an edge of the spin bit
+// going out to its reflection coming back, the downstream RTT the opposite
+type QUICCounters struct {
+	LongUp    int64
+	LongDown  int64
+	ShortUp   int64
+	ShortDown int64
+	Initial   int64
+	ZeroRTT   int64
+	Handshake int64
+	Retry     int64
+	// VersionNegotiation counts the version negotiation packets
+	VersionNegotiation int64
+	// NotQUIC counts the UDP packets that are not QUIC
+	NotQUIC int64
+	// Version is the version of the last long header packet
+	Version uint32
+
+	// HandshakeDone is set at the first short header packet of the client.
+	// HandshakeTime is the time since its first Initial in nanoseconds, 0
+	// if not seen. They are kept across emit windows
+	HandshakeDone bool
+	HandshakeTime int64
+
+	SpinEdges int64
+	SpinRTT   welford.Welford
+	UpRTT     welford.Welford
+	DownRTT   welford.Welford
+
+	CIDChanges int64
+
+	// Connection state
+	clientDir int
+	initialTS int64
+	spinSeen  [2]bool
+	spin      [2]byte
+	lastEdge  [2]int64
+	cidLen    [2]int
+	cid       [2]string
+}
+
+// quicDir returns the index of the direction of pkt in the state of the
+// counter
+func quicDir(pkt *network.Packet) int {
+	if pkt.Dir == network.TrafficOut {
+		return 1
+	}
+	return 0
+}
+
+// longType returns the type of a long header packet, normalized to the
+// numbering of version 1
+func longType(first byte, version uint32) int {
+	t := int(first>>4) & 0x3
+	if version == QUICVersion2 {
+		return (t + 3) % 4
+	}
+	return t
+}
+
+// addLong follows a long header packet with payload b
+func (c *QUICCounters) addLong(pkt *network.Packet, b []byte) {
+	if pkt.Dir == network.TrafficOut {
+		c.LongUp++
+	} else {
+		c.LongDown++
+	}
+	if len(b) < 6 {
+		return
+	}
+	version := binary.BigEndian.Uint32(b[1:5])
+	if version == 0 {
+		c.VersionNegotiation++
+		return
+	}
+	c.Version = version
+	// The source connection ID sets the length of the destination
+	// connection IDs of the short header packets towards this end
+	dcidLen := int(b[5])
+	if len(b) > 6+dcidLen {
+		scidLen := int(b[6+dcidLen])
+		if len(b) >= 7+dcidLen+scidLen {
+			c.cidLen[1-quicDir(pkt)] = scidLen
+		}
+	}
+	switch longType(b[0], version) {
+	case quicInitial:
+		c.Initial++
+		if c.initialTS == 0 {
+			c.initialTS = pkt.TStamp
+			c.clientDir = pkt.Dir
+		}
+	case quicZeroRTT:
+		c.ZeroRTT++
+	case quicHandshake:
+		c.Handshake++
+	case quicRetry:
+		c.Retry++
+	}
+}
+
+// addShort follows a short header packet with payload b
+func (c *QUICCounters) addShort(pkt *network.Packet, b []byte) {
+	dir := quicDir(pkt)
+	if pkt.Dir == network.TrafficOut {
+		c.ShortUp++
+	} else {
+		c.ShortDown++
+	}
+	if !c.HandshakeDone && c.initialTS != 0 && pkt.Dir == c.clientDir {
+		c.HandshakeDone = true
+		c.HandshakeTime = pkt.TStamp - c.initialTS
+	}
+
+	if n := c.cidLen[dir]; n > 0 && len(b) > n {
+		cid := string(b[1 : 1+n])
+		if c.cid[dir] != "" && c.cid[dir] != cid {
+			c.CIDChanges++
+		}
+		c.cid[dir] = cid
+	}
+
+	spin := (b[0] >> 5) & 1
+	if !c.spinSeen[dir] {
+		c.spinSeen[dir] = true
+		c.spin[dir] = spin
+		return
+	}
+	if spin == c.spin[dir] {
+		return
+	}
+	c.spin[dir] = spin
+	c.SpinEdges++
+	if c.lastEdge[dir] != 0 {
+		c.SpinRTT.AddValue(float64(pkt.TStamp - c.lastEdge[dir]))
+	}
+	// The edge reflects the last edge in the opposite direction
+	if other := c.lastEdge[1-dir]; other != 0 && other > c.lastEdge[dir] {
+		if pkt.Dir == network.TrafficIn {
+			c.UpRTT.AddValue(float64(pkt.TStamp - other))
+		} else {
+			c.DownRTT.AddValue(float64(pkt.TStamp - other))
+		}
+	}
+	c.lastEdge[dir] = pkt.TStamp
+}
+
+// AddPacket follows the QUIC headers of pkt. Only the first packet of
+// coalesced long header packets is accounted
+func (c *QUICCounters) AddPacket(pkt *network.Packet) error {
+	if pkt.IsTCP || pkt.Udp == nil {
+		log.Debugln("QUICCounters can not process a non UDP packet")
+		return errors.New("can not process a non UDP packet")
+	}
+	b := pkt.Udp.Payload
+	// Packets must have the fixed bit set, unless greased with RFC 9287
+	// which is not supported
+	if len(b) == 0 || b[0]&0x40 == 0 {
+		c.NotQUIC++
+		return nil
+	}
+	if b[0]&0x80 != 0 {
+		c.addLong(pkt, b)
+	} else {
+		c.addShort(pkt, b)
+	}
+	return nil
+}
+
+// Reset resets the counters and the state of the connection
+func (c *QUICCounters) Reset() error {
+	c.Clear()
+	c.Version = 0
+	c.HandshakeDone = false
+	c.HandshakeTime = 0
+	c.clientDir = 0
+	c.initialTS = 0
+	c.spinSeen = [2]bool{}
+	c.spin = [2]byte{}
+	c.lastEdge = [2]int64{}
+	c.cidLen = [2]int{}
+	c.cid = [2]string{}
+	return nil
+}
+
+// Clear clears the counters. The state of the connection is kept
+func (c *QUICCounters) Clear() error {
+	c.LongUp = 0
+	c.LongDown = 0
+	c.ShortUp = 0
+	c.ShortDown = 0
+	c.Initial = 0
+	c.ZeroRTT = 0
+	c.Handshake = 0
+	c.Retry = 0
+	c.VersionNegotiation = 0
+	c.NotQUIC = 0
+	c.SpinEdges = 0
+	c.SpinRTT.Reset()
+	c.UpRTT.Reset()
+	c.DownRTT.Reset()
+	c.CIDChanges = 0
+	return nil
+}
+
+// Type returns a string with the type name of the counter.
+func (c *QUICCounters) Type() string {
+	return "QUICCounters"
+}
+
+type QUICCountersOut struct {
+	LongUp             int64
+	LongDown           int64
+	ShortUp            int64
+	ShortDown          int64
+	Initial            int64
+	ZeroRTT            int64
+	Handshake          int64
+	Retry              int64
+	VersionNegotiation int64
+	NotQUIC            int64
+	Version            uint32
+	HandshakeDone      bool
+	HandshakeTime      int64
+	SpinEdges          int64
+	SpinRTTAvg         float64
+	SpinRTTVar         float64
+	UpRTTAvg           float64
+	UpRTTVar           float64
+	DownRTTAvg         float64
+	DownRTTVar         float64
+	CIDChanges         int64
+}
+
+// Collect returns a []byte representation of the counter
+func (c *QUICCounters) Collect() []byte {
+	b, _ := json.Marshal(QUICCountersOut{
+		LongUp:             c.LongUp,
+		LongDown:           c.LongDown,
+		ShortUp:            c.ShortUp,
+		ShortDown:          c.ShortDown,
+		Initial:            c.Initial,
+		ZeroRTT:            c.ZeroRTT,
+		Handshake:          c.Handshake,
+		Retry:              c.Retry,
+		VersionNegotiation: c.VersionNegotiation,
+		NotQUIC:            c.NotQUIC,
+		Version:            c.Version,
+		HandshakeDone:      c.HandshakeDone,
+		HandshakeTime:      c.HandshakeTime,
+		SpinEdges:          c.SpinEdges,
+		SpinRTTAvg:         c.SpinRTT.Avg,
+		SpinRTTVar:         c.SpinRTT.Var,
+		UpRTTAvg:           c.UpRTT.Avg,
+		UpRTTVar:           c.UpRTT.Var,
+		DownRTTAvg:         c.DownRTT.Avg,
+		DownRTTVar:         c.DownRTT.Var,
+		CIDChanges:         c.CIDChanges,
+	})
+	return b
+}
+
+// quicCountersFields has the fields of QUICCounters without its methods
+type quicCountersFields QUICCounters
+
+// quicCountersGob is the serialized form of QUICCounters, including the
+// state of the connection
+type quicCountersGob struct {
+	Fields    quicCountersFields
+	ClientDir int
+	InitialTS int64
+	SpinSeen  [2]bool
+	Spin      [2]byte
+	LastEdge  [2]int64
+	CIDLen    [2]int
+	CID       [2]string
+}
+
+// GobEncode serializes the counter, including its internal state
+func (c *QUICCounters) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(quicCountersGob{
+		Fields:    quicCountersFields(*c),
+		ClientDir: c.clientDir,
+		InitialTS: c.initialTS,
+		SpinSeen:  c.spinSeen,
+		Spin:      c.spin,
+		LastEdge:  c.lastEdge,
+		CIDLen:    c.cidLen,
+		CID:       c.cid,
+	})
+	return buf.Bytes(), err
+}
+
+// GobDecode restores a counter serialized by GobEncode
+func (c *QUICCounters) GobDecode(b []byte) error {
+	var g quicCountersGob
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&g); err != nil {
+		return err
+	}
+	*c = QUICCounters(g.Fields)
+	c.clientDir = g.ClientDir
+	c.initialTS = g.InitialTS
+	c.spinSeen = g.SpinSeen
+	c.spin = g.Spin
+	c.lastEdge = g.LastEdge
+	c.cidLen = g.CIDLen
+	c.cid = g.CID
+	return nil
+}
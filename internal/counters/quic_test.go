@@ -0,0 +1,115 @@
+package counters
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+)
+
+// quicLong returns a long header packet with the first byte first
+func quicLong(first byte, version uint32, dcid, scid string) []byte {
+	b := []byte{first}
+	b = binary.BigEndian.AppendUint32(b, version)
+	b = append(b, byte(len(dcid)))
+	b = append(b, dcid...)
+	b = append(b, byte(len(scid)))
+	b = append(b, scid...)
+	return append(b, make([]byte, 20)...)
+}
+
+// quicShort returns a short header packet with the spin bit spin
+func quicShort(spin byte, dcid string) []byte {
+	b := []byte{0x40 | spin<<5}
+	b = append(b, dcid...)
+	return append(b, make([]byte, 20)...)
+}
+
+// udpPacket creates a UDP packet with payload
+func udpPacket(ts time.Duration, dir int, payload []byte) *network.Packet {
+	udp := &layers.UDP{}
+	udp.Payload = payload
+	return &network.Packet{TStamp: int64(ts), Dir: dir, Udp: udp, Length: int64(8 + len(payload)), DataLength: int64(len(payload))}
+}
+
+func TestQUICCounters(t *testing.T) {
+	c := &QUICCounters{}
+	c.Reset()
+	ms := time.Millisecond
+	out, in := network.TrafficOut, network.TrafficIn
+	for _, pkt := range []*network.Packet{
+		udpPacket(10*ms, out, quicLong(0xc0, QUICVersion1, "original", "cli1")),
+		udpPacket(30*ms, in, quicLong(0xc0, QUICVersion1, "cli1", "srv00001")),
+		udpPacket(30*ms, in, quicLong(0xe0, QUICVersion1, "cli1", "srv00001")),
+		udpPacket(35*ms, out, quicShort(0, "srv00001")),
+		udpPacket(40*ms, in, quicShort(0, "cli1")),
+		// The client flips the spin bit, reflected by the server
+		udpPacket(60*ms, out, quicShort(1, "srv00001")),
+		udpPacket(80*ms, in, quicShort(1, "cli1")),
+		udpPacket(85*ms, out, quicShort(0, "srv00001")),
+		udpPacket(105*ms, in, quicShort(0, "cli1")),
+		// Migration to a new connection ID
+		udpPacket(106*ms, out, quicShort(0, "srv00002")),
+		udpPacket(107*ms, out, []byte{0x01, 0x02}),
+	} {
+		if err := c.AddPacket(pkt); err != nil {
+			t.Fatalf("Can not add the packet: %s", err)
+		}
+	}
+	if c.LongUp != 1 || c.LongDown != 2 || c.ShortUp != 4 || c.ShortDown != 3 || c.NotQUIC != 1 {
+		t.Fatalf("Wrong packet counts %+v", c)
+	}
+	if c.Initial != 2 || c.Handshake != 1 || c.Version != QUICVersion1 {
+		t.Fatalf("Wrong long header packets %+v", c)
+	}
+	if !c.HandshakeDone || c.HandshakeTime != int64(25*ms) {
+		t.Fatalf("Wrong handshake %t %d", c.HandshakeDone, c.HandshakeTime)
+	}
+	if c.SpinEdges != 4 || c.SpinRTT.N != 2 || c.SpinRTT.Avg != float64(25*ms) {
+		t.Fatalf("Wrong spin bit RTT %d %+v", c.SpinEdges, c.SpinRTT)
+	}
+	if c.UpRTT.N != 2 || c.UpRTT.Avg != float64(20*ms) || c.DownRTT.N != 1 || c.DownRTT.Avg != float64(5*ms) {
+		t.Fatalf("Wrong RTT split %+v %+v", c.UpRTT, c.DownRTT)
+	}
+	if c.CIDChanges != 1 {
+		t.Fatalf("Wrong connection ID changes %d", c.CIDChanges)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(c); err != nil {
+		t.Fatalf("Can not encode the counter: %s", err)
+	}
+	d := &QUICCounters{}
+	if err := gob.NewDecoder(&buf).Decode(d); err != nil {
+		t.Fatalf("Can not decode the counter: %s", err)
+	}
+	if string(c.Collect()) != string(d.Collect()) || d.cid != c.cid || d.spinSeen != c.spinSeen {
+		t.Fatalf("Decoded counter %s differs from the original %s", d.Collect(), c.Collect())
+	}
+
+	// The state of the connection is kept across emit windows
+	c.Clear()
+	c.AddPacket(udpPacket(110*ms, out, quicShort(1, "srv00002")))
+	if !c.HandshakeDone || c.SpinEdges != 1 || c.SpinRTT.Avg != float64(25*ms) || c.CIDChanges != 0 {
+		t.Fatalf("Wrong state after clear %+v", c)
+	}
+
+	if err := c.AddPacket(&network.Packet{IsTCP: true}); err == nil {
+		t.Fatalf("TCP packet accepted")
+	}
+}
+
+func TestQUICVersion2(t *testing.T) {
+	c := &QUICCounters{}
+	c.Reset()
+	// Version 2 Initial packets have type 1
+	c.AddPacket(udpPacket(0, network.TrafficOut, quicLong(0xd0, QUICVersion2, "original", "cli1")))
+	c.AddPacket(udpPacket(0, network.TrafficIn, quicLong(0xc0, 0, "cli1", "original")))
+	if c.Initial != 1 || c.ZeroRTT != 0 || c.VersionNegotiation != 1 || c.Version != QUICVersion2 {
+		t.Fatalf("Wrong version 2 packets %+v", c)
+	}
+}
@@ -0,0 +1,170 @@
+package counters
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CounterInfo describes a counter that can be collected by the services
+type CounterInfo struct {
+	// Name of the counter, as returned by its Type function and used in the
+	// configuration of the services
+	Name string
+	// Description is a short description of what the counter measures
+	Description string
+	// Output is a value of the type encoded by Collect, used to derive the
+	// schema of the output
+	Output interface{} `json:"-"`
+	// New returns a new instance of the counter
+	New func() Counter `json:"-"`
+	// Schema describes the fields of the output. Filled by Registered
+	Schema []FieldSchema `json:",omitempty"`
+}
+
+// FieldSchema describes a field of the output of a counter
+type FieldSchema struct {
+	Name string `json:",omitempty"`
+	// Type is the JSON type of the field: "number", "string", "boolean",
+	// "array", "object" or "any"
+	Type string
+	// Fields contains the fields of objects with a known structure
+	Fields []FieldSchema `json:",omitempty"`
+	// Items describes the elements of arrays
+	Items *FieldSchema `json:",omitempty"`
+}
+
+var (
+	registry     = make(map[string]CounterInfo)
+	registryLock sync.RWMutex
+)
+
+// Register makes a counter available to the services. Counters defined
+// outside of this package register themselves from the init function of
+// their package
+func Register(info CounterInfo) error {
+	if info.Name == "" {
+		return errors.New("counters must have a name")
+	}
+	if info.New == nil {
+		return errors.New("counter " + info.Name + " has no constructor")
+	}
+	if t := info.New().Type(); t != info.Name {
+		return errors.New("counter " + info.Name + " has type " + t)
+	}
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, found := registry[info.Name]; found {
+		return errors.New("counter " + info.Name + " is already registered")
+	}
+	registry[info.Name] = info
+	return nil
+}
+
+// MustRegister is like Register but panics on errors
+func MustRegister(info CounterInfo) {
+	if err := Register(info); err != nil {
+		panic(err)
+	}
+}
+
+// lookup returns the registered counter with the given name
+func lookup(name string) (CounterInfo, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	info, found := registry[name]
+	return info, found
+}
+
+// Registered returns the registered counters sorted by name, with the schema
+// of their output
+func Registered() []CounterInfo {
+	registryLock.RLock()
+	ret := make([]CounterInfo, 0, len(registry))
+	for _, info := range registry {
+		ret = append(ret, info)
+	}
+	registryLock.RUnlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	for i := range ret {
+		if ret[i].Output != nil {
+			ret[i].Schema = schemaOf(reflect.TypeOf(ret[i].Output)).Fields
+		}
+	}
+	return ret
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// schemaOf returns the schema of the JSON encoding of the values of type t
+func schemaOf(t reflect.Type) FieldSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == rawMessageType {
+		return FieldSchema{Type: "any"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return FieldSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return FieldSchema{Type: "number"}
+	case reflect.String:
+		return FieldSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// Encoded in base64
+			return FieldSchema{Type: "string"}
+		}
+		items := schemaOf(t.Elem())
+		return FieldSchema{Type: "array", Items: &items}
+	case reflect.Map:
+		return FieldSchema{Type: "object"}
+	case reflect.Struct:
+		return FieldSchema{Type: "object", Fields: structFields(t)}
+	}
+	return FieldSchema{Type: "any"}
+}
+
+// structFields returns the schema of the fields of the struct type t
+func structFields(t reflect.Type) []FieldSchema {
+	fields := []FieldSchema{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			}
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && ft.Kind() == reflect.Struct && name == f.Name {
+			// Fields of embedded structs are encoded as fields of t
+			fields = append(fields, structFields(ft)...)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		s := schemaOf(f.Type)
+		s.Name = name
+		fields = append(fields, s)
+	}
+	return fields
+}
@@ -0,0 +1,283 @@
+package counters
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+	"github.com/traffic-refinery/traffic-refinery/internal/welford"
+)
+
+// TCPLatencySplit splits the RTT of a TCP flow at the vantage point into
+// the upstream RTT, towards the service, and the downstream RTT, towards the
+// local hosts. The handshake gives one sample of each: SYN to SYN-ACK on the
+// side of the responder and SYN-ACK to ACK on the side of the initiator. The
+// data phase gives samples matching the segments with their acknowledgements
+// in each direction
+type TCPLatencySplit struct {
+	// UpHandshakeRTT and DownHandshakeRTT are the handshake RTTs in
+	// nanoseconds, 0 if not measured in the emit window
+	UpHandshakeRTT   int64
+	DownHandshakeRTT int64
+	SynRetr          int64
+	SynAckRetr       int64
+
+	UpRTT   welford.Welford
+	DownRTT welford.Welford
+
+	// Handshake in progress
+	synSeen, synAckSeen, established bool
+	synTS, synAckTS                  int64
+	synDir                           int
+	synSeq, synAckSeq                uint32
+
+	unAckedUp   map[uint32]int64
+	unAckedDown map[uint32]int64
+
+	lastAckUp, lastAckDown uint32
+}
+
+// addHandshakeRTT accounts a handshake RTT measured on the side of the
+// packets towards dir
+func (c *TCPLatencySplit) addHandshakeRTT(dir int, rtt int64) {
+	if dir == network.TrafficOut {
+		c.UpHandshakeRTT = rtt
+	} else {
+		c.DownHandshakeRTT = rtt
+	}
+}
+
+// handshake follows the three way handshake of the flow
+func (c *TCPLatencySplit) handshake(pkt *network.Packet) {
+	tcp := pkt.Tcp
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		if c.synSeen && c.synDir == pkt.Dir && c.synSeq == tcp.Seq {
+			c.SynRetr++
+		}
+		// Measure from the last SYN, as the SYN-ACK most likely answers it
+		c.synSeen = true
+		c.synTS = pkt.TStamp
+		c.synDir = pkt.Dir
+		c.synSeq = tcp.Seq
+		c.synAckSeen = false
+		c.established = false
+	case tcp.SYN && tcp.ACK:
+		if !c.synSeen || pkt.Dir == c.synDir || tcp.Ack != c.synSeq+1 {
+			return
+		}
+		if !c.synAckSeen {
+			c.addHandshakeRTT(c.synDir, pkt.TStamp-c.synTS)
+		} else {
+			c.SynAckRetr++
+		}
+		c.synAckSeen = true
+		c.synAckTS = pkt.TStamp
+		c.synAckSeq = tcp.Seq
+	case tcp.ACK:
+		if !c.synAckSeen || c.established || pkt.Dir != c.synDir || tcp.Ack != c.synAckSeq+1 {
+			return
+		}
+		if c.synDir == network.TrafficOut {
+			c.addHandshakeRTT(network.TrafficIn, pkt.TStamp-c.synAckTS)
+		} else {
+			c.addHandshakeRTT(network.TrafficOut, pkt.TStamp-c.synAckTS)
+		}
+		c.established = true
+	}
+}
+
+// maxUnAcked is the maximum number of segments waiting for acknowledgement
+// tracked in each direction. Segments sent while the limit is reached give no
+// sample
+const maxUnAcked = 1024
+
+// seqAfter returns true if the sequence number a comes after b, accounting
+// for wraparound
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// dataRTT measures the RTT of the segments sent in the opposite direction
+// of pkt that it acknowledges, accounting the samples in rtt. sent has the
+// timestamps of the segments waiting for acknowledgement in the opposite
+// direction, by expected ack, lastAck is the last ack in the direction of
+// pkt and pending has the segments of the direction of pkt
+func dataRTT(pkt *network.Packet, rtt *welford.Welford, sent map[uint32]int64, lastAck *uint32, pending map[uint32]int64) {
+	if pkt.Tcp.ACK {
+		if ts, ok := sent[pkt.Tcp.Ack]; ok {
+			// Retransmitted segments are marked with 0 as their samples are
+			// ambiguous
+			if ts != 0 {
+				rtt.AddValue(float64(pkt.TStamp - ts))
+			}
+			delete(sent, pkt.Tcp.Ack)
+		}
+		if *lastAck == 0 || seqAfter(pkt.Tcp.Ack, *lastAck) {
+			*lastAck = pkt.Tcp.Ack
+			for key := range sent {
+				if seqAfter(*lastAck, key) {
+					delete(sent, key)
+				}
+			}
+		}
+	}
+	payload := pkt.Length - 4*int64(pkt.Tcp.DataOffset)
+	if payload > 0 {
+		next := pkt.Tcp.Seq + uint32(payload)
+		if _, ok := pending[next]; ok {
+			pending[next] = 0
+		} else if len(pending) < maxUnAcked {
+			pending[next] = pkt.TStamp
+		}
+	}
+}
+
+// AddPacket measures the RTTs using pkt
+func (c *TCPLatencySplit) AddPacket(pkt *network.Packet) error {
+	if !pkt.IsTCP {
+		log.Debugln("TCPLatencySplit can not process a non TCP packet")
+		return errors.New("can not process a non TCP packet")
+	}
+	c.handshake(pkt)
+	if pkt.Dir == network.TrafficIn {
+		// Incoming acks of outgoing segments measure the upstream RTT
+		dataRTT(pkt, &c.UpRTT, c.unAckedUp, &c.lastAckDown, c.unAckedDown)
+	} else if pkt.Dir == network.TrafficOut {
+		dataRTT(pkt, &c.DownRTT, c.unAckedDown, &c.lastAckUp, c.unAckedUp)
+	}
+	return nil
+}
+
+// Reset resets the counter, including the state of the handshake
+func (c *TCPLatencySplit) Reset() error {
+	c.Clear()
+	c.synSeen = false
+	c.synAckSeen = false
+	c.synTS = 0
+	c.synAckTS = 0
+	c.synDir = 0
+	c.synSeq = 0
+	c.synAckSeq = 0
+	c.established = false
+	c.unAckedUp = make(map[uint32]int64)
+	c.unAckedDown = make(map[uint32]int64)
+	c.lastAckUp = 0
+	c.lastAckDown = 0
+	return nil
+}
+
+// Clear clears the measurements. A handshake in progress or segments waiting
+// for their acknowledgement are measured in the next emit window
+func (c *TCPLatencySplit) Clear() error {
+	c.UpHandshakeRTT = 0
+	c.DownHandshakeRTT = 0
+	c.SynRetr = 0
+	c.SynAckRetr = 0
+	c.UpRTT.Reset()
+	c.DownRTT.Reset()
+	return nil
+}
+
+// Type returns a string with the type name of the counter.
+func (c *TCPLatencySplit) Type() string {
+	return "TCPLatencySplit"
+}
+
+type TCPLatencySplitOut struct {
+	UpHandshakeRTT   int64
+	DownHandshakeRTT int64
+	SynRetr          int64
+	SynAckRetr       int64
+	UpRTTAvg         float64
+	UpRTTVar         float64
+	UpRTTSamples     int64
+	DownRTTAvg       float64
+	DownRTTVar       float64
+	DownRTTSamples   int64
+}
+
+// Collect returns a []byte representation of the counter
+func (c *TCPLatencySplit) Collect() []byte {
+	b, _ := json.Marshal(TCPLatencySplitOut{
+		UpHandshakeRTT:   c.UpHandshakeRTT,
+		DownHandshakeRTT: c.DownHandshakeRTT,
+		SynRetr:          c.SynRetr,
+		SynAckRetr:       c.SynAckRetr,
+		UpRTTAvg:         c.UpRTT.Avg,
+		UpRTTVar:         c.UpRTT.Var,
+		UpRTTSamples:     int64(c.UpRTT.N),
+		DownRTTAvg:       c.DownRTT.Avg,
+		DownRTTVar:       c.DownRTT.Var,
+		DownRTTSamples:   int64(c.DownRTT.N),
+	})
+	return b
+}
+
+// tcpLatencySplitFields has the fields of TCPLatencySplit without its methods
+type tcpLatencySplitFields TCPLatencySplit
+
+// tcpLatencySplitGob is the serialized form of TCPLatencySplit, including the
+// state of the handshake and of the segments waiting for acknowledgement
+type tcpLatencySplitGob struct {
+	Fields                 tcpLatencySplitFields
+	SynSeen, SynAckSeen    bool
+	Established            bool
+	SynTS, SynAckTS        int64
+	SynDir                 int
+	SynSeq, SynAckSeq      uint32
+	UnAckedUp, UnAckedDown map[uint32]int64
+	LastAckUp, LastAckDown uint32
+}
+
+// GobEncode serializes the counter, including its internal state
+func (c *TCPLatencySplit) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(tcpLatencySplitGob{
+		Fields:      tcpLatencySplitFields(*c),
+		SynSeen:     c.synSeen,
+		SynAckSeen:  c.synAckSeen,
+		SynTS:       c.synTS,
+		SynAckTS:    c.synAckTS,
+		SynDir:      c.synDir,
+		SynSeq:      c.synSeq,
+		SynAckSeq:   c.synAckSeq,
+		Established: c.established,
+		UnAckedUp:   c.unAckedUp,
+		UnAckedDown: c.unAckedDown,
+		LastAckUp:   c.lastAckUp,
+		LastAckDown: c.lastAckDown,
+	})
+	return buf.Bytes(), err
+}
+
+// GobDecode restores a counter serialized by GobEncode
+func (c *TCPLatencySplit) GobDecode(b []byte) error {
+	var g tcpLatencySplitGob
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&g); err != nil {
+		return err
+	}
+	*c = TCPLatencySplit(g.Fields)
+	c.synSeen = g.SynSeen
+	c.synAckSeen = g.SynAckSeen
+	c.synTS = g.SynTS
+	c.synAckTS = g.SynAckTS
+	c.synDir = g.SynDir
+	c.synSeq = g.SynSeq
+	c.synAckSeq = g.SynAckSeq
+	c.established = g.Established
+	c.unAckedUp = g.UnAckedUp
+	c.unAckedDown = g.UnAckedDown
+	if c.unAckedUp == nil {
+		c.unAckedUp = make(map[uint32]int64)
+	}
+	if c.unAckedDown == nil {
+		c.unAckedDown = make(map[uint32]int64)
+	}
+	c.lastAckUp = g.LastAckUp
+	c.lastAckDown = g.LastAckDown
+	return nil
+}
@@ -0,0 +1,111 @@
+package counters
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+)
+
+// tcpPacket creates a TCP packet with a 20 bytes header and payload bytes
+func tcpPacket(ts time.Duration, dir int, tcp layers.TCP, payload int64) *network.Packet {
+	tcp.DataOffset = 5
+	return &network.Packet{TStamp: int64(ts), Dir: dir, IsTCP: true, Tcp: &tcp, Length: 20 + payload}
+}
+
+func TestTCPLatencySplit(t *testing.T) {
+	c := &TCPLatencySplit{}
+	c.Reset()
+	ms := time.Millisecond
+	for _, pkt := range []*network.Packet{
+		tcpPacket(0, network.TrafficOut, layers.TCP{SYN: true, Seq: 100}, 0),
+		// SYN retransmitted after a timeout
+		tcpPacket(1000*ms, network.TrafficOut, layers.TCP{SYN: true, Seq: 100}, 0),
+		tcpPacket(1030*ms, network.TrafficIn, layers.TCP{SYN: true, ACK: true, Seq: 500, Ack: 101}, 0),
+		tcpPacket(1035*ms, network.TrafficOut, layers.TCP{ACK: true, Seq: 101, Ack: 501}, 0),
+		// Request and response
+		tcpPacket(1040*ms, network.TrafficOut, layers.TCP{ACK: true, PSH: true, Seq: 101, Ack: 501}, 100),
+		tcpPacket(1070*ms, network.TrafficIn, layers.TCP{ACK: true, Seq: 501, Ack: 201}, 1000),
+		tcpPacket(1076*ms, network.TrafficOut, layers.TCP{ACK: true, Seq: 201, Ack: 1501}, 0),
+	} {
+		if err := c.AddPacket(pkt); err != nil {
+			t.Fatalf("Can not add the packet: %s", err)
+		}
+	}
+	if c.UpHandshakeRTT != int64(30*ms) || c.DownHandshakeRTT != int64(5*ms) || c.SynRetr != 1 {
+		t.Fatalf("Wrong handshake RTTs %d %d or retransmissions %d", c.UpHandshakeRTT, c.DownHandshakeRTT, c.SynRetr)
+	}
+	if c.UpRTT.N != 1 || c.UpRTT.Avg != float64(30*ms) || c.DownRTT.N != 1 || c.DownRTT.Avg != float64(6*ms) {
+		t.Fatalf("Wrong data RTTs %+v %+v", c.UpRTT, c.DownRTT)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(c); err != nil {
+		t.Fatalf("Can not encode the counter: %s", err)
+	}
+	d := &TCPLatencySplit{}
+	if err := gob.NewDecoder(&buf).Decode(d); err != nil {
+		t.Fatalf("Can not decode the counter: %s", err)
+	}
+	if string(c.Collect()) != string(d.Collect()) || d.synAckSeq != c.synAckSeq || !d.established {
+		t.Fatalf("Decoded counter %s differs from the original %s", d.Collect(), c.Collect())
+	}
+
+	// Handshakes are reported in the emit window they complete
+	c.Clear()
+	if c.UpHandshakeRTT != 0 || c.UpRTT.N != 0 {
+		t.Fatalf("Measurements not cleared")
+	}
+	c.AddPacket(tcpPacket(1100*ms, network.TrafficOut, layers.TCP{ACK: true, Seq: 201, Ack: 501}, 0))
+	if c.DownHandshakeRTT != 0 {
+		t.Fatalf("Handshake measured twice")
+	}
+}
+
+func TestTCPLatencySplitIncoming(t *testing.T) {
+	c := &TCPLatencySplit{}
+	c.Reset()
+	ms := time.Millisecond
+	// Connection opened by a remote host: the SYN-ACK goes through the local side
+	c.AddPacket(tcpPacket(0, network.TrafficIn, layers.TCP{SYN: true, Seq: 10}, 0))
+	c.AddPacket(tcpPacket(2*ms, network.TrafficOut, layers.TCP{SYN: true, ACK: true, Seq: 20, Ack: 11}, 0))
+	c.AddPacket(tcpPacket(42*ms, network.TrafficIn, layers.TCP{ACK: true, Seq: 11, Ack: 21}, 0))
+	if c.DownHandshakeRTT != int64(2*ms) || c.UpHandshakeRTT != int64(40*ms) {
+		t.Fatalf("Wrong handshake RTTs %d %d", c.UpHandshakeRTT, c.DownHandshakeRTT)
+	}
+	if err := c.AddPacket(&network.Packet{}); err == nil {
+		t.Fatalf("Non TCP packet accepted")
+	}
+}
+
+func TestTCPLatencySplitWraparound(t *testing.T) {
+	c := &TCPLatencySplit{}
+	c.Reset()
+	ms := time.Millisecond
+	// The sequence numbers of the outgoing segments wrap around
+	seq := uint32(1<<32 - 50)
+	for _, pkt := range []*network.Packet{
+		tcpPacket(10*ms, network.TrafficOut, layers.TCP{ACK: true, Seq: seq, Ack: 1}, 100),
+		tcpPacket(20*ms, network.TrafficOut, layers.TCP{ACK: true, Seq: seq + 100, Ack: 1}, 100),
+		// Partial ack before the wraparound
+		tcpPacket(30*ms, network.TrafficIn, layers.TCP{ACK: true, Seq: 1, Ack: seq + 40}, 0),
+		tcpPacket(40*ms, network.TrafficIn, layers.TCP{ACK: true, Seq: 1, Ack: seq + 100}, 0),
+		tcpPacket(50*ms, network.TrafficIn, layers.TCP{ACK: true, Seq: 1, Ack: seq + 200}, 0),
+	} {
+		c.AddPacket(pkt)
+	}
+	if c.UpRTT.N != 2 || c.UpRTT.Avg != float64(30*ms) || c.lastAckDown != seq+200 {
+		t.Fatalf("Wrong RTTs across the wraparound %+v, last ack %d", c.UpRTT, c.lastAckDown)
+	}
+
+	// Segments never acknowledged are tracked up to a limit
+	for i := 0; i < 2*maxUnAcked; i++ {
+		c.AddPacket(tcpPacket(60*ms, network.TrafficOut, layers.TCP{ACK: true, Seq: uint32(i * 10), Ack: 1}, 10))
+	}
+	if len(c.unAckedUp) != maxUnAcked {
+		t.Fatalf("Tracked %d segments instead of %d", len(c.unAckedUp), maxUnAcked)
+	}
+}
@@ -1,15 +1,21 @@
 package counters
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/json"
 	"errors"
 
+	"github.com/google/gopacket/layers"
 	log "github.com/sirupsen/logrus"
 	"github.com/traffic-refinery/traffic-refinery/internal/network"
 	"github.com/traffic-refinery/traffic-refinery/internal/welford"
 )
 
-// TCPState is a data structure to collect packet and byte counters
+// TCPState tracks the flags, retransmissions, windows and bytes in flight of
+// a TCP flow. The options of the handshake are used to scale the receive
+// windows and to sample the RTT from the timestamps
 type TCPState struct {
 	AckUpCounter     int64
 	AckDownCounter   int64
@@ -36,10 +42,178 @@ type TCPState struct {
 	DownBytesInFlight welford.Welford
 	RTT               welford.Welford
 
+	// Options advertised in the SYN of each direction. The window scales
+	// are -1 if not advertised. They are kept across emit windows
+	UpMSS             int64
+	DownMSS           int64
+	UpWScale          int64
+	DownWScale        int64
+	UpSackPermitted   bool
+	DownSackPermitted bool
+	UpTimestamps      bool
+	DownTimestamps    bool
+
+	// UpZeroWindow and DownZeroWindow count the times the receive window
+	// advertised in each direction dropped to zero. UpWindowFull and
+	// DownWindowFull count the segments filling the receive window of the
+	// other end
+	UpZeroWindow   int64
+	DownZeroWindow int64
+	UpWindowFull   int64
+	DownWindowFull int64
+	UpSackBlocks   int64
+	DownSackBlocks int64
+	// UpTSRTT and DownTSRTT are the RTTs measured when the timestamps of
+	// each direction are echoed
+	UpTSRTT   welford.Welford
+	DownTSRTT welford.Welford
+
 	unAckedUp   map[uint32]int64
 	unAckedDown map[uint32]int64
 
 	lastSeqUp, lastSeqDown, lastAckUp, lastAckDown uint32
+
+	// Last scaled window advertised in each direction, -1 if none
+	lastWindowUp, lastWindowDown int64
+	// Timestamps sent in each direction waiting to be echoed
+	tsUp, tsDown map[uint32]int64
+}
+
+// tcpOptions are the options of a TCP segment used by TCPState
+type tcpOptions struct {
+	mss, wscale   int64
+	sackPermitted bool
+	sackBlocks    int64
+	timestamps    bool
+	tsVal, tsEcr  uint32
+}
+
+// parseTCPOptions returns the options of tcp. The window scale is -1 if not
+// present
+func parseTCPOptions(tcp *layers.TCP) tcpOptions {
+	opts := tcpOptions{wscale: -1}
+	for _, opt := range tcp.Options {
+		switch opt.OptionType {
+		case layers.TCPOptionKindMSS:
+			if len(opt.OptionData) == 2 {
+				opts.mss = int64(binary.BigEndian.Uint16(opt.OptionData))
+			}
+		case layers.TCPOptionKindWindowScale:
+			if len(opt.OptionData) == 1 {
+				opts.wscale = int64(opt.OptionData[0])
+				// RFC 7323 limits the shift to 14
+				if opts.wscale > 14 {
+					opts.wscale = 14
+				}
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			opts.sackPermitted = true
+		case layers.TCPOptionKindSACK:
+			opts.sackBlocks += int64(len(opt.OptionData) / 8)
+		case layers.TCPOptionKindTimestamps:
+			if len(opt.OptionData) == 8 {
+				opts.timestamps = true
+				opts.tsVal = binary.BigEndian.Uint32(opt.OptionData[:4])
+				opts.tsEcr = binary.BigEndian.Uint32(opt.OptionData[4:])
+			}
+		}
+	}
+	return opts
+}
+
+// window returns the receive window advertised by pkt, scaled if both ends
+// advertised the window scale option. The window of SYN segments is never
+// scaled
+func (c *TCPState) window(pkt *network.Packet) int64 {
+	window := int64(pkt.Tcp.Window)
+	if pkt.Tcp.SYN || c.UpWScale < 0 || c.DownWScale < 0 {
+		return window
+	}
+	if pkt.Dir == network.TrafficOut {
+		return window << c.UpWScale
+	}
+	return window << c.DownWScale
+}
+
+// maxPendingTimestamps is the maximum number of timestamps waiting to be
+// echoed tracked in each direction. Timestamps sent while the limit is
+// reached give no sample
+const maxPendingTimestamps = 1024
+
+// timestampRTT samples the RTT when pkt echoes a timestamp sent in the
+// opposite direction. sent has the times the timestamps of the opposite
+// direction were first seen and pending the ones of the direction of pkt
+func timestampRTT(pkt *network.Packet, opts tcpOptions, rtt *welford.Welford, sent map[uint32]int64, pending map[uint32]int64) {
+	if !opts.timestamps {
+		return
+	}
+	if _, ok := pending[opts.tsVal]; !ok && len(pending) < maxPendingTimestamps {
+		pending[opts.tsVal] = pkt.TStamp
+	}
+	if !pkt.Tcp.ACK || opts.tsEcr == 0 {
+		return
+	}
+	if ts, ok := sent[opts.tsEcr]; ok {
+		rtt.AddValue(float64(pkt.TStamp - ts))
+		for key := range sent {
+			if !seqAfter(key, opts.tsEcr) {
+				delete(sent, key)
+			}
+		}
+	}
+}
+
+// inFlight returns the bytes in flight after a segment ending at next, given
+// the last ack of the other end
+func inFlight(next, lastAck uint32) (int64, bool) {
+	if lastAck == 0 {
+		return 0, false
+	}
+	diff := int32(next - lastAck)
+	if diff < 0 {
+		return 0, false
+	}
+	return int64(diff), true
+}
+
+// addOptions accounts the options and the window of pkt, returning the scaled
+// window
+func (c *TCPState) addOptions(pkt *network.Packet) int64 {
+	bytes := pkt.Length - 4*int64(pkt.Tcp.DataOffset)
+	opts := parseTCPOptions(pkt.Tcp)
+	up := pkt.Dir == network.TrafficOut
+	if pkt.Tcp.SYN {
+		if up {
+			c.UpMSS, c.UpWScale = opts.mss, opts.wscale
+			c.UpSackPermitted, c.UpTimestamps = opts.sackPermitted, opts.timestamps
+		} else {
+			c.DownMSS, c.DownWScale = opts.mss, opts.wscale
+			c.DownSackPermitted, c.DownTimestamps = opts.sackPermitted, opts.timestamps
+		}
+	}
+	window := c.window(pkt)
+	if up {
+		c.UpSackBlocks += opts.sackBlocks
+		timestampRTT(pkt, opts, &c.DownTSRTT, c.tsDown, c.tsUp)
+		if pkt.Tcp.ACK && !pkt.Tcp.RST && !pkt.Tcp.FIN && window == 0 && c.lastWindowUp != 0 {
+			c.UpZeroWindow++
+		}
+		if n, ok := inFlight(pkt.Tcp.Seq+uint32(bytes), c.lastAckDown); bytes > 0 && ok && c.lastWindowDown >= 0 && n >= c.lastWindowDown {
+			c.UpWindowFull++
+		}
+		c.lastWindowUp = window
+	} else {
+		c.DownSackBlocks += opts.sackBlocks
+		timestampRTT(pkt, opts, &c.UpTSRTT, c.tsUp, c.tsDown)
+		if pkt.Tcp.ACK && !pkt.Tcp.RST && !pkt.Tcp.FIN && window == 0 && c.lastWindowDown != 0 {
+			c.DownZeroWindow++
+		}
+		if n, ok := inFlight(pkt.Tcp.Seq+uint32(bytes), c.lastAckUp); bytes > 0 && ok && c.lastWindowUp >= 0 && n >= c.lastWindowUp {
+			c.DownWindowFull++
+		}
+		c.lastWindowDown = window
+	}
+	return window
 }
 
 func (c *TCPState) AddPacket(pkt *network.Packet) error {
@@ -47,6 +221,7 @@ func (c *TCPState) AddPacket(pkt *network.Packet) error {
 		log.Debugln("TCPState can not process a non TCP packet")
 		return errors.New("can not process a non TCP packet")
 	}
+	window := c.addOptions(pkt)
 	if pkt.Dir == network.TrafficIn {
 		// log.Debugf("Incoming traffic %t %d", pkt.Tcp.ACK, pkt.Tcp.Ack)
 		if pkt.Tcp.ACK {
@@ -79,7 +254,7 @@ func (c *TCPState) AddPacket(pkt *network.Packet) error {
 		}
 		bytes := pkt.Length - 4*int64(pkt.Tcp.DataOffset)
 		c.BytesDownCounter += bytes
-		c.DownRecWindow.AddValue(float64(pkt.Tcp.Window))
+		c.DownRecWindow.AddValue(float64(window))
 		c.DownBytesPerPkt.AddValue(float64(bytes))
 		c.DownBytesInFlight.AddValue(float64(pkt.SeqNumber + uint32(bytes) - c.lastAckUp))
 		// Only process retransmissions for packets with data
@@ -121,7 +296,7 @@ func (c *TCPState) AddPacket(pkt *network.Packet) error {
 		}
 		bytes := pkt.Length - 4*int64(pkt.Tcp.DataOffset)
 		c.BytesUpCounter += bytes
-		c.UpRecWindow.AddValue(float64(pkt.Tcp.Window))
+		c.UpRecWindow.AddValue(float64(window))
 		c.UpBytesPerPkt.AddValue(float64(bytes))
 		c.UpBytesInFlight.AddValue(float64(pkt.SeqNumber + uint32(bytes) - c.lastAckDown))
 		// Only process retransmissions for packets with data
@@ -168,6 +343,16 @@ func (c *TCPState) Reset() error {
 
 	c.RTT.Reset()
 
+	c.UpMSS = 0
+	c.DownMSS = 0
+	c.UpWScale = -1
+	c.DownWScale = -1
+	c.UpSackPermitted = false
+	c.DownSackPermitted = false
+	c.UpTimestamps = false
+	c.DownTimestamps = false
+	c.clearOptions()
+
 	// fmt.Println("Resetting counters")
 	c.unAckedUp = make(map[uint32]int64)
 	c.unAckedDown = make(map[uint32]int64)
@@ -207,6 +392,9 @@ func (c *TCPState) Clear() error {
 
 	c.RTT.Reset()
 
+	// The options of the handshake are kept to scale the windows
+	c.clearOptions()
+
 	c.unAckedUp = make(map[uint32]int64)
 	c.unAckedDown = make(map[uint32]int64)
 
@@ -218,6 +406,22 @@ func (c *TCPState) Clear() error {
 	return nil
 }
 
+// clearOptions clears the statistics of the options and windows
+func (c *TCPState) clearOptions() {
+	c.UpZeroWindow = 0
+	c.DownZeroWindow = 0
+	c.UpWindowFull = 0
+	c.DownWindowFull = 0
+	c.UpSackBlocks = 0
+	c.DownSackBlocks = 0
+	c.UpTSRTT.Reset()
+	c.DownTSRTT.Reset()
+	c.lastWindowUp = -1
+	c.lastWindowDown = -1
+	c.tsUp = make(map[uint32]int64)
+	c.tsDown = make(map[uint32]int64)
+}
+
 // Type returns a string with the type name of the counter.
 func (c *TCPState) Type() string {
 	return "TCPState"
@@ -255,6 +459,25 @@ type TCPStateOut struct {
 	UpBytesInFlightVar   float64
 	DownBytesInFlightVar float64
 	RTTVar               float64
+
+	UpMSS             int64
+	DownMSS           int64
+	UpWScale          int64
+	DownWScale        int64
+	UpSackPermitted   bool
+	DownSackPermitted bool
+	UpTimestamps      bool
+	DownTimestamps    bool
+	UpZeroWindow      int64
+	DownZeroWindow    int64
+	UpWindowFull      int64
+	DownWindowFull    int64
+	UpSackBlocks      int64
+	DownSackBlocks    int64
+	UpTSRTTAvg        float64
+	UpTSRTTVar        float64
+	DownTSRTTAvg      float64
+	DownTSRTTVar      float64
 }
 
 // Collect returns a []byte representation of the counter
@@ -290,6 +513,88 @@ func (c *TCPState) Collect() []byte {
 		DownBytesInFlightVar: c.DownBytesInFlight.Var,
 		RTTAvg:               c.RTT.Avg,
 		RTTVar:               c.RTT.Var,
+		UpMSS:                c.UpMSS,
+		DownMSS:              c.DownMSS,
+		UpWScale:             c.UpWScale,
+		DownWScale:           c.DownWScale,
+		UpSackPermitted:      c.UpSackPermitted,
+		DownSackPermitted:    c.DownSackPermitted,
+		UpTimestamps:         c.UpTimestamps,
+		DownTimestamps:       c.DownTimestamps,
+		UpZeroWindow:         c.UpZeroWindow,
+		DownZeroWindow:       c.DownZeroWindow,
+		UpWindowFull:         c.UpWindowFull,
+		DownWindowFull:       c.DownWindowFull,
+		UpSackBlocks:         c.UpSackBlocks,
+		DownSackBlocks:       c.DownSackBlocks,
+		UpTSRTTAvg:           c.UpTSRTT.Avg,
+		UpTSRTTVar:           c.UpTSRTT.Var,
+		DownTSRTTAvg:         c.DownTSRTT.Avg,
+		DownTSRTTVar:         c.DownTSRTT.Var,
 	})
 	return b
 }
+
+// tcpStateFields has the fields of TCPState without its methods
+type tcpStateFields TCPState
+
+// tcpStateGob is the serialized form of TCPState, including the state used
+// to match segments and acknowledgements
+type tcpStateGob struct {
+	Fields                                         tcpStateFields
+	UnAckedUp, UnAckedDown                         map[uint32]int64
+	LastSeqUp, LastSeqDown, LastAckUp, LastAckDown uint32
+	LastWindowUp, LastWindowDown                   int64
+	TSUp, TSDown                                   map[uint32]int64
+}
+
+// GobEncode serializes the counter, including its internal state
+func (c *TCPState) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(tcpStateGob{
+		Fields:         tcpStateFields(*c),
+		UnAckedUp:      c.unAckedUp,
+		UnAckedDown:    c.unAckedDown,
+		LastSeqUp:      c.lastSeqUp,
+		LastSeqDown:    c.lastSeqDown,
+		LastAckUp:      c.lastAckUp,
+		LastAckDown:    c.lastAckDown,
+		LastWindowUp:   c.lastWindowUp,
+		LastWindowDown: c.lastWindowDown,
+		TSUp:           c.tsUp,
+		TSDown:         c.tsDown,
+	})
+	return buf.Bytes(), err
+}
+
+// GobDecode restores a counter serialized by GobEncode
+func (c *TCPState) GobDecode(b []byte) error {
+	var g tcpStateGob
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&g); err != nil {
+		return err
+	}
+	*c = TCPState(g.Fields)
+	c.unAckedUp = g.UnAckedUp
+	c.unAckedDown = g.UnAckedDown
+	if c.unAckedUp == nil {
+		c.unAckedUp = make(map[uint32]int64)
+	}
+	if c.unAckedDown == nil {
+		c.unAckedDown = make(map[uint32]int64)
+	}
+	c.lastSeqUp = g.LastSeqUp
+	c.lastSeqDown = g.LastSeqDown
+	c.lastAckUp = g.LastAckUp
+	c.lastAckDown = g.LastAckDown
+	c.lastWindowUp = g.LastWindowUp
+	c.lastWindowDown = g.LastWindowDown
+	c.tsUp = g.TSUp
+	c.tsDown = g.TSDown
+	if c.tsUp == nil {
+		c.tsUp = make(map[uint32]int64)
+	}
+	if c.tsDown == nil {
+		c.tsDown = make(map[uint32]int64)
+	}
+	return nil
+}
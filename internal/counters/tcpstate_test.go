@@ -1,8 +1,14 @@
 package counters
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
 	"testing"
+	"time"
 
+	"github.com/google/gopacket/layers"
 	"github.com/traffic-refinery/traffic-refinery/internal/network"
 	"github.com/traffic-refinery/traffic-refinery/internal/utils"
 )
@@ -54,3 +60,131 @@ func TestCollectTCPState(t *testing.T) {
 	}
 	t.Logf("Counter representation: %s", c.Collect())
 }
+
+func TestGobTCPState(t *testing.T) {
+	trace := network.GetTrace(utils.GetRepoPath() + "/test/traffic_data/short_test.pcap")
+	c := &TCPState{}
+	c.Reset()
+	for _, pkt := range trace.Trace {
+		c.AddPacket(&pkt.Pkt)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(c); err != nil {
+		t.Fatalf("Can not encode the counter: %s", err)
+	}
+	d := &TCPState{}
+	if err := gob.NewDecoder(&buf).Decode(d); err != nil {
+		t.Fatalf("Can not decode the counter: %s", err)
+	}
+	if string(c.Collect()) != string(d.Collect()) {
+		t.Fatalf("Decoded counter %s differs from the original %s", d.Collect(), c.Collect())
+	}
+	if len(d.unAckedUp) != len(c.unAckedUp) || d.lastSeqUp != c.lastSeqUp || d.RTT != c.RTT {
+		t.Fatalf("Decoded counter state differs from the original")
+	}
+}
+
+// tcpTimestamps returns a timestamps option
+func tcpTimestamps(val, ecr uint32) layers.TCPOption {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, val)
+	binary.BigEndian.PutUint32(data[4:], ecr)
+	return layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: data}
+}
+
+// tcpHandshakeOptions returns the options of a SYN
+func tcpHandshakeOptions(mss uint16, wscale byte, val, ecr uint32) []layers.TCPOption {
+	return []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: binary.BigEndian.AppendUint16(nil, mss)},
+		{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{wscale}},
+		{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+		tcpTimestamps(val, ecr),
+	}
+}
+
+func TestOptionsTCPState(t *testing.T) {
+	c := &TCPState{}
+	c.Reset()
+	ms := time.Millisecond
+	sack := layers.TCPOption{OptionType: layers.TCPOptionKindSACK, OptionLength: 18, OptionData: make([]byte, 16)}
+	for _, pkt := range []*network.Packet{
+		tcpPacket(0, network.TrafficOut, layers.TCP{SYN: true, Seq: 100, Window: 65535,
+			Options: tcpHandshakeOptions(1460, 7, 1000, 0)}, 0),
+		tcpPacket(20*ms, network.TrafficIn, layers.TCP{SYN: true, ACK: true, Seq: 500, Ack: 101, Window: 65535,
+			Options: tcpHandshakeOptions(1400, 2, 5000, 1000)}, 0),
+		tcpPacket(25*ms, network.TrafficOut, layers.TCP{ACK: true, Seq: 101, Ack: 501, Window: 2,
+			Options: []layers.TCPOption{tcpTimestamps(1001, 5000)}}, 0),
+		// The data fills the 256 bytes window of the client
+		tcpPacket(30*ms, network.TrafficIn, layers.TCP{ACK: true, Seq: 501, Ack: 101, Window: 100}, 1000),
+		tcpPacket(31*ms, network.TrafficOut, layers.TCP{ACK: true, Seq: 101, Ack: 1501, Window: 0}, 0),
+		tcpPacket(32*ms, network.TrafficOut, layers.TCP{ACK: true, Seq: 101, Ack: 1501, Window: 0,
+			Options: []layers.TCPOption{sack}}, 0),
+	} {
+		if err := c.AddPacket(pkt); err != nil {
+			t.Fatalf("Can not add the packet: %s", err)
+		}
+	}
+
+	var out TCPStateOut
+	if err := json.Unmarshal(c.Collect(), &out); err != nil {
+		t.Fatalf("Can not parse the counter: %s", err)
+	}
+	if out.UpMSS != 1460 || out.DownMSS != 1400 || out.UpWScale != 7 || out.DownWScale != 2 ||
+		!out.UpSackPermitted || !out.DownSackPermitted || !out.UpTimestamps || !out.DownTimestamps {
+		t.Fatalf("Wrong handshake options %+v", out)
+	}
+	if out.DownWindowFull != 1 || out.UpZeroWindow != 1 || out.UpSackBlocks != 2 || out.DownZeroWindow != 0 {
+		t.Fatalf("Wrong window events or SACK blocks %+v", out)
+	}
+	if out.UpTSRTTAvg != float64(20*ms) || out.DownTSRTTAvg != float64(5*ms) {
+		t.Fatalf("Wrong timestamp RTTs %f %f", out.UpTSRTTAvg, out.DownTSRTTAvg)
+	}
+	// The windows of the SYNs are not scaled
+	if c.lastWindowDown != 400 || c.DownRecWindow.Avg != (65535.0+400)/2 {
+		t.Fatalf("Wrong scaled window %d %f", c.lastWindowDown, c.DownRecWindow.Avg)
+	}
+
+	// The options of the handshake are kept across emit windows
+	c.Clear()
+	if c.UpWScale != 7 || c.UpZeroWindow != 0 || c.UpTSRTT.N != 0 {
+		t.Fatalf("Wrong options after clear %+v", c)
+	}
+	c.Reset()
+	if c.UpWScale != -1 || c.UpMSS != 0 {
+		t.Fatalf("Options not reset %+v", c)
+	}
+}
+
+func TestTimestampsTCPState(t *testing.T) {
+	c := &TCPState{}
+	c.Reset()
+	ms := time.Millisecond
+	// The timestamps of the client wrap around before the server echoes them
+	for _, pkt := range []*network.Packet{
+		tcpPacket(0, network.TrafficOut, layers.TCP{ACK: true, Seq: 100, Ack: 500,
+			Options: []layers.TCPOption{tcpTimestamps(0xffffffff, 1)}}, 100),
+		tcpPacket(10*ms, network.TrafficOut, layers.TCP{ACK: true, Seq: 200, Ack: 500,
+			Options: []layers.TCPOption{tcpTimestamps(2, 1)}}, 100),
+		tcpPacket(30*ms, network.TrafficIn, layers.TCP{ACK: true, Seq: 500, Ack: 300,
+			Options: []layers.TCPOption{tcpTimestamps(3, 2)}}, 0),
+	} {
+		if err := c.AddPacket(pkt); err != nil {
+			t.Fatalf("Can not add the packet: %s", err)
+		}
+	}
+	if c.UpTSRTT.N != 1 || c.UpTSRTT.Avg != float64(20*ms) {
+		t.Fatalf("Wrong timestamp RTT %+v", c.UpTSRTT)
+	}
+	if len(c.tsUp) != 0 {
+		t.Fatalf("Echoed timestamps still pending %v", c.tsUp)
+	}
+
+	// Timestamps never echoed are tracked up to the limit
+	for i := 0; i < 2*maxPendingTimestamps; i++ {
+		c.AddPacket(tcpPacket(time.Duration(i)*ms, network.TrafficOut, layers.TCP{ACK: true, Seq: 300, Ack: 500,
+			Options: []layers.TCPOption{tcpTimestamps(uint32(10+i), 3)}}, 0))
+	}
+	if len(c.tsUp) != maxPendingTimestamps {
+		t.Fatalf("Wrong number of pending timestamps %d", len(c.tsUp))
+	}
+}
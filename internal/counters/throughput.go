@@ -0,0 +1,154 @@
+package counters
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+)
+
+const (
+	// DefaultBinSize is the length of the bins of ThroughputSeries when not
+	// configured
+	DefaultBinSize = time.Second
+	// DefaultMaxBins is the maximum number of bins of ThroughputSeries in an
+	// emit window when not configured
+	DefaultMaxBins = 600
+)
+
+// ThroughputSeries records the bytes and packets of a flow in each direction
+// in fixed length time bins, exported as series for each emit window
+type ThroughputSeries struct {
+	// BinSize is the length of the bins in nanoseconds. Bins are aligned to
+	// multiples of BinSize so that the series of different flows line up
+	BinSize int64
+	// MaxBins bounds the length of the series. Packets past the last bin are
+	// only accounted in Dropped
+	MaxBins int
+	// Start is the start time of the first bin of the series
+	Start      int64
+	InBytes    []int64
+	OutBytes   []int64
+	InPackets  []int64
+	OutPackets []int64
+	Dropped    int64
+}
+
+// AddPacket accounts pkt in the bin of its timestamp
+func (c *ThroughputSeries) AddPacket(pkt *network.Packet) error {
+	if c.BinSize <= 0 {
+		return errors.New("throughput series with no bin size")
+	}
+	if len(c.InBytes) == 0 {
+		c.Start = pkt.TStamp - pkt.TStamp%c.BinSize
+	}
+	bin := 0
+	// Packets reordered before the start of the series go in the first bin
+	if pkt.TStamp > c.Start {
+		bin = int((pkt.TStamp - c.Start) / c.BinSize)
+	}
+	if bin >= c.MaxBins {
+		c.Dropped++
+		return nil
+	}
+	for len(c.InBytes) <= bin {
+		c.InBytes = append(c.InBytes, 0)
+		c.OutBytes = append(c.OutBytes, 0)
+		c.InPackets = append(c.InPackets, 0)
+		c.OutPackets = append(c.OutPackets, 0)
+	}
+	if pkt.Dir == network.TrafficIn {
+		c.InBytes[bin] += pkt.Length
+		c.InPackets[bin]++
+	} else if pkt.Dir == network.TrafficOut {
+		c.OutBytes[bin] += pkt.Length
+		c.OutPackets[bin]++
+	}
+	return nil
+}
+
+// Configure sets the length of the bins, "Bin", e.g. "100ms", and the
+// maximum number of bins in an emit window, "MaxBins"
+func (c *ThroughputSeries) Configure(params Params) error {
+	if err := params.Check("Bin", "MaxBins"); err != nil {
+		return err
+	}
+	bin, err := params.Duration("Bin", DefaultBinSize)
+	if err != nil {
+		return err
+	}
+	if bin <= 0 {
+		return errors.New("Bin must be positive")
+	}
+	maxBins, err := params.Int("MaxBins", DefaultMaxBins)
+	if err != nil {
+		return err
+	}
+	if maxBins <= 0 {
+		return errors.New("MaxBins must be positive")
+	}
+	c.BinSize = int64(bin)
+	c.MaxBins = maxBins
+	return nil
+}
+
+// Reset resets the series. The configured parameters are kept
+func (c *ThroughputSeries) Reset() error {
+	if c.BinSize == 0 {
+		c.BinSize = int64(DefaultBinSize)
+	}
+	if c.MaxBins == 0 {
+		c.MaxBins = DefaultMaxBins
+	}
+	return c.Clear()
+}
+
+// Clear starts a new series
+func (c *ThroughputSeries) Clear() error {
+	c.Start = 0
+	c.InBytes = c.InBytes[:0]
+	c.OutBytes = c.OutBytes[:0]
+	c.InPackets = c.InPackets[:0]
+	c.OutPackets = c.OutPackets[:0]
+	c.Dropped = 0
+	return nil
+}
+
+// Size returns the estimated memory footprint of the counter with MaxBins
+// bins in each series
+func (c *ThroughputSeries) Size() int64 {
+	return DefaultSize + 4*8*int64(c.MaxBins)
+}
+
+// Type returns a string with the type name of the counter.
+func (c *ThroughputSeries) Type() string {
+	return "ThroughputSeries"
+}
+
+type ThroughputSeriesOut struct {
+	// BinSize is the length of the bins in nanoseconds
+	BinSize int64
+	// Start is the start time of the first bin
+	Start      int64
+	InBytes    []int64
+	OutBytes   []int64
+	InPackets  []int64
+	OutPackets []int64
+	// Dropped is the number of packets past the last bin
+	Dropped int64
+}
+
+// Collect returns a []byte representation of the counter
+func (c *ThroughputSeries) Collect() []byte {
+	b, _ := json.Marshal(ThroughputSeriesOut{
+		BinSize:    c.BinSize,
+		Start:      c.Start,
+		InBytes:    c.InBytes,
+		OutBytes:   c.OutBytes,
+		InPackets:  c.InPackets,
+		OutPackets: c.OutPackets,
+		Dropped:    c.Dropped,
+	})
+	return b
+}
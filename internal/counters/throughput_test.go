@@ -0,0 +1,68 @@
+package counters
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+)
+
+func TestThroughputSeries(t *testing.T) {
+	c := &ThroughputSeries{}
+	if err := c.Configure(Params{"Bin": "100ms", "MaxBins": 5}); err != nil {
+		t.Fatalf("Can not configure the counter: %s", err)
+	}
+	c.Reset()
+	start := int64(10*time.Second + 50*time.Millisecond)
+	for _, p := range []struct {
+		offset time.Duration
+		dir    int
+	}{
+		{0, network.TrafficOut},
+		{10 * time.Millisecond, network.TrafficIn},
+		{20 * time.Millisecond, network.TrafficIn},
+		// Stall in the second bin
+		{160 * time.Millisecond, network.TrafficIn},
+		// Past the last bin
+		{time.Second, network.TrafficIn},
+	} {
+		c.AddPacket(&network.Packet{TStamp: start + int64(p.offset), Dir: p.dir, Length: 100})
+	}
+
+	var out ThroughputSeriesOut
+	if err := json.Unmarshal(c.Collect(), &out); err != nil {
+		t.Fatalf("Can not parse the counter: %s", err)
+	}
+	if out.Start != int64(10*time.Second) || out.BinSize != int64(100*time.Millisecond) {
+		t.Fatalf("Wrong bins start %d size %d", out.Start, out.BinSize)
+	}
+	expected := []int64{200, 0, 100}
+	if len(out.InBytes) != len(expected) {
+		t.Fatalf("Wrong series length %v", out.InBytes)
+	}
+	for i := range expected {
+		if out.InBytes[i] != expected[i] || out.InPackets[i] != expected[i]/100 {
+			t.Fatalf("Wrong downstream series %v %v", out.InBytes, out.InPackets)
+		}
+	}
+	if out.OutBytes[0] != 100 || out.OutPackets[0] != 1 || out.Dropped != 1 {
+		t.Fatalf("Wrong upstream series %v or dropped packets %d", out.OutBytes, out.Dropped)
+	}
+
+	// A new series starts after each export
+	c.Clear()
+	c.AddPacket(&network.Packet{TStamp: int64(20 * time.Second), Dir: network.TrafficIn, Length: 10})
+	out = ThroughputSeriesOut{}
+	json.Unmarshal(c.Collect(), &out)
+	if out.Start != int64(20*time.Second) || len(out.InBytes) != 1 || out.InBytes[0] != 10 || out.Dropped != 0 {
+		t.Fatalf("Wrong series after clear %+v", out)
+	}
+
+	if err := c.Configure(Params{"Bin": "0s"}); err == nil {
+		t.Fatalf("Empty bins accepted")
+	}
+	if err := c.Configure(Params{"Bin": int64(time.Second)}); err != nil || c.BinSize != int64(time.Second) {
+		t.Fatalf("Bin size in nanoseconds not accepted: %v", err)
+	}
+}
@@ -1,7 +1,9 @@
 package counters
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 
 	log "github.com/sirupsen/logrus"
 
@@ -20,6 +22,8 @@ type VideoSegment struct {
 	MaxDSeq   int64
 }
 
+// VideoCounters tracks the video segments downloaded by a flow, delimited by
+// the upstream requests
 type VideoCounters struct {
 	UpstreamChunks  []VideoSegment
 	RunningUpstream VideoSegment
@@ -40,13 +44,17 @@ func (vf *VideoCounters) AddPacket(pkt *network.Packet) error {
 				vf.RunningUpstream.TsEnd = vf.RunningUpstream.LastPkt
 				vf.UpstreamChunks = append(vf.UpstreamChunks, vf.RunningUpstream)
 			}
-			vf.RunningUpstream = VideoSegment{Len: int64(pkt.Length), TsStart: pkt.TStamp, Seq: int64(pkt.Tcp.Seq)}
+			vf.RunningUpstream = VideoSegment{Len: int64(pkt.Length), TsStart: pkt.TStamp}
+			// The TCP layer of UDP packets holds stale data
+			if pkt.IsTCP {
+				vf.RunningUpstream.Seq = int64(pkt.Tcp.Seq)
+			}
 		}
 	} else if pkt.DataLength > 0 {
 		vf.RunningUpstream.DownPkts++
 		vf.RunningUpstream.DonwBytes += int64(pkt.DataLength)
 
-		if int64(pkt.Tcp.Seq) > vf.RunningUpstream.MaxDSeq {
+		if pkt.IsTCP && int64(pkt.Tcp.Seq) > vf.RunningUpstream.MaxDSeq {
 			vf.RunningUpstream.MaxDSeq = int64(pkt.Tcp.Seq)
 		}
 		if pkt.TStamp > vf.RunningUpstream.TsEnd {
@@ -90,3 +98,48 @@ func (c *VideoCounters) Collect() []byte {
 	b, _ := json.Marshal(out)
 	return b
 }
+
+// videoSegmentSize is the size of a serialized VideoSegment
+const videoSegmentSize = 8 * 8
+
+// appendSegment appends the fields of the segment s to dst
+func appendSegment(dst []byte, s *VideoSegment) []byte {
+	for _, n := range []int64{s.Len, s.Seq, s.TsStart, s.TsEnd, s.LastPkt, s.DownPkts, s.DonwBytes, s.MaxDSeq} {
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(n))
+	}
+	return dst
+}
+
+// readSegment returns the segment appended to data by appendSegment
+func readSegment(data []byte) VideoSegment {
+	n := func(i int) int64 {
+		return int64(binary.LittleEndian.Uint64(data[8*i:]))
+	}
+	return VideoSegment{Len: n(0), Seq: n(1), TsStart: n(2), TsEnd: n(3), LastPkt: n(4), DownPkts: n(5), DonwBytes: n(6), MaxDSeq: n(7)}
+}
+
+// AppendBinary appends the running segment and the completed ones to dst
+func (vf *VideoCounters) AppendBinary(dst []byte) ([]byte, error) {
+	dst = appendSegment(dst, &vf.RunningUpstream)
+	for i := range vf.UpstreamChunks {
+		dst = appendSegment(dst, &vf.UpstreamChunks[i])
+	}
+	return dst, nil
+}
+
+// UnmarshalBinary restores the segments appended by AppendBinary, reusing the
+// memory of the completed segments
+func (vf *VideoCounters) UnmarshalBinary(data []byte) error {
+	if len(data) < videoSegmentSize || len(data)%videoSegmentSize != 0 {
+		return errors.New("wrong VideoCounters size")
+	}
+	vf.RunningUpstream = readSegment(data)
+	if vf.UpstreamChunks == nil {
+		vf.UpstreamChunks = make([]VideoSegment, 0, len(data)/videoSegmentSize-1)
+	}
+	vf.UpstreamChunks = vf.UpstreamChunks[:0]
+	for off := videoSegmentSize; off < len(data); off += videoSegmentSize {
+		vf.UpstreamChunks = append(vf.UpstreamChunks, readSegment(data[off:]))
+	}
+	return nil
+}
@@ -56,3 +56,25 @@ func TestCollectVideoCounters(t *testing.T) {
 	}
 	t.Logf("Counter representation: %s", c.Collect())
 }
+
+func TestBinaryVideoCounters(t *testing.T) {
+	c := &VideoCounters{}
+	c.Reset()
+	c.UpstreamChunks = append(c.UpstreamChunks, VideoSegment{Len: 1, Seq: 2, TsStart: 3, TsEnd: 4, LastPkt: 5, DownPkts: 6, DonwBytes: 7, MaxDSeq: 8})
+	c.RunningUpstream = VideoSegment{Len: 10, TsStart: 30}
+	data, err := c.AppendBinary(nil)
+	if err != nil {
+		t.Fatalf("Can not encode the counter: %s", err)
+	}
+	// The segments of the previous state are replaced
+	d := &VideoCounters{UpstreamChunks: make([]VideoSegment, 3)}
+	if err := d.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Can not decode the counter: %s", err)
+	}
+	if string(d.Collect()) != string(c.Collect()) {
+		t.Fatalf("Decoded counter %s differs from the original %s", d.Collect(), c.Collect())
+	}
+	if err := d.UnmarshalBinary(data[1:]); err == nil {
+		t.Fatalf("Truncated counter decoded")
+	}
+}
@@ -0,0 +1,316 @@
+package flowstats
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/cache"
+	"github.com/traffic-refinery/traffic-refinery/internal/counters"
+)
+
+// Admission policies applied to new flows when the cache is full
+const (
+	// AdmissionDrop rejects new flows
+	AdmissionDrop = "drop"
+	// AdmissionEvictOldest evicts the flows that started first
+	AdmissionEvictOldest = "oldest"
+	// AdmissionEvictIdle evicts the flows that have been idle the longest
+	AdmissionEvictIdle = "idle"
+	// AdmissionSample admits a sample of the new flows, evicting the flows
+	// that have been idle the longest to make room for them
+	AdmissionSample = "sample"
+)
+
+const (
+	// flowSizeEstimate is the estimated memory footprint in bytes of a flow
+	// without its counters
+	flowSizeEstimate = 512
+	// evictionFraction is the fraction of the cache limit freed every time
+	// the cache is full, to amortize the cost of finding the flows to evict
+	evictionFraction = 16
+)
+
+// FlowCacheStats contains the counters describing the flow cache usage
+type FlowCacheStats struct {
+	// Flows is the number of flows in the cache
+	Flows int64
+	// Bytes is the estimated memory used by the flows in the cache
+	Bytes int64
+	// Rejected is the number of new flows rejected because the cache was full
+	Rejected uint64
+	// RateLimited is the number of new flows rejected by the rate limit
+	RateLimited uint64
+	// Evicted is the number of flows evicted to make room for new ones
+	Evicted uint64
+	// DroppedClosed is the number of terminated flows dropped because too
+	// many were waiting for a dump
+	DroppedClosed uint64
+}
+
+// admission contains the state used to limit the size of the cache and the
+// rate of creation of new flows
+type admission struct {
+	maxFlows   int64
+	maxBytes   int64
+	policy     string
+	sampleRate float64
+
+	// Token bucket limiting the creation of new flows. Refilled based on the
+	// packet timestamps to behave consistently in replay mode
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastRefill int64
+	rateLock   sync.Mutex
+
+	flows       int64
+	bytes       int64
+	rejected    uint64
+	rateLimited uint64
+	evicted     uint64
+	evictLock   sync.Mutex
+	// droppedClosed is the number of terminated flows dropped before a dump
+	droppedClosed uint64
+}
+
+// SetLimits sets the maximum number of flows and the maximum estimated memory
+// in bytes used by the cache, 0 means no limit. policy selects what happens to
+// new flows when the cache is full: "drop", "oldest", "idle" or "sample".
+// sampleRate is the fraction of new flows admitted by the "sample" policy
+func (fc *FlowCache) SetLimits(maxFlows int, maxBytes int64, policy string, sampleRate float64) error {
+	switch policy {
+	case "":
+		policy = AdmissionDrop
+	case AdmissionDrop, AdmissionEvictOldest, AdmissionEvictIdle:
+	case AdmissionSample:
+		if sampleRate < 0 || sampleRate > 1 {
+			return errors.New("sample rate must be between 0 and 1")
+		}
+	default:
+		return errors.New("unknown admission policy " + policy)
+	}
+	fc.admission.maxFlows = int64(maxFlows)
+	fc.admission.maxBytes = maxBytes
+	fc.admission.policy = policy
+	fc.admission.sampleRate = sampleRate
+	return nil
+}
+
+// SetNewFlowRate limits the creation of new flows to rate per second, with
+// bursts of up to burst flows. A rate of 0 disables the limit
+func (fc *FlowCache) SetNewFlowRate(rate float64, burst int) {
+	if burst <= 0 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	fc.admission.rate = rate
+	fc.admission.burst = float64(burst)
+	fc.admission.tokens = float64(burst)
+}
+
+// Stats returns the counters describing the cache usage
+func (fc *FlowCache) Stats() FlowCacheStats {
+	return FlowCacheStats{
+		Flows:         atomic.LoadInt64(&fc.admission.flows),
+		Bytes:         atomic.LoadInt64(&fc.admission.bytes),
+		Rejected:      atomic.LoadUint64(&fc.admission.rejected),
+		RateLimited:   atomic.LoadUint64(&fc.admission.rateLimited),
+		Evicted:       atomic.LoadUint64(&fc.admission.evicted),
+		DroppedClosed: atomic.LoadUint64(&fc.admission.droppedClosed),
+	}
+}
+
+// flowSize returns the estimated memory footprint of a flow, including the
+// snapshot of the output of its counters. The counters are estimated from
+// their parameters, so that a flow is accounted the same size when added and
+// removed
+func flowSize(flow *Flow) int64 {
+	size := int64(flowSizeEstimate)
+	for _, c := range flow.Cntrs {
+		size += 2 * counters.Size(c)
+	}
+	return size
+}
+
+// flowAdded and flowRemoved account for flows entering and leaving the
+// table t
+func (fc *FlowCache) flowAdded(t *flowTable, flow *Flow) {
+	t.index.add(flow.Service, flow.key(), 1)
+	atomic.AddInt64(&t.flows, 1)
+	atomic.AddInt64(&fc.admission.flows, 1)
+	atomic.AddInt64(&fc.admission.bytes, flowSize(flow))
+}
+
+func (fc *FlowCache) flowRemoved(t *flowTable, flow *Flow) {
+	t.index.add(flow.Service, flow.key(), -1)
+	atomic.AddInt64(&t.flows, -1)
+	atomic.AddInt64(&fc.admission.flows, -1)
+	atomic.AddInt64(&fc.admission.bytes, -flowSize(flow))
+}
+
+// allowRate returns true if the rate limit allows creating a new flow at
+// time ts, expressed in nanoseconds
+func (fc *FlowCache) allowRate(ts int64) bool {
+	a := &fc.admission
+	if a.rate <= 0 {
+		return true
+	}
+	a.rateLock.Lock()
+	defer a.rateLock.Unlock()
+	if ts > a.lastRefill {
+		if a.lastRefill > 0 {
+			a.tokens += a.rate * float64(ts-a.lastRefill) / float64(time.Second)
+			if a.tokens > a.burst {
+				a.tokens = a.burst
+			}
+		}
+		a.lastRefill = ts
+	}
+	if a.tokens < 1 {
+		return false
+	}
+	a.tokens--
+	return true
+}
+
+// full returns the number of flows to evict to bring the cache back under
+// its limits, 0 if the cache is not full
+func (fc *FlowCache) full() int64 {
+	a := &fc.admission
+	flows := atomic.LoadInt64(&a.flows)
+	bytes := atomic.LoadInt64(&a.bytes)
+	var n int64
+	if a.maxFlows > 0 && flows >= a.maxFlows {
+		n = flows - a.maxFlows + a.maxFlows/evictionFraction + 1
+	}
+	if a.maxBytes > 0 && bytes >= a.maxBytes && flows > 0 {
+		avg := bytes / flows
+		if nb := (bytes-a.maxBytes+a.maxBytes/evictionFraction)/avg + 1; nb > n {
+			n = nb
+		}
+	}
+	return n
+}
+
+// admit decides whether a new flow starting at time ts can be added to the
+// table t, evicting other flows if required by the admission policy
+func (fc *FlowCache) admit(t *flowTable, ts int64) bool {
+	a := &fc.admission
+	if !fc.allowRate(ts) {
+		atomic.AddUint64(&a.rateLimited, 1)
+		return false
+	}
+	if fc.full() == 0 {
+		return true
+	}
+	var order func(*Flow) int64
+	switch a.policy {
+	case AdmissionEvictOldest:
+		order = func(f *Flow) int64 { return f.FirstSeen }
+	case AdmissionEvictIdle:
+		order = func(f *Flow) int64 { return f.LastSeen }
+	case AdmissionSample:
+		if rand.Float64() >= a.sampleRate {
+			atomic.AddUint64(&a.rejected, 1)
+			return false
+		}
+		order = func(f *Flow) int64 { return f.LastSeen }
+	default:
+		atomic.AddUint64(&a.rejected, 1)
+		return false
+	}
+	if !fc.evict(t, order) {
+		atomic.AddUint64(&a.rejected, 1)
+		return false
+	}
+	return true
+}
+
+// evict brings the cache below its limits removing the flows with the lowest
+// value of ts. The table t evicts a share of the excess proportional to the
+// number of its flows, the tables owned by other workers are asked to evict
+// their share between two of their packets. Returns false if the cache is
+// still full and t had no flow to evict, in which case the new flow has no
+// room until the other tables evict theirs. Evicted flows are exported at the
+// next dump
+func (fc *FlowCache) evict(t *flowTable, ts func(*Flow) int64) bool {
+	n := fc.evictShare(t.cache, &t.flows, ts)
+	if fc.full() == 0 {
+		return true
+	}
+	for _, other := range fc.allTables() {
+		if other != t && other.owned() {
+			flows := &other.flows
+			other.post(func(c cache.Cache) {
+				fc.evictShare(c, flows, ts)
+			})
+		}
+	}
+	return n > 0
+}
+
+// evictShare removes from the cache c, holding flows flows, its share of the
+// flows to evict to bring the cache below its limits. Returns the number of
+// flows evicted
+func (fc *FlowCache) evictShare(c cache.Cache, flows *int64, ts func(*Flow) int64) int64 {
+	a := &fc.admission
+	a.evictLock.Lock()
+	defer a.evictLock.Unlock()
+
+	// Another caller might have already made room
+	n := fc.full()
+	if n == 0 {
+		return 0
+	}
+	own, total := atomic.LoadInt64(flows), atomic.LoadInt64(&a.flows)
+	if own < total {
+		n = (n*own + total - 1) / total
+	}
+	if n == 0 {
+		return 0
+	}
+
+	values := []int64{}
+	if i, err := c.IterativeDump(); err != nil {
+		log.Errorln(err)
+		return 0
+	} else {
+		for {
+			v, err := c.NextElement(i)
+			if err != nil || v == nil {
+				break
+			}
+			values = append(values, ts(v.(*Flow)))
+		}
+	}
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	if n > int64(len(values)) {
+		n = int64(len(values))
+	}
+	cutoff := values[n-1]
+
+	var evicted int64
+	c.PurgeFunc(func(v interface{}) bool {
+		flow, ok := v.(*Flow)
+		if !ok || evicted >= n || ts(flow) > cutoff {
+			return false
+		}
+		evicted++
+		flow.Termination = TerminationOverload
+		return true
+	})
+	atomic.AddUint64(&a.evicted, uint64(evicted))
+	log.Debugf("Evicted %d flows from the full cache", evicted)
+	return evicted
+}
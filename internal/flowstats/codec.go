@@ -0,0 +1,262 @@
+package flowstats
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/counters"
+)
+
+// Flows are stored by the caches that keep their elements as bytes with a
+// fixed binary layout: the fixed size fields, then the strings, each preceded
+// by its length. When all the counters of a flow are BinaryCounters their
+// state follows, each preceded by its length, otherwise the counters are kept
+// outside the bytes in a flowExt. So is the snapshot of the previous epoch
+// until it is collected, so that most flows have no part outside the bytes
+
+const (
+	// flowFixedSize is the size of the fixed size fields: FirstSeen,
+	// LastSeen, the timeouts, the epoch and the volume, followed by the flags
+	flowFixedSize = 9*8 + 1
+	// Flags of the serialized flows
+	flowFinIn   = 1
+	flowFinOut  = 2
+	flowCntrsIn = 4
+)
+
+// flowExt contains the parts of a flow kept outside its serialized form
+type flowExt struct {
+	cntrs   []counters.Counter
+	standby *flowSnapshot
+}
+
+// flowCodec converts flows to and from bytes for the caches that store their
+// elements as bytes
+type flowCodec struct {
+	fc *FlowCache
+}
+
+// flowStrings returns pointers to the string fields of the flow f, in the
+// order they are serialized
+func flowStrings(f *Flow) [10]*string {
+	return [10]*string{&f.Id, &f.Service, &f.DomainName, &f.ServiceIP, &f.LocalIP,
+		&f.Protocol, &f.LocalPort, &f.ServicePort, &f.HwAddr, &f.Termination}
+}
+
+// binaryCounters returns true if the state of all the counters cntrs can be
+// serialized
+func binaryCounters(cntrs []counters.Counter) bool {
+	for _, c := range cntrs {
+		if _, ok := c.(counters.BinaryCounter); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Encode appends the serialized flow v to dst. The part kept outside the
+// bytes reuses the one of the flow, if any
+func (c *flowCodec) Encode(dst []byte, v interface{}) ([]byte, interface{}, error) {
+	flow, ok := v.(*Flow)
+	if !ok {
+		return nil, nil, errors.New("can only encode flows")
+	}
+	for _, n := range []int64{flow.FirstSeen, flow.LastSeen, flow.activeTimeout, flow.idleTimeout, int64(flow.epoch),
+		flow.vol.InPackets, flow.vol.OutPackets, flow.vol.InBytes, flow.vol.OutBytes} {
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(n))
+	}
+	inline := len(flow.Cntrs) <= math.MaxUint16 && binaryCounters(flow.Cntrs)
+	var flags byte
+	if flow.finIn {
+		flags |= flowFinIn
+	}
+	if flow.finOut {
+		flags |= flowFinOut
+	}
+	if inline {
+		flags |= flowCntrsIn
+	}
+	dst = append(dst, flags)
+	for _, s := range flowStrings(flow) {
+		if len(*s) > math.MaxUint16 {
+			return nil, nil, errors.New("flow field too long")
+		}
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(len(*s)))
+		dst = append(dst, *s...)
+	}
+
+	if !inline {
+		if flow.ext == nil {
+			flow.ext = &flowExt{}
+		}
+		flow.ext.cntrs = flow.Cntrs
+		flow.ext.standby = flow.standby
+		return dst, flow.ext, nil
+	}
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(len(flow.Cntrs)))
+	for _, cntr := range flow.Cntrs {
+		start := len(dst)
+		dst = append(dst, 0, 0, 0, 0)
+		var err error
+		if dst, err = cntr.(counters.BinaryCounter).AppendBinary(dst); err != nil {
+			return nil, nil, err
+		}
+		binary.LittleEndian.PutUint32(dst[start:], uint32(len(dst)-start-4))
+	}
+	if flow.standby == nil {
+		return dst, nil, nil
+	}
+	if flow.ext == nil {
+		flow.ext = &flowExt{}
+	}
+	flow.ext.cntrs = nil
+	flow.ext.standby = flow.standby
+	return dst, flow.ext, nil
+}
+
+// Decode restores a flow serialized by Encode. The flow is attached to the
+// current privacy policy of the cache
+func (c *flowCodec) Decode(data []byte, ext interface{}) (interface{}, error) {
+	return c.DecodeInto(data, ext, nil)
+}
+
+// DecodeInto is like Decode, restoring the flow into v if it is a flow. The
+// strings of v are only replaced if they changed, and so are its counters if
+// they belong to another service or were released
+func (c *flowCodec) DecodeInto(data []byte, ext interface{}, v interface{}) (interface{}, error) {
+	if len(data) < flowFixedSize {
+		return nil, errors.New("truncated flow")
+	}
+	flow, ok := v.(*Flow)
+	if !ok || flow == nil {
+		flow = &Flow{}
+	}
+	prevService, prevInline := flow.Service, flow.inline
+	flow.policy = c.fc.policy
+	n := func(i int) int64 {
+		return int64(binary.LittleEndian.Uint64(data[8*i:]))
+	}
+	flow.FirstSeen = n(0)
+	flow.LastSeen = n(1)
+	flow.activeTimeout = n(2)
+	flow.idleTimeout = n(3)
+	flow.epoch = uint64(n(4))
+	flow.vol = flowVolume{InPackets: n(5), OutPackets: n(6), InBytes: n(7), OutBytes: n(8)}
+	flags := data[flowFixedSize-1]
+	flow.finIn = flags&flowFinIn != 0
+	flow.finOut = flags&flowFinOut != 0
+
+	// The strings that changed share a single allocation
+	fields := flowStrings(flow)
+	var starts, lens [len(fields)]int
+	var changed [len(fields)]bool
+	off, total := flowFixedSize, 0
+	for i, s := range fields {
+		if off+2 > len(data) {
+			return nil, errors.New("truncated flow")
+		}
+		lens[i] = int(binary.LittleEndian.Uint16(data[off:]))
+		starts[i] = off + 2
+		off = starts[i] + lens[i]
+		if off > len(data) {
+			return nil, errors.New("truncated flow")
+		}
+		if changed[i] = string(data[starts[i]:off]) != *s; changed[i] {
+			total += lens[i]
+		}
+	}
+	if total > 0 {
+		var b strings.Builder
+		b.Grow(total)
+		for i := range fields {
+			if changed[i] {
+				b.Write(data[starts[i] : starts[i]+lens[i]])
+			}
+		}
+		all := b.String()
+		start := 0
+		for i, s := range fields {
+			if changed[i] {
+				*s = all[start : start+lens[i]]
+				start += lens[i]
+			}
+		}
+	}
+
+	e, _ := ext.(*flowExt)
+	flow.ext = e
+	flow.standby = nil
+	if e != nil {
+		flow.standby = e.standby
+	}
+	if flags&flowCntrsIn == 0 {
+		if e == nil {
+			return nil, errors.New("missing flow counters")
+		}
+		flow.Cntrs = e.cntrs
+		flow.inline = false
+	} else if err := c.decodeCounters(flow, data[off:], prevInline && prevService == flow.Service); err != nil {
+		return nil, err
+	}
+
+	if flow.clock == nil || prevService != flow.Service {
+		flow.clock = c.fc.epochs.clock(flow.Service)
+	}
+	return flow, nil
+}
+
+// decodeCounters restores the counters serialized in data into those of the
+// flow if reuse is true, or into new instances otherwise
+func (c *flowCodec) decodeCounters(flow *Flow, data []byte, reuse bool) error {
+	if len(data) < 2 {
+		return errors.New("truncated flow counters")
+	}
+	count := int(binary.LittleEndian.Uint16(data))
+	data = data[2:]
+	if !reuse || len(flow.Cntrs) != count {
+		flow.Cntrs = nil
+		if count > 0 {
+			sid, ok := c.fc.serviceMap.GetId(flow.Service)
+			if !ok {
+				return errors.New("unknown service " + flow.Service)
+			}
+			flow.Cntrs = c.fc.newCounters(sid)
+			if len(flow.Cntrs) != count {
+				return errors.New("wrong number of flow counters")
+			}
+		}
+	}
+	flow.inline = true
+	for _, cntr := range flow.Cntrs {
+		if len(data) < 4 {
+			return errors.New("truncated flow counters")
+		}
+		l := int(binary.LittleEndian.Uint32(data))
+		if 4+l > len(data) {
+			return errors.New("truncated flow counters")
+		}
+		bc, ok := cntr.(counters.BinaryCounter)
+		if !ok {
+			return errors.New("counter " + cntr.Type() + " can not be decoded")
+		}
+		if err := bc.UnmarshalBinary(data[4 : 4+l]); err != nil {
+			return err
+		}
+		data = data[4+l:]
+	}
+	return nil
+}
+
+// release returns a copy of the flow f, found locked in a cache, to keep after
+// unlocking it. Caches storing flows as bytes reuse f for their next lookup,
+// so f must not be used afterwards
+func (f *Flow) release() *Flow {
+	kept := *f
+	f.Cntrs = nil
+	f.inline = false
+	f.standby = nil
+	f.ext = nil
+	return &kept
+}
@@ -0,0 +1,109 @@
+package flowstats
+
+import (
+	"testing"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/counters"
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+)
+
+// newTestCodecFlow returns a flow of the service Test with a packet counter
+// holding one packet
+func newTestCodecFlow() *Flow {
+	f := CreateFlow()
+	f.Id = "0123"
+	f.Service = "Test"
+	f.ServiceIP = "198.38.120.133"
+	f.LocalIP = "192.168.43.72"
+	f.Protocol = "tcp"
+	f.LocalPort = "51751"
+	f.ServicePort = "443"
+	f.FirstSeen = 1
+	f.LastSeen = 2
+	f.Cntrs = append(f.Cntrs, &counters.PacketCounters{})
+	f.AddPacket(newTestTCPPacket(2, network.TrafficIn, false, false))
+	return f
+}
+
+func TestFlowCodecInline(t *testing.T) {
+	fc := newTestFlowCache(t, "BigCache")
+	if err := fc.AddServices([]Service{{Name: "Test", Collect: []counters.CounterConfig{{Name: "PacketCounters"}}}}); err != nil {
+		t.Fatalf("Can not initialize flowcache services: %s", err)
+	}
+	codec := &flowCodec{fc: fc}
+
+	f := newTestCodecFlow()
+	data, ext, err := codec.Encode(nil, f)
+	if err != nil {
+		t.Fatalf("Can not encode the flow: %s", err)
+	}
+	if ext != nil {
+		t.Fatalf("Flow with binary counters should have no part outside its bytes, found %v", ext)
+	}
+
+	v, err := codec.DecodeInto(data, ext, nil)
+	if err != nil {
+		t.Fatalf("Can not decode the flow: %s", err)
+	}
+	decoded := v.(*Flow)
+	if decoded.Id != f.Id || decoded.ServiceIP != f.ServiceIP || decoded.LocalPort != f.LocalPort || decoded.LastSeen != f.LastSeen {
+		t.Fatalf("Decoded flow %+v differs from %+v", decoded, f)
+	}
+	if len(decoded.Cntrs) != 1 || decoded.Cntrs[0] == f.Cntrs[0] {
+		t.Fatalf("Decoded flow should own new counters")
+	}
+	if *decoded.Cntrs[0].(*counters.PacketCounters) != *f.Cntrs[0].(*counters.PacketCounters) {
+		t.Fatalf("Decoded counters %+v differ from %+v", decoded.Cntrs[0], f.Cntrs[0])
+	}
+
+	// Decoding into the same flow reuses its strings and counters
+	cntr := decoded.Cntrs[0]
+	id := decoded.Id
+	v, err = codec.DecodeInto(data, nil, decoded)
+	if err != nil {
+		t.Fatalf("Can not decode the flow: %s", err)
+	}
+	if v.(*Flow) != decoded || decoded.Cntrs[0] != cntr || decoded.Id != id {
+		t.Fatalf("Decoding into a flow should reuse it")
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		codec.DecodeInto(data, nil, decoded)
+	}); allocs != 0 {
+		t.Fatalf("Decoding into a flow of the same service should not allocate, %.0f allocations", allocs)
+	}
+
+	// A released flow keeps its counters, the next decode creates new ones
+	kept := decoded.release()
+	if _, err = codec.DecodeInto(data, nil, decoded); err != nil {
+		t.Fatalf("Can not decode the flow: %s", err)
+	}
+	if kept.Cntrs[0] != cntr || decoded.Cntrs[0] == cntr {
+		t.Fatalf("Released flow should keep its counters")
+	}
+}
+
+func TestFlowCodecExt(t *testing.T) {
+	codec := &flowCodec{fc: newTestFlowCache(t, "BigCache")}
+
+	// Counters that can not be serialized are kept outside the bytes
+	f := newTestCodecFlow()
+	f.Cntrs = append(f.Cntrs, &counters.TCPState{})
+	data, ext, err := codec.Encode(nil, f)
+	if err != nil {
+		t.Fatalf("Can not encode the flow: %s", err)
+	}
+	e, ok := ext.(*flowExt)
+	if !ok || len(e.cntrs) != 2 {
+		t.Fatalf("Flow counters should be kept outside its bytes, found %v", ext)
+	}
+	v, err := codec.Decode(data, ext)
+	if err != nil {
+		t.Fatalf("Can not decode the flow: %s", err)
+	}
+	if decoded := v.(*Flow); decoded.Cntrs[0] != f.Cntrs[0] || decoded.Cntrs[1] != f.Cntrs[1] {
+		t.Fatalf("Decoded flow should share the counters kept outside its bytes")
+	}
+	if _, err = codec.Decode(data, nil); err == nil {
+		t.Fatalf("Decoding a flow without its counters should fail")
+	}
+}
@@ -0,0 +1,172 @@
+package flowstats
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/counters"
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+)
+
+// The output of the flows is double buffered. Packets update the counters of
+// the current epoch of the flow service while dumps collect the output of the
+// previous one. A dump starts a new epoch for the services it collects, so
+// that the snapshot of every flow is cut at the same instant and no packet
+// is counted twice or lost between the collection and the clearing of the
+// counters.
+// Flows take their snapshot lazily: either when they receive the first
+// packet of the new epoch or when the dump reaches them, whichever comes
+// first. The snapshot collects the output of the counters and clears them in
+// place, so the state of the connection they track carries over to the next
+// epoch.
+
+// epochs contains the epoch clock of each service
+type epochs struct {
+	clocks map[string]*uint64
+	sync.RWMutex
+}
+
+// clock returns the epoch clock of the service, creating it if needed
+func (e *epochs) clock(service string) *uint64 {
+	e.RLock()
+	c, ok := e.clocks[service]
+	e.RUnlock()
+	if ok {
+		return c
+	}
+	e.Lock()
+	defer e.Unlock()
+	if c, ok = e.clocks[service]; !ok {
+		if e.clocks == nil {
+			e.clocks = make(map[string]*uint64)
+		}
+		c = new(uint64)
+		e.clocks[service] = c
+	}
+	return c
+}
+
+// advance starts a new epoch for the given services. A nil list selects all
+// services
+func (e *epochs) advance(services map[string]bool) {
+	if services != nil {
+		for s := range services {
+			atomic.AddUint64(e.clock(s), 1)
+		}
+		return
+	}
+	e.RLock()
+	for _, c := range e.clocks {
+		atomic.AddUint64(c, 1)
+	}
+	e.RUnlock()
+}
+
+// flowSnapshot is the output of a flow in a past epoch, waiting to be
+// collected by a dump
+type flowSnapshot struct {
+	cntrs    []counters.Counter
+	vol      flowVolume
+	lastSeen int64
+}
+
+// collectedCounter holds the output of a counter collected at the end of an
+// epoch. It ignores the packets it receives
+type collectedCounter struct {
+	OutCounter
+}
+
+func (c *collectedCounter) AddPacket(pkt *network.Packet) error {
+	return nil
+}
+
+func (c *collectedCounter) Reset() error {
+	return nil
+}
+
+func (c *collectedCounter) Clear() error {
+	return nil
+}
+
+// Type returns the type of the collected counter
+func (c *collectedCounter) Type() string {
+	return c.CType
+}
+
+// Collect returns the output of the collected counter
+func (c *collectedCounter) Collect() []byte {
+	return c.Data
+}
+
+// takeSnapshot collects the output of the counters of the flow and clears
+// them in place. Must be called while holding the lock of the flow
+func (f *Flow) takeSnapshot() *flowSnapshot {
+	s := &flowSnapshot{
+		cntrs:    make([]counters.Counter, 0, len(f.Cntrs)),
+		vol:      f.vol,
+		lastSeen: f.LastSeen,
+	}
+	for _, counter := range f.Cntrs {
+		s.cntrs = append(s.cntrs, &collectedCounter{OutCounter{
+			CType: counter.Type(),
+			Data:  counter.Collect(),
+		}})
+		counter.Clear()
+	}
+	f.vol = flowVolume{}
+	return s
+}
+
+// rotate takes the snapshot of the flow if its epoch is over. If the snapshot
+// of a previous epoch has not been collected yet no new snapshot is taken,
+// and the counters keep accumulating until the next dump. Must be called
+// while holding the lock of the flow
+func (f *Flow) rotate() {
+	if f.clock == nil {
+		return
+	}
+	e := atomic.LoadUint64(f.clock)
+	if f.epoch == e {
+		return
+	}
+	f.epoch = e
+	if f.standby != nil {
+		return
+	}
+	f.standby = f.takeSnapshot()
+}
+
+// snapshotFlow returns a copy of the flow f holding the output of its
+// previous epoch, or false if the flow started in the current epoch. Must be
+// called while holding the lock of the flow
+func (f *Flow) snapshotFlow() (Flow, bool) {
+	f.rotate()
+	return f.popSnapshot()
+}
+
+// popSnapshot returns a copy of the flow f holding the snapshot not collected
+// yet, if any, and releases it
+func (f *Flow) popSnapshot() (Flow, bool) {
+	s := f.standby
+	if s == nil {
+		return Flow{}, false
+	}
+	f.standby = nil
+	out := *f
+	out.Cntrs = s.cntrs
+	out.vol = s.vol
+	out.LastSeen = s.lastSeen
+	return out, true
+}
+
+// closedFlows returns the flows to export for the closed flow f: the
+// snapshot of its previous epoch, if not collected yet, followed by its
+// final state
+func closedFlows(f *Flow) []*Flow {
+	prev, ok := f.popSnapshot()
+	if !ok {
+		return []*Flow{f}
+	}
+	prev.Termination = ""
+	return []*Flow{&prev, f}
+}
@@ -0,0 +1,245 @@
+package flowstats
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/counters"
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+)
+
+// testCounter counts the packets it receives
+type testCounter struct {
+	N int
+}
+
+func (c *testCounter) AddPacket(pkt *network.Packet) error {
+	c.N++
+	return nil
+}
+
+func (c *testCounter) Reset() error {
+	c.N = 0
+	return nil
+}
+
+func (c *testCounter) Clear() error {
+	c.N = 0
+	return nil
+}
+
+func (c *testCounter) Type() string {
+	return "testCounter"
+}
+
+func (c *testCounter) Collect() []byte {
+	b, _ := json.Marshal(c)
+	return b
+}
+
+// newTestEpochFlowcache returns a cache containing a flow with a testCounter
+// for each epoch
+func newTestEpochFlowcache(t *testing.T) *FlowCache {
+	flowcache := newTestFlowCache(t, "ConcurrentCacheMap")
+	pkt := newTestTCPPacket(1, network.TrafficIn, false, false)
+	flowcache.ProcessPacket(pkt)
+	key := NewFlowKey(pkt)
+	v, _ := flowcache.cache.GetAndLock(string(key[:]))
+	flow := v.(*Flow)
+	flow.Cntrs = []counters.Counter{&testCounter{}}
+	flowcache.cache.SetAndUnlock(string(key[:]), flow)
+	return flowcache
+}
+
+// dumpedPackets returns the sum of the testCounter values in the dump
+func dumpedPackets(t *testing.T, dump []json.RawMessage) int {
+	n := 0
+	for _, b := range dump {
+		var of OutFlow
+		if err := json.Unmarshal(b, &of); err != nil {
+			t.Fatalf("Can not parse the dumped flow: %s", err)
+		}
+		for _, c := range of.Cntrs {
+			var tc testCounter
+			json.Unmarshal(c.Data, &tc)
+			n += tc.N
+		}
+	}
+	return n
+}
+
+func TestFlowcacheEpochs(t *testing.T) {
+	flowcache := newTestEpochFlowcache(t)
+	for ts := int64(2); ts <= 4; ts++ {
+		flowcache.ProcessPacket(newTestTCPPacket(ts, network.TrafficIn, false, false))
+	}
+	if n := dumpedPackets(t, flowcache.DumpToString()); n != 3 {
+		t.Fatalf("Dumped %d packets instead of 3", n)
+	}
+
+	// Packets received after the start of an epoch are not part of the
+	// snapshot of the previous one
+	for ts := int64(5); ts <= 6; ts++ {
+		flowcache.ProcessPacket(newTestTCPPacket(ts, network.TrafficIn, false, false))
+	}
+	flowcache.epochs.advance(nil)
+	flowcache.ProcessPacket(newTestTCPPacket(7, network.TrafficIn, false, false))
+	flowcache.forEachFlow(func(f *Flow) {
+		f.rotate()
+		if f.standby == nil || dumpedPackets(t, []json.RawMessage{f.collect(f.standby.cntrs)}) != 2 || f.Cntrs[0].(*testCounter).N != 1 {
+			t.Fatalf("Wrong epoch buffers: snapshot %v, current %v", f.standby, f.Cntrs)
+		}
+	})
+
+	// A flow closed with a pending snapshot exports both
+	flowcache.ProcessPacket(newTestTCPPacket(8, network.TrafficIn, false, true))
+	dump := flowcache.DumpToString()
+	if len(dump) != 2 {
+		t.Fatalf("Expected 2 records for the closed flow, found %d", len(dump))
+	}
+	if n := dumpedPackets(t, dump); n != 4 {
+		t.Fatalf("Dumped %d packets instead of 4", n)
+	}
+}
+
+func TestFlowcacheEpochsConcurrentDumps(t *testing.T) {
+	flowcache := newTestEpochFlowcache(t)
+	packets := 2000
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ts := 2; ts < packets+2; ts++ {
+			flowcache.ProcessPacket(newTestTCPPacket(int64(ts), network.TrafficIn, false, false))
+		}
+	}()
+	dumped := 0
+	for i := 0; i < 50; i++ {
+		dumped += dumpedPackets(t, flowcache.DumpServicesToString([]string{"Test"}))
+	}
+	wg.Wait()
+	dumped += dumpedPackets(t, flowcache.DumpToString())
+	if dumped != packets {
+		t.Fatalf("Dumped %d packets instead of %d", dumped, packets)
+	}
+}
+
+// newTestHandshakePacket returns a TCP packet of the test flow with one byte
+// of payload
+func newTestHandshakePacket(ts int64, dir int, syn, ack bool, seq, acked uint32) *network.Packet {
+	pkt := newTestTCPPacket(ts, dir, false, false)
+	pkt.Tcp = &layers.TCP{SYN: syn, ACK: ack, Seq: seq, Ack: acked}
+	pkt.Length = 1
+	pkt.DataLength = 1
+	pkt.RawData = make([]byte, ethernetAndIPv6HeaderLen+1)
+	pkt.RawData[ethernetAndIPv6HeaderLen] = byte(ts / int64(time.Millisecond))
+	return pkt
+}
+
+// ethernetAndIPv6HeaderLen is the length of the headers preceding the
+// transport layer of the test packets
+const ethernetAndIPv6HeaderLen = 14 + 40
+
+// newTestCountersFlowcache returns a cache whose Test service collects the
+// counters collect
+func newTestCountersFlowcache(t *testing.T, collect ...counters.CounterConfig) *FlowCache {
+	flowcache := newTestFlowCache(t, "ConcurrentCacheMap")
+	if err := flowcache.AddServices([]Service{{Name: "Test", Collect: collect}}); err != nil {
+		t.Fatalf("Can not initialize flowcache services: %s", err)
+	}
+	return flowcache
+}
+
+// dumpCounter dumps the cache and decodes the output of the i-th counter of
+// each flow into a new value returned by out
+func dumpCounter(t *testing.T, flowcache *FlowCache, i int, out func() interface{}) {
+	for _, b := range flowcache.DumpToString() {
+		var of OutFlow
+		if err := json.Unmarshal(b, &of); err != nil {
+			t.Fatalf("Can not parse the dumped flow: %s", err)
+		}
+		if err := json.Unmarshal(of.Cntrs[i].Data, out()); err != nil {
+			t.Fatalf("Can not parse the dumped counter: %s", err)
+		}
+	}
+}
+
+func TestFlowcacheEpochsConnectionState(t *testing.T) {
+	flowcache := newTestCountersFlowcache(t,
+		counters.CounterConfig{Name: "TCPLatencySplit"},
+		counters.CounterConfig{Name: "ByteCopyCounters", Params: counters.Params{"ToCopy": 3, "Layers": "PayloadOnly"}},
+	)
+
+	// The handshake spans three emit windows
+	ms := int64(time.Millisecond)
+	packets := []*network.Packet{
+		newTestHandshakePacket(1*ms, network.TrafficOut, true, false, 100, 0),
+		newTestHandshakePacket(11*ms, network.TrafficIn, true, true, 500, 101),
+		newTestHandshakePacket(50*ms, network.TrafficOut, false, true, 101, 501),
+	}
+	var down int64
+	copied := []int32{}
+	data := []byte{}
+	for _, pkt := range packets {
+		flowcache.ProcessPacket(pkt)
+		for _, b := range flowcache.DumpToString() {
+			var of OutFlow
+			if err := json.Unmarshal(b, &of); err != nil {
+				t.Fatalf("Can not parse the dumped flow: %s", err)
+			}
+			var latency counters.TCPLatencySplitOut
+			var bytes counters.ByteCopyCountersOut
+			json.Unmarshal(of.Cntrs[0].Data, &latency)
+			json.Unmarshal(of.Cntrs[1].Data, &bytes)
+			down += latency.DownHandshakeRTT
+			copied = append(copied, bytes.CopiedBytes)
+			data = append(data, bytes.Data...)
+		}
+	}
+	if down != 39*ms {
+		t.Fatalf("Downstream handshake RTT %d instead of %d", down, 39*ms)
+	}
+	if fmt.Sprint(copied) != "[1 2 3]" || fmt.Sprint(data) != "[1 11 50]" {
+		t.Fatalf("Copied %v bytes %v instead of [1 2 3] bytes [1 11 50]", copied, data)
+	}
+}
+
+func TestFlowcacheEpochsWindowScale(t *testing.T) {
+	flowcache := newTestCountersFlowcache(t, counters.CounterConfig{Name: "TCPState"})
+	wscale := func(shift byte) []layers.TCPOption {
+		return []layers.TCPOption{{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{shift}}}
+	}
+	ms := int64(time.Millisecond)
+	syn := newTestHandshakePacket(1*ms, network.TrafficOut, true, false, 100, 0)
+	syn.Tcp.Options = wscale(7)
+	synAck := newTestHandshakePacket(11*ms, network.TrafficIn, true, true, 500, 101)
+	synAck.Tcp.Options = wscale(8)
+	up := newTestHandshakePacket(50*ms, network.TrafficOut, false, true, 101, 501)
+	up.Tcp.Window = 100
+	down := newTestHandshakePacket(60*ms, network.TrafficIn, false, true, 501, 102)
+	down.Tcp.Window = 10
+
+	// Each packet is in its own emit window
+	outs := []*counters.TCPStateOut{}
+	for _, pkt := range []*network.Packet{syn, synAck, up, down} {
+		flowcache.ProcessPacket(pkt)
+		dumpCounter(t, flowcache, 0, func() interface{} {
+			outs = append(outs, &counters.TCPStateOut{})
+			return outs[len(outs)-1]
+		})
+	}
+	if len(outs) != 4 {
+		t.Fatalf("Dumped %d records instead of 4", len(outs))
+	}
+	if outs[2].UpWScale != 7 || outs[2].DownWScale != 8 || outs[2].UpRecWindowAvg != 100<<7 {
+		t.Fatalf("Wrong upstream window after the handshake: %+v", outs[2])
+	}
+	if outs[3].DownRecWindowAvg != 10<<8 {
+		t.Fatalf("Wrong downstream window after the handshake: %+v", outs[3])
+	}
+}
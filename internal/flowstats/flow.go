@@ -10,6 +10,27 @@ import (
 	"github.com/traffic-refinery/traffic-refinery/internal/network"
 )
 
+const (
+	// TerminationFin is the termination reason of TCP flows closed with a FIN
+	// in both directions
+	TerminationFin = "fin"
+	// TerminationRst is the termination reason of TCP flows reset by one of
+	// the endpoints
+	TerminationRst = "rst"
+	// TerminationEvicted is the termination reason of flows removed from the
+	// cache after being inactive for longer than the eviction time
+	TerminationEvicted = "evicted"
+	// TerminationIdle is the termination reason of flows that did not see
+	// any packet for longer than their idle timeout
+	TerminationIdle = "idle"
+	// TerminationActive is the termination reason of flows that lasted
+	// longer than their active timeout
+	TerminationActive = "active"
+	// TerminationOverload is the termination reason of flows evicted to make
+	// room for new ones when the cache is full
+	TerminationOverload = "overload"
+)
+
 // Flow is a general flow interface.
 // Functions that all flow type structures have to implement.
 
@@ -24,8 +45,39 @@ type Flow struct {
 	Protocol    string
 	LocalPort   string
 	ServicePort string
-
+	HwAddr      string
+	// FirstSeen and LastSeen are the timestamps of the first and last packets
+	// of the flow
+	FirstSeen int64
+	LastSeen  int64
+	// Termination is the reason why the flow ended. Empty for active flows
+	Termination string
+
+	// Cntrs are the counters of the current epoch
 	Cntrs []counters.Counter
+	// standby is the snapshot of the previous epoch, nil once collected.
+	// epoch is the epoch of Cntrs and clock the epoch clock of the flow
+	// service
+	standby *flowSnapshot
+	// vol is the traffic of the current epoch, used to compute the rollups
+	vol   flowVolume
+	epoch uint64
+	clock *uint64
+
+	// finIn and finOut record whether a FIN has been seen in each direction
+	finIn  bool
+	finOut bool
+	// activeTimeout and idleTimeout are the timeouts of the flow in
+	// nanoseconds. 0 disables the timeout
+	activeTimeout int64
+	idleTimeout   int64
+	// policy is the privacy policy applied when collecting the flow
+	policy *PrivacyPolicy
+	// ext is the part of the flow kept outside the bytes of the caches
+	// storing flows as bytes, nil if none. inline is true if Cntrs were
+	// decoded from those bytes and are owned by the flow
+	ext    *flowExt
+	inline bool
 }
 
 func CreateFlow() *Flow {
@@ -39,6 +91,12 @@ func (f *Flow) AddPacket(pkt *network.Packet) error {
 		return errors.New("packet can not be nil")
 	}
 
+	if f.FirstSeen == 0 {
+		f.FirstSeen = pkt.TStamp
+	}
+	f.LastSeen = pkt.TStamp
+	f.vol.add(pkt)
+
 	for _, counter := range f.Cntrs {
 		log.Debugf("Updating counter of type %s for flow %s", counter.Type(), f.Id)
 		counter.AddPacket(pkt)
@@ -48,11 +106,54 @@ func (f *Flow) AddPacket(pkt *network.Packet) error {
 	return nil
 }
 
-// Reset resets the flow statistics
+// trackTCP updates the TCP connection state of the flow based on the packet
+// pkt and returns true if the connection is closed. A connection is closed by
+// a RST or by the acknowledgement following a FIN in both directions
+func (f *Flow) trackTCP(pkt *network.Packet) bool {
+	if !pkt.IsTCP || pkt.Tcp == nil {
+		return false
+	}
+	if pkt.Tcp.RST {
+		f.Termination = TerminationRst
+		return true
+	}
+	if pkt.Tcp.FIN {
+		if pkt.Dir == network.TrafficIn {
+			f.finIn = true
+		} else {
+			f.finOut = true
+		}
+		return false
+	}
+	if f.finIn && f.finOut {
+		f.Termination = TerminationFin
+		return true
+	}
+	return false
+}
+
+// expire returns true if the flow timed out at time now, expressed in
+// nanoseconds, and sets the termination reason accordingly
+func (f *Flow) expire(now int64) bool {
+	if f.idleTimeout > 0 && now-f.LastSeen >= f.idleTimeout {
+		f.Termination = TerminationIdle
+		return true
+	}
+	if f.activeTimeout > 0 && now-f.FirstSeen >= f.activeTimeout {
+		f.Termination = TerminationActive
+		return true
+	}
+	return false
+}
+
+// Reset resets the flow statistics and drops the snapshot of the previous
+// epoch
 func (f *Flow) Reset() error {
 	for _, counter := range f.Cntrs {
 		counter.Reset()
 	}
+	f.vol = flowVolume{}
+	f.standby = nil
 	return nil
 }
 
@@ -78,12 +179,21 @@ type OutFlow struct {
 	Protocol    string
 	LocalPort   string
 	ServicePort string
+	HwAddr      string
+	FirstSeen   int64
+	LastSeen    int64
+	Termination string
 
 	Cntrs []OutCounter
 }
 
 // Collect converts a flow into JSON form
 func (f *Flow) Collect() []byte {
+	return f.collect(f.Cntrs)
+}
+
+// collect converts a flow into JSON form using the counters cntrs
+func (f *Flow) collect(cntrs []counters.Counter) []byte {
 	of := OutFlow{
 		Id:          f.Id,
 		Service:     f.Service,
@@ -93,8 +203,15 @@ func (f *Flow) Collect() []byte {
 		Protocol:    f.Protocol,
 		LocalPort:   f.LocalPort,
 		ServicePort: f.ServicePort,
+		HwAddr:      f.HwAddr,
+		FirstSeen:   f.FirstSeen,
+		LastSeen:    f.LastSeen,
+		Termination: f.Termination,
+	}
+	if f.policy != nil {
+		f.policy.Apply(&of)
 	}
-	for _, c := range f.Cntrs {
+	for _, c := range cntrs {
 		of.Cntrs = append(of.Cntrs, OutCounter{
 			CType: c.Type(),
 			Data:  c.Collect(),
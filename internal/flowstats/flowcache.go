@@ -3,13 +3,12 @@
 package flowstats
 
 import (
-	"crypto/md5"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -17,6 +16,7 @@ import (
 	"github.com/traffic-refinery/traffic-refinery/internal/cache"
 	"github.com/traffic-refinery/traffic-refinery/internal/counters"
 	"github.com/traffic-refinery/traffic-refinery/internal/network"
+	"github.com/traffic-refinery/traffic-refinery/internal/qoe"
 	"github.com/traffic-refinery/traffic-refinery/internal/servicemap"
 )
 
@@ -24,63 +24,189 @@ import (
 type FlowCache struct {
 	// Internal cache. Any Cache type can be used
 	cache cache.Cache
+	// tables contains the flow tables, the first one stores the flows of the
+	// packets passed to ProcessPacket. With per worker tables the others
+	// are owned by the workers
+	tables     []*flowTable
+	tablesLock sync.Mutex
+	perWorker  bool
+	// evictTime and cleanupTime are used to expire the flows of the tables
+	// owned by workers. lastCleanup is the time of the last cleanup
+	evictTime   time.Duration
+	cleanupTime time.Duration
+	lastCleanup int64
 	// DNS Cache for service type detection
 	serviceMap *servicemap.ServiceMap
-	// Whether to anonymize IP addresses or not
-	anonymize bool
+	// Privacy policy applied to the exported flows
+	policy *PrivacyPolicy
 	// serviceIdToCountersId
 	serviceIdToCountersId map[servicemap.ServiceID][]int
 	// availableCounters
 	availableCounters counters.AvailableCounters
+	// closed contains the flows terminated since the last dump, at most
+	// maxClosed
+	closed     []*Flow
+	closedLock sync.Mutex
+	maxClosed  int
+	// activeTimeout and idleTimeout are the default flow timeouts
+	activeTimeout time.Duration
+	idleTimeout   time.Duration
+	// serviceTimeouts contains the timeouts configured for each service
+	serviceTimeouts map[servicemap.ServiceID]flowTimeouts
+	// lastTs is the timestamp of the most recent packet processed. Used as
+	// clock to expire flows consistently in replay mode
+	lastTs int64
+	// admission limits the size of the cache and the creation of new flows
+	admission admission
+	// epochs contains the epoch clocks of the services. Dumps are serialized
+	// by dumpLock so that each epoch is collected before the next one starts
+	epochs   epochs
+	dumpLock sync.Mutex
+	// rollupLevels are the aggregation levels computed at each dump.
+	// noFlowRecords disables the export of the per flow records
+	rollupLevels  []string
+	noFlowRecords bool
+	// dropped accumulates the traffic rejected by the admission policy for
+	// the rollups
+	dropped droppedTraffic
+	// hitters tracks the heavy hitters of all the traffic, if set
+	hitters *HeavyHitters
+	// videoSessions infers the QoE of the video sessions, if set
+	videoSessions *qoe.Sessions
+}
+
+// DefaultMaxClosed is the default maximum number of terminated flows kept
+// until the next dump
+const DefaultMaxClosed = 100000
+
+// flowTimeouts contains the active and idle timeouts of a flow
+type flowTimeouts struct {
+	active time.Duration
+	idle   time.Duration
 }
 
 // NewFlowCache initiates a new FlowCache.
 // t specifies the cache type. Possible cache types:
 //
 // - "ConcurrentCacheMap": Concurrent Map with periodic eviction of expired
-// entries. Currently the only supported cache type
+// entries
 //
-// - "BigCache": (NOT IMPLEMENTED) modified version of https://github.com/allegro/bigcache
+// - "BigCache": sharded cache inspired by https://github.com/allegro/bigcache
+// storing the flow records in a fixed binary layout in byte arenas that the
+// garbage collector does not scan. The counters stay on the heap and are
+// updated in place. Trades a copy of the flow record per packet for shorter GC
+// pauses with millions of flows
 //
-// - "CacheMap": (NOT IMPLEMENTED) a simple map with no concurrency support
+// - "PerWorker": each worker returned by NewWorker stores its flows in a
+// private map with no concurrency support. Dumps concatenate the flows of all
+// workers. Requires the packets of a flow to always reach the same worker, as
+// with PF_RING clustering or AF_PACKET fanout. Flows are expired at dump time
 //
-// - "Map": (NOT IMPLEMENTED) a simple map with no concurrency support
+// - "CacheMap": (NOT IMPLEMENTED) a simple map with no concurrency support
 func NewFlowCache(t string, serviceMap *servicemap.ServiceMap, evictTime, cleanupTime time.Duration, shardsCount uint32, anonymize bool) (*FlowCache, error) {
 	ret := &FlowCache{}
+	ret.evictTime = evictTime
+	ret.cleanupTime = cleanupTime
+	ret.maxClosed = DefaultMaxClosed
 
 	log.Debugf("Cache type selected %s", t)
 
-	if strings.ToLower(t) == "concurrentcachemap" {
-		ret.cache = cache.NewConcurrentCacheMap(shardsCount, evictTime, nil, cleanupTime)
+	table := &flowTable{}
+	if strings.ToLower(t) == "perworker" {
+		ret.perWorker = true
+		table = ret.newWorkerTable()
+	} else if strings.ToLower(t) == "concurrentcachemap" {
+		c := cache.NewConcurrentCacheMap(shardsCount, evictTime, ret.onEvicted(table), cleanupTime)
+		c.SetHashFunc(flowKeyHash)
+		table.cache = c
+	} else if strings.ToLower(t) == "bigcache" {
+		c := cache.NewBigCache(shardsCount, evictTime, ret.onEvicted(table), cleanupTime, &flowCodec{fc: ret})
+		c.SetHashFunc(flowKeyHash)
+		c.ReuseLocked()
+		table.cache = c
 	} else {
 		return nil, errors.New("incorrect type for cache")
 	}
+	ret.cache = table.cache
+	ret.tables = []*flowTable{table}
 
 	ret.serviceMap = serviceMap
-	ret.anonymize = anonymize
+	// anonymize is a shorthand for a policy anonymizing the local IP
+	// addresses with a random key. Use SetPrivacyPolicy for finer control
+	var err error
+	if ret.policy, err = NewPrivacyPolicy(nil, nil); err != nil {
+		return nil, err
+	}
+	if anonymize {
+		ret.policy.LocalIP.Action = PolicyCryptoPAn
+	}
+	if err = ret.policy.Validate(); err != nil {
+		return nil, err
+	}
 
 	ret.serviceIdToCountersId = make(map[servicemap.ServiceID][]int)
+	ret.serviceTimeouts = make(map[servicemap.ServiceID]flowTimeouts)
 
 	log.Debugln("Flowcache initialized correctly")
 	return ret, nil
 }
 
+// SetPrivacyPolicy sets the privacy policy applied to the flows created
+// from now on
+func (fc *FlowCache) SetPrivacyPolicy(policy *PrivacyPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	fc.policy = policy
+	return nil
+}
+
+// SetMaxClosed sets the maximum number of terminated flows kept until the
+// next dump. Flows terminated when the limit is reached are dropped, 0 drops
+// all terminated flows, when the cache is never dumped
+func (fc *FlowCache) SetMaxClosed(n int) {
+	fc.closedLock.Lock()
+	fc.maxClosed = n
+	fc.closedLock.Unlock()
+}
+
+// SetTimeouts sets the default active and idle timeouts of the flows. Flows
+// lasting longer than active or not receiving packets for longer than idle
+// are terminated and exported. 0 disables the timeout
+func (fc *FlowCache) SetTimeouts(active, idle time.Duration) {
+	fc.activeTimeout = active
+	fc.idleTimeout = idle
+}
+
+// timeouts returns the timeouts to use for flows of the service sid
+func (fc *FlowCache) timeouts(sid servicemap.ServiceID) flowTimeouts {
+	t := flowTimeouts{active: fc.activeTimeout, idle: fc.idleTimeout}
+	if st, ok := fc.serviceTimeouts[sid]; ok {
+		if st.active > 0 {
+			t.active = st.active
+		}
+		if st.idle > 0 {
+			t.idle = st.idle
+		}
+	}
+	return t
+}
+
 func (fc *FlowCache) AddServices(services []Service) error {
-	slist := []string{}
+	configs := []counters.CounterConfig{}
 	for _, service := range services {
-		slist = append(slist, service.Collect...)
+		configs = append(configs, service.Collect...)
 	}
-	nameToID, err := fc.availableCounters.Build(slist)
+	ids, err := fc.availableCounters.BuildConfigs(configs)
 	if err != nil {
 		return err
 	}
 
 	for _, service := range services {
 		if id, ok := fc.serviceMap.GetId(service.Name); ok {
-			fc.serviceIdToCountersId[id] = []int{}
-			for _, c := range service.Collect {
-				fc.serviceIdToCountersId[id] = append(fc.serviceIdToCountersId[id], nameToID[c])
-			}
+			fc.serviceIdToCountersId[id] = ids[:len(service.Collect):len(service.Collect)]
+			fc.serviceTimeouts[id] = flowTimeouts{active: service.ActiveTimeout, idle: service.IdleTimeout}
+			ids = ids[len(service.Collect):]
 		} else {
 			return errors.New("can't find service " + service.Name)
 		}
@@ -89,25 +215,57 @@ func (fc *FlowCache) AddServices(services []Service) error {
 	return nil
 }
 
-func (fc *FlowCache) addPacket(pkt *network.Packet, hash *string) error {
-	if value, ok := fc.cache.GetAndLock(*hash); ok {
-		log.Debugln("Packet already in the cache, processing service ip ", pkt.ServiceIP)
+// addPacket adds the packet pkt to its flow in the table t
+func (fc *FlowCache) addPacket(t *flowTable, pkt *network.Packet, clientIP string, key *FlowKey) error {
+	c := t.cache
+	hash := string(key[:])
+	if value, ok := c.GetAndLock(hash); ok {
 		flow, _ := value.(*Flow)
-		flow.AddPacket(pkt)
-		fc.cache.SetAndUnlock(*hash, flow)
+		if !flow.expire(pkt.TStamp) {
+			log.Debugln("Packet already in the cache, processing service ip ", pkt.ServiceIP)
+			fc.hitters.add(pkt, key, true)
+			fc.updateFlow(t, hash, flow, pkt)
+			return nil
+		}
+		// The flow timed out, the packet starts a new one
+		flow = flow.release()
+		log.Debugf("Flow %s terminated with reason %s", flow.Id, flow.Termination)
+		c.RemoveAndUnlock(hash)
+		fc.flowRemoved(t, flow)
+		fc.addClosed(flow)
+	}
+	if pkt.IsTCP && pkt.Tcp != nil && pkt.Tcp.RST {
+		// Resets are not used to start new flows as they usually belong to
+		// connections that are already terminated
+		log.Debugf("Ignoring reset for unknown flow %s", key)
+		if fc.hitters != nil {
+			_, ok := fc.serviceMap.LookupClientIP(clientIP, pkt.ServiceIP)
+			fc.hitters.add(pkt, key, ok)
+		}
 	} else {
 		//Query dns cache for the flow type
-		if s, ok := fc.serviceMap.LookupIP(pkt.ServiceIP); ok {
+		s, ok := fc.serviceMap.LookupClientIP(clientIP, pkt.ServiceIP)
+		fc.hitters.add(pkt, key, ok)
+		if ok {
 			// TODO Assumes only first service match per IP is used
 			sid := s[0]
 			log.Debugln("Create new flow of service type ", sid, " for service ip ", pkt.ServiceIP)
 			if service, found := fc.serviceMap.GetService(sid); found {
+				if !fc.admit(t, pkt.TStamp) {
+					log.Debugln("New flow for service ip ", pkt.ServiceIP, " rejected by the admission policy")
+					if len(fc.rollupLevels) > 0 {
+						fc.dropped.add(service.Name, pkt)
+					}
+					return nil
+				}
 				flow := CreateFlow()
-				flow.Id = *hash
+				flow.Id = key.String()
 				flow.Service = service.Name
 				flow.DomainName = ""
 				flow.ServiceIP = pkt.ServiceIP
 				flow.LocalIP = pkt.MyIP
+				flow.HwAddr = pkt.HwAddr
+				flow.policy = fc.policy
 				if pkt.IsTCP {
 					flow.Protocol = "tcp"
 				} else {
@@ -115,13 +273,22 @@ func (fc *FlowCache) addPacket(pkt *network.Packet, hash *string) error {
 				}
 				flow.LocalPort = strconv.Itoa(int(pkt.MyPort))
 				flow.ServicePort = strconv.Itoa(int(pkt.ServicePort))
-				for _, counter := range fc.serviceIdToCountersId[sid] {
-					instance, _ := fc.availableCounters.InstantiateById(counter)
-					flow.Cntrs = append(flow.Cntrs, instance)
-				}
+				timeouts := fc.timeouts(sid)
+				flow.activeTimeout = int64(timeouts.active)
+				flow.idleTimeout = int64(timeouts.idle)
+				flow.clock = fc.epochs.clock(service.Name)
+				flow.epoch = atomic.LoadUint64(flow.clock)
+				flow.Cntrs = fc.newCounters(sid)
 				flow.Reset()
 				flow.AddPacket(pkt)
-				fc.cache.Set(*hash, flow)
+				flow.trackTCP(pkt)
+				if added, _ := c.Add(hash, flow); added {
+					fc.flowAdded(t, flow)
+				} else if value, ok := c.GetAndLock(hash); ok {
+					// Another parser created the flow since the lookup above,
+					// the packet is added to that flow instead
+					fc.updateFlow(t, hash, value.(*Flow), pkt)
+				}
 			}
 		} else {
 			log.Debugln("IP ", pkt.ServiceIP, " does not belong to a known service")
@@ -130,93 +297,276 @@ func (fc *FlowCache) addPacket(pkt *network.Packet, hash *string) error {
 	return nil
 }
 
+// updateFlow adds pkt to flow, locked in the table t under hash, and stores
+// it back. The flow is closed if pkt terminates it
+func (fc *FlowCache) updateFlow(t *flowTable, hash string, flow *Flow, pkt *network.Packet) {
+	c := t.cache
+	flow.rotate()
+	flow.AddPacket(pkt)
+	if flow.trackTCP(pkt) {
+		flow = flow.release()
+		log.Debugf("Flow %s terminated with reason %s", flow.Id, flow.Termination)
+		c.RemoveAndUnlock(hash)
+		fc.flowRemoved(t, flow)
+		fc.addClosed(flow)
+	} else {
+		c.SetAndUnlock(hash, flow)
+	}
+}
+
+// newCounters returns new instances of the counters collected for the
+// service sid
+func (fc *FlowCache) newCounters(sid servicemap.ServiceID) []counters.Counter {
+	ids := fc.serviceIdToCountersId[sid]
+	ret := make([]counters.Counter, 0, len(ids))
+	for _, id := range ids {
+		instance, err := fc.availableCounters.InstantiateById(id)
+		if err != nil {
+			continue
+		}
+		if pc, ok := instance.(counters.PayloadCounter); ok {
+			pc.SetPayloadFilter(fc.policy.PayloadFilter())
+		}
+		instance.Reset()
+		ret = append(ret, instance)
+	}
+	return ret
+}
+
+// addClosed stores a terminated flow until the next dump, or drops it if too
+// many flows are waiting
+func (fc *FlowCache) addClosed(flow *Flow) {
+	fc.closedLock.Lock()
+	defer fc.closedLock.Unlock()
+	if len(fc.closed) >= fc.maxClosed {
+		atomic.AddUint64(&fc.admission.droppedClosed, 1)
+		return
+	}
+	fc.closed = append(fc.closed, flow)
+}
+
+// onEvicted returns the function called by the cache of the table t for the
+// flows it evicts so that their remaining statistics are exported at the next
+// dump
+func (fc *FlowCache) onEvicted(t *flowTable) func(v interface{}) {
+	return func(v interface{}) {
+		if flow, ok := v.(*Flow); ok {
+			log.Debugf("Flow %s evicted from the cache", flow.Id)
+			fc.flowRemoved(t, flow)
+			if flow.Termination == "" {
+				flow.Termination = TerminationEvicted
+			}
+			fc.addClosed(flow)
+		}
+	}
+}
+
+// expireFlows terminates the flows of the given services that timed out
+// according to the timestamp of the most recent packet processed. A nil
+// services set selects all services
+func (fc *FlowCache) expireFlows(services map[string]bool) {
+	now := atomic.LoadInt64(&fc.lastTs)
+	if now == 0 {
+		return
+	}
+	if services != nil {
+		fc.visitFlows(services, func(flow *Flow) bool {
+			return flow.expire(now)
+		})
+		return
+	}
+	fc.eachTable(func(c cache.Cache) {
+		c.PurgeFunc(func(v interface{}) bool {
+			flow, ok := v.(*Flow)
+			return ok && flow.expire(now)
+		})
+	})
+}
+
+// popClosed returns the flows of the given services terminated since the
+// last dump. A nil services set selects all services.
+// Flows that timed out are terminated first
+func (fc *FlowCache) popClosed(services map[string]bool) []*Flow {
+	fc.purgeWorkerTables()
+	fc.expireFlows(services)
+	fc.closedLock.Lock()
+	defer fc.closedLock.Unlock()
+	if services == nil {
+		closed := fc.closed
+		fc.closed = nil
+		return closed
+	}
+	closed := []*Flow{}
+	remaining := fc.closed[:0]
+	for _, f := range fc.closed {
+		if services[f.Service] {
+			closed = append(closed, f)
+		} else {
+			remaining = append(remaining, f)
+		}
+	}
+	for i := len(remaining); i < len(fc.closed); i++ {
+		fc.closed[i] = nil
+	}
+	fc.closed = remaining
+	return closed
+}
+
 // ProcessPacket processes incoming packets. If the flow is already in the cache, it updates
 // its counters. If not, it creates it based on the DNS type and inserts it into
 // the cache.
 func (fc *FlowCache) ProcessPacket(pkt *network.Packet) error {
-	if fc.anonymize {
-		var testKey = []byte{45, 148, 31, 183, 121, 99, 98, 199, 103, 48, 199, 151, 176, 128, 82, 175, 33, 228, 17, 204, 122, 199, 124, 65, 130, 80, 120, 210, 81, 207, 169, 48}
-		cpan, _ := network.NewCryptoPAn(testKey)
+	return fc.processPacket(fc.tables[0], pkt)
+}
 
-		var obfsaddr = cpan.Anonymize(net.ParseIP(pkt.MyIP))
-		pkt.MyIP = obfsaddr.String()
+// processPacket processes the packet pkt updating the flows in table t
+func (fc *FlowCache) processPacket(t *flowTable, pkt *network.Packet) error {
+	if pkt.TStamp > atomic.LoadInt64(&fc.lastTs) {
+		atomic.StoreInt64(&fc.lastTs, pkt.TStamp)
 	}
 
-	hash := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s-%s-%d-%d", pkt.ServiceIP, pkt.MyIP, pkt.ServicePort, pkt.MyPort))))
-	log.Debugf("Received packet for flow %s", hash)
+	key := NewFlowKey(pkt)
+	log.Debugf("Received packet for flow %s", &key)
 
-	return fc.addPacket(pkt, &hash)
+	// Tables owned by workers run the requests of the dumps between packets
+	if t.owned() {
+		t.acquire()
+		defer t.release()
+		t.serve()
+	}
 
+	// Addresses are anonymized by the privacy policy on export, the client
+	// address is used as is for the service lookup
+	return fc.addPacket(t, pkt, pkt.MyIP, &key)
 }
 
-// Dump copies the entire cache int a map.
-func (fc *FlowCache) Dump() map[string]Flow {
-	log.Debugln("Dumping the flow cache into a map")
-	if i, err := fc.cache.IterativeDump(); err != nil {
-		log.Errorln(err)
-		return nil
-	} else {
-		ret := make(map[string]Flow)
+// forEachFlow calls f on each flow of each table. Changes made by f are
+// stored back into the cache
+func (fc *FlowCache) forEachFlow(f func(*Flow)) {
+	fc.eachTable(func(c cache.Cache) {
+		i, err := c.IterativeDump()
+		if err != nil {
+			log.Errorln(err)
+			return
+		}
 		for {
-			v, err := fc.cache.NextElement(i)
+			v, err := c.NextElement(i)
 			if err != nil {
 				log.Errorln(err)
 				break
 			} else if v == nil {
 				break
-			} else {
-				f := v.(*Flow)
-				ret[f.Id] = *f
-				f.Clear()
 			}
+			f(v.(*Flow))
+		}
+		c.StopIteration(i)
+	})
+}
+
+// Dump copies the entire cache into a slice.
+// Flows terminated since the last dump are included with their final state,
+// so a 5-tuple can appear more than once.
+// Starts a new epoch for all services, flows started in the new epoch are
+// left for the next dump
+func (fc *FlowCache) Dump() []Flow {
+	log.Debugln("Dumping the flow cache into a slice")
+	fc.dumpLock.Lock()
+	defer fc.dumpLock.Unlock()
+	fc.epochs.advance(nil)
+	ret := []Flow{}
+	for _, closed := range fc.popClosed(nil) {
+		for _, f := range closedFlows(closed) {
+			ret = append(ret, *f)
 		}
-		return ret
 	}
+	fc.forEachFlow(func(f *Flow) {
+		if out, ok := f.snapshotFlow(); ok {
+			ret = append(ret, out)
+		}
+	})
+	return ret
 }
 
 // DumpToChannel copies the entire cache int a channel, entry by entry.
 func (fc *FlowCache) DumpToChannel(c chan Flow) {
-	if i, err := fc.cache.IterativeDump(); err != nil {
-		log.Errorln(err)
-		return
-	} else {
-		for {
-			v, err := fc.cache.NextElement(i)
-			if err != nil {
-				break
-			} else {
-				if v == nil {
-					close(c)
-				}
-				f := v.(*Flow)
-				c <- *f
-				f.Clear()
-			}
+	fc.dumpLock.Lock()
+	defer fc.dumpLock.Unlock()
+	fc.epochs.advance(nil)
+	for _, closed := range fc.popClosed(nil) {
+		for _, f := range closedFlows(closed) {
+			c <- *f
 		}
 	}
+	fc.forEachFlow(func(f *Flow) {
+		if out, ok := f.snapshotFlow(); ok {
+			c <- out
+		}
+	})
+	close(c)
 }
 
 // Dump copies the entire cache int a map.
 func (fc *FlowCache) DumpToString() []json.RawMessage {
+	return fc.DumpServicesToString(nil)
+}
+
+// DumpServicesToString starts a new epoch for the given services and collects
+// the statistics of their flows in the previous one. Flows of other services
+// are left untouched so that each service can be dumped on its own schedule.
+// A nil list dumps all services
+func (fc *FlowCache) DumpServicesToString(services []string) []json.RawMessage {
+	flows, _ := fc.DumpServices(services)
+	return flows
+}
+
+// DumpServices is like DumpServicesToString, also returning the rollups of
+// the collected flows at the configured aggregation levels. No flow records
+// are returned if they are disabled by SetRollups.
+// The rollups only cover the given services: when services are dumped in
+// groups, such as those sharing an emit interval, each group reports its own
+// rollups, so a device has one "device" rollup per group.
+// Only the flows of the given services are visited, through the index of
+// each table
+func (fc *FlowCache) DumpServices(services []string) ([]json.RawMessage, []Rollup) {
 	log.Debugln("Dumping the flow cache into a map")
+	fc.dumpLock.Lock()
+	defer fc.dumpLock.Unlock()
+	var selected map[string]bool
+	if services != nil {
+		selected = make(map[string]bool)
+		for _, s := range services {
+			selected[s] = true
+		}
+	}
+	fc.epochs.advance(selected)
+	r := newRollups(fc.rollupLevels)
 	flows := []json.RawMessage{}
-	if i, err := fc.cache.IterativeDump(); err != nil {
-		log.Errorln(err)
-		return nil
-	} else {
-		for {
-			v, err := fc.cache.NextElement(i)
-			if err != nil {
-				log.Errorln(err)
-				break
-			} else if v == nil {
-				break
-			} else {
-				f := v.(*Flow)
+	for _, closed := range fc.popClosed(selected) {
+		for _, f := range closedFlows(closed) {
+			r.add(f, f.vol)
+			fc.addVideoSegments(f, f.Cntrs)
+			if !fc.noFlowRecords {
 				flows = append(flows, f.Collect())
-				f.Clear()
 			}
 		}
 	}
-	return flows
+	collect := func(f *Flow) {
+		if out, ok := f.snapshotFlow(); ok {
+			r.add(&out, out.vol)
+			fc.addVideoSegments(&out, out.Cntrs)
+			if !fc.noFlowRecords {
+				flows = append(flows, out.Collect())
+			}
+		}
+	}
+	if selected == nil {
+		fc.forEachFlow(collect)
+	} else {
+		fc.visitFlows(selected, func(f *Flow) bool {
+			collect(f)
+			return false
+		})
+	}
+	r.addDropped(fc.dropped.pop(selected))
+	return flows, r.out(fc.policy)
 }
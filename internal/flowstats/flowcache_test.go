@@ -4,9 +4,14 @@ import (
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/gopacket/layers"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/cache"
 	"github.com/traffic-refinery/traffic-refinery/internal/config"
 	"github.com/traffic-refinery/traffic-refinery/internal/counters"
 	"github.com/traffic-refinery/traffic-refinery/internal/network"
@@ -35,12 +40,12 @@ func TestFlowcacheAddFlow(t *testing.T) {
 		})
 		fcacheServices = append(fcacheServices, Service{
 			Name:    s.Name,
-			Collect: s.Collect,
+			Collect: CounterConfigs(s.Collect),
 		})
 	}
 
 	var smap *servicemap.ServiceMap
-	if smap, err = servicemap.NewServiceMap(conf.DNSCache.EvictTime, conf.DNSCache.CleanupTime); err != nil {
+	if smap, err = servicemap.NewServiceMap(conf.DNSCache.EvictTime, conf.DNSCache.CleanupTime, conf.DNSCache.MaxEntries, uint32(conf.DNSCache.ShardsCount)); err != nil {
 		panic(err)
 	}
 	smap.ConfigServiceMap(smapServices)
@@ -60,7 +65,14 @@ func TestFlowcacheAddFlow(t *testing.T) {
 	for _, pkt := range trace.Trace {
 		flowcache.ProcessPacket(&pkt.Pkt)
 	}
-	hash := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s-%s-%d-%d", "198.38.120.133", "192.168.43.72", 443, 51751))))
+	key := NewFlowKey(&network.Packet{
+		ServiceAddr: net.ParseIP("198.38.120.133"),
+		MyAddr:      net.ParseIP("192.168.43.72"),
+		ServicePort: 443,
+		MyPort:      51751,
+		IsTCP:       true,
+	})
+	hash := string(key[:])
 	if value, ok := flowcache.cache.GetAndLock(hash); ok {
 		flow, ok := value.(*Flow)
 		if !ok {
@@ -102,12 +114,12 @@ func TestFlowcacheFlowExpire(t *testing.T) {
 		})
 		fcacheServices = append(fcacheServices, Service{
 			Name:    s.Name,
-			Collect: s.Collect,
+			Collect: CounterConfigs(s.Collect),
 		})
 	}
 
 	var smap *servicemap.ServiceMap
-	if smap, err = servicemap.NewServiceMap(conf.DNSCache.EvictTime, conf.DNSCache.CleanupTime); err != nil {
+	if smap, err = servicemap.NewServiceMap(conf.DNSCache.EvictTime, conf.DNSCache.CleanupTime, conf.DNSCache.MaxEntries, uint32(conf.DNSCache.ShardsCount)); err != nil {
 		panic(err)
 	}
 	smap.ConfigServiceMap(smapServices)
@@ -128,9 +140,572 @@ func TestFlowcacheFlowExpire(t *testing.T) {
 		flowcache.ProcessPacket(&pkt.Pkt)
 	}
 	time.Sleep(4 * time.Second)
-	hash := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s-%s-%d-%d", "198.38.120.133", "192.168.43.72", 443, 51751))))
+	key := NewFlowKey(&network.Packet{
+		ServiceAddr: net.ParseIP("198.38.120.133"),
+		MyAddr:      net.ParseIP("192.168.43.72"),
+		ServicePort: 443,
+		MyPort:      51751,
+		IsTCP:       true,
+	})
+	hash := string(key[:])
 	if _, ok := flowcache.cache.GetAndLock(hash); ok {
-		t.Fatalf("Flow %s should not be in  thecache:\n", hash)
+		t.Fatalf("Flow %s should not be in  thecache:\n", &key)
+	}
+}
+
+// newTestTCPPacket creates a packet of the flow 198.38.120.133:443 -
+// 192.168.43.72:51751 with the given direction and flags
+func newTestTCPPacket(ts int64, dir int, fin, rst bool) *network.Packet {
+	pkt := &network.Packet{
+		TStamp:      ts,
+		Dir:         dir,
+		ServiceIP:   "198.38.120.133",
+		MyIP:        "192.168.43.72",
+		ServiceAddr: net.ParseIP("198.38.120.133"),
+		MyAddr:      net.ParseIP("192.168.43.72"),
+		ServicePort: 443,
+		MyPort:      51751,
+		IsTCP:       true,
+		Tcp:         &layers.TCP{ACK: true, FIN: fin, RST: rst},
+	}
+	return pkt
+}
+
+// newTestFlowCache returns a cache of type cacheType in which the flows of the
+// test packets belong to the service Test
+func newTestFlowCache(tb testing.TB, cacheType string) *FlowCache {
+	return newTestFlowCacheTimes(tb, cacheType, 10*time.Minute, 0)
+}
+
+// newTestFlowCacheTimes is like newTestFlowCache, expiring the flows not
+// updated for evictTime every cleanupTime
+func newTestFlowCacheTimes(tb testing.TB, cacheType string, evictTime, cleanupTime time.Duration) *FlowCache {
+	smap, err := servicemap.NewServiceMap(10*time.Minute, 5*time.Minute, 1000, 4)
+	if err != nil {
+		tb.Fatalf("Can not create the service map: %s", err)
+	}
+	if err = smap.ConfigServiceMap([]servicemap.Service{{
+		Name:          "Test",
+		ServiceFilter: servicemap.Filter{Prefixes: []string{"198.38.120.0/24"}},
+		Code:          servicemap.ServiceID(0),
+	}}); err != nil {
+		tb.Fatalf("Can not configure the service map: %s", err)
+	}
+	flowcache, err := NewFlowCache(cacheType, smap, evictTime, cleanupTime, 4, false)
+	if err != nil {
+		tb.Fatalf("Can not create the flow cache: %s", err)
+	}
+	return flowcache
+}
+
+func TestFlowcacheTermination(t *testing.T) {
+	for _, cacheType := range []string{"ConcurrentCacheMap", "BigCache", "PerWorker"} {
+		testFlowcacheTermination(t, cacheType)
+	}
+}
+
+func testFlowcacheTermination(t *testing.T, cacheType string) {
+	flowcache := newTestFlowCache(t, cacheType)
+
+	flowcache.ProcessPacket(newTestTCPPacket(1, network.TrafficIn, false, false))
+	flowcache.ProcessPacket(newTestTCPPacket(2, network.TrafficOut, true, false))
+	flowcache.ProcessPacket(newTestTCPPacket(3, network.TrafficIn, true, false))
+	flows := flowcache.Dump()
+	if len(flows) != 1 {
+		t.Fatalf("%s: Expected 1 flow, found %d", cacheType, len(flows))
+	}
+	for _, f := range flows {
+		if f.Termination != "" {
+			t.Fatalf("%s: Flow %s should still be active, terminated with reason %s", cacheType, f.Id, f.Termination)
+		}
+	}
+
+	flowcache.ProcessPacket(newTestTCPPacket(4, network.TrafficOut, false, false))
+	flows = flowcache.Dump()
+	if len(flows) != 1 {
+		t.Fatalf("%s: Expected 1 flow, found %d", cacheType, len(flows))
+	}
+	for _, f := range flows {
+		if f.Termination != TerminationFin {
+			t.Fatalf("%s: Flow %s terminated with reason %s instead of %s", cacheType, f.Id, f.Termination, TerminationFin)
+		}
+		if f.FirstSeen != 1 || f.LastSeen != 4 {
+			t.Fatalf("%s: Flow %s has wrong timestamps: first seen %d, last seen %d", cacheType, f.Id, f.FirstSeen, f.LastSeen)
+		}
+	}
+	if flows = flowcache.Dump(); len(flows) != 0 {
+		t.Fatalf("%s: Closed flow should not be dumped twice", cacheType)
+	}
+
+	// A reset terminates the flow right away and does not start a new one
+	flowcache.ProcessPacket(newTestTCPPacket(5, network.TrafficIn, false, false))
+	flowcache.ProcessPacket(newTestTCPPacket(6, network.TrafficOut, false, true))
+	flowcache.ProcessPacket(newTestTCPPacket(7, network.TrafficIn, false, true))
+	flows = flowcache.Dump()
+	if len(flows) != 1 {
+		t.Fatalf("%s: Expected 1 flow, found %d", cacheType, len(flows))
+	}
+	for _, f := range flows {
+		if f.Termination != TerminationRst {
+			t.Fatalf("%s: Flow %s terminated with reason %s instead of %s", cacheType, f.Id, f.Termination, TerminationRst)
+		}
+	}
+}
+
+func TestFlowcacheSwappedPorts(t *testing.T) {
+	for _, cacheType := range []string{"ConcurrentCacheMap", "BigCache", "PerWorker"} {
+		flowcache := newTestFlowCache(t, cacheType)
+
+		// The two flows have the same symmetric hash
+		pkt := newTestTCPPacket(1, network.TrafficIn, false, false)
+		swapped := newTestTCPPacket(2, network.TrafficIn, false, false)
+		swapped.ServicePort, swapped.MyPort = pkt.MyPort, pkt.ServicePort
+		if k1, k2 := NewFlowKey(pkt), NewFlowKey(swapped); k1.FastHash() != k2.FastHash() {
+			t.Fatalf("%s: Keys %s and %s should have the same hash", cacheType, &k1, &k2)
+		}
+		for i := 0; i < 3; i++ {
+			flowcache.ProcessPacket(pkt)
+			flowcache.ProcessPacket(swapped)
+		}
+		flows := flowcache.Dump()
+		if len(flows) != 2 {
+			t.Fatalf("%s: Expected 2 flows, found %d", cacheType, len(flows))
+		}
+		for _, f := range flows {
+			if f.vol.InPackets != 3 {
+				t.Fatalf("%s: Flow %s has %d packets instead of 3", cacheType, f.Id, f.vol.InPackets)
+			}
+		}
+	}
+}
+
+func TestFlowcacheClosed(t *testing.T) {
+	flowcache := newTestFlowCache(t, "ConcurrentCacheMap")
+
+	// Two connections on the same 5-tuple are both exported
+	reopen := func() {
+		for ts := int64(1); ts <= 4; ts += 2 {
+			flowcache.ProcessPacket(newTestTCPPacket(ts, network.TrafficIn, false, false))
+			flowcache.ProcessPacket(newTestTCPPacket(ts+1, network.TrafficOut, false, true))
+		}
+	}
+	reopen()
+	flows := flowcache.Dump()
+	if len(flows) != 2 || flows[0].Id != flows[1].Id || flows[0].FirstSeen == flows[1].FirstSeen {
+		t.Fatalf("Expected 2 flows with the same 5-tuple, found %+v", flows)
+	}
+
+	// Terminated flows waiting for a dump are bounded
+	flowcache.SetMaxClosed(1)
+	reopen()
+	if flows = flowcache.Dump(); len(flows) != 1 || flowcache.Stats().DroppedClosed != 1 {
+		t.Fatalf("Expected 1 flow and 1 dropped, found %d flows and %d dropped", len(flows), flowcache.Stats().DroppedClosed)
+	}
+}
+
+func TestFlowcacheEviction(t *testing.T) {
+	flowcache := newTestFlowCacheTimes(t, "ConcurrentCacheMap", time.Millisecond, 0)
+
+	flowcache.ProcessPacket(newTestTCPPacket(1, network.TrafficIn, false, false))
+	time.Sleep(5 * time.Millisecond)
+	flowcache.cache.PurgeExpired()
+	flows := flowcache.Dump()
+	if len(flows) != 1 {
+		t.Fatalf("Expected 1 evicted flow, found %d", len(flows))
+	}
+	for _, f := range flows {
+		if f.Termination != TerminationEvicted {
+			t.Fatalf("Flow %s terminated with reason %s instead of %s", f.Id, f.Termination, TerminationEvicted)
+		}
+	}
+	if flows = flowcache.Dump(); len(flows) != 0 {
+		t.Fatalf("Evicted flow should not be dumped twice")
+	}
+}
+
+func TestFlowcacheTimeouts(t *testing.T) {
+	flowcache := newTestFlowCache(t, "ConcurrentCacheMap")
+	flowcache.SetTimeouts(10*time.Second, time.Second)
+	if err := flowcache.AddServices([]Service{{Name: "Test", ActiveTimeout: 5 * time.Second}}); err != nil {
+		t.Fatalf("Can not initialize flowcache services: %s", err)
+	}
+
+	// Packets closer than the idle timeout until the active timeout expires
+	sec := int64(time.Second)
+	for ts := int64(0); ts <= 6; ts++ {
+		flowcache.ProcessPacket(newTestTCPPacket(sec+ts*sec/2, network.TrafficIn, false, false))
+	}
+	flows := flowcache.Dump()
+	if len(flows) != 1 {
+		t.Fatalf("Expected 1 flow, found %d", len(flows))
+	}
+	for _, f := range flows {
+		if f.Termination != "" {
+			t.Fatalf("Flow %s should still be active, terminated with reason %s", f.Id, f.Termination)
+		}
+	}
+	for ts := int64(7); ts <= 12; ts++ {
+		flowcache.ProcessPacket(newTestTCPPacket(sec+ts*sec/2, network.TrafficIn, false, false))
+	}
+	// Expired by the active timeout of the service and restarted
+	closed := flowcache.popClosed(nil)
+	if len(closed) != 1 || closed[0].Termination != TerminationActive {
+		t.Fatalf("Expected 1 flow terminated by the active timeout, found %d", len(closed))
+	}
+	if closed[0].FirstSeen != sec || closed[0].LastSeen != sec+9*sec/2 {
+		t.Fatalf("Flow %s has wrong timestamps: first seen %d, last seen %d", closed[0].Id, closed[0].FirstSeen, closed[0].LastSeen)
+	}
+
+	// A packet of another flow moves the clock past the idle timeout
+	other := newTestTCPPacket(10*sec, network.TrafficIn, false, false)
+	other.MyPort = 51752
+	flowcache.ProcessPacket(other)
+	closed = flowcache.popClosed(nil)
+	if len(closed) != 1 || closed[0].Termination != TerminationIdle {
+		t.Fatalf("Expected 1 flow terminated by the idle timeout, found %d", len(closed))
+	}
+}
+
+func TestFlowcacheDumpServices(t *testing.T) {
+	flowcache := newTestFlowCache(t, "ConcurrentCacheMap")
+	if err := flowcache.serviceMap.ConfigServiceMap([]servicemap.Service{{
+		Name:          "Other",
+		ServiceFilter: servicemap.Filter{Prefixes: []string{"10.0.0.0/8"}},
+		Code:          servicemap.ServiceID(1),
+	}}); err != nil {
+		t.Fatalf("Can not add the service: %s", err)
+	}
+
+	flowcache.ProcessPacket(newTestTCPPacket(1, network.TrafficIn, false, false))
+	other := newTestTCPPacket(2, network.TrafficIn, false, false)
+	other.ServiceIP = "10.0.0.1"
+	other.ServiceAddr = net.ParseIP("10.0.0.1")
+	flowcache.ProcessPacket(other)
+	// Terminated flows are also dumped with their service only
+	flowcache.ProcessPacket(newTestTCPPacket(3, network.TrafficIn, false, true))
+
+	if flows := flowcache.DumpServicesToString([]string{"Other"}); len(flows) != 1 {
+		t.Fatalf("Expected 1 flow for service Other, found %d", len(flows))
+	}
+	if flows := flowcache.DumpServicesToString([]string{"Test"}); len(flows) != 1 {
+		t.Fatalf("Expected 1 flow for service Test, found %d", len(flows))
+	}
+	if flows := flowcache.DumpServicesToString([]string{"Test"}); len(flows) != 0 {
+		t.Fatalf("Expected no flows for service Test, found %d", len(flows))
+	}
+	if flows := flowcache.DumpToString(); len(flows) != 1 {
+		t.Fatalf("Expected 1 flow in the cache, found %d", len(flows))
+	}
+}
+
+// visitRecorder records the services of the flows visited in a cache and the
+// iterations over the whole cache
+type visitRecorder struct {
+	cache.Cache
+	services   []string
+	iterations int
+}
+
+func (c *visitRecorder) Visit(key string, f func(interface{}) bool) bool {
+	return c.Cache.Visit(key, func(v interface{}) bool {
+		c.services = append(c.services, v.(*Flow).Service)
+		return f(v)
+	})
+}
+
+func (c *visitRecorder) IterativeDump() (cache.CacheIterator, error) {
+	c.iterations++
+	return c.Cache.IterativeDump()
+}
+
+func TestFlowcacheDumpServicesIndex(t *testing.T) {
+	for _, cacheType := range []string{"ConcurrentCacheMap", "BigCache", "PerWorker"} {
+		flowcache := newTestFlowCache(t, cacheType)
+		if err := flowcache.serviceMap.ConfigServiceMap([]servicemap.Service{{
+			Name:          "Other",
+			ServiceFilter: servicemap.Filter{Prefixes: []string{"10.0.0.0/8"}},
+			Code:          servicemap.ServiceID(1),
+		}}); err != nil {
+			t.Fatalf("Can not add the service: %s", err)
+		}
+		flowcache.ProcessPacket(newTestTCPPacket(1, network.TrafficIn, false, false))
+		other := newTestTCPPacket(2, network.TrafficIn, false, false)
+		other.ServiceIP = "10.0.0.1"
+		other.ServiceAddr = net.ParseIP("10.0.0.1")
+		flowcache.ProcessPacket(other)
+
+		// The dump of a service only visits its own flows
+		recorder := &visitRecorder{Cache: flowcache.tables[0].cache}
+		flowcache.tables[0].cache = recorder
+		for _, service := range []string{"Other", "Test"} {
+			recorder.services = nil
+			if flows := flowcache.DumpServicesToString([]string{service}); len(flows) != 1 {
+				t.Fatalf("%s: expected 1 flow for service %s, found %d", cacheType, service, len(flows))
+			}
+			if len(recorder.services) == 0 || recorder.iterations != 0 {
+				t.Fatalf("%s: flows of service %s not dumped through the index", cacheType, service)
+			}
+			for _, s := range recorder.services {
+				if s != service {
+					t.Fatalf("%s: dump of service %s visited a flow of service %s", cacheType, service, s)
+				}
+			}
+		}
+	}
+}
+
+func TestFlowcacheWorkers(t *testing.T) {
+	shared := newTestFlowCache(t, "ConcurrentCacheMap")
+	if shared.NewWorker() != shared {
+		t.Fatalf("Workers of a shared cache should use the cache")
+	}
+
+	flowcache := newTestFlowCache(t, "PerWorker")
+	workers := []network.PacketProcessor{flowcache.NewWorker(), flowcache.NewWorker()}
+	var wg sync.WaitGroup
+	for i, w := range workers {
+		wg.Add(1)
+		go func(i int, w network.PacketProcessor) {
+			defer wg.Done()
+			for ts := int64(1); ts <= 100; ts++ {
+				pkt := newTestTCPPacket(ts, network.TrafficIn, false, false)
+				pkt.MyPort = uint16(50000 + i)
+				w.ProcessPacket(pkt)
+			}
+		}(i, w)
+	}
+	// Dumps run concurrently with the workers
+	for i := 0; i < 10; i++ {
+		flowcache.DumpToString()
+	}
+	wg.Wait()
+	flows := flowcache.Dump()
+	if len(flows) != 2 {
+		t.Fatalf("Expected 2 flows, found %d", len(flows))
+	}
+	for _, f := range flows {
+		if f.Termination != "" || f.LastSeen != 100 {
+			t.Fatalf("Flow %s has wrong state: termination %s, last seen %d", f.Id, f.Termination, f.LastSeen)
+		}
+	}
+
+	// Flows of the worker tables are evicted at dump time
+	flowcache = newTestFlowCacheTimes(t, "PerWorker", time.Millisecond, time.Millisecond)
+	for i := 0; i < 2; i++ {
+		pkt := newTestTCPPacket(1, network.TrafficIn, false, false)
+		pkt.MyPort = uint16(50000 + i)
+		flowcache.NewWorker().ProcessPacket(pkt)
+	}
+	time.Sleep(5 * time.Millisecond)
+	flows = flowcache.Dump()
+	if len(flows) != 2 {
+		t.Fatalf("Expected 2 evicted flows, found %d", len(flows))
+	}
+	for _, f := range flows {
+		if f.Termination != TerminationEvicted {
+			t.Fatalf("Flow %s terminated with reason %s instead of %s", f.Id, f.Termination, TerminationEvicted)
+		}
+	}
+	if st := flowcache.Stats(); st.Flows != 0 {
+		t.Fatalf("Expected no flows in the cache, found %d", st.Flows)
+	}
+}
+
+func TestFlowcacheWorkersHandoff(t *testing.T) {
+	flowcache, err := NewFlowCache("PerWorker", nil, 10*time.Minute, 5*time.Minute, 4, false)
+	if err != nil {
+		panic(err)
+	}
+	table := flowcache.NewWorker().(*FlowWorker).table
+
+	// While the owner processes a packet the dumps are handed off to it
+	table.acquire()
+	done := make(chan struct{})
+	go func() {
+		table.run(func(c cache.Cache) {})
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatalf("Dump ran on the table while the owner was using it")
+	default:
+	}
+	for served := false; !served; {
+		table.serve()
+		select {
+		case <-done:
+			served = true
+		case <-time.After(time.Millisecond):
+		}
+	}
+	table.release()
+
+	// Dumps use the tables of idle owners themselves
+	ran := false
+	table.run(func(c cache.Cache) { ran = true })
+	if !ran {
+		t.Fatalf("Dump did not run on the table of an idle owner")
+	}
+}
+
+func TestFlowcacheWorkersLimits(t *testing.T) {
+	flowcache := newTestFlowCache(t, "PerWorker")
+	if err := flowcache.SetLimits(4, 0, AdmissionEvictIdle, 0); err != nil {
+		t.Fatal(err)
+	}
+	full, empty := flowcache.NewWorker(), flowcache.NewWorker()
+	for i := 0; i < 4; i++ {
+		pkt := newTestTCPPacket(int64(i+1), network.TrafficIn, false, false)
+		pkt.MyPort = uint16(50000 + i)
+		full.ProcessPacket(pkt)
+	}
+
+	// The worker with no flows can not make room, it asks the other one to
+	// evict its flows
+	pkt := newTestTCPPacket(5, network.TrafficIn, false, false)
+	pkt.MyPort = 60000
+	empty.ProcessPacket(pkt)
+	if st := flowcache.Stats(); st.Flows != 4 || st.Rejected != 1 || st.Evicted != 0 {
+		t.Fatalf("Wrong cache counters before the eviction: %+v", st)
+	}
+	pkt = newTestTCPPacket(6, network.TrafficIn, false, false)
+	pkt.MyPort = 50003
+	full.ProcessPacket(pkt)
+	if st := flowcache.Stats(); st.Flows >= 4 || st.Evicted == 0 {
+		t.Fatalf("Wrong cache counters after the eviction: %+v", st)
+	}
+	pkt = newTestTCPPacket(7, network.TrafficIn, false, false)
+	pkt.MyPort = 60000
+	empty.ProcessPacket(pkt)
+	if st := flowcache.Stats(); st.Flows > 4 || st.Rejected != 1 {
+		t.Fatalf("Wrong cache counters after admitting the new flow: %+v", st)
+	}
+}
+
+func TestFlowcacheLimits(t *testing.T) {
+	flowcache := newTestFlowCache(t, "ConcurrentCacheMap")
+	if err := flowcache.SetLimits(4, 0, AdmissionDrop, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		pkt := newTestTCPPacket(int64(i+1), network.TrafficIn, false, false)
+		pkt.MyPort = uint16(50000 + i)
+		flowcache.ProcessPacket(pkt)
+	}
+	if st := flowcache.Stats(); st.Flows != 4 || st.Rejected != 2 || st.Evicted != 0 {
+		t.Fatalf("Wrong cache counters with drop policy: %+v", st)
+	}
+
+	flowcache = newTestFlowCache(t, "ConcurrentCacheMap")
+	if err := flowcache.SetLimits(4, 0, AdmissionEvictIdle, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		pkt := newTestTCPPacket(int64(i+1), network.TrafficIn, false, false)
+		pkt.MyPort = uint16(50000 + i)
+		flowcache.ProcessPacket(pkt)
+	}
+	st := flowcache.Stats()
+	if st.Rejected != 0 || st.Evicted == 0 || st.Flows > 4 {
+		t.Fatalf("Wrong cache counters with idle policy: %+v", st)
+	}
+	overload := 0
+	for _, f := range flowcache.Dump() {
+		if f.Termination == TerminationOverload {
+			overload++
+			if f.LastSeen > 2 {
+				t.Fatalf("Flow %s last seen at %d should not have been evicted", f.Id, f.LastSeen)
+			}
+		}
+	}
+	if uint64(overload) != st.Evicted {
+		t.Fatalf("Exported %d evicted flows instead of %d", overload, st.Evicted)
+	}
+
+	if err := flowcache.SetLimits(4, 0, "unknown", 0); err == nil {
+		t.Fatalf("Unknown admission policy should not be accepted")
+	}
+}
+
+// racingCache runs race the first time a lookup misses, as another parser
+// creating the flow right after the lookup would
+type racingCache struct {
+	cache.Cache
+	race func()
+}
+
+func (c *racingCache) GetAndLock(key string) (interface{}, bool) {
+	v, ok := c.Cache.GetAndLock(key)
+	if !ok && c.race != nil {
+		race := c.race
+		c.race = nil
+		race()
+	}
+	return v, ok
+}
+
+func TestFlowcacheConcurrentNewFlow(t *testing.T) {
+	for _, cacheType := range []string{"ConcurrentCacheMap", "BigCache"} {
+		flowcache := newTestFlowCache(t, cacheType)
+		flowcache.tables[0].cache = &racingCache{
+			Cache: flowcache.tables[0].cache,
+			race: func() {
+				flowcache.ProcessPacket(newTestTCPPacket(1, network.TrafficIn, false, false))
+			},
+		}
+		// The packet losing the race is added to the flow created by the
+		// other parser, which is accounted once
+		flowcache.ProcessPacket(newTestTCPPacket(2, network.TrafficIn, false, false))
+		if st := flowcache.Stats(); st.Flows != 1 {
+			t.Fatalf("%s: expected 1 flow in the admission counters, found %d", cacheType, st.Flows)
+		}
+		flows := flowcache.Dump()
+		if len(flows) != 1 || flows[0].LastSeen != 2 {
+			t.Fatalf("%s: packet not added to the existing flow %+v", cacheType, flows)
+		}
+	}
+}
+
+func TestFlowcacheLimitsCounterSize(t *testing.T) {
+	flowcache := newTestFlowCache(t, "ConcurrentCacheMap")
+	if err := flowcache.AddServices([]Service{{Name: "Test", Collect: []counters.CounterConfig{
+		{Name: "ThroughputSeries", Params: counters.Params{"MaxBins": 6000}},
+	}}}); err != nil {
+		t.Fatalf("Can not initialize flowcache services: %s", err)
+	}
+	if err := flowcache.SetLimits(0, 1<<20, AdmissionDrop, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Each flow can hold 6000 bins of 4 series, in the flow and in its
+	// snapshot
+	for i := 0; i < 20; i++ {
+		pkt := newTestTCPPacket(int64(i+1), network.TrafficIn, false, false)
+		pkt.MyPort = uint16(50000 + i)
+		flowcache.ProcessPacket(pkt)
+	}
+	if st := flowcache.Stats(); st.Flows != 3 || st.Rejected != 17 {
+		t.Fatalf("Wrong cache counters with large counters: %+v", st)
+	}
+}
+
+func TestFlowcacheNewFlowRate(t *testing.T) {
+	flowcache := newTestFlowCache(t, "ConcurrentCacheMap")
+	flowcache.SetNewFlowRate(1, 2)
+	for i := 0; i < 5; i++ {
+		pkt := newTestTCPPacket(int64(time.Second), network.TrafficIn, false, false)
+		pkt.MyPort = uint16(50000 + i)
+		flowcache.ProcessPacket(pkt)
+	}
+	if st := flowcache.Stats(); st.Flows != 2 || st.RateLimited != 3 {
+		t.Fatalf("Wrong cache counters with rate limit: %+v", st)
+	}
+	// Tokens are refilled as time passes
+	pkt := newTestTCPPacket(int64(2*time.Second), network.TrafficIn, false, false)
+	pkt.MyPort = 50010
+	flowcache.ProcessPacket(pkt)
+	if st := flowcache.Stats(); st.Flows != 3 {
+		t.Fatalf("Wrong cache counters after refill: %+v", st)
 	}
 }
 
@@ -155,12 +730,12 @@ func TestFlowcacheAddFlows(t *testing.T) {
 		})
 		fcacheServices = append(fcacheServices, Service{
 			Name:    s.Name,
-			Collect: s.Collect,
+			Collect: CounterConfigs(s.Collect),
 		})
 	}
 
 	var smap *servicemap.ServiceMap
-	if smap, err = servicemap.NewServiceMap(conf.DNSCache.EvictTime, conf.DNSCache.CleanupTime); err != nil {
+	if smap, err = servicemap.NewServiceMap(conf.DNSCache.EvictTime, conf.DNSCache.CleanupTime, conf.DNSCache.MaxEntries, uint32(conf.DNSCache.ShardsCount)); err != nil {
 		panic(err)
 	}
 	smap.ConfigServiceMap(smapServices)
@@ -207,12 +782,12 @@ func TestFlowcacheDump(t *testing.T) {
 		})
 		fcacheServices = append(fcacheServices, Service{
 			Name:    s.Name,
-			Collect: s.Collect,
+			Collect: CounterConfigs(s.Collect),
 		})
 	}
 
 	var smap *servicemap.ServiceMap
-	if smap, err = servicemap.NewServiceMap(conf.DNSCache.EvictTime, conf.DNSCache.CleanupTime); err != nil {
+	if smap, err = servicemap.NewServiceMap(conf.DNSCache.EvictTime, conf.DNSCache.CleanupTime, conf.DNSCache.MaxEntries, uint32(conf.DNSCache.ShardsCount)); err != nil {
 		panic(err)
 	}
 	smap.ConfigServiceMap(smapServices)
@@ -239,9 +814,59 @@ func TestFlowcacheDump(t *testing.T) {
 func BenchmarkFlowcacheHash(b *testing.B) {
 	trace := network.GetRandomTrace(b.N, 64)
 
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkt := &trace.Trace[i].Pkt
+		key := NewFlowKey(pkt)
+		_ = key.FastHash()
+	}
+}
+
+func BenchmarkFlowcacheHashMD5(b *testing.B) {
+	trace := network.GetRandomTrace(b.N, 64)
+
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		pkt := &trace.Trace[i].Pkt
 		_ = fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s-%s-%d-%d", pkt.ServiceIP, pkt.MyIP, pkt.ServicePort, pkt.MyPort))))
 	}
 }
+
+func BenchmarkFlowcacheProcessPacket(b *testing.B) {
+	for _, cacheType := range []string{"ConcurrentCacheMap", "BigCache"} {
+		b.Run(cacheType, func(b *testing.B) {
+			flowcache := newTestFlowCache(b, cacheType)
+			if err := flowcache.AddServices([]Service{{Name: "Test", Collect: []counters.CounterConfig{{Name: "PacketCounters"}}}}); err != nil {
+				b.Fatalf("Can not initialize flowcache services: %s", err)
+			}
+			pkt := newTestTCPPacket(1, network.TrafficIn, false, false)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pkt.TStamp = int64(i)
+				flowcache.ProcessPacket(pkt)
+			}
+		})
+	}
+}
+
+func TestFlowcacheProcessPacketAllocs(t *testing.T) {
+	allocs := map[string]float64{}
+	for _, cacheType := range []string{"ConcurrentCacheMap", "BigCache"} {
+		flowcache := newTestFlowCache(t, cacheType)
+		if err := flowcache.AddServices([]Service{{Name: "Test", Collect: []counters.CounterConfig{{Name: "PacketCounters"}}}}); err != nil {
+			t.Fatalf("Can not initialize flowcache services: %s", err)
+		}
+		pkt := newTestTCPPacket(1, network.TrafficIn, false, false)
+		flowcache.ProcessPacket(pkt)
+		allocs[cacheType] = testing.AllocsPerRun(100, func() {
+			pkt.TStamp++
+			flowcache.ProcessPacket(pkt)
+		})
+	}
+	// The flows in the BigCache are decoded into a reused flow, with their
+	// counters kept in the bytes of the cache
+	if allocs["BigCache"] > allocs["ConcurrentCacheMap"] {
+		t.Fatalf("BigCache allocates %.0f times per packet, ConcurrentCacheMap %.0f", allocs["BigCache"], allocs["ConcurrentCacheMap"])
+	}
+}
@@ -0,0 +1,301 @@
+package flowstats
+
+import (
+	"errors"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/cache"
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+	"github.com/traffic-refinery/traffic-refinery/internal/sketch"
+)
+
+const (
+	// domainCacheCleanup is the period of removal of the unused IP to domain
+	// mappings, and domainCacheEvict the time after which a mapping is unused.
+	// Mappings outlive the TTL of the answers as clients keep using the
+	// addresses of long connections
+	domainCacheCleanup = 5 * time.Minute
+	domainCacheEvict   = 10 * time.Minute
+	// domainCacheShards is the number of shards of the IP to domain cache
+	domainCacheShards = 16
+)
+
+// TopK contains the heaviest items by bytes and by packets
+type TopK struct {
+	Bytes   []sketch.Counter
+	Packets []sketch.Counter
+}
+
+// HeavyHittersScope contains the heavy hitters of a subset of the traffic
+type HeavyHittersScope struct {
+	Bytes        int64
+	Packets      int64
+	Destinations TopK
+	Domains      TopK
+	Clients      TopK
+}
+
+// HeavyHittersOut contains the heavy hitters of all the traffic and of the
+// traffic not classified by the service map
+type HeavyHittersOut struct {
+	K            int
+	All          HeavyHittersScope
+	Unclassified HeavyHittersScope
+}
+
+// topSketches tracks the heaviest items of a dimension by bytes and packets
+type topSketches struct {
+	bytes   *sketch.SpaceSaving
+	packets *sketch.SpaceSaving
+}
+
+func newTopSketches(capacity int) (topSketches, error) {
+	var t topSketches
+	var err error
+	if t.bytes, err = sketch.NewSpaceSaving(capacity); err != nil {
+		return t, err
+	}
+	t.packets, err = sketch.NewSpaceSaving(capacity)
+	return t, err
+}
+
+func (t topSketches) add(key string, length int64) {
+	t.bytes.Add(key, length)
+	t.packets.Add(key, 1)
+}
+
+func (t topSketches) reset() {
+	t.bytes.Reset()
+	t.packets.Reset()
+}
+
+// scopeSketches tracks the heavy hitters of a subset of the traffic
+type scopeSketches struct {
+	destinations topSketches
+	domains      topSketches
+	clients      topSketches
+}
+
+func newScopeSketches(capacity int) (*scopeSketches, error) {
+	s := &scopeSketches{}
+	var err error
+	if s.destinations, err = newTopSketches(capacity); err != nil {
+		return nil, err
+	}
+	if s.domains, err = newTopSketches(capacity); err != nil {
+		return nil, err
+	}
+	if s.clients, err = newTopSketches(capacity); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *scopeSketches) add(pkt *network.Packet, domain string) {
+	s.destinations.add(pkt.ServiceIP, pkt.Length)
+	s.clients.add(pkt.MyIP, pkt.Length)
+	if domain != "" {
+		s.domains.add(domain, pkt.Length)
+	}
+}
+
+func (s *scopeSketches) reset() {
+	s.destinations.reset()
+	s.domains.reset()
+	s.clients.reset()
+}
+
+func (t topSketches) merge(o topSketches) {
+	t.bytes.Merge(o.bytes)
+	t.packets.Merge(o.packets)
+}
+
+func (s *scopeSketches) merge(o *scopeSketches) {
+	s.destinations.merge(o.destinations)
+	s.domains.merge(o.domains)
+	s.clients.merge(o.clients)
+}
+
+// hitterShard contains the sketches of a subset of the flows
+type hitterShard struct {
+	all          *scopeSketches
+	unclassified *scopeSketches
+	sync.Mutex
+}
+
+// HeavyHitters keeps the top K destinations, domains and clients by bytes and
+// packets in bounded memory, using SpaceSaving sketches. Domains are learned
+// from the DNS answers, so HeavyHitters must also be added as processor of
+// the DNS parser.
+// The flows are split among shards, one per CPU, each with its own sketches
+// so that the parsers rarely wait for each other. The sketches of the shards
+// are merged when collected
+type HeavyHitters struct {
+	k        int
+	capacity int
+	shards   []*hitterShard
+	// domains maps the IPs resolved by DNS to their domain
+	domains *cache.SimpleTimeCache
+}
+
+// NewHeavyHitters creates a HeavyHitters reporting the top k items of each
+// dimension. capacity is the number of counters of each sketch, a larger
+// capacity gives more accurate counts. 0 uses 10 times k. maxDomains bounds
+// the number of IP to domain mappings kept
+func NewHeavyHitters(k, capacity, maxDomains int) (*HeavyHitters, error) {
+	if k <= 0 {
+		return nil, errors.New("the number of heavy hitters must be positive")
+	}
+	if capacity == 0 {
+		capacity = 10 * k
+	} else if capacity < k {
+		return nil, errors.New("the capacity of the sketches can not be smaller than the number of heavy hitters")
+	}
+	hh := &HeavyHitters{k: k, capacity: capacity}
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		shard := &hitterShard{}
+		var err error
+		if shard.all, err = newScopeSketches(capacity); err != nil {
+			return nil, err
+		}
+		if shard.unclassified, err = newScopeSketches(capacity); err != nil {
+			return nil, err
+		}
+		hh.shards = append(hh.shards, shard)
+	}
+	hh.domains = cache.NewSimpleTimeCache(domainCacheCleanup, domainCacheEvict, maxDomains, domainCacheShards)
+	return hh, nil
+}
+
+// ProcessDNS records the domain of the IPs in the DNS answers
+func (hh *HeavyHitters) ProcessDNS(msg *network.DNSMessage) error {
+	if !msg.Dns.QR || len(msg.Dns.Questions) == 0 {
+		return nil
+	}
+	domain := string(msg.Dns.Questions[0].Name)
+	for _, answer := range msg.Dns.Answers {
+		if answer.Type == layers.DNSTypeA || answer.Type == layers.DNSTypeAAAA {
+			hh.domains.Insert(answer.IP.String(), domain, 0)
+		}
+	}
+	return nil
+}
+
+// add accounts the packet pkt of the flow with key key. classified tells
+// whether the service map attributed the packet to a service
+func (hh *HeavyHitters) add(pkt *network.Packet, key *FlowKey, classified bool) {
+	if hh == nil {
+		return
+	}
+	domain := ""
+	if d, ok := hh.domains.Lookup(pkt.ServiceIP); ok {
+		domain = d.(string)
+	}
+	shard := hh.shards[key.FastHash()%uint64(len(hh.shards))]
+	shard.Lock()
+	shard.all.add(pkt, domain)
+	if !classified {
+		shard.unclassified.add(pkt, domain)
+	}
+	shard.Unlock()
+}
+
+// collect returns the heavy hitters since the last call and resets the
+// sketches
+func (hh *HeavyHitters) collect(policy *PrivacyPolicy) HeavyHittersOut {
+	all, _ := newScopeSketches(hh.capacity)
+	unclassified, _ := newScopeSketches(hh.capacity)
+	for _, shard := range hh.shards {
+		shard.Lock()
+		all.merge(shard.all)
+		unclassified.merge(shard.unclassified)
+		shard.all.reset()
+		shard.unclassified.reset()
+		shard.Unlock()
+	}
+	return HeavyHittersOut{
+		K:            hh.k,
+		All:          all.out(hh.k, policy),
+		Unclassified: unclassified.out(hh.k, policy),
+	}
+}
+
+func (s *scopeSketches) out(k int, policy *PrivacyPolicy) HeavyHittersScope {
+	var destination, domain, client func(string) string
+	if policy != nil {
+		destination = func(key string) string {
+			return policy.applyIP(&policy.ServiceIP, key)
+		}
+		domain = func(key string) string {
+			return policy.applyDomain(&policy.DomainName, key)
+		}
+		client = func(key string) string {
+			return policy.applyIP(&policy.LocalIP, key)
+		}
+	}
+	return HeavyHittersScope{
+		Bytes:        s.clients.bytes.Total(),
+		Packets:      s.clients.packets.Total(),
+		Destinations: s.destinations.out(k, destination),
+		Domains:      s.domains.out(k, domain),
+		Clients:      s.clients.out(k, client),
+	}
+}
+
+func (t topSketches) out(k int, apply func(string) string) TopK {
+	return TopK{
+		Bytes:   topCounters(t.bytes, k, apply),
+		Packets: topCounters(t.packets, k, apply),
+	}
+}
+
+// topCounters returns the k heaviest items of ss with apply applied to their
+// keys. Items mapped to the same key are merged and items mapped to an empty
+// key are dropped
+func topCounters(ss *sketch.SpaceSaving, k int, apply func(string) string) []sketch.Counter {
+	if apply == nil {
+		return ss.Top(k)
+	}
+	merged := make(map[string]int)
+	ret := []sketch.Counter{}
+	for _, c := range ss.Top(-1) {
+		c.Key = apply(c.Key)
+		if c.Key == "" {
+			continue
+		}
+		if i, ok := merged[c.Key]; ok {
+			ret[i].Count += c.Count
+			ret[i].Error += c.Error
+			continue
+		}
+		merged[c.Key] = len(ret)
+		ret = append(ret, c)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Count > ret[j].Count
+	})
+	if len(ret) > k {
+		ret = ret[:k]
+	}
+	return ret
+}
+
+// SetHeavyHitters sets the tracker of the heavy hitters fed with all the
+// packets processed by the cache. nil disables the tracking
+func (fc *FlowCache) SetHeavyHitters(hh *HeavyHitters) {
+	fc.hitters = hh
+}
+
+// DumpHeavyHitters returns the heavy hitters since the previous dump, with
+// the privacy policy of the cache applied to the addresses and domains
+func (fc *FlowCache) DumpHeavyHitters() (HeavyHittersOut, bool) {
+	if fc.hitters == nil {
+		return HeavyHittersOut{}, false
+	}
+	return fc.hitters.collect(fc.policy), true
+}
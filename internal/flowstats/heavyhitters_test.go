@@ -0,0 +1,108 @@
+package flowstats
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+)
+
+// newTestServicePacket returns a packet from the test client to the service
+// ip
+func newTestServicePacket(ip string, length int64) *network.Packet {
+	pkt := newTestTCPPacket(1, network.TrafficOut, false, false)
+	pkt.ServiceIP = ip
+	pkt.ServiceAddr = net.ParseIP(ip)
+	pkt.Length = length
+	return pkt
+}
+
+func TestFlowcacheHeavyHitters(t *testing.T) {
+	flowcache := newTestFlowCache(t, "ConcurrentCacheMap")
+	if _, ok := flowcache.DumpHeavyHitters(); ok {
+		t.Fatalf("Heavy hitters dumped while disabled")
+	}
+	if _, err := NewHeavyHitters(10, 5, 100); err == nil {
+		t.Fatalf("Sketches smaller than the number of heavy hitters accepted")
+	}
+	hh, err := NewHeavyHitters(2, 0, 100)
+	if err != nil {
+		t.Fatalf("Can not create the heavy hitters: %s", err)
+	}
+	flowcache.SetHeavyHitters(hh)
+
+	hh.ProcessDNS(&network.DNSMessage{Dns: &layers.DNS{
+		QR:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte("one.example.com")}},
+		Answers:   []layers.DNSResourceRecord{{Type: layers.DNSTypeA, IP: net.ParseIP("1.1.1.1"), TTL: 60}},
+	}})
+
+	for i := 0; i < 10; i++ {
+		flowcache.ProcessPacket(newTestServicePacket("198.38.120.133", 1000))
+	}
+	for i := 0; i < 5; i++ {
+		flowcache.ProcessPacket(newTestServicePacket("1.1.1.1", 100))
+	}
+	for i := 0; i < 3; i++ {
+		flowcache.ProcessPacket(newTestServicePacket("8.8.8.8", 500))
+	}
+	flowcache.ProcessPacket(newTestServicePacket("9.9.9.9", 10))
+
+	out, ok := flowcache.DumpHeavyHitters()
+	if !ok {
+		t.Fatalf("Heavy hitters not dumped")
+	}
+	if out.All.Packets != 19 || out.All.Bytes != 12010 {
+		t.Fatalf("Wrong totals %d packets %d bytes", out.All.Packets, out.All.Bytes)
+	}
+	if out.Unclassified.Packets != 9 || out.Unclassified.Bytes != 2010 {
+		t.Fatalf("Wrong unclassified totals %d packets %d bytes", out.Unclassified.Packets, out.Unclassified.Bytes)
+	}
+	dst := out.Unclassified.Destinations
+	if len(dst.Bytes) != 2 || dst.Bytes[0].Key != "8.8.8.8" || dst.Bytes[1].Key != "1.1.1.1" {
+		t.Fatalf("Wrong top unclassified destinations by bytes %+v", dst.Bytes)
+	}
+	if dst.Packets[0].Key != "1.1.1.1" || dst.Packets[0].Count != 5 {
+		t.Fatalf("Wrong top unclassified destinations by packets %+v", dst.Packets)
+	}
+	if out.All.Destinations.Bytes[0].Key != "198.38.120.133" {
+		t.Fatalf("Wrong top destinations by bytes %+v", out.All.Destinations.Bytes)
+	}
+	domains := out.Unclassified.Domains.Bytes
+	if len(domains) != 1 || domains[0].Key != "one.example.com" || domains[0].Count != 500 {
+		t.Fatalf("Wrong top unclassified domains %+v", domains)
+	}
+	clients := out.All.Clients.Packets
+	if len(clients) != 1 || clients[0].Key != "192.168.43.72" || clients[0].Count != 19 {
+		t.Fatalf("Wrong top clients %+v", clients)
+	}
+
+	// The sketches restart after each dump
+	out, _ = flowcache.DumpHeavyHitters()
+	if out.All.Packets != 0 || len(out.All.Destinations.Bytes) != 0 {
+		t.Fatalf("Heavy hitters not reset after the dump")
+	}
+}
+
+func TestHeavyHittersPrivacy(t *testing.T) {
+	// The clients are spread over several shards
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	hh, _ := NewHeavyHitters(5, 0, 100)
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.1.1"} {
+		pkt := newTestServicePacket("8.8.8.8", 100)
+		pkt.MyIP = ip
+		pkt.MyAddr = net.ParseIP(ip)
+		key := NewFlowKey(pkt)
+		hh.add(pkt, &key, false)
+	}
+	policy, _ := NewPrivacyPolicy(nil, nil)
+	policy.LocalIP = FieldPolicy{Action: PolicyTruncate, PrefixV4: 24}
+	out := hh.collect(policy)
+	clients := out.Unclassified.Clients.Bytes
+	if len(clients) != 2 || clients[0].Key != "10.0.0.0" || clients[0].Count != 200 {
+		t.Fatalf("Clients not merged by the privacy policy %+v", clients)
+	}
+}
@@ -0,0 +1,78 @@
+package flowstats
+
+import (
+	"encoding/hex"
+	"sync"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/cache"
+)
+
+// flowIndex lists the keys of the flows of a table by service, so that the
+// dump of a group of services only visits their flows. Each key is counted
+// as the flows entering and leaving the table can be accounted in any order
+// by concurrent parsers. Keys are stored as arrays so that the garbage
+// collector does not need to scan the index
+type flowIndex struct {
+	services map[string]map[FlowKey]int32
+	sync.Mutex
+}
+
+// add adds n to the count of key in the flows of service, removing the key
+// when the count drops to zero
+func (x *flowIndex) add(service string, key FlowKey, n int32) {
+	x.Lock()
+	defer x.Unlock()
+	if x.services == nil {
+		x.services = make(map[string]map[FlowKey]int32)
+	}
+	keys := x.services[service]
+	if keys == nil {
+		keys = make(map[FlowKey]int32)
+		x.services[service] = keys
+	}
+	if count := keys[key] + n; count != 0 {
+		keys[key] = count
+	} else {
+		delete(keys, key)
+	}
+}
+
+// keys returns the keys of the flows of the given services
+func (x *flowIndex) keys(services map[string]bool) []FlowKey {
+	x.Lock()
+	defer x.Unlock()
+	ret := []FlowKey{}
+	for service := range services {
+		for key, count := range x.services[service] {
+			if count > 0 {
+				ret = append(ret, key)
+			}
+		}
+	}
+	return ret
+}
+
+// key returns the key of the flow in the cache, of which its Id is the hex
+// representation
+func (f *Flow) key() (k FlowKey) {
+	hex.Decode(k[:], []byte(f.Id))
+	return k
+}
+
+// visitFlows calls f on each flow of the given services while holding its
+// lock. Changes made by f are stored back into the cache. The flows for which
+// f returns true are removed and passed to the eviction callback of their
+// table. Only the flows of the services are visited
+func (fc *FlowCache) visitFlows(services map[string]bool, f func(*Flow) bool) {
+	visit := func(v interface{}) bool {
+		return f(v.(*Flow))
+	}
+	for _, t := range fc.allTables() {
+		index := &t.index
+		t.run(func(c cache.Cache) {
+			for _, key := range index.keys(services) {
+				c.Visit(string(key[:]), visit)
+			}
+		})
+	}
+}
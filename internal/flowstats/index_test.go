@@ -0,0 +1,43 @@
+package flowstats
+
+import (
+	"testing"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+)
+
+func TestFlowIndex(t *testing.T) {
+	var x flowIndex
+	var a, b FlowKey
+	a[0], b[0] = 1, 2
+	x.add("Test", a, 1)
+	x.add("Other", b, 1)
+	// A flow removed before being accounted as added leaves no key
+	x.add("Test", b, -1)
+	x.add("Test", b, 1)
+	// A flow replaced by a new one with the same key keeps it
+	x.add("Test", a, 1)
+	x.add("Test", a, -1)
+	if keys := x.keys(map[string]bool{"Test": true}); len(keys) != 1 || keys[0] != a {
+		t.Fatalf("Wrong keys for service Test %v", keys)
+	}
+	if keys := x.keys(map[string]bool{"Test": true, "Other": true}); len(keys) != 2 {
+		t.Fatalf("Wrong keys for both services %v", keys)
+	}
+}
+
+func TestFlowcacheIndexRemoved(t *testing.T) {
+	for _, cacheType := range []string{"ConcurrentCacheMap", "BigCache", "PerWorker"} {
+		flowcache := newTestFlowCache(t, cacheType)
+		flowcache.ProcessPacket(newTestTCPPacket(1, network.TrafficIn, false, false))
+		selected := map[string]bool{"Test": true}
+		if keys := flowcache.tables[0].index.keys(selected); len(keys) != 1 {
+			t.Fatalf("%s: expected 1 indexed flow, found %d", cacheType, len(keys))
+		}
+		// Terminated flows leave the index
+		flowcache.ProcessPacket(newTestTCPPacket(2, network.TrafficIn, false, true))
+		if keys := flowcache.tables[0].index.keys(selected); len(keys) != 0 {
+			t.Fatalf("%s: terminated flow still indexed", cacheType)
+		}
+	}
+}
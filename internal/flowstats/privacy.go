@@ -0,0 +1,299 @@
+package flowstats
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/counters"
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+)
+
+// Actions that can be applied to an output field
+const (
+	// PolicyKeep exports the field unchanged
+	PolicyKeep = "keep"
+	// PolicyTruncate exports a prefix of the field: the network prefix of
+	// addresses, the OUI of MAC addresses, the last labels of domain names
+	// and the first bytes of payloads
+	PolicyTruncate = "truncate"
+	// PolicyCryptoPAn exports addresses anonymized with Crypto-PAn
+	PolicyCryptoPAn = "cryptopan"
+	// PolicyHMAC exports the HMAC-SHA256 of the field
+	PolicyHMAC = "hmac"
+	// PolicyDrop removes the field from the output
+	PolicyDrop = "drop"
+)
+
+const (
+	defaultPrefixV4 = 24
+	defaultPrefixV6 = 48
+	defaultLabels   = 2
+	defaultBytes    = 64
+	// hmacLen is the number of bytes of the HMAC exported for string fields
+	hmacLen = 16
+)
+
+// FieldPolicy determines how a field is exported
+type FieldPolicy struct {
+	// Action is one of "keep", "truncate", "cryptopan", "hmac" or "drop".
+	// Empty means "keep"
+	Action string
+	// PrefixV4 and PrefixV6 are the prefix lengths kept when truncating
+	// addresses. Default to 24 and 48
+	PrefixV4 int
+	PrefixV6 int
+	// Labels is the number of labels kept when truncating domain names.
+	// Defaults to 2
+	Labels int
+	// Bytes is the number of bytes kept when truncating payloads. Defaults
+	// to 64
+	Bytes int
+}
+
+func (fp *FieldPolicy) keep() bool {
+	return fp.Action == "" || fp.Action == PolicyKeep
+}
+
+// PrivacyPolicy contains the policies applied to the fields of exported flows
+type PrivacyPolicy struct {
+	LocalIP     FieldPolicy
+	ServiceIP   FieldPolicy
+	LocalPort   FieldPolicy
+	ServicePort FieldPolicy
+	HwAddr      FieldPolicy
+	DomainName  FieldPolicy
+	Payload     FieldPolicy
+
+	// anonymizer is used by the "cryptopan" action
+	anonymizer *network.Anonymizer
+	// hmacKey is used by the "hmac" action
+	hmacKey []byte
+}
+
+// MinHMACKeySize is the minimum length in bytes of the keys of the "hmac"
+// action
+const MinHMACKeySize = sha256.Size
+
+// NewPrivacyPolicy creates a policy keeping all fields. anonymizer and hmacKey
+// are used by the "cryptopan" and "hmac" actions. If nil, a random key is
+// generated when needed. hmacKey must be at least MinHMACKeySize bytes long
+func NewPrivacyPolicy(anonymizer *network.Anonymizer, hmacKey []byte) (*PrivacyPolicy, error) {
+	if hmacKey != nil && len(hmacKey) < MinHMACKeySize {
+		return nil, errors.New("HMAC key shorter than " + strconv.Itoa(MinHMACKeySize) + " bytes")
+	}
+	p := &PrivacyPolicy{
+		anonymizer: anonymizer,
+		hmacKey:    hmacKey,
+	}
+	if p.hmacKey == nil {
+		p.hmacKey = make([]byte, MinHMACKeySize)
+		if _, err := rand.Read(p.hmacKey); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Validate checks that the actions are supported by the fields they are
+// applied to, generating a random Crypto-PAn key if needed
+func (p *PrivacyPolicy) Validate() error {
+	fields := []struct {
+		name    string
+		policy  *FieldPolicy
+		allowed []string
+	}{
+		{"LocalIP", &p.LocalIP, []string{PolicyTruncate, PolicyCryptoPAn, PolicyHMAC, PolicyDrop}},
+		{"ServiceIP", &p.ServiceIP, []string{PolicyTruncate, PolicyCryptoPAn, PolicyHMAC, PolicyDrop}},
+		{"LocalPort", &p.LocalPort, []string{PolicyHMAC, PolicyDrop}},
+		{"ServicePort", &p.ServicePort, []string{PolicyHMAC, PolicyDrop}},
+		{"HwAddr", &p.HwAddr, []string{PolicyTruncate, PolicyHMAC, PolicyDrop}},
+		{"DomainName", &p.DomainName, []string{PolicyTruncate, PolicyHMAC, PolicyDrop}},
+		{"Payload", &p.Payload, []string{PolicyTruncate, PolicyHMAC, PolicyDrop}},
+	}
+	for _, f := range fields {
+		if f.policy.keep() {
+			continue
+		}
+		found := false
+		for _, a := range f.allowed {
+			if f.policy.Action == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("unsupported privacy action " + f.policy.Action + " for field " + f.name)
+		}
+		if f.policy.Action == PolicyCryptoPAn && p.anonymizer == nil {
+			var err error
+			if p.anonymizer, err = network.NewAnonymizer("", 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *PrivacyPolicy) hmac(data []byte) []byte {
+	mac := hmac.New(sha256.New, p.hmacKey)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (p *PrivacyPolicy) hmacString(s string) string {
+	return hex.EncodeToString(p.hmac([]byte(s))[:hmacLen])
+}
+
+func (p *PrivacyPolicy) applyIP(fp *FieldPolicy, s string) string {
+	switch fp.Action {
+	case PolicyDrop:
+		return ""
+	case PolicyHMAC:
+		return p.hmacString(s)
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+	switch fp.Action {
+	case PolicyTruncate:
+		if v4 := ip.To4(); v4 != nil {
+			prefix := fp.PrefixV4
+			if prefix == 0 {
+				prefix = defaultPrefixV4
+			}
+			return v4.Mask(net.CIDRMask(prefix, 8*net.IPv4len)).String()
+		}
+		prefix := fp.PrefixV6
+		if prefix == 0 {
+			prefix = defaultPrefixV6
+		}
+		return ip.Mask(net.CIDRMask(prefix, 8*net.IPv6len)).String()
+	case PolicyCryptoPAn:
+		return p.anonymizer.Anonymize(ip).String()
+	}
+	return s
+}
+
+func (p *PrivacyPolicy) applyPort(fp *FieldPolicy, s string) string {
+	switch fp.Action {
+	case PolicyDrop:
+		return ""
+	case PolicyHMAC:
+		return p.hmacString(s)
+	}
+	return s
+}
+
+func (p *PrivacyPolicy) applyHwAddr(fp *FieldPolicy, s string) string {
+	switch fp.Action {
+	case PolicyDrop:
+		return ""
+	case PolicyHMAC:
+		return p.hmacString(s)
+	case PolicyTruncate:
+		if mac, err := net.ParseMAC(s); err == nil {
+			for i := 3; i < len(mac); i++ {
+				mac[i] = 0
+			}
+			return mac.String()
+		}
+	}
+	return s
+}
+
+func (p *PrivacyPolicy) applyDomain(fp *FieldPolicy, s string) string {
+	switch fp.Action {
+	case PolicyDrop:
+		return ""
+	case PolicyHMAC:
+		if s == "" {
+			return s
+		}
+		return p.hmacString(s)
+	case PolicyTruncate:
+		labels := fp.Labels
+		if labels == 0 {
+			labels = defaultLabels
+		}
+		parts := strings.Split(strings.TrimSuffix(s, "."), ".")
+		if len(parts) > labels {
+			return strings.Join(parts[len(parts)-labels:], ".")
+		}
+	}
+	return s
+}
+
+// ApplyLocalIP returns the local address s as exported by the policy
+func (p *PrivacyPolicy) ApplyLocalIP(s string) string {
+	return p.applyIP(&p.LocalIP, s)
+}
+
+// ApplyServiceIP returns the service address s as exported by the policy
+func (p *PrivacyPolicy) ApplyServiceIP(s string) string {
+	return p.applyIP(&p.ServiceIP, s)
+}
+
+// ApplyDomain returns the domain name s as exported by the policy
+func (p *PrivacyPolicy) ApplyDomain(s string) string {
+	return p.applyDomain(&p.DomainName, s)
+}
+
+// PayloadFilter returns the filter applied to the payload bytes copied by
+// counters. Returns nil if payloads are kept unchanged
+func (p *PrivacyPolicy) PayloadFilter() counters.PayloadFilter {
+	fp := p.Payload
+	switch fp.Action {
+	case PolicyDrop:
+		return func([]byte) []byte {
+			return nil
+		}
+	case PolicyHMAC:
+		return func(data []byte) []byte {
+			if len(data) == 0 {
+				return data
+			}
+			return p.hmac(data)
+		}
+	case PolicyTruncate:
+		n := fp.Bytes
+		if n == 0 {
+			n = defaultBytes
+		}
+		return func(data []byte) []byte {
+			if len(data) > n {
+				return data[:n]
+			}
+			return data
+		}
+	}
+	return nil
+}
+
+// flowId returns the identifier exported for the flow id. As identifiers are
+// built from the flow addresses and ports, they are replaced by their HMAC
+// unless all of them are kept
+func (p *PrivacyPolicy) flowId(id string) string {
+	if p.LocalIP.keep() && p.ServiceIP.keep() && p.LocalPort.keep() && p.ServicePort.keep() {
+		return id
+	}
+	return p.hmacString(id)
+}
+
+// Apply applies the policy to the fields of the exported flow of.
+// Payloads are filtered by the counters copying them
+func (p *PrivacyPolicy) Apply(of *OutFlow) {
+	of.Id = p.flowId(of.Id)
+	of.LocalIP = p.applyIP(&p.LocalIP, of.LocalIP)
+	of.ServiceIP = p.applyIP(&p.ServiceIP, of.ServiceIP)
+	of.LocalPort = p.applyPort(&p.LocalPort, of.LocalPort)
+	of.ServicePort = p.applyPort(&p.ServicePort, of.ServicePort)
+	of.HwAddr = p.applyHwAddr(&p.HwAddr, of.HwAddr)
+	of.DomainName = p.applyDomain(&p.DomainName, of.DomainName)
+}
@@ -0,0 +1,96 @@
+package flowstats
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrivacyPolicyApply(t *testing.T) {
+	if _, err := NewPrivacyPolicy(nil, []byte("test key")); err == nil {
+		t.Fatalf("Short HMAC key accepted")
+	}
+	policy, err := NewPrivacyPolicy(nil, bytes.Repeat([]byte("k"), MinHMACKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.LocalIP = FieldPolicy{Action: PolicyTruncate}
+	policy.ServiceIP = FieldPolicy{Action: PolicyCryptoPAn}
+	policy.LocalPort = FieldPolicy{Action: PolicyDrop}
+	policy.ServicePort = FieldPolicy{Action: PolicyKeep}
+	policy.HwAddr = FieldPolicy{Action: PolicyTruncate}
+	policy.DomainName = FieldPolicy{Action: PolicyTruncate, Labels: 2}
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("Valid policy rejected: %s", err)
+	}
+
+	of := OutFlow{
+		Id:          "flow",
+		LocalIP:     "192.168.43.72",
+		ServiceIP:   "198.38.120.133",
+		LocalPort:   "51751",
+		ServicePort: "443",
+		HwAddr:      "aa:bb:cc:dd:ee:ff",
+		DomainName:  "video.example.com",
+	}
+	policy.Apply(&of)
+	if of.LocalIP != "192.168.43.0" {
+		t.Fatalf("LocalIP truncated to %s instead of 192.168.43.0", of.LocalIP)
+	}
+	if of.ServiceIP == "198.38.120.133" || of.ServiceIP == "" {
+		t.Fatalf("ServiceIP not anonymized: %s", of.ServiceIP)
+	}
+	if of.LocalPort != "" || of.ServicePort != "443" {
+		t.Fatalf("Wrong ports %s and %s", of.LocalPort, of.ServicePort)
+	}
+	if of.HwAddr != "aa:bb:cc:00:00:00" {
+		t.Fatalf("HwAddr truncated to %s instead of aa:bb:cc:00:00:00", of.HwAddr)
+	}
+	if of.DomainName != "example.com" {
+		t.Fatalf("DomainName truncated to %s instead of example.com", of.DomainName)
+	}
+	if of.Id == "flow" {
+		t.Fatalf("Flow id should be hashed when addresses are not kept")
+	}
+
+	policy.LocalIP = FieldPolicy{Action: PolicyHMAC}
+	first, second := OutFlow{LocalIP: "192.168.43.72"}, OutFlow{LocalIP: "192.168.43.72"}
+	policy.Apply(&first)
+	policy.Apply(&second)
+	if first.LocalIP != second.LocalIP || first.LocalIP == "192.168.43.72" {
+		t.Fatalf("HMAC of LocalIP is not consistent: %s and %s", first.LocalIP, second.LocalIP)
+	}
+}
+
+func TestPrivacyPolicyValidate(t *testing.T) {
+	policy, err := NewPrivacyPolicy(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.LocalPort = FieldPolicy{Action: PolicyCryptoPAn}
+	if err := policy.Validate(); err == nil {
+		t.Fatalf("Crypto-PAn should not be accepted for ports")
+	}
+	policy.LocalPort = FieldPolicy{Action: "unknown"}
+	if err := policy.Validate(); err == nil {
+		t.Fatalf("Unknown actions should not be accepted")
+	}
+}
+
+func TestPrivacyPolicyPayload(t *testing.T) {
+	policy, err := NewPrivacyPolicy(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte{1}, 100)
+	if policy.PayloadFilter() != nil {
+		t.Fatalf("Kept payloads should not be filtered")
+	}
+	policy.Payload = FieldPolicy{Action: PolicyTruncate, Bytes: 10}
+	if data := policy.PayloadFilter()(payload); len(data) != 10 {
+		t.Fatalf("Payload truncated to %d bytes instead of 10", len(data))
+	}
+	policy.Payload = FieldPolicy{Action: PolicyDrop}
+	if data := policy.PayloadFilter()(payload); data != nil {
+		t.Fatalf("Payload should be dropped")
+	}
+}
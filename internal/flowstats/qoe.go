@@ -0,0 +1,64 @@
+package flowstats
+
+import (
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/counters"
+	"github.com/traffic-refinery/traffic-refinery/internal/qoe"
+)
+
+// SetVideoSessions sets the video sessions fed with the segments of the
+// flows with VideoCounters at each dump. nil disables the QoE inference
+func (fc *FlowCache) SetVideoSessions(sessions *qoe.Sessions) {
+	fc.videoSessions = sessions
+}
+
+// addVideoSegments adds the segments of the video counters in cntrs of the
+// flow f to the session of its client. The counters of the snapshots are
+// read from their output
+func (fc *FlowCache) addVideoSegments(f *Flow, cntrs []counters.Counter) {
+	if fc.videoSessions == nil {
+		return
+	}
+	for _, c := range cntrs {
+		var segments []counters.VideoSegment
+		switch vc := c.(type) {
+		case *counters.VideoCounters:
+			segments = make([]counters.VideoSegment, 0, len(vc.UpstreamChunks)+1)
+			segments = append(segments, vc.UpstreamChunks...)
+			if vc.RunningUpstream.TsStart > 0 {
+				segments = append(segments, vc.RunningUpstream)
+			}
+		case *collectedCounter:
+			if vc.CType != "VideoCounters" {
+				continue
+			}
+			var out counters.VideoCountersOut
+			if err := json.Unmarshal(vc.Data, &out); err != nil {
+				continue
+			}
+			segments = out.VideoSegments
+		default:
+			continue
+		}
+		fc.videoSessions.Add(qoe.SessionKey{Service: f.Service, ClientIP: f.LocalIP}, f.Id, segments)
+	}
+}
+
+// DumpVideoSessions returns the records of the video sessions ended at the
+// time of the most recent packet, with the privacy policy of the cache
+// applied to the client addresses. Sessions are fed at the dumps of the
+// services, whose emit interval should be shorter than the session timeout
+func (fc *FlowCache) DumpVideoSessions() ([]qoe.SessionOut, bool) {
+	if fc.videoSessions == nil {
+		return nil, false
+	}
+	out := fc.videoSessions.Collect(atomic.LoadInt64(&fc.lastTs), false)
+	if fc.policy != nil {
+		for i := range out {
+			out[i].ClientIP = fc.policy.applyIP(&fc.policy.LocalIP, out[i].ClientIP)
+		}
+	}
+	return out, true
+}
@@ -0,0 +1,63 @@
+package flowstats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/counters"
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+	"github.com/traffic-refinery/traffic-refinery/internal/qoe"
+	"github.com/traffic-refinery/traffic-refinery/internal/utils"
+)
+
+func TestFlowcacheVideoSessions(t *testing.T) {
+	flowcache := newTestFlowCache(t, "ConcurrentCacheMap")
+	if err := flowcache.AddServices([]Service{{Name: "Test", Collect: []counters.CounterConfig{{Name: "VideoCounters"}}}}); err != nil {
+		t.Fatalf("Can not add the services: %s", err)
+	}
+	if _, ok := flowcache.DumpVideoSessions(); ok {
+		t.Fatalf("Video sessions dumped while disabled")
+	}
+	model, err := qoe.LoadModel(utils.GetRepoPath() + "/test/qoe/video_qoe_model.json")
+	if err != nil {
+		t.Fatalf("Can not load the model: %s", err)
+	}
+	sessions, _ := qoe.NewSessions(model, 10*time.Second)
+	flowcache.SetVideoSessions(sessions)
+	policy, _ := NewPrivacyPolicy(nil, nil)
+	policy.LocalIP = FieldPolicy{Action: PolicyTruncate, PrefixV4: 24}
+	flowcache.SetPrivacyPolicy(policy)
+
+	// Three segments requested every 2 seconds
+	ts := int64(time.Second)
+	for i := 0; i < 3; i++ {
+		req := newTestClientPacket("192.168.43.72", network.TrafficOut, 500)
+		req.TStamp = ts
+		req.DataLength = 400
+		flowcache.ProcessPacket(req)
+		for j := 0; j < 20; j++ {
+			pkt := newTestClientPacket("192.168.43.72", network.TrafficIn, 1500)
+			pkt.TStamp = ts + int64(j)*int64(10*time.Millisecond)
+			pkt.DataLength = 1000
+			flowcache.ProcessPacket(pkt)
+		}
+		ts += int64(2 * time.Second)
+	}
+	flowcache.DumpServices(nil)
+	if out, _ := flowcache.DumpVideoSessions(); len(out) != 0 {
+		t.Fatalf("Session ended while active %+v", out)
+	}
+
+	// A packet after the session timeout ends the session
+	pkt := newTestClientPacket("192.168.43.72", network.TrafficOut, 60)
+	pkt.TStamp = ts + int64(time.Minute)
+	flowcache.ProcessPacket(pkt)
+	flowcache.DumpServices(nil)
+	out, ok := flowcache.DumpVideoSessions()
+	if !ok || len(out) != 1 {
+		t.Fatalf("Expected 1 video session, got %+v", out)
+	}
+	if s := out[0]; s.Service != "Test" || s.ClientIP != "192.168.43.0" || s.Segments != 3 || s.Bytes != 60000 {
+		t.Fatalf("Wrong video session %+v", s)
+	}
+}
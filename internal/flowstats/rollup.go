@@ -0,0 +1,280 @@
+package flowstats
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+)
+
+// Aggregation levels of the rollups
+const (
+	// RollupServiceClient aggregates the flows of each service and client IP
+	RollupServiceClient = "service_client"
+	// RollupServiceSubnet aggregates the flows of each service and client
+	// subnet, /24 for IPv4 and /48 for IPv6
+	RollupServiceSubnet = "service_subnet"
+	// RollupService aggregates the flows of each service
+	RollupService = "service"
+	// RollupDevice aggregates the flows of each device MAC address
+	RollupDevice = "device"
+)
+
+const (
+	rollupPrefixV4 = 24
+	rollupPrefixV6 = 48
+	// maxDroppedKeys is the maximum number of clients whose rejected traffic
+	// is tracked between two dumps. The rejected traffic of further clients
+	// is only accounted to their service
+	maxDroppedKeys = 65536
+)
+
+// flowVolume contains the packets and bytes of a flow in each direction
+type flowVolume struct {
+	InPackets  int64
+	OutPackets int64
+	InBytes    int64
+	OutBytes   int64
+}
+
+// add accounts the packet pkt
+func (v *flowVolume) add(pkt *network.Packet) {
+	if pkt.Dir == network.TrafficIn {
+		v.InPackets++
+		v.InBytes += pkt.Length
+	} else if pkt.Dir == network.TrafficOut {
+		v.OutPackets++
+		v.OutBytes += pkt.Length
+	}
+}
+
+// RollupRecord contains the traffic of the flows sharing the same key at an
+// aggregation level. Fields not part of the key are empty
+type RollupRecord struct {
+	Service      string `json:",omitempty"`
+	ClientIP     string `json:",omitempty"`
+	ClientSubnet string `json:",omitempty"`
+	HwAddr       string `json:",omitempty"`
+	// Flows is the number of flows with traffic in the interval
+	Flows      int64
+	InPackets  int64
+	OutPackets int64
+	InBytes    int64
+	OutBytes   int64
+	// DroppedPackets and DroppedBytes are the traffic of the new flows
+	// rejected by the admission policy of the cache, not part of any flow
+	DroppedPackets int64
+	DroppedBytes   int64
+}
+
+// Rollup contains the records of an aggregation level
+type Rollup struct {
+	Level   string
+	Records []RollupRecord
+}
+
+// rollupKey identifies a record of an aggregation level
+type rollupKey struct {
+	service string
+	client  string
+	subnet  string
+	hwAddr  string
+}
+
+// droppedKey identifies the clients whose traffic was rejected
+type droppedKey struct {
+	service string
+	client  string
+	hwAddr  string
+}
+
+// droppedTraffic accumulates the traffic of the packets rejected by the
+// admission policy until the next dump
+type droppedTraffic struct {
+	vols map[droppedKey]*flowVolume
+	sync.Mutex
+}
+
+// add accounts the packet pkt of the service rejected by the admission
+// policy
+func (d *droppedTraffic) add(service string, pkt *network.Packet) {
+	k := droppedKey{service: service, client: pkt.MyIP, hwAddr: pkt.HwAddr}
+	d.Lock()
+	defer d.Unlock()
+	if d.vols == nil {
+		d.vols = make(map[droppedKey]*flowVolume)
+	}
+	vol, ok := d.vols[k]
+	if !ok {
+		if len(d.vols) >= maxDroppedKeys {
+			k = droppedKey{service: service}
+			vol = d.vols[k]
+		}
+		if vol == nil {
+			vol = &flowVolume{}
+			d.vols[k] = vol
+		}
+	}
+	vol.add(pkt)
+}
+
+// pop removes and returns the rejected traffic of the selected services, of
+// all services if selected is nil
+func (d *droppedTraffic) pop(selected map[string]bool) map[droppedKey]*flowVolume {
+	d.Lock()
+	defer d.Unlock()
+	if selected == nil {
+		ret := d.vols
+		d.vols = nil
+		return ret
+	}
+	ret := make(map[droppedKey]*flowVolume)
+	for k, vol := range d.vols {
+		if selected[k.service] {
+			ret[k] = vol
+			delete(d.vols, k)
+		}
+	}
+	return ret
+}
+
+// rollups accumulates the traffic of the flows collected by a dump
+type rollups struct {
+	levels  []string
+	records []map[rollupKey]*RollupRecord
+}
+
+// SetRollups sets the aggregation levels computed at each dump: any of
+// "service_client", "service_subnet", "service" and "device". flowRecords
+// selects whether the per flow records are exported as well
+func (fc *FlowCache) SetRollups(levels []string, flowRecords bool) error {
+	for _, l := range levels {
+		switch l {
+		case RollupServiceClient, RollupServiceSubnet, RollupService, RollupDevice:
+		default:
+			return errors.New("unknown rollup level " + l)
+		}
+	}
+	fc.rollupLevels = levels
+	fc.noFlowRecords = !flowRecords
+	return nil
+}
+
+// ExportsFlows returns true if the dumps export the per flow records
+func (fc *FlowCache) ExportsFlows() bool {
+	return !fc.noFlowRecords
+}
+
+func newRollups(levels []string) *rollups {
+	r := &rollups{levels: levels}
+	for range levels {
+		r.records = append(r.records, make(map[rollupKey]*RollupRecord))
+	}
+	return r
+}
+
+// subnet returns the network address of the client subnet of ip
+func subnet(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(rollupPrefixV4, 8*net.IPv4len)).String()
+	}
+	return addr.Mask(net.CIDRMask(rollupPrefixV6, 8*net.IPv6len)).String()
+}
+
+// record returns the record of the i-th level containing the traffic of the
+// client of service
+func (r *rollups) record(i int, service, client, hwAddr string) *RollupRecord {
+	var k rollupKey
+	switch r.levels[i] {
+	case RollupServiceClient:
+		k = rollupKey{service: service, client: client}
+	case RollupServiceSubnet:
+		k = rollupKey{service: service, subnet: subnet(client)}
+	case RollupService:
+		k = rollupKey{service: service}
+	case RollupDevice:
+		k = rollupKey{hwAddr: hwAddr}
+	}
+	rec, ok := r.records[i][k]
+	if !ok {
+		rec = &RollupRecord{}
+		r.records[i][k] = rec
+	}
+	return rec
+}
+
+// add accounts the traffic vol of the flow f at each level
+func (r *rollups) add(f *Flow, vol flowVolume) {
+	if vol.InPackets == 0 && vol.OutPackets == 0 {
+		return
+	}
+	for i := range r.levels {
+		rec := r.record(i, f.Service, f.LocalIP, f.HwAddr)
+		rec.Flows++
+		rec.InPackets += vol.InPackets
+		rec.OutPackets += vol.OutPackets
+		rec.InBytes += vol.InBytes
+		rec.OutBytes += vol.OutBytes
+	}
+}
+
+// addDropped accounts the traffic rejected by the admission policy at each
+// level. The traffic of the clients beyond maxDroppedKeys is only found in
+// the records of their service
+func (r *rollups) addDropped(dropped map[droppedKey]*flowVolume) {
+	for k, vol := range dropped {
+		for i := range r.levels {
+			rec := r.record(i, k.service, k.client, k.hwAddr)
+			rec.DroppedPackets += vol.InPackets + vol.OutPackets
+			rec.DroppedBytes += vol.InBytes + vol.OutBytes
+		}
+	}
+}
+
+// out returns the records of each level with the privacy policy applied to
+// the client addresses
+func (r *rollups) out(policy *PrivacyPolicy) []Rollup {
+	ret := []Rollup{}
+	for i, level := range r.levels {
+		rollup := Rollup{Level: level, Records: []RollupRecord{}}
+		for k, rec := range r.records[i] {
+			rec.Service = k.service
+			rec.ClientIP = k.client
+			rec.ClientSubnet = k.subnet
+			rec.HwAddr = k.hwAddr
+			if policy != nil {
+				if rec.ClientIP != "" {
+					rec.ClientIP = policy.applyIP(&policy.LocalIP, rec.ClientIP)
+				}
+				if rec.ClientSubnet != "" {
+					rec.ClientSubnet = policy.applyIP(&policy.LocalIP, rec.ClientSubnet)
+				}
+				if rec.HwAddr != "" {
+					rec.HwAddr = policy.applyHwAddr(&policy.HwAddr, rec.HwAddr)
+				}
+			}
+			rollup.Records = append(rollup.Records, *rec)
+		}
+		sort.Slice(rollup.Records, func(a, b int) bool {
+			ra, rb := rollup.Records[a], rollup.Records[b]
+			if ra.Service != rb.Service {
+				return ra.Service < rb.Service
+			}
+			if ra.ClientIP != rb.ClientIP {
+				return ra.ClientIP < rb.ClientIP
+			}
+			if ra.ClientSubnet != rb.ClientSubnet {
+				return ra.ClientSubnet < rb.ClientSubnet
+			}
+			return ra.HwAddr < rb.HwAddr
+		})
+		ret = append(ret, rollup)
+	}
+	return ret
+}
@@ -0,0 +1,111 @@
+package flowstats
+
+import (
+	"net"
+	"testing"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+)
+
+// newTestClientPacket returns a packet of the test service from the client ip
+func newTestClientPacket(ip string, dir int, length int64) *network.Packet {
+	pkt := newTestTCPPacket(1, dir, false, false)
+	pkt.MyIP = ip
+	pkt.MyAddr = net.ParseIP(ip)
+	pkt.Length = length
+	return pkt
+}
+
+func TestFlowcacheRollups(t *testing.T) {
+	flowcache := newTestFlowCache(t, "ConcurrentCacheMap")
+
+	if err := flowcache.SetRollups([]string{"unknown"}, true); err == nil {
+		t.Fatalf("Unknown rollup level accepted")
+	}
+	levels := []string{RollupServiceClient, RollupServiceSubnet, RollupService}
+	if err := flowcache.SetRollups(levels, false); err != nil {
+		t.Fatalf("Can not set the rollups: %s", err)
+	}
+	if flowcache.ExportsFlows() {
+		t.Fatalf("Flow records exported while disabled")
+	}
+
+	flowcache.ProcessPacket(newTestClientPacket("192.168.43.72", network.TrafficIn, 1000))
+	flowcache.ProcessPacket(newTestClientPacket("192.168.43.72", network.TrafficOut, 100))
+	flowcache.ProcessPacket(newTestClientPacket("192.168.43.73", network.TrafficIn, 500))
+	flowcache.ProcessPacket(newTestClientPacket("10.0.0.5", network.TrafficIn, 200))
+
+	flows, rollups := flowcache.DumpServices(nil)
+	if len(flows) != 0 {
+		t.Fatalf("Expected no flow records, got %d", len(flows))
+	}
+	if len(rollups) != len(levels) {
+		t.Fatalf("Expected %d rollups, got %d", len(levels), len(rollups))
+	}
+	expected := map[string]int{RollupServiceClient: 3, RollupServiceSubnet: 2, RollupService: 1}
+	for _, r := range rollups {
+		if len(r.Records) != expected[r.Level] {
+			t.Fatalf("Expected %d records at level %s, got %d", expected[r.Level], r.Level, len(r.Records))
+		}
+		var in, out, flows int64
+		for _, rec := range r.Records {
+			in += rec.InBytes
+			out += rec.OutBytes
+			flows += rec.Flows
+		}
+		if in != 1700 || out != 100 || flows != 3 {
+			t.Fatalf("Wrong totals at level %s: %d flows, %d bytes in, %d bytes out", r.Level, flows, in, out)
+		}
+	}
+	subnets := rollups[1].Records
+	if subnets[0].ClientSubnet != "10.0.0.0" || subnets[1].ClientSubnet != "192.168.43.0" || subnets[1].Flows != 2 {
+		t.Fatalf("Wrong subnet records %+v", subnets)
+	}
+
+	// The next dump only contains the traffic of its interval
+	flowcache.ProcessPacket(newTestClientPacket("10.0.0.5", network.TrafficOut, 50))
+	_, rollups = flowcache.DumpServices(nil)
+	service := rollups[2].Records
+	if len(service) != 1 || service[0].Flows != 1 || service[0].OutBytes != 50 || service[0].InBytes != 0 {
+		t.Fatalf("Wrong service records after the second dump %+v", service)
+	}
+}
+
+func TestFlowcacheRollupsDropped(t *testing.T) {
+	flowcache := newTestFlowCache(t, "ConcurrentCacheMap")
+	if err := flowcache.SetRollups([]string{RollupServiceClient, RollupService}, false); err != nil {
+		t.Fatalf("Can not set the rollups: %s", err)
+	}
+	if err := flowcache.SetLimits(1, 0, AdmissionDrop, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second client has no room in the cache
+	flowcache.ProcessPacket(newTestClientPacket("192.168.43.72", network.TrafficIn, 1000))
+	flowcache.ProcessPacket(newTestClientPacket("192.168.43.73", network.TrafficIn, 500))
+	flowcache.ProcessPacket(newTestClientPacket("192.168.43.73", network.TrafficOut, 100))
+
+	_, rollups := flowcache.DumpServices(nil)
+	clients := rollups[0].Records
+	if len(clients) != 2 {
+		t.Fatalf("Expected 2 client records, got %+v", clients)
+	}
+	if clients[0].Flows != 1 || clients[0].InBytes != 1000 || clients[0].DroppedPackets != 0 {
+		t.Fatalf("Wrong record of the admitted client %+v", clients[0])
+	}
+	if clients[1].Flows != 0 || clients[1].InBytes != 0 || clients[1].DroppedPackets != 2 || clients[1].DroppedBytes != 600 {
+		t.Fatalf("Wrong record of the rejected client %+v", clients[1])
+	}
+	service := rollups[1].Records
+	if len(service) != 1 || service[0].Flows != 1 || service[0].InBytes != 1000 || service[0].DroppedBytes != 600 {
+		t.Fatalf("Wrong service records %+v", service)
+	}
+
+	// The rejected traffic is only reported once
+	_, rollups = flowcache.DumpServices(nil)
+	for _, rec := range rollups[1].Records {
+		if rec.DroppedPackets != 0 {
+			t.Fatalf("Rejected traffic reported twice %+v", rec)
+		}
+	}
+}
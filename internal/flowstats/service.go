@@ -1,8 +1,30 @@
 package flowstats
 
+import (
+	"time"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/config"
+	"github.com/traffic-refinery/traffic-refinery/internal/counters"
+)
+
 type Service struct {
 	// Name of the service
 	Name string
-	// Collect is the list of counters to collect in string format
-	Collect []string
+	// Collect is the list of counters to collect with their parameters
+	Collect []counters.CounterConfig
+	// ActiveTimeout is the maximum duration of a flow record. 0 uses the
+	// timeout of the cache
+	ActiveTimeout time.Duration
+	// IdleTimeout is the time without packets after which a flow is
+	// terminated. 0 uses the timeout of the cache
+	IdleTimeout time.Duration
+}
+
+// CounterConfigs converts the counters of a service configuration
+func CounterConfigs(c []config.CounterConfig) []counters.CounterConfig {
+	ret := make([]counters.CounterConfig, 0, len(c))
+	for _, counter := range c {
+		ret = append(ret, counters.CounterConfig{Name: counter.Name, Params: counter.Params})
+	}
+	return ret
 }
@@ -1,7 +1,14 @@
 package flowstats
 
 import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
 )
 
 const fnvBasis = 14695981039346656037
@@ -58,3 +65,73 @@ func fnvHash(s []byte) (h uint64) {
 	}
 	return
 }
+
+const (
+	// FlowKeySize is the size of a FlowKey: two IPv6 sized addresses, two
+	// ports and the transport protocol
+	FlowKeySize = 2*net.IPv6len + 2 + 2 + 1
+
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// FlowKey is a fixed size binary representation of a flow 5-tuple.
+// IPv4 addresses are stored in their IPv4-mapped IPv6 form
+type FlowKey [FlowKeySize]byte
+
+// putAddr writes ip in the 16 bytes of dst
+func putAddr(dst []byte, ip net.IP) {
+	if len(ip) == net.IPv4len {
+		for i := 0; i < 10; i++ {
+			dst[i] = 0
+		}
+		dst[10] = 0xff
+		dst[11] = 0xff
+		copy(dst[12:16], ip)
+	} else {
+		copy(dst[0:16], ip)
+	}
+}
+
+// NewFlowKey generates the FlowKey of the flow packet pkt belongs to
+func NewFlowKey(pkt *network.Packet) (k FlowKey) {
+	putAddr(k[0:16], pkt.ServiceAddr)
+	putAddr(k[16:32], pkt.MyAddr)
+	binary.BigEndian.PutUint16(k[32:34], pkt.ServicePort)
+	binary.BigEndian.PutUint16(k[34:36], pkt.MyPort)
+	if pkt.IsTCP {
+		k[36] = protoTCP
+	} else {
+		k[36] = protoUDP
+	}
+	return
+}
+
+// TupleFlow returns the TupleFlow corresponding to the key
+func (k *FlowKey) TupleFlow() (f TupleFlow) {
+	f = NewTupleFlow(k[0:16], k[16:32], k[32:34], k[34:36])
+	if k[36] == protoTCP {
+		f.typ = layers.EndpointTCPPort
+	} else {
+		f.typ = layers.EndpointUDPPort
+	}
+	return
+}
+
+// FastHash returns the symmetric hash of the key's 5-tuple
+func (k *FlowKey) FastHash() uint64 {
+	return k.TupleFlow().FastHash()
+}
+
+// String returns the hex representation of the key
+func (k *FlowKey) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+// flowKeyHash is the hash function used to shard flows in the cache.
+// key must be the string conversion of a FlowKey
+func flowKeyHash(key string) uint64 {
+	var k FlowKey
+	copy(k[:], key)
+	return k.FastHash()
+}
@@ -0,0 +1,109 @@
+package flowstats
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+	"github.com/traffic-refinery/traffic-refinery/internal/servicemap"
+)
+
+func TestFlowKeyProtocol(t *testing.T) {
+	pkt := &network.Packet{
+		ServiceAddr: net.ParseIP("198.38.120.133").To4(),
+		MyAddr:      net.ParseIP("192.168.43.72").To4(),
+		ServicePort: 443,
+		MyPort:      51751,
+		IsTCP:       true,
+	}
+	tcpKey := NewFlowKey(pkt)
+	pkt.IsTCP = false
+	udpKey := NewFlowKey(pkt)
+	if tcpKey == udpKey {
+		t.Fatalf("TCP and UDP flows on the same ports share the key %s", &tcpKey)
+	}
+}
+
+func TestFlowKeyAddressForm(t *testing.T) {
+	pkt4 := &network.Packet{
+		ServiceAddr: net.ParseIP("198.38.120.133").To4(),
+		MyAddr:      net.ParseIP("192.168.43.72").To4(),
+		ServicePort: 443,
+		MyPort:      51751,
+		IsTCP:       true,
+	}
+	pkt16 := &network.Packet{
+		ServiceAddr: net.ParseIP("198.38.120.133"),
+		MyAddr:      net.ParseIP("192.168.43.72"),
+		ServicePort: 443,
+		MyPort:      51751,
+		IsTCP:       true,
+	}
+	if k4, k16 := NewFlowKey(pkt4), NewFlowKey(pkt16); k4 != k16 {
+		t.Fatalf("Keys %s and %s of the same IPv4 flow are different", &k4, &k16)
+	}
+}
+
+func TestFlowKeyHashSymmetric(t *testing.T) {
+	pkt := &network.Packet{
+		ServiceAddr: net.ParseIP("198.38.120.133"),
+		MyAddr:      net.ParseIP("192.168.43.72"),
+		ServicePort: 443,
+		MyPort:      51751,
+		IsTCP:       true,
+	}
+	key := NewFlowKey(pkt)
+	pkt.ServiceAddr, pkt.MyAddr = pkt.MyAddr, pkt.ServiceAddr
+	pkt.ServicePort, pkt.MyPort = pkt.MyPort, pkt.ServicePort
+	reversed := NewFlowKey(pkt)
+	if key.FastHash() != reversed.FastHash() {
+		t.Fatalf("Hash of %s and %s should be the same", &key, &reversed)
+	}
+	if flowKeyHash(string(key[:])) != key.FastHash() {
+		t.Fatalf("Hash of the string key does not match the hash of the key")
+	}
+}
+
+func TestFlowKeyAnonymized(t *testing.T) {
+	smap, err := servicemap.NewServiceMap(10*time.Minute, 5*time.Minute, 1000, 4)
+	if err != nil {
+		t.Fatalf("Can not create the service map: %s", err)
+	}
+	smap.ConfigServiceMap([]servicemap.Service{{
+		Name:          "Test",
+		ServiceFilter: servicemap.Filter{Prefixes: []string{"198.38.120.0/24"}},
+		Code:          servicemap.ServiceID(0),
+	}})
+	flowcache, err := NewFlowCache("ConcurrentCacheMap", smap, 10*time.Minute, 0, 4, true)
+	if err != nil {
+		t.Fatalf("Can not create the flow cache: %s", err)
+	}
+	pkt := &network.Packet{
+		ServiceIP:   "198.38.120.133",
+		ServiceAddr: net.ParseIP("198.38.120.133"),
+		MyIP:        "192.168.43.72",
+		MyAddr:      net.ParseIP("192.168.43.72"),
+		ServicePort: 443,
+		MyPort:      51751,
+		IsTCP:       true,
+		Dir:         network.TrafficIn,
+	}
+	raw := NewFlowKey(pkt)
+	flowcache.ProcessPacket(pkt)
+
+	// The flow table keeps the original addresses, the exported flow Id is
+	// not built from them
+	flows := flowcache.DumpToString()
+	if len(flows) != 1 {
+		t.Fatalf("Expected 1 flow, found %d", len(flows))
+	}
+	of := OutFlow{}
+	if err := json.Unmarshal(flows[0], &of); err != nil {
+		t.Fatalf("Can not unmarshal the flow: %s", err)
+	}
+	if of.Id == raw.String() || of.LocalIP == "192.168.43.72" {
+		t.Fatalf("Flow %s exported with the address of the client %s", of.Id, of.LocalIP)
+	}
+}
@@ -0,0 +1,194 @@
+package flowstats
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/cache"
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+)
+
+// States of the tables owned by workers
+const (
+	// tableIdle means the owner of the table is not processing a packet
+	tableIdle = iota
+	// tableOwned means the owner of the table is processing a packet
+	tableOwned
+	// tableClaimed means a dump is using the table while the owner is idle
+	tableClaimed
+)
+
+const (
+	// tableRequests is the number of requests that can be pending for a
+	// table owned by a worker
+	tableRequests = 16
+	// handoffPoll is the interval at which a dump waiting for the owner of
+	// a table checks whether the owner went idle
+	handoffPoll = time.Millisecond
+)
+
+// flowTable is a table storing flows. Tables are either shared by all the
+// parsers, in which case the cache provides its own synchronization, or owned
+// by a single worker
+type flowTable struct {
+	cache cache.Cache
+	// requests hands the work on the table off to its owner, which runs it
+	// between two packets. nil for shared tables
+	requests chan func(c cache.Cache)
+	// state tells who is using a table owned by a worker. A dump only uses
+	// the table itself when the owner is idle, claim is held meanwhile so
+	// that a packet arriving during the dump waits for it
+	state int32
+	claim sync.Mutex
+	// flows is the number of flows in the table
+	flows int64
+	// index lists the flows of the table by service
+	index flowIndex
+}
+
+// FlowWorker processes the packets of a single parser, storing their flows in
+// a private table. The parsers must be fed by a NIC or fanout hashing that
+// keeps the packets of a flow on the same parser
+type FlowWorker struct {
+	fc    *FlowCache
+	table *flowTable
+}
+
+// ProcessPacket processes the packet pkt updating the flows of the worker
+func (w *FlowWorker) ProcessPacket(pkt *network.Packet) error {
+	return w.fc.processPacket(w.table, pkt)
+}
+
+// newWorkerTable creates a table owned by a single worker
+func (fc *FlowCache) newWorkerTable() *flowTable {
+	t := &flowTable{requests: make(chan func(c cache.Cache), tableRequests)}
+	t.cache = cache.NewMap(fc.evictTime, fc.onEvicted(t))
+	return t
+}
+
+// NewWorker returns the packet processor to be used by a parser. With the
+// "PerWorker" cache type each parser gets a private flow table, otherwise all
+// parsers share the cache
+func (fc *FlowCache) NewWorker() network.PacketProcessor {
+	if !fc.perWorker {
+		return fc
+	}
+	w := &FlowWorker{fc: fc, table: fc.newWorkerTable()}
+	fc.tablesLock.Lock()
+	fc.tables = append(fc.tables, w.table)
+	fc.tablesLock.Unlock()
+	return w
+}
+
+// owned returns true if the table is owned by a worker
+func (t *flowTable) owned() bool {
+	return t.requests != nil
+}
+
+// acquire marks the table as in use by its owner, waiting for a dump that
+// claimed the table while the owner was idle
+func (t *flowTable) acquire() {
+	for !atomic.CompareAndSwapInt32(&t.state, tableIdle, tableOwned) {
+		t.claim.Lock()
+		t.claim.Unlock()
+	}
+}
+
+// release marks the table as idle
+func (t *flowTable) release() {
+	atomic.StoreInt32(&t.state, tableIdle)
+}
+
+// serve runs the pending requests. Must be called by the goroutine using the
+// table
+func (t *flowTable) serve() {
+	for {
+		select {
+		case r := <-t.requests:
+			r(t.cache)
+		default:
+			return
+		}
+	}
+}
+
+// post queues the request r for the owner of the table without waiting, and
+// returns false if too many requests are pending
+func (t *flowTable) post(r func(c cache.Cache)) bool {
+	select {
+	case t.requests <- r:
+		return true
+	default:
+		return false
+	}
+}
+
+// tryServe runs the pending requests if the owner of the table is idle
+func (t *flowTable) tryServe() {
+	t.claim.Lock()
+	defer t.claim.Unlock()
+	if atomic.CompareAndSwapInt32(&t.state, tableIdle, tableClaimed) {
+		t.serve()
+		atomic.StoreInt32(&t.state, tableIdle)
+	}
+}
+
+// run calls f on the cache of the table and waits for it to complete. On the
+// tables owned by workers f is run by the owner between two packets, so that
+// the owner never waits for a dump while it is processing traffic. If the
+// owner is idle f is run by the caller instead
+func (t *flowTable) run(f func(c cache.Cache)) {
+	if !t.owned() {
+		f(t.cache)
+		return
+	}
+	done := make(chan struct{})
+	r := func(c cache.Cache) {
+		f(c)
+		close(done)
+	}
+	ticker := time.NewTicker(handoffPoll)
+	defer ticker.Stop()
+	for queued := false; ; {
+		if !queued {
+			queued = t.post(r)
+		}
+		t.tryServe()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// eachTable calls f on the cache of each table, one table at a time
+func (fc *FlowCache) eachTable(f func(c cache.Cache)) {
+	for _, t := range fc.allTables() {
+		t.run(f)
+	}
+}
+
+// allTables returns the tables of the cache
+func (fc *FlowCache) allTables() []*flowTable {
+	fc.tablesLock.Lock()
+	defer fc.tablesLock.Unlock()
+	return append([]*flowTable{}, fc.tables...)
+}
+
+// purgeWorkerTables removes the flows not updated for longer than the eviction
+// time from the tables owned by workers, that have no cleanup timer
+func (fc *FlowCache) purgeWorkerTables() {
+	if !fc.perWorker {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&fc.lastCleanup)
+	if now-last < int64(fc.cleanupTime) || !atomic.CompareAndSwapInt64(&fc.lastCleanup, last, now) {
+		return
+	}
+	fc.eachTable(func(c cache.Cache) {
+		c.PurgeExpired()
+	})
+}
@@ -0,0 +1,129 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Anonymizer anonymizes IP addresses with Crypto-PAn using a key loaded from
+// a file or generated at startup. The key can optionally be replaced with a
+// newly generated one periodically
+type Anonymizer struct {
+	cpan     *Cryptopan
+	rotation time.Duration
+	stop     chan bool
+	sync.RWMutex
+}
+
+// LoadCryptoPAnKey reads a Crypto-PAn key from the file path. The file
+// contains either the raw key or its hex encoding
+func LoadCryptoPAnKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == Size {
+		return data, nil
+	}
+	text := bytes.TrimSpace(data)
+	key := make([]byte, hex.DecodedLen(len(text)))
+	if _, err := hex.Decode(key, text); err != nil {
+		return nil, KeySizeError(len(data))
+	}
+	if len(key) != Size {
+		return nil, KeySizeError(len(key))
+	}
+	return key, nil
+}
+
+// GenerateCryptoPAnKey returns a new random Crypto-PAn key
+func GenerateCryptoPAnKey() ([]byte, error) {
+	key := make([]byte, Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// NewAnonymizer creates a new Anonymizer. keyFile is the path of the file
+// containing the key, if empty a random key is generated. If rotation is
+// greater than 0 the key is replaced with a newly generated one every rotation
+func NewAnonymizer(keyFile string, rotation time.Duration) (*Anonymizer, error) {
+	var key []byte
+	var err error
+	if keyFile != "" {
+		key, err = LoadCryptoPAnKey(keyFile)
+	} else {
+		key, err = GenerateCryptoPAnKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Anonymizer{}
+	if a.cpan, err = NewCryptoPAn(key); err != nil {
+		return nil, err
+	}
+	a.rotation = rotation
+	a.stop = make(chan bool)
+	if a.rotation > 0 {
+		a.runRotationTimer()
+	}
+	return a, nil
+}
+
+// Anonymize anonymizes the IP address addr with the current key
+func (a *Anonymizer) Anonymize(addr net.IP) net.IP {
+	a.RLock()
+	defer a.RUnlock()
+	return a.cpan.Anonymize(addr)
+}
+
+// Rotate replaces the current key with a newly generated one
+func (a *Anonymizer) Rotate() error {
+	key, err := GenerateCryptoPAnKey()
+	if err != nil {
+		return err
+	}
+	cpan, err := NewCryptoPAn(key)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	a.cpan = cpan
+	a.Unlock()
+	return nil
+}
+
+func (a *Anonymizer) runRotationTimer() {
+	go func() {
+		ticker := time.NewTicker(a.rotation)
+		for {
+			select {
+			case <-ticker.C:
+				if err := a.Rotate(); err != nil {
+					log.Errorf("Could not rotate the anonymization key: %s", err)
+				} else {
+					log.Infoln("Rotated the anonymization key")
+				}
+			case <-a.stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic key rotation
+func (a *Anonymizer) Stop() {
+	if a.rotation > 0 {
+		a.stop <- true
+	}
+}
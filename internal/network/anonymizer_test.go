@@ -0,0 +1,64 @@
+package network
+
+import (
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAnonymizerKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	rawFile := filepath.Join(dir, "key.raw")
+	hexFile := filepath.Join(dir, "key.hex")
+	if err := os.WriteFile(rawFile, testKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(hexFile, []byte(hex.EncodeToString(testKey)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	vectors := []testVector{
+		{"128.11.68.132", "135.242.180.132"},
+		{"192.102.249.13", "252.138.62.131"},
+		{"204.29.20.4", "243.33.20.123"},
+	}
+	for _, file := range []string{rawFile, hexFile} {
+		a, err := NewAnonymizer(file, 0)
+		if err != nil {
+			t.Fatalf("Can not load key from %s: %s", file, err)
+		}
+		for _, vec := range vectors {
+			if obfs := a.Anonymize(net.ParseIP(vec.origAddr)).String(); obfs != vec.obfsAddr {
+				t.Fatalf("Anonymizer with key from %s mapped %s to %s instead of %s", file, vec.origAddr, obfs, vec.obfsAddr)
+			}
+		}
+	}
+
+	shortFile := filepath.Join(dir, "key.short")
+	if err := os.WriteFile(shortFile, []byte("0011"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAnonymizer(shortFile, 0); err == nil {
+		t.Fatalf("Key of the wrong size should not be accepted")
+	}
+}
+
+func TestAnonymizerRotate(t *testing.T) {
+	a, err := NewAnonymizer("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := net.ParseIP("192.168.1.10")
+	before := a.Anonymize(addr)
+	if !before.Equal(a.Anonymize(addr)) {
+		t.Fatalf("Anonymization of %s is not consistent", addr)
+	}
+	if err := a.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if before.Equal(a.Anonymize(addr)) {
+		t.Fatalf("Anonymization of %s did not change after rotating the key", addr)
+	}
+}
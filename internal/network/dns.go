@@ -12,8 +12,9 @@ import (
 
 // DNSParser
 type DNSParser struct {
-	netif *NetworkInterface
-	sm    *servicemap.ServiceMap
+	netif      *NetworkInterface
+	sm         *servicemap.ServiceMap
+	processors []DNSProcessor
 }
 
 func (dp *DNSParser) NewDNSParser(netif *NetworkInterface, sm *servicemap.ServiceMap) {
@@ -21,6 +22,12 @@ func (dp *DNSParser) NewDNSParser(netif *NetworkInterface, sm *servicemap.Servic
 	dp.sm = sm
 }
 
+// AddProcessor registers a processor that receives every DNS message parsed.
+// Processors must be added before starting Parse
+func (dp *DNSParser) AddProcessor(processor DNSProcessor) {
+	dp.processors = append(dp.processors, processor)
+}
+
 // DNSParser is the worker function for parsing network traffic, focusing on dns traffic.
 // Reads directly from the NetworkInterface it has been assigned
 // The waitgroup is used to cleanly shut down.
@@ -56,7 +63,7 @@ loop:
 		// process data from ring
 		default:
 			// Read raw bytes from ring - NOT a gopacket.packet
-			pkt, _, err := dp.netif.ReadPacketData()
+			pkt, ci, err := dp.netif.ReadPacketData()
 
 			if err == io.EOF {
 				break
@@ -65,10 +72,28 @@ loop:
 			}
 
 			err = parser.DecodeLayers(pkt, &decoded)
+			src, dst := "", ""
 			for _, typ := range decoded {
 				switch typ {
+				case layers.LayerTypeIPv4:
+					src, dst = ip4.SrcIP.String(), ip4.DstIP.String()
+				case layers.LayerTypeIPv6:
+					src, dst = ip6.SrcIP.String(), ip6.DstIP.String()
 				case layers.LayerTypeDNS:
-					dp.sm.ParseDNSResponse(dns)
+					msg := DNSMessage{
+						Dns:    &dns,
+						TStamp: ci.Timestamp.UnixNano(),
+					}
+					if dns.QR {
+						// Responses travel from the resolver to the client
+						msg.Client, msg.Resolver = dst, src
+						msg.Services, _ = dp.sm.ParseDNSResponseForClient(dns, msg.Client)
+					} else {
+						msg.Client, msg.Resolver = src, dst
+					}
+					for _, processor := range dp.processors {
+						processor.ProcessDNS(&msg)
+					}
 				default:
 					continue
 				}
@@ -0,0 +1,23 @@
+package network
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/traffic-refinery/traffic-refinery/internal/servicemap"
+)
+
+// DNSMessage carries a decoded DNS message along with the endpoints that
+// exchanged it.
+// Dns is reused by the parser, processors must not keep references to it
+type DNSMessage struct {
+	Dns      *layers.DNS
+	TStamp   int64
+	Client   string
+	Resolver string
+	Services []servicemap.ServiceID
+}
+
+// General DNS Processor interface.
+// Implement to receive DNS messages from the DNS parser
+type DNSProcessor interface {
+	ProcessDNS(msg *DNSMessage) error
+}
@@ -45,7 +45,7 @@ func TestDNSCache(t *testing.T) {
 	var smap *servicemap.ServiceMap
 	var err error
 
-	if smap, err = servicemap.NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime); err != nil {
+	if smap, err = servicemap.NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime, c.DNSCache.MaxEntries, uint32(c.DNSCache.ShardsCount)); err != nil {
 		t.Fatalf("Fatal error in creating service map %s", err)
 	}
 	smap.ConfigServiceMap(smapServices)
@@ -88,7 +88,7 @@ func BenchmarkDNSCacheInsertsVideo(b *testing.B) {
 	var smap *servicemap.ServiceMap
 	var err error
 
-	if smap, err = servicemap.NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime); err != nil {
+	if smap, err = servicemap.NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime, c.DNSCache.MaxEntries, uint32(c.DNSCache.ShardsCount)); err != nil {
 		b.Fatalf("Fatal error in creating service map %s", err)
 	}
 	smap.ConfigServiceMap(smapServices)
@@ -131,7 +131,7 @@ func BenchmarkDNSCacheInsertsAds(b *testing.B) {
 	var smap *servicemap.ServiceMap
 	var err error
 
-	if smap, err = servicemap.NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime); err != nil {
+	if smap, err = servicemap.NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime, c.DNSCache.MaxEntries, uint32(c.DNSCache.ShardsCount)); err != nil {
 		b.Fatalf("Fatal error in creating service map %s", err)
 	}
 	smap.ConfigServiceMap(smapServices)
@@ -174,7 +174,7 @@ func BenchmarkDNSCacheLookups(b *testing.B) {
 	var smap *servicemap.ServiceMap
 	var err error
 
-	if smap, err = servicemap.NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime); err != nil {
+	if smap, err = servicemap.NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime, c.DNSCache.MaxEntries, uint32(c.DNSCache.ShardsCount)); err != nil {
 		b.Fatalf("Fatal error in creating service map %s", err)
 	}
 	smap.ConfigServiceMap(smapServices)
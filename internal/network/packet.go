@@ -1,6 +1,8 @@
 package network
 
 import (
+	"net"
+
 	"github.com/google/gopacket/layers"
 )
 
@@ -20,6 +22,8 @@ type Packet struct {
 	Length      int64
 	ServiceIP   string
 	MyIP        string
+	ServiceAddr net.IP
+	MyAddr      net.IP
 	IsTCP       bool
 	DataLength  int64
 	ServicePort uint16
@@ -47,6 +51,8 @@ func (packet *Packet) Clear() {
 	packet.Length = 0
 	packet.ServiceIP = ""
 	packet.MyIP = ""
+	packet.ServiceAddr = nil
+	packet.MyAddr = nil
 	packet.IsTCP = false
 	packet.DataLength = 0
 	packet.ServicePort = 0
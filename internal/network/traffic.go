@@ -2,6 +2,7 @@ package network
 
 import (
 	"io"
+	"net"
 	"sync"
 
 	"github.com/google/gopacket"
@@ -81,6 +82,14 @@ func (tp *TrafficParser) parseIpV6Layer(ip *layers.IPv6, dir int) (int64, string
 	return ipDataLen, sIp, mIp, isLocal, nil
 }
 
+// getAddresses returns the service and local addresses based on the direction
+func getAddresses(src, dst net.IP, dir int) (net.IP, net.IP) {
+	if dir == TrafficOut {
+		return dst, src
+	}
+	return src, dst
+}
+
 func (tp *TrafficParser) parseEthLayer(eth *layers.Ethernet, dir int) (string, error) {
 	var hwAddr string
 	if dir == TrafficOut {
@@ -154,6 +163,7 @@ loop:
 					pkt.HwAddr, parsingErr = tp.parseEthLayer(pkt.Eth, pkt.Dir)
 				case layers.LayerTypeIPv4:
 					pkt.Length, pkt.ServiceIP, pkt.MyIP, pkt.IsLocal, parsingErr = tp.parseIpV4Layer(pkt.Ip4, pkt.Dir)
+					pkt.ServiceAddr, pkt.MyAddr = getAddresses(pkt.Ip4.SrcIP, pkt.Ip4.DstIP, pkt.Dir)
 					pkt.IsIPv4 = true
 				case layers.LayerTypeTCP:
 					pkt.DataLength, pkt.ServicePort, pkt.MyPort, pkt.SeqNumber, parsingErr = tp.parseTcpLayer(pkt.Tcp, pkt.Length, pkt.Dir)
@@ -165,6 +175,7 @@ loop:
 					isValid = true
 				case layers.LayerTypeIPv6:
 					pkt.Length, pkt.ServiceIP, pkt.MyIP, pkt.IsLocal, parsingErr = tp.parseIpV6Layer(pkt.Ip6, pkt.Dir)
+					pkt.ServiceAddr, pkt.MyAddr = getAddresses(pkt.Ip6.SrcIP, pkt.Ip6.DstIP, pkt.Dir)
 					pkt.IsIPv4 = false
 				}
 			}
@@ -73,6 +73,7 @@ func (pktData *PacketData) parseIPLayer(pkt gopacket.Packet) error {
 			pktData.Pkt.ServiceIP = ip.DstIP.String()
 			pktData.Pkt.Dir = TrafficOut
 		}
+		pktData.Pkt.ServiceAddr, pktData.Pkt.MyAddr = getAddresses(ip.SrcIP, ip.DstIP, pktData.Pkt.Dir)
 		return nil
 	} else {
 		return errors.New("not an IP pkt")
@@ -202,6 +203,8 @@ func GetRandomPacket(len int) (pktData *PacketData) {
 	pktData.Pkt.Length = int64(len)
 	pktData.Pkt.ServiceIP = GetRandomIP()
 	pktData.Pkt.MyIP = GetRandomIP()
+	pktData.Pkt.ServiceAddr = net.ParseIP(pktData.Pkt.ServiceIP)
+	pktData.Pkt.MyAddr = net.ParseIP(pktData.Pkt.MyIP)
 	pktData.Pkt.IsIPv4 = true
 	pktData.Pkt.DataLength = int64(len) - 20
 	pktData.Pkt.ServicePort = GetRandomPort()
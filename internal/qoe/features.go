@@ -0,0 +1,129 @@
+package qoe
+
+import (
+	"math"
+	"sort"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/counters"
+	"github.com/traffic-refinery/traffic-refinery/internal/welford"
+)
+
+// StartupSegments is the number of segments at the start of a session used
+// to compute the startup features
+const StartupSegments = 5
+
+// FeatureNames are the features of a session available to the models.
+// Times are in seconds, sizes in bytes and rates in bits per second
+var FeatureNames = []string{
+	// Segments is the number of segments
+	"Segments",
+	// Duration is the time from the first request to the end of the last
+	// download
+	"Duration",
+	"Bytes",
+	// Bitrate is the average rate of the downloads over the session
+	"Bitrate",
+	// Throughput is the average rate of the downloads while downloading
+	"Throughput",
+	"SegmentSizeAvg",
+	"SegmentSizeStd",
+	"SegmentSizeMax",
+	"DownloadTimeAvg",
+	// InterRequestAvg and InterRequestStd describe the time between
+	// consecutive requests
+	"InterRequestAvg",
+	"InterRequestStd",
+	// IdleFraction is the fraction of the session without downloads
+	"IdleFraction",
+	// StartupBytes and StartupTime are the bytes of the first segments and
+	// the time to download them
+	"StartupBytes",
+	"StartupTime",
+}
+
+// Indexes of the features in FeatureNames
+const (
+	featSegments = iota
+	featDuration
+	featBytes
+	featBitrate
+	featThroughput
+	featSegmentSizeAvg
+	featSegmentSizeStd
+	featSegmentSizeMax
+	featDownloadTimeAvg
+	featInterRequestAvg
+	featInterRequestStd
+	featIdleFraction
+	featStartupBytes
+	featStartupTime
+)
+
+// seconds converts nanoseconds to seconds
+func seconds(ns int64) float64 {
+	return float64(ns) / 1e9
+}
+
+// Features computes the features of a session from its segments, indexed as
+// FeatureNames. The segments are sorted by request time
+func Features(segments []counters.VideoSegment) []float64 {
+	f := make([]float64, len(FeatureNames))
+	if len(segments) == 0 {
+		return f
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].TsStart < segments[j].TsStart
+	})
+
+	var size, download, interRequest welford.Welford
+	var bytes, busy, end, busyEnd int64
+	start := segments[0].TsStart
+	for i, s := range segments {
+		bytes += s.DonwBytes
+		size.AddValue(float64(s.DonwBytes))
+		segEnd := s.LastPkt
+		if segEnd < s.TsStart {
+			segEnd = s.TsStart
+		}
+		download.AddValue(seconds(segEnd - s.TsStart))
+		if i > 0 {
+			interRequest.AddValue(seconds(s.TsStart - segments[i-1].TsStart))
+		}
+		if float64(s.DonwBytes) > f[featSegmentSizeMax] {
+			f[featSegmentSizeMax] = float64(s.DonwBytes)
+		}
+		// Downloads of parallel flows overlap
+		if s.TsStart > busyEnd {
+			busy += segEnd - s.TsStart
+			busyEnd = segEnd
+		} else if segEnd > busyEnd {
+			busy += segEnd - busyEnd
+			busyEnd = segEnd
+		}
+		if segEnd > end {
+			end = segEnd
+		}
+		if i < StartupSegments {
+			f[featStartupBytes] = float64(bytes)
+			f[featStartupTime] = seconds(end - start)
+		}
+	}
+
+	duration := seconds(end - start)
+	f[featSegments] = float64(len(segments))
+	f[featDuration] = duration
+	f[featBytes] = float64(bytes)
+	if duration > 0 {
+		f[featBitrate] = float64(8*bytes) / duration
+		f[featIdleFraction] = math.Max(0, 1-seconds(busy)/duration)
+	}
+	if busy > 0 {
+		f[featThroughput] = float64(8*bytes) / seconds(busy)
+	}
+	f[featSegmentSizeAvg] = size.Avg
+	f[featSegmentSizeStd] = size.StdDev
+	f[featDownloadTimeAvg] = download.Avg
+	f[featInterRequestAvg] = interRequest.Avg
+	f[featInterRequestStd] = interRequest.StdDev
+	return f
+}
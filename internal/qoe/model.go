@@ -0,0 +1,214 @@
+// Package qoe infers the quality of experience of video sessions from the
+// segments downloaded by their flows
+package qoe
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Tree is a binary decision tree stored as arrays indexed by node, in the
+// layout exported by common machine learning libraries. Node 0 is the root.
+// Internal nodes go to Left[i] if the feature Feature[i] is lower or equal
+// than Threshold[i], to Right[i] otherwise. Leaves have Left[i] set to -1 and
+// their prediction in Value[i]
+type Tree struct {
+	Feature   []int
+	Threshold []float64
+	Left      []int
+	Right     []int
+	Value     [][]float64
+}
+
+// Ensemble is a set of trees whose predictions are averaged. The leaves of
+// classifiers contain the probability of each of the Classes, the leaves of
+// regressors a single value
+type Ensemble struct {
+	Classes []string
+	Trees   []Tree
+}
+
+// Model is the inference model of the video QoE. Trees refer to the features
+// by their index in Features, which must be in FeatureNames
+type Model struct {
+	Features []string
+	// MinSegmentBytes is the minimum size of the segments used for the
+	// inference. Smaller downloads, e.g. manifests, are ignored
+	MinSegmentBytes int64
+	// StartupDelay predicts the startup delay in seconds
+	StartupDelay Ensemble
+	// Resolution classifies the resolution of the session
+	Resolution Ensemble
+	// Rebuffering predicts the likelihood of rebuffering events
+	Rebuffering Ensemble
+	// Live predicts the likelihood that the session is live streaming
+	Live Ensemble
+
+	// features maps the indexes of Features to the ones of FeatureNames
+	features []int
+}
+
+// LoadModel loads the JSON model in the file path
+func LoadModel(path string) (*Model, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Model{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("can not parse the model %s: %w", path, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid model %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// Validate checks that the model is well formed
+func (m *Model) Validate() error {
+	m.features = make([]int, len(m.Features))
+	for i, name := range m.Features {
+		m.features[i] = -1
+		for j, known := range FeatureNames {
+			if name == known {
+				m.features[i] = j
+			}
+		}
+		if m.features[i] < 0 {
+			return errors.New("unknown feature " + name)
+		}
+	}
+	for _, e := range []struct {
+		name       string
+		ensemble   *Ensemble
+		classifier bool
+	}{
+		{"StartupDelay", &m.StartupDelay, false},
+		{"Resolution", &m.Resolution, true},
+		{"Rebuffering", &m.Rebuffering, false},
+		{"Live", &m.Live, false},
+	} {
+		if err := e.ensemble.validate(len(m.Features)); err != nil {
+			return fmt.Errorf("%s: %w", e.name, err)
+		}
+		if e.classifier != (len(e.ensemble.Classes) > 0) {
+			if e.classifier {
+				return errors.New(e.name + " must be a classifier")
+			}
+			return errors.New(e.name + " must be a regressor")
+		}
+	}
+	return nil
+}
+
+// validate checks the trees of the ensemble, using n features
+func (e *Ensemble) validate(n int) error {
+	if len(e.Trees) == 0 {
+		return errors.New("no trees")
+	}
+	values := len(e.Classes)
+	if values == 0 {
+		values = 1
+	}
+	for i, t := range e.Trees {
+		nodes := len(t.Left)
+		if nodes == 0 || len(t.Right) != nodes || len(t.Feature) != nodes || len(t.Threshold) != nodes || len(t.Value) != nodes {
+			return fmt.Errorf("tree %d has arrays of different lengths", i)
+		}
+		for j := 0; j < nodes; j++ {
+			if t.Left[j] < 0 {
+				if len(t.Value[j]) != values {
+					return fmt.Errorf("tree %d leaf %d has %d values instead of %d", i, j, len(t.Value[j]), values)
+				}
+				continue
+			}
+			// Children following their parent guarantee that every path
+			// ends in a leaf
+			if t.Left[j] <= j || t.Left[j] >= nodes || t.Right[j] <= j || t.Right[j] >= nodes {
+				return fmt.Errorf("tree %d node %d has invalid children", i, j)
+			}
+			if t.Feature[j] < 0 || t.Feature[j] >= n {
+				return fmt.Errorf("tree %d node %d has invalid feature %d", i, j, t.Feature[j])
+			}
+		}
+	}
+	return nil
+}
+
+// predict returns the leaf of the tree reached by x
+func (t *Tree) predict(x []float64) []float64 {
+	i := 0
+	for t.Left[i] >= 0 {
+		if x[t.Feature[i]] <= t.Threshold[i] {
+			i = t.Left[i]
+		} else {
+			i = t.Right[i]
+		}
+	}
+	return t.Value[i]
+}
+
+// predict returns the average of the predictions of the trees
+func (e *Ensemble) predict(x []float64) []float64 {
+	var ret []float64
+	for i := range e.Trees {
+		leaf := e.Trees[i].predict(x)
+		if ret == nil {
+			ret = make([]float64, len(leaf))
+		}
+		for j, v := range leaf {
+			ret[j] += v / float64(len(e.Trees))
+		}
+	}
+	return ret
+}
+
+// class returns the most likely class predicted by the ensemble
+func (e *Ensemble) class(x []float64) string {
+	p := e.predict(x)
+	best := 0
+	for i := range p {
+		if p[i] > p[best] {
+			best = i
+		}
+	}
+	return e.Classes[best]
+}
+
+// Infer computes the QoE of a session with the features f, indexed as
+// FeatureNames
+func (m *Model) Infer(f []float64) Inference {
+	x := make([]float64, len(m.features))
+	for i, j := range m.features {
+		x[i] = f[j]
+	}
+	return Inference{
+		StartupDelay: m.StartupDelay.predict(x)[0],
+		Resolution:   m.Resolution.class(x),
+		Rebuffering:  clamp(m.Rebuffering.predict(x)[0]),
+		Live:         m.Live.predict(x)[0] >= 0.5,
+	}
+}
+
+// clamp limits a likelihood to [0, 1]
+func clamp(p float64) float64 {
+	if p < 0 {
+		return 0
+	}
+	if p > 1 {
+		return 1
+	}
+	return p
+}
+
+// Inference is the QoE inferred for a session
+type Inference struct {
+	// StartupDelay is in seconds
+	StartupDelay float64
+	Resolution   string
+	// Rebuffering is the likelihood of rebuffering events in [0, 1]
+	Rebuffering float64
+	Live        bool
+}
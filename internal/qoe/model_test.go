@@ -0,0 +1,76 @@
+package qoe
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/utils"
+)
+
+// testModel is the path of the model used by the tests
+var testModel = utils.GetRepoPath() + "/test/qoe/video_qoe_model.json"
+
+func TestLoadModel(t *testing.T) {
+	m, err := LoadModel(testModel)
+	if err != nil {
+		t.Fatalf("Can not load the model: %s", err)
+	}
+	f := make([]float64, len(FeatureNames))
+	f[featStartupTime] = 3
+	f[featBitrate] = 5e6
+	f[featIdleFraction] = 0.5
+	f[featInterRequestStd] = 0.1
+	qoe := m.Infer(f)
+	if qoe.StartupDelay != 4 || qoe.Resolution != "1080p" || qoe.Rebuffering != 0.1 || !qoe.Live {
+		t.Fatalf("Wrong inference %+v", qoe)
+	}
+	f[featBitrate] = 2e6
+	if qoe := m.Infer(f); qoe.Resolution != "720p" {
+		t.Fatalf("Wrong resolution %s", qoe.Resolution)
+	}
+
+	if _, err := LoadModel(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatalf("Missing model loaded")
+	}
+}
+
+func TestValidateModel(t *testing.T) {
+	leaf := Tree{Feature: []int{-2}, Threshold: []float64{0}, Left: []int{-1}, Right: []int{-1}, Value: [][]float64{{1}}}
+	valid := func() *Model {
+		return &Model{
+			Features:     []string{"Bitrate"},
+			StartupDelay: Ensemble{Trees: []Tree{leaf}},
+			Resolution: Ensemble{Classes: []string{"sd"}, Trees: []Tree{{
+				Feature: []int{0, -2, -2}, Threshold: []float64{1e6, 0, 0},
+				Left: []int{1, -1, -1}, Right: []int{2, -1, -1}, Value: [][]float64{nil, {1}, {1}},
+			}}},
+			Rebuffering: Ensemble{Trees: []Tree{leaf}},
+			Live:        Ensemble{Trees: []Tree{leaf}},
+		}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("Valid model rejected: %s", err)
+	}
+	for name, change := range map[string]func(m *Model){
+		"unknown feature":       func(m *Model) { m.Features = []string{"Resolution"} },
+		"no trees":              func(m *Model) { m.Live.Trees = nil },
+		"regressor resolution":  func(m *Model) { m.Resolution.Classes = nil },
+		"classifier live":       func(m *Model) { m.Live.Classes = []string{"yes"} },
+		"loop":                  func(m *Model) { m.Resolution.Trees[0].Left[0] = 0 },
+		"missing feature":       func(m *Model) { m.Resolution.Trees[0].Feature[0] = 1 },
+		"wrong number of value": func(m *Model) { m.Resolution.Trees[0].Value[1] = []float64{0.5, 0.5} },
+	} {
+		m := valid()
+		change(m)
+		if err := m.Validate(); err == nil {
+			t.Fatalf("Model with %s accepted", name)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "model.json")
+	os.WriteFile(path, []byte(`{"Features": ["Bitrate"]}`), 0644)
+	if _, err := LoadModel(path); err == nil {
+		t.Fatalf("Model without trees loaded")
+	}
+}
@@ -0,0 +1,160 @@
+package qoe
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/counters"
+)
+
+// MaxSessionSegments bounds the number of segments kept for a session. Later
+// segments are ignored
+const MaxSessionSegments = 10000
+
+// SessionKey identifies a video session: the flows of a client to a service
+type SessionKey struct {
+	Service  string
+	ClientIP string
+}
+
+// segmentKey identifies a segment. Segments are collected from the counters
+// of their flow until they complete, so the last update replaces the
+// previous ones
+type segmentKey struct {
+	flow    string
+	tsStart int64
+}
+
+// session contains the segments of a session in progress
+type session struct {
+	segments map[segmentKey]counters.VideoSegment
+	flows    map[string]bool
+	last     int64
+}
+
+// SessionOut is the record of a video session
+type SessionOut struct {
+	SessionKey
+	// Start and End are the timestamps of the first request and of the end
+	// of the last download
+	Start    int64
+	End      int64
+	Flows    int
+	Segments int
+	Bytes    int64
+	// Bitrate is the average rate of the downloads in bits per second
+	Bitrate float64
+	Inference
+}
+
+// Sessions groups the segments of the video flows in sessions and infers
+// their QoE with a model when they end. A session ends when none of its
+// flows downloads a segment for longer than the timeout. Sessions is safe
+// for concurrent use
+type Sessions struct {
+	model    *Model
+	timeout  int64
+	sessions map[SessionKey]*session
+	// ended are the sessions ended while adding segments
+	ended []SessionOut
+	sync.Mutex
+}
+
+// NewSessions creates a Sessions inferring the QoE with model and ending the
+// sessions after timeout without downloads
+func NewSessions(model *Model, timeout time.Duration) (*Sessions, error) {
+	if model == nil {
+		return nil, errors.New("no QoE model")
+	}
+	if timeout <= 0 {
+		return nil, errors.New("the session timeout must be positive")
+	}
+	return &Sessions{
+		model:    model,
+		timeout:  int64(timeout),
+		sessions: make(map[SessionKey]*session),
+	}, nil
+}
+
+// activity returns the timestamp of the last activity of a segment
+func activity(s counters.VideoSegment) int64 {
+	if s.LastPkt > s.TsStart {
+		return s.LastPkt
+	}
+	return s.TsStart
+}
+
+// Add adds the segments downloaded by the flow flowId in the session key
+func (ss *Sessions) Add(key SessionKey, flowId string, segments []counters.VideoSegment) {
+	ss.Lock()
+	defer ss.Unlock()
+	for _, seg := range segments {
+		if seg.DownPkts == 0 || seg.DonwBytes < ss.model.MinSegmentBytes {
+			continue
+		}
+		s, ok := ss.sessions[key]
+		if ok && activity(seg)-s.last > ss.timeout {
+			ss.ended = append(ss.ended, ss.infer(key, s))
+			ok = false
+		}
+		if !ok {
+			s = &session{
+				segments: make(map[segmentKey]counters.VideoSegment),
+				flows:    make(map[string]bool),
+			}
+			ss.sessions[key] = s
+		}
+		sk := segmentKey{flow: flowId, tsStart: seg.TsStart}
+		if _, ok := s.segments[sk]; !ok && len(s.segments) >= MaxSessionSegments {
+			continue
+		}
+		s.segments[sk] = seg
+		s.flows[flowId] = true
+		if a := activity(seg); a > s.last {
+			s.last = a
+		}
+	}
+}
+
+// infer computes the record of the session s
+func (ss *Sessions) infer(key SessionKey, s *session) SessionOut {
+	segments := make([]counters.VideoSegment, 0, len(s.segments))
+	for _, seg := range s.segments {
+		segments = append(segments, seg)
+	}
+	f := Features(segments)
+	return SessionOut{
+		SessionKey: key,
+		Start:      segments[0].TsStart,
+		End:        s.last,
+		Flows:      len(s.flows),
+		Segments:   len(segments),
+		Bytes:      int64(f[featBytes]),
+		Bitrate:    f[featBitrate],
+		Inference:  ss.model.Infer(f),
+	}
+}
+
+// Collect returns the records of the sessions ended at the timestamp now.
+// flush ends all the sessions
+func (ss *Sessions) Collect(now int64, flush bool) []SessionOut {
+	ss.Lock()
+	defer ss.Unlock()
+	out := ss.ended
+	ss.ended = nil
+	for key, s := range ss.sessions {
+		if flush || now-s.last > ss.timeout {
+			out = append(out, ss.infer(key, s))
+			delete(ss.sessions, key)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Start < out[j].Start
+	})
+	if out == nil {
+		out = []SessionOut{}
+	}
+	return out
+}
@@ -0,0 +1,100 @@
+package qoe
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/counters"
+)
+
+// segment returns a segment requested at start seconds downloading bytes
+// until end seconds
+func segment(start, end float64, bytes int64) counters.VideoSegment {
+	return counters.VideoSegment{
+		TsStart:   int64(start * 1e9),
+		LastPkt:   int64(end * 1e9),
+		DownPkts:  bytes / 1000,
+		DonwBytes: bytes,
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	f := Features([]counters.VideoSegment{
+		segment(4, 6, 200000),
+		segment(0, 1, 100000),
+		// Parallel download on another flow
+		segment(0.5, 2, 100000),
+		segment(8, 10, 100000),
+	})
+	expected := map[int]float64{
+		featSegments:        4,
+		featDuration:        10,
+		featBytes:           500000,
+		featBitrate:         400000,
+		featThroughput:      4e6 / 6,
+		featSegmentSizeMax:  200000,
+		featIdleFraction:    0.4,
+		featStartupBytes:    500000,
+		featStartupTime:     10,
+		featInterRequestAvg: 8.0 / 3,
+	}
+	for i, v := range expected {
+		if math.Abs(f[i]-v) > 1e-6 {
+			t.Fatalf("Wrong feature %s: %f instead of %f", FeatureNames[i], f[i], v)
+		}
+	}
+	if f := Features(nil); len(f) != len(FeatureNames) || f[featSegments] != 0 {
+		t.Fatalf("Wrong features of an empty session %v", f)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	m, err := LoadModel(testModel)
+	if err != nil {
+		t.Fatalf("Can not load the model: %s", err)
+	}
+	if _, err := NewSessions(nil, time.Minute); err == nil {
+		t.Fatalf("Sessions without model created")
+	}
+	ss, err := NewSessions(m, 30*time.Second)
+	if err != nil {
+		t.Fatalf("Can not create the sessions: %s", err)
+	}
+	key := SessionKey{Service: "Video", ClientIP: "10.0.0.1"}
+	// The download in progress is updated by the next dump
+	ss.Add(key, "flow1", []counters.VideoSegment{segment(0, 1, 500000), segment(2, 2.5, 300000)})
+	ss.Add(key, "flow1", []counters.VideoSegment{segment(2, 3, 600000)})
+	// Small downloads are not segments
+	ss.Add(key, "flow2", []counters.VideoSegment{segment(3, 3.1, 5000), segment(4, 5, 500000)})
+	ss.Add(SessionKey{Service: "Video", ClientIP: "10.0.0.2"}, "flow3", []counters.VideoSegment{segment(20, 21, 500000)})
+
+	if out := ss.Collect(int64(30*time.Second), false); len(out) != 0 {
+		t.Fatalf("Sessions ended before their timeout %+v", out)
+	}
+	out := ss.Collect(int64(40*time.Second), false)
+	if len(out) != 1 {
+		t.Fatalf("Expected 1 ended session, got %d", len(out))
+	}
+	s := out[0]
+	if s.SessionKey != key || s.Flows != 2 || s.Segments != 3 || s.Bytes != 1600000 {
+		t.Fatalf("Wrong session %+v", s)
+	}
+	if s.Start != 0 || s.End != int64(5*time.Second) || s.Bitrate != 1600000*8/5 {
+		t.Fatalf("Wrong session times %d %d or bitrate %f", s.Start, s.End, s.Bitrate)
+	}
+	if s.StartupDelay != 4 || s.Resolution != "720p" {
+		t.Fatalf("Wrong inference %+v", s.Inference)
+	}
+
+	// A client coming back after the timeout starts a new session
+	ss.Add(key, "flow4", []counters.VideoSegment{segment(100, 101, 500000)})
+	ss.Add(key, "flow4", []counters.VideoSegment{segment(200, 201, 500000)})
+	out = ss.Collect(int64(200*time.Second), true)
+	if len(out) != 3 || out[0].ClientIP != "10.0.0.2" || out[1].Start != int64(100*time.Second) || out[2].Segments != 1 {
+		t.Fatalf("Wrong sessions after the timeout %+v", out)
+	}
+	if out := ss.Collect(0, true); len(out) != 0 {
+		t.Fatalf("Sessions collected twice")
+	}
+}
@@ -34,7 +34,7 @@ func TestDNSCacheInsert(t *testing.T) {
 	var smap *ServiceMap
 	var err error
 
-	if smap, err = NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime); err != nil {
+	if smap, err = NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime, c.DNSCache.MaxEntries, uint32(c.DNSCache.ShardsCount)); err != nil {
 		t.Fatalf("Fatal error in creating service map %s", err)
 	}
 	smap.ConfigServiceMap(smapServices)
@@ -87,7 +87,7 @@ func TestDNSCacheNotFound(t *testing.T) {
 	var smap *ServiceMap
 	var err error
 
-	if smap, err = NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime); err != nil {
+	if smap, err = NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime, c.DNSCache.MaxEntries, uint32(c.DNSCache.ShardsCount)); err != nil {
 		t.Fatalf("Fatal error in creating service map %s", err)
 	}
 	smap.ConfigServiceMap(smapServices)
@@ -110,3 +110,74 @@ func TestDNSCacheNotFound(t *testing.T) {
 		t.Fatalf("IP 1.1.1.2 should not be in the dns map\n")
 	}
 }
+
+func TestDNSCachePerClient(t *testing.T) {
+	// Load test configuration
+	c := config.TrafficRefineryConfig{}
+	testConfig := utils.GetRepoPath() + "/test/config/trconfig_video.json"
+	c.ImportConfigFromFile(testConfig)
+
+	smapServices := []Service{}
+	for i, s := range c.Services {
+		smapServices = append(smapServices, Service{
+			Name: s.Name,
+			ServiceFilter: Filter{
+				DomainsString: s.Filter.DomainsString,
+				DomainsRegex:  s.Filter.DomainsRegex,
+				Prefixes:      s.Filter.Prefixes,
+			},
+			Code: ServiceID(i),
+		})
+	}
+
+	var smap *ServiceMap
+	var err error
+	if smap, err = NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime, c.DNSCache.MaxEntries, uint32(c.DNSCache.ShardsCount)); err != nil {
+		t.Fatalf("Fatal error in creating service map %s", err)
+	}
+	smap.ConfigServiceMap(smapServices)
+	smap.SetPerClient(true)
+
+	// Two clients resolve domains of different services to the same IP
+	smap.ParseDNSResponseForClient(layers.DNS{
+		Answers: []layers.DNSResourceRecord{
+			{
+				IP:  net.ParseIP("1.1.1.1"),
+				TTL: 1000000,
+			},
+		},
+		Questions: []layers.DNSQuestion{
+			{
+				Name: []byte("api-global.netflix.com"),
+			},
+		},
+	}, "192.168.1.2")
+	smap.ParseDNSResponseForClient(layers.DNS{
+		Answers: []layers.DNSResourceRecord{
+			{
+				IP:  net.ParseIP("1.1.1.1"),
+				TTL: 1000000,
+			},
+		},
+		Questions: []layers.DNSQuestion{
+			{
+				Name: []byte("www.youtube.com"),
+			},
+		},
+	}, "192.168.1.3")
+
+	for client, expected := range map[string]string{
+		"192.168.1.2": "Netflix",
+		"192.168.1.3": "Youtube",
+		// Clients with no resolution of their own use the latest answer
+		"192.168.1.4": "Youtube",
+	} {
+		if ids, found := smap.LookupClientIP(client, "1.1.1.1"); found {
+			if name, found := smap.GetName(ids[0]); !found || name != expected {
+				t.Fatalf("IP 1.1.1.1 for client %s should be %s and instead is %s\n", client, expected, name)
+			}
+		} else {
+			t.Fatalf("IP 1.1.1.1 for client %s is not found in the dns map\n", client)
+		}
+	}
+}
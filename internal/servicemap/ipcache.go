@@ -12,17 +12,30 @@ type IPCache struct {
 	IPCacheMap *cache.SimpleTimeCache
 }
 
-func NewIPCache(cleanupTime, evictTime time.Duration) (*IPCache, error) {
+// NewIPCache generates a new IPCache holding at most maxEntries entries.
+// A maxEntries of 0 disables the limit
+func NewIPCache(cleanupTime, evictTime time.Duration, maxEntries int, shardsCount uint32) (*IPCache, error) {
 	dc := &IPCache{}
-	dc.IPCacheMap = cache.NewSimpleTimeCache(cleanupTime, evictTime)
+	dc.IPCacheMap = cache.NewSimpleTimeCache(cleanupTime, evictTime, maxEntries, shardsCount)
 	return dc, nil
 }
 
+// clientKey returns the key used to store entries attributed to a single client
+func clientKey(client, ip string) string {
+	return client + "-" + ip
+}
+
 // Insert new entry in the IPCache
 func (dc *IPCache) Insert(ip string, services []ServiceID, ttl int64) {
 	dc.IPCacheMap.Insert(ip, services, ttl)
 }
 
+// InsertForClient inserts a new entry in the IPCache that is only valid for
+// the given client
+func (dc *IPCache) InsertForClient(client, ip string, services []ServiceID, ttl int64) {
+	dc.IPCacheMap.Insert(clientKey(client, ip), services, ttl)
+}
+
 // Lookup allows to lookup entries in the cache map
 func (dc *IPCache) Lookup(ip string) ([]ServiceID, bool) {
 	if entry, ok := dc.IPCacheMap.Lookup(ip); ok {
@@ -30,3 +43,13 @@ func (dc *IPCache) Lookup(ip string) ([]ServiceID, bool) {
 	}
 	return nil, false
 }
+
+// Stats returns the usage counters of the cache
+func (dc *IPCache) Stats() cache.SimpleTimeCacheStats {
+	return dc.IPCacheMap.Stats()
+}
+
+// LookupForClient allows to lookup entries inserted for a specific client
+func (dc *IPCache) LookupForClient(client, ip string) ([]ServiceID, bool) {
+	return dc.Lookup(clientKey(client, ip))
+}
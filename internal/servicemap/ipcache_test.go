@@ -35,7 +35,7 @@ func TestIPCacheExpire(t *testing.T) {
 	var smap *ServiceMap
 	var err error
 
-	if smap, err = NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime); err != nil {
+	if smap, err = NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime, c.DNSCache.MaxEntries, uint32(c.DNSCache.ShardsCount)); err != nil {
 		t.Fatalf("Fatal error in creating service map %s", err)
 	}
 	smap.ConfigServiceMap(smapServices)
@@ -29,7 +29,7 @@ func (dc *IPMap) addService(code ServiceID, prefixes []string) error {
 		if _, n, err := net.ParseCIDR(p); err == nil {
 			added := false
 			for i := range dc.prefixes {
-				if dc.prefixes[i].prefix.Network() == n.Network() {
+				if dc.prefixes[i].prefix.String() == n.String() {
 					// todo add check that is not in there already
 					dc.prefixes[i].services = append(dc.prefixes[i].services, code)
 					added = true
@@ -3,6 +3,7 @@ package servicemap
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/traffic-refinery/traffic-refinery/internal/config"
 	"github.com/traffic-refinery/traffic-refinery/internal/utils"
@@ -32,7 +33,7 @@ func TestIPMapInsert(t *testing.T) {
 	var smap *ServiceMap
 	var err error
 
-	if smap, err = NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime); err != nil {
+	if smap, err = NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime, c.DNSCache.MaxEntries, uint32(c.DNSCache.ShardsCount)); err != nil {
 		t.Fatalf("Fatal error in creating service map %s", err)
 	}
 	smap.ConfigServiceMap(smapServices)
@@ -71,7 +72,7 @@ func TestIPMapNotFound(t *testing.T) {
 	var smap *ServiceMap
 	var err error
 
-	if smap, err = NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime); err != nil {
+	if smap, err = NewServiceMap(c.DNSCache.EvictTime, c.DNSCache.CleanupTime, c.DNSCache.MaxEntries, uint32(c.DNSCache.ShardsCount)); err != nil {
 		t.Fatalf("Fatal error in creating service map %s", err)
 	}
 	smap.ConfigServiceMap(smapServices)
@@ -80,3 +81,24 @@ func TestIPMapNotFound(t *testing.T) {
 		t.Fatalf("IP 1.1.1.1 should not be in the ip map\n")
 	}
 }
+
+func TestIPMapDistinctPrefixes(t *testing.T) {
+	smap, err := NewServiceMap(10*time.Minute, 5*time.Minute, 1000, 4)
+	if err != nil {
+		t.Fatalf("Fatal error in creating service map %s", err)
+	}
+	smap.ConfigServiceMap([]Service{
+		{Name: "First", ServiceFilter: Filter{Prefixes: []string{"198.38.120.0/24"}}, Code: 0},
+		{Name: "Second", ServiceFilter: Filter{Prefixes: []string{"10.0.0.0/8"}}, Code: 1},
+	})
+
+	for ip, service := range map[string]string{"198.38.120.1": "First", "10.1.2.3": "Second"} {
+		ids, found := smap.LookupIP(ip)
+		if !found || len(ids) != 1 {
+			t.Fatalf("IP %s should match one service, found %v", ip, ids)
+		}
+		if name, _ := smap.GetName(ids[0]); name != service {
+			t.Fatalf("IP %s should be %s and instead is %s", ip, service, name)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/google/gopacket/layers"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/cache"
 )
 
 const (
@@ -26,10 +28,14 @@ type ServiceMap struct {
 	ipMap *IPMap
 	// ipMap is the map from dns domains to services
 	dnsMap *DNSMap
+	// perClient determines whether DNS answers are also cached per client
+	perClient bool
 }
 
-// NewServiceMap generates a new ServiceMap structure
-func NewServiceMap(cleanupTime, evictTime time.Duration) (*ServiceMap, error) {
+// NewServiceMap generates a new ServiceMap structure.
+// maxEntries and shardsCount configure the size and concurrency of the cache
+// of IP to service mappings
+func NewServiceMap(cleanupTime, evictTime time.Duration, maxEntries int, shardsCount uint32) (*ServiceMap, error) {
 	sm := &ServiceMap{}
 	var err error
 
@@ -43,7 +49,7 @@ func NewServiceMap(cleanupTime, evictTime time.Duration) (*ServiceMap, error) {
 		return nil, err
 	}
 
-	if sm.ipCache, err = NewIPCache(cleanupTime, evictTime); err != nil {
+	if sm.ipCache, err = NewIPCache(cleanupTime, evictTime, maxEntries, shardsCount); err != nil {
 		return nil, err
 	}
 
@@ -80,12 +86,33 @@ func (sm *ServiceMap) ConfigServiceMap(services []Service) error {
 	return nil
 }
 
+// SetPerClient enables or disables per client attribution of DNS answers.
+// When enabled, a server IP is first attributed according to what the client
+// reaching it has resolved, falling back to the most recent answer seen from
+// any client.
+func (sm *ServiceMap) SetPerClient(perClient bool) {
+	sm.perClient = perClient
+}
+
 // ParseDNSResponse matches a DNS response to the configured services.
 // First tries to match by domain, then by regex, and finally by IP address.
 func (sm *ServiceMap) ParseDNSResponse(dns layers.DNS) {
-	if ip, _, services, found, ttl := sm.dnsMap.ParseDNSResponseFirstMatch(dns); found {
+	sm.ParseDNSResponseForClient(dns, "")
+}
+
+// ParseDNSResponseForClient matches a DNS response to the configured services
+// and records the match for the client that issued the query.
+// An empty client only updates the global mappings.
+// Returns the matched services.
+func (sm *ServiceMap) ParseDNSResponseForClient(dns layers.DNS, client string) ([]ServiceID, bool) {
+	ip, _, services, found, ttl := sm.dnsMap.ParseDNSResponseFirstMatch(dns)
+	if found {
 		sm.ipCache.Insert(ip, services, ttl)
+		if sm.perClient && client != "" {
+			sm.ipCache.InsertForClient(client, ip, services, ttl)
+		}
 	}
+	return services, found
 }
 
 // Lookup allows to lookup entries in the cache map
@@ -102,11 +129,29 @@ func (sm *ServiceMap) LookupIP(ip string) ([]ServiceID, bool) {
 		sm.ipCache.Insert(ip, services, 0)
 		return services, true
 	} else {
-		sm.ipCache.Insert(ip, services, 0)
+		// Unknown IPs are rechecked periodically
+		sm.ipCache.Insert(ip, services, NotFoundEntryTimeout)
 		return services, false
 	}
 }
 
+// LookupClientIP allows to lookup entries in the cache map for traffic between
+// client and ip. Mappings resolved by client take precedence over global ones.
+func (sm *ServiceMap) LookupClientIP(client, ip string) ([]ServiceID, bool) {
+	if sm.perClient && client != "" {
+		if services, ok := sm.ipCache.LookupForClient(client, ip); ok && len(services) > 0 {
+			return services, true
+		}
+	}
+	return sm.LookupIP(ip)
+}
+
+// IPCacheStats returns the usage counters of the cache of IP to service
+// mappings
+func (sm *ServiceMap) IPCacheStats() cache.SimpleTimeCacheStats {
+	return sm.ipCache.Stats()
+}
+
 func (sm *ServiceMap) GetName(id ServiceID) (string, bool) {
 	if s, ok := sm.idToService[id]; ok {
 		return s.Name, true
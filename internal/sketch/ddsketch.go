@@ -0,0 +1,190 @@
+package sketch
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// minIndexable is the smallest positive value with its own bin in a DDSketch.
+// Smaller values are counted as zeros
+const minIndexable = 1e-9
+
+// DDSketch estimates the quantiles of a stream of non-negative values with a
+// bounded relative error. Values are counted in logarithmic bins, bin i
+// holding the values in (Gamma^(i-1), Gamma^i]. When the number of bins
+// exceeds MaxBins the lowest bins are collapsed, trading the accuracy of the
+// lowest quantiles for bounded memory. Sketches with the same accuracy can be
+// merged. The fields are exported to allow serializing the sketch.
+// DDSketch is not safe for concurrent use
+type DDSketch struct {
+	Gamma   float64
+	MaxBins int
+	Bins    map[int]int64
+	Zeros   int64
+	Count   int64
+	Min     float64
+	Max     float64
+	Sum     float64
+
+	logGamma float64
+}
+
+// NewDDSketch creates a sketch estimating quantiles within the relative
+// accuracy alpha, e.g. 0.01, using at most maxBins bins
+func NewDDSketch(alpha float64, maxBins int) (*DDSketch, error) {
+	if alpha <= 0 || alpha >= 1 {
+		return nil, errors.New("the accuracy of the sketch must be in (0, 1)")
+	}
+	if maxBins <= 0 {
+		return nil, errors.New("the number of bins of the sketch must be positive")
+	}
+	gamma := (1 + alpha) / (1 - alpha)
+	return &DDSketch{
+		Gamma:    gamma,
+		MaxBins:  maxBins,
+		Bins:     make(map[int]int64),
+		logGamma: math.Log(gamma),
+	}, nil
+}
+
+// index returns the bin of the positive value v
+func (s *DDSketch) index(v float64) int {
+	if s.logGamma == 0 {
+		s.logGamma = math.Log(s.Gamma)
+	}
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+// value returns the estimate of the values in bin i
+func (s *DDSketch) value(i int) float64 {
+	return 2 * math.Pow(s.Gamma, float64(i)) / (s.Gamma + 1)
+}
+
+// Add adds the value v. Negative values are counted as zeros
+func (s *DDSketch) Add(v float64) {
+	if v < 0 {
+		v = 0
+	}
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+	if v < minIndexable {
+		s.Zeros++
+		return
+	}
+	if s.Bins == nil {
+		s.Bins = make(map[int]int64)
+	}
+	s.Bins[s.index(v)]++
+	s.collapse()
+}
+
+// collapse merges the lowest bins until at most MaxBins are left
+func (s *DDSketch) collapse() {
+	for len(s.Bins) > s.MaxBins {
+		first, second := math.MaxInt, math.MaxInt
+		for i := range s.Bins {
+			if i < first {
+				first, second = i, first
+			} else if i < second {
+				second = i
+			}
+		}
+		s.Bins[second] += s.Bins[first]
+		delete(s.Bins, first)
+	}
+}
+
+// Merge adds the values of o to the sketch. The sketches must have the same
+// accuracy
+func (s *DDSketch) Merge(o *DDSketch) error {
+	if s.Gamma != o.Gamma {
+		return errors.New("can not merge sketches with different accuracy")
+	}
+	if o.Count == 0 {
+		return nil
+	}
+	if s.Count == 0 || o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if s.Count == 0 || o.Max > s.Max {
+		s.Max = o.Max
+	}
+	s.Count += o.Count
+	s.Sum += o.Sum
+	s.Zeros += o.Zeros
+	if s.Bins == nil {
+		s.Bins = make(map[int]int64)
+	}
+	for i, n := range o.Bins {
+		s.Bins[i] += n
+	}
+	s.collapse()
+	return nil
+}
+
+// Quantile returns the estimate of the q quantile, with q in [0, 1]. Returns
+// 0 if the sketch is empty
+func (s *DDSketch) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return s.Min
+	}
+	if q >= 1 {
+		return s.Max
+	}
+	rank := int64(q * float64(s.Count-1))
+	if rank < s.Zeros {
+		return 0
+	}
+	seen := s.Zeros
+	for _, i := range s.sortedBins() {
+		seen += s.Bins[i]
+		if seen > rank {
+			return math.Max(s.Min, math.Min(s.Max, s.value(i)))
+		}
+	}
+	return s.Max
+}
+
+// Histogram returns the number of values in the buckets delimited by the
+// increasing upper bounds, plus a last bucket for the values above all the
+// bounds. Values are placed by the estimate of their bin
+func (s *DDSketch) Histogram(bounds []float64) []int64 {
+	ret := make([]int64, len(bounds)+1)
+	if s.Zeros > 0 {
+		ret[sort.SearchFloat64s(bounds, 0)] += s.Zeros
+	}
+	for i, n := range s.Bins {
+		ret[sort.SearchFloat64s(bounds, s.value(i))] += n
+	}
+	return ret
+}
+
+// sortedBins returns the indexes of the bins in use in increasing order
+func (s *DDSketch) sortedBins() []int {
+	keys := make([]int, 0, len(s.Bins))
+	for i := range s.Bins {
+		keys = append(keys, i)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// Reset removes all the values
+func (s *DDSketch) Reset() {
+	s.Bins = make(map[int]int64)
+	s.Zeros = 0
+	s.Count = 0
+	s.Min = 0
+	s.Max = 0
+	s.Sum = 0
+}
@@ -0,0 +1,69 @@
+package sketch
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDDSketch(t *testing.T) {
+	if _, err := NewDDSketch(0, 10); err == nil {
+		t.Fatalf("Sketch with no accuracy created")
+	}
+	s, err := NewDDSketch(0.01, 2048)
+	if err != nil {
+		t.Fatalf("Can not create the sketch: %s", err)
+	}
+	if s.Quantile(0.5) != 0 {
+		t.Fatalf("Wrong quantile of an empty sketch")
+	}
+	// Bimodal distribution: 100 small and 100 large values
+	for i := 1; i <= 100; i++ {
+		s.Add(float64(i))
+		s.Add(float64(1400 + i))
+	}
+	s.Add(0)
+	for q, expected := range map[float64]float64{0.25: 50, 0.75: 1450, 0.99: 1498} {
+		if v := s.Quantile(q); math.Abs(v-expected) > 0.01*expected+1 {
+			t.Fatalf("Wrong quantile %f: %f instead of %f", q, v, expected)
+		}
+	}
+	if s.Quantile(0) != 0 || s.Quantile(1) != 1500 || s.Count != 201 {
+		t.Fatalf("Wrong extremes %f %f or count %d", s.Quantile(0), s.Quantile(1), s.Count)
+	}
+	h := s.Histogram([]float64{64, 1024})
+	if len(h) != 3 || h[0] != 65 || h[1] != 36 || h[2] != 100 {
+		t.Fatalf("Wrong histogram %v", h)
+	}
+
+	o, _ := NewDDSketch(0.01, 2048)
+	o.Add(5000)
+	if err := s.Merge(o); err != nil {
+		t.Fatalf("Can not merge sketches: %s", err)
+	}
+	if s.Count != 202 || s.Max != 5000 {
+		t.Fatalf("Wrong merged sketch count %d max %f", s.Count, s.Max)
+	}
+	other, _ := NewDDSketch(0.05, 2048)
+	if err := s.Merge(other); err == nil {
+		t.Fatalf("Merged sketches with different accuracy")
+	}
+
+	s.Reset()
+	if s.Count != 0 || len(s.Bins) != 0 || s.Zeros != 0 {
+		t.Fatalf("Sketch not reset")
+	}
+}
+
+func TestDDSketchCollapse(t *testing.T) {
+	s, _ := NewDDSketch(0.01, 10)
+	for i := 1; i <= 1000; i++ {
+		s.Add(float64(i))
+	}
+	if len(s.Bins) != 10 {
+		t.Fatalf("Wrong number of bins %d", len(s.Bins))
+	}
+	// The highest quantiles are still accurate
+	if v := s.Quantile(0.999); math.Abs(v-999) > 0.01*999+1 {
+		t.Fatalf("Wrong quantile after collapsing %f", v)
+	}
+}
@@ -0,0 +1,188 @@
+// Package sketch implements summaries of traffic streams in bounded memory
+package sketch
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+)
+
+// Counter is an item tracked by a SpaceSaving sketch. Count overestimates the
+// real weight of the item by at most Error
+type Counter struct {
+	Key   string
+	Count int64
+	Error int64
+}
+
+// ssEntry is a counter stored in the heap of the sketch
+type ssEntry struct {
+	Counter
+	index int
+}
+
+// ssHeap is a min-heap of counters ordered by count
+type ssHeap []*ssEntry
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *ssHeap) Push(x interface{}) {
+	e := x.(*ssEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *ssHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// SpaceSaving finds the heaviest items of a weighted stream keeping a fixed
+// number of counters. When all counters are in use a new item replaces the
+// one with the smallest count, inheriting it as its error. Any item heavier
+// than a 1/capacity fraction of the total weight is guaranteed to be tracked.
+// SpaceSaving is not safe for concurrent use
+type SpaceSaving struct {
+	capacity int
+	entries  ssHeap
+	index    map[string]*ssEntry
+	total    int64
+}
+
+// NewSpaceSaving creates a sketch tracking at most capacity items
+func NewSpaceSaving(capacity int) (*SpaceSaving, error) {
+	if capacity <= 0 {
+		return nil, errors.New("the capacity of the sketch must be positive")
+	}
+	return &SpaceSaving{
+		capacity: capacity,
+		entries:  make(ssHeap, 0, capacity),
+		index:    make(map[string]*ssEntry, capacity),
+	}, nil
+}
+
+// Add accounts weight to the item key
+func (ss *SpaceSaving) Add(key string, weight int64) {
+	ss.total += weight
+	if e, ok := ss.index[key]; ok {
+		e.Count += weight
+		heap.Fix(&ss.entries, e.index)
+		return
+	}
+	if len(ss.entries) < ss.capacity {
+		e := &ssEntry{Counter: Counter{Key: key, Count: weight}}
+		heap.Push(&ss.entries, e)
+		ss.index[key] = e
+		return
+	}
+	e := ss.entries[0]
+	delete(ss.index, e.Key)
+	e.Key = key
+	e.Error = e.Count
+	e.Count += weight
+	ss.index[key] = e
+	heap.Fix(&ss.entries, 0)
+}
+
+// min returns the smallest count tracked if all the counters are in use, that
+// bounds the weight of the items not tracked, 0 otherwise
+func (ss *SpaceSaving) min() int64 {
+	if len(ss.entries) < ss.capacity {
+		return 0
+	}
+	return ss.entries[0].Count
+}
+
+// Merge adds the items of o to the sketch. Items missing from one of the
+// sketches are accounted with the smallest count of that sketch as error, so
+// that counts keep overestimating the real weights. The heaviest items are
+// kept when the merged items exceed the capacity
+func (ss *SpaceSaving) Merge(o *SpaceSaving) {
+	if o.total == 0 {
+		return
+	}
+	sMin, oMin := ss.min(), o.min()
+	merged := make(map[string]Counter, len(ss.entries)+len(o.entries))
+	for _, e := range ss.entries {
+		c := e.Counter
+		c.Count += oMin
+		c.Error += oMin
+		merged[c.Key] = c
+	}
+	for _, e := range o.entries {
+		c, ok := merged[e.Key]
+		if ok {
+			c.Count += e.Count - oMin
+			c.Error += e.Error - oMin
+		} else {
+			c = e.Counter
+			c.Count += sMin
+			c.Error += sMin
+		}
+		merged[c.Key] = c
+	}
+	counters := make([]Counter, 0, len(merged))
+	for _, c := range merged {
+		counters = append(counters, c)
+	}
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].Count != counters[j].Count {
+			return counters[i].Count > counters[j].Count
+		}
+		return counters[i].Key < counters[j].Key
+	})
+	if len(counters) > ss.capacity {
+		counters = counters[:ss.capacity]
+	}
+	total := ss.total + o.total
+	ss.Reset()
+	ss.total = total
+	for _, c := range counters {
+		e := &ssEntry{Counter: c}
+		heap.Push(&ss.entries, e)
+		ss.index[c.Key] = e
+	}
+}
+
+// Top returns the k items with the largest count, heaviest first
+func (ss *SpaceSaving) Top(k int) []Counter {
+	ret := make([]Counter, 0, len(ss.entries))
+	for _, e := range ss.entries {
+		ret = append(ret, e.Counter)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Key < ret[j].Key
+	})
+	if k >= 0 && k < len(ret) {
+		ret = ret[:k]
+	}
+	return ret
+}
+
+// Total returns the weight of all the items added
+func (ss *SpaceSaving) Total() int64 {
+	return ss.total
+}
+
+// Len returns the number of items tracked
+func (ss *SpaceSaving) Len() int {
+	return len(ss.entries)
+}
+
+// Reset removes all the items
+func (ss *SpaceSaving) Reset() {
+	ss.entries = ss.entries[:0]
+	ss.index = make(map[string]*ssEntry, ss.capacity)
+	ss.total = 0
+}
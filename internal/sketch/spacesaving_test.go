@@ -0,0 +1,88 @@
+package sketch
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSpaceSavingExact(t *testing.T) {
+	ss, err := NewSpaceSaving(10)
+	if err != nil {
+		t.Fatalf("Can not create the sketch: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		for j := 0; j <= i; j++ {
+			ss.Add(fmt.Sprintf("item%d", i), 10)
+		}
+	}
+	top := ss.Top(3)
+	if len(top) != 3 {
+		t.Fatalf("Expected 3 items, got %d", len(top))
+	}
+	for i, c := range top {
+		key := fmt.Sprintf("item%d", 4-i)
+		if c.Key != key || c.Count != int64(10*(5-i)) || c.Error != 0 {
+			t.Fatalf("Expected %s with count %d, got %+v", key, 10*(5-i), c)
+		}
+	}
+	if ss.Total() != 150 {
+		t.Fatalf("Expected a total of 150, got %d", ss.Total())
+	}
+}
+
+func TestSpaceSavingHeavyHitters(t *testing.T) {
+	ss, _ := NewSpaceSaving(20)
+	// Two heavy items hidden in a long tail of distinct light ones
+	for i := 0; i < 10000; i++ {
+		ss.Add(fmt.Sprintf("light%d", i), 1)
+		if i%10 == 0 {
+			ss.Add("heavy1", 5)
+		}
+		if i%20 == 0 {
+			ss.Add("heavy2", 5)
+		}
+	}
+	if ss.Len() != 20 {
+		t.Fatalf("Sketch grew to %d items", ss.Len())
+	}
+	top := ss.Top(2)
+	if top[0].Key != "heavy1" || top[1].Key != "heavy2" {
+		t.Fatalf("Heavy hitters not found: %+v", top)
+	}
+	for _, c := range top {
+		if c.Count-c.Error > map[string]int64{"heavy1": 5000, "heavy2": 2500}[c.Key] {
+			t.Fatalf("Count of %s underestimated: %+v", c.Key, c)
+		}
+	}
+
+	ss.Reset()
+	if ss.Len() != 0 || ss.Total() != 0 || len(ss.Top(10)) != 0 {
+		t.Fatalf("Sketch not empty after reset")
+	}
+}
+
+func TestSpaceSavingMerge(t *testing.T) {
+	a, _ := NewSpaceSaving(2)
+	b, _ := NewSpaceSaving(2)
+	a.Add("x", 10)
+	a.Add("y", 5)
+	a.Add("z", 1)
+	b.Add("x", 3)
+	b.Add("w", 4)
+	a.Merge(b)
+	// z replaced y in a. w, missing from a, inherits the smallest count of a
+	// as error and outweighs z
+	top := a.Top(-1)
+	if len(top) != 2 || top[0] != (Counter{Key: "x", Count: 13}) || top[1] != (Counter{Key: "w", Count: 10, Error: 6}) {
+		t.Fatalf("Wrong merged items %v", top)
+	}
+	if a.Total() != 23 {
+		t.Fatalf("Total %d instead of 23", a.Total())
+	}
+}
+
+func TestSpaceSavingCapacity(t *testing.T) {
+	if _, err := NewSpaceSaving(0); err == nil {
+		t.Fatalf("Sketch with no capacity accepted")
+	}
+}
@@ -2,18 +2,29 @@
 package stats
 
 import (
+	"bytes"
 	"encoding/json"
 	"time"
 
 	"github.com/traffic-refinery/traffic-refinery/internal/flowstats"
 )
 
+const (
+	// DefaultCacheDumpPeriod is the period used to dump services with no
+	// emit interval configured
+	DefaultCacheDumpPeriod = 10 * time.Second
+	// MinCacheDumpPeriod is the shortest period allowed for dumping services
+	MinCacheDumpPeriod = 100 * time.Millisecond
+)
+
 type OutTraffic struct {
 	Flows []json.RawMessage
 }
 
 type CacheDump struct {
-	Fc       *flowstats.FlowCache
+	Fc *flowstats.FlowCache
+	// Services is the list of services to dump. A nil list dumps all services
+	Services []string
 	lastTime int64
 }
 
@@ -32,6 +43,8 @@ func (cp *CacheDump) Init() error {
 	return nil
 }
 
+// Run dumps the flows of the services. Rollups are printed as "Rollup"
+// records, one per aggregation level, on the lines following the flows
 func (cp *CacheDump) Run() []byte {
 	endTime := time.Now().Unix()
 
@@ -44,11 +57,22 @@ func (cp *CacheDump) Run() []byte {
 		Data:    nil,
 	}
 
-	trafficData := cp.Fc.DumpToString()
+	trafficData, rollups := cp.Fc.DumpServices(cp.Services)
+
+	records := [][]byte{}
+	if cp.Fc.ExportsFlows() {
+		data, _ := json.Marshal(trafficData)
+		outJson.Data = data
+		data, _ = json.Marshal(outJson)
+		records = append(records, data)
+	}
+	for _, rollup := range rollups {
+		outJson.Type = "Rollup"
+		outJson.Data, _ = json.Marshal(rollup)
+		data, _ := json.Marshal(outJson)
+		records = append(records, data)
+	}
 	cp.lastTime = endTime
 
-	data, _ := json.Marshal(trafficData)
-	outJson.Data = data
-	data, _ = json.Marshal(outJson)
-	return data
+	return bytes.Join(records, []byte("\n"))
 }
@@ -0,0 +1,267 @@
+// Package stats implements different methods to print various statistics
+package stats
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/cache"
+	"github.com/traffic-refinery/traffic-refinery/internal/flowstats"
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+	"github.com/traffic-refinery/traffic-refinery/internal/servicemap"
+	"github.com/traffic-refinery/traffic-refinery/internal/welford"
+)
+
+const (
+	// DNSQueryTimeout is the time after which a query with no response is
+	// considered unanswered
+	DNSQueryTimeout = 5 * time.Second
+	// DNSMaxPending is the maximum number of queries waiting for a response.
+	// When full, the oldest query is evicted to make room for a new one
+	DNSMaxPending = 1 << 16
+)
+
+// pendingQuery is a query waiting for a response
+type pendingQuery struct {
+	key string
+	ts  int64
+}
+
+// DNSStats collects analytics on the DNS traffic seen by the DNS parser.
+// It is fed by the parser as a network.DNSProcessor and printed as a Stats
+// collector
+type DNSStats struct {
+	Sm       *servicemap.ServiceMap
+	lastTime int64
+
+	queries   int64
+	responses int64
+	nxDomain  int64
+	servFail  int64
+	timeouts  int64
+	latency   welford.Welford
+	// serviceDomains contains the set of domains resolved for each service
+	serviceDomains map[string]map[string]bool
+	// clientResolvers contains the set of resolvers used by each client
+	clientResolvers map[string]map[string]bool
+	// pending contains the queries waiting for a response, kept in order of
+	// arrival in pendingOrder. evicted is the number of queries evicted
+	// because too many were pending
+	pending      map[string]*list.Element
+	pendingOrder *list.List
+	evicted      int64
+	// lastTs is the timestamp of the most recent message processed
+	lastTs int64
+	// policy is the privacy policy applied to the exported addresses and
+	// domains, if set
+	policy *flowstats.PrivacyPolicy
+
+	sync.Mutex
+}
+
+// DNSStatsOut is the representation of the DNS analytics for an emit window
+type DNSStatsOut struct {
+	Queries      int64
+	Responses    int64
+	NXDomain     int64
+	ServFail     int64
+	NXDomainRate float64
+	ServFailRate float64
+	Unanswered   int64
+	// EvictedQueries is the number of queries no longer matched with their
+	// response because too many were waiting for one
+	EvictedQueries  int64
+	LatencyAvg      float64
+	LatencyVar      float64
+	ServiceDomains  map[string][]string
+	ClientResolvers map[string][]string
+	IPCache         cache.SimpleTimeCacheStats
+}
+
+func NewDNSStats(sm *servicemap.ServiceMap) *DNSStats {
+	cp := new(DNSStats)
+	cp.Sm = sm
+	cp.clear()
+	cp.pending = make(map[string]*list.Element)
+	cp.pendingOrder = list.New()
+	return cp
+}
+
+// SetPrivacyPolicy sets the privacy policy applied to the exported addresses
+// and domains. Clients are treated as local addresses and resolvers as
+// service addresses
+func (cp *DNSStats) SetPrivacyPolicy(policy *flowstats.PrivacyPolicy) {
+	cp.Lock()
+	cp.policy = policy
+	cp.Unlock()
+}
+
+// exportSets converts the sets of values of each key into lists, applying
+// the privacy policy to the keys with keyFn and to the values with valueFn.
+// Values removed by the policy are omitted
+func exportSets(sets map[string]map[string]bool, keyFn, valueFn func(string) string) map[string][]string {
+	out := make(map[string][]string)
+	for k, values := range sets {
+		k = keyFn(k)
+		seen := make(map[string]bool)
+		for _, v := range out[k] {
+			seen[v] = true
+		}
+		for v := range values {
+			if v = valueFn(v); v != "" && !seen[v] {
+				seen[v] = true
+				out[k] = append(out[k], v)
+			}
+		}
+	}
+	return out
+}
+
+// clear resets the counters of the current emit window
+func (cp *DNSStats) clear() {
+	cp.queries = 0
+	cp.responses = 0
+	cp.nxDomain = 0
+	cp.servFail = 0
+	cp.timeouts = 0
+	cp.evicted = 0
+	cp.latency.Reset()
+	cp.serviceDomains = make(map[string]map[string]bool)
+	cp.clientResolvers = make(map[string]map[string]bool)
+}
+
+// queryKey returns the key used to match a response with its query
+func queryKey(msg *network.DNSMessage) string {
+	return fmt.Sprintf("%s-%s-%d", msg.Client, msg.Resolver, msg.Dns.ID)
+}
+
+// addPending records the query with key key sent at time ts, evicting the
+// oldest pending query if too many are waiting for a response
+func (cp *DNSStats) addPending(key string, ts int64) {
+	if e, ok := cp.pending[key]; ok {
+		e.Value.(*pendingQuery).ts = ts
+		cp.pendingOrder.MoveToBack(e)
+		return
+	}
+	if len(cp.pending) >= DNSMaxPending {
+		oldest := cp.pendingOrder.Front()
+		delete(cp.pending, oldest.Value.(*pendingQuery).key)
+		cp.pendingOrder.Remove(oldest)
+		cp.evicted++
+	}
+	cp.pending[key] = cp.pendingOrder.PushBack(&pendingQuery{key: key, ts: ts})
+}
+
+// ProcessDNS updates the analytics based on the DNS message msg
+func (cp *DNSStats) ProcessDNS(msg *network.DNSMessage) error {
+	cp.Lock()
+	defer cp.Unlock()
+
+	if _, ok := cp.clientResolvers[msg.Client]; !ok {
+		cp.clientResolvers[msg.Client] = make(map[string]bool)
+	}
+	cp.clientResolvers[msg.Client][msg.Resolver] = true
+	if msg.TStamp > cp.lastTs {
+		cp.lastTs = msg.TStamp
+	}
+
+	if !msg.Dns.QR {
+		cp.queries++
+		cp.addPending(queryKey(msg), msg.TStamp)
+		return nil
+	}
+
+	cp.responses++
+	switch msg.Dns.ResponseCode {
+	case layers.DNSResponseCodeNXDomain:
+		cp.nxDomain++
+	case layers.DNSResponseCodeServFail:
+		cp.servFail++
+	}
+	key := queryKey(msg)
+	if e, ok := cp.pending[key]; ok {
+		cp.latency.AddValue(float64(msg.TStamp - e.Value.(*pendingQuery).ts))
+		delete(cp.pending, key)
+		cp.pendingOrder.Remove(e)
+	}
+	if len(msg.Dns.Questions) > 0 {
+		for _, id := range msg.Services {
+			if name, found := cp.Sm.GetName(id); found {
+				if _, ok := cp.serviceDomains[name]; !ok {
+					cp.serviceDomains[name] = make(map[string]bool)
+				}
+				cp.serviceDomains[name][string(msg.Dns.Questions[0].Name)] = true
+			}
+		}
+	}
+	return nil
+}
+
+func (cp *DNSStats) Type() string {
+	return "DNSStats"
+}
+
+func (cp *DNSStats) Init() error {
+	cp.lastTime = time.Now().Unix()
+	return nil
+}
+
+func (cp *DNSStats) Run() []byte {
+	endTime := time.Now().Unix()
+
+	cp.Lock()
+	// Queries without a response for too long are accounted as unanswered.
+	// Uses packet timestamps to behave consistently in replay mode
+	expire := cp.lastTs - int64(DNSQueryTimeout)
+	for e := cp.pendingOrder.Front(); e != nil && e.Value.(*pendingQuery).ts < expire; e = cp.pendingOrder.Front() {
+		cp.timeouts++
+		delete(cp.pending, e.Value.(*pendingQuery).key)
+		cp.pendingOrder.Remove(e)
+	}
+	out := DNSStatsOut{
+		Queries:        cp.queries,
+		Responses:      cp.responses,
+		NXDomain:       cp.nxDomain,
+		ServFail:       cp.servFail,
+		Unanswered:     cp.timeouts,
+		EvictedQueries: cp.evicted,
+		LatencyAvg:     cp.latency.Avg,
+		LatencyVar:     cp.latency.Var,
+		IPCache:        cp.Sm.IPCacheStats(),
+	}
+	if cp.responses > 0 {
+		out.NXDomainRate = float64(cp.nxDomain) / float64(cp.responses)
+		out.ServFailRate = float64(cp.servFail) / float64(cp.responses)
+	}
+	keep := func(s string) string { return s }
+	if cp.policy != nil {
+		out.ServiceDomains = exportSets(cp.serviceDomains, keep, cp.policy.ApplyDomain)
+		out.ClientResolvers = exportSets(cp.clientResolvers, cp.policy.ApplyLocalIP, cp.policy.ApplyServiceIP)
+	} else {
+		out.ServiceDomains = exportSets(cp.serviceDomains, keep, keep)
+		out.ClientResolvers = exportSets(cp.clientResolvers, keep, keep)
+	}
+	cp.clear()
+	cp.Unlock()
+
+	dnsData, _ := json.Marshal(out)
+
+	outJson := OutJson{
+		Version: "3.0",
+		Conf:    "--",
+		Type:    cp.Type(),
+		TsStart: cp.lastTime,
+		TsEnd:   endTime,
+		Data:    dnsData,
+	}
+
+	cp.lastTime = endTime
+
+	b, _ := json.Marshal(outJson)
+	return b
+}
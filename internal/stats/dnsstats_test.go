@@ -0,0 +1,177 @@
+package stats
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/flowstats"
+	"github.com/traffic-refinery/traffic-refinery/internal/network"
+	"github.com/traffic-refinery/traffic-refinery/internal/servicemap"
+)
+
+func TestDNSStats(t *testing.T) {
+	smap, err := servicemap.NewServiceMap(10*time.Minute, 5*time.Minute, 1000, 4)
+	if err != nil {
+		t.Fatalf("Fatal error in creating service map %s", err)
+	}
+	smap.ConfigServiceMap([]servicemap.Service{
+		{
+			Name: "Netflix",
+			Code: 0,
+			ServiceFilter: servicemap.Filter{
+				DomainsString: []string{"netflix.com"},
+			},
+		},
+	})
+
+	ds := NewDNSStats(smap)
+	ds.Init()
+	question := []layers.DNSQuestion{{Name: []byte("api-global.netflix.com")}}
+	ds.ProcessDNS(&network.DNSMessage{
+		Dns:      &layers.DNS{ID: 1, QR: false, Questions: question},
+		TStamp:   1000,
+		Client:   "192.168.1.2",
+		Resolver: "8.8.8.8",
+	})
+	ds.ProcessDNS(&network.DNSMessage{
+		Dns:      &layers.DNS{ID: 1, QR: true, Questions: question},
+		TStamp:   3000,
+		Client:   "192.168.1.2",
+		Resolver: "8.8.8.8",
+		Services: []servicemap.ServiceID{0},
+	})
+	ds.ProcessDNS(&network.DNSMessage{
+		Dns:      &layers.DNS{ID: 2, QR: true, ResponseCode: layers.DNSResponseCodeNXDomain},
+		TStamp:   4000,
+		Client:   "192.168.1.3",
+		Resolver: "1.1.1.1",
+	})
+
+	out := OutJson{}
+	if err := json.Unmarshal(ds.Run(), &out); err != nil {
+		t.Fatalf("Can not unmarshal the collector output: %s", err)
+	}
+	data := DNSStatsOut{}
+	if err := json.Unmarshal(out.Data, &data); err != nil {
+		t.Fatalf("Can not unmarshal the DNS stats: %s", err)
+	}
+	if data.Queries != 1 || data.Responses != 2 {
+		t.Fatalf("Queries %d and responses %d do not correspond to expected ones %d %d", data.Queries, data.Responses, 1, 2)
+	} else if data.NXDomainRate != 0.5 {
+		t.Fatalf("NXDOMAIN rate %f does not correspond to expected one %f", data.NXDomainRate, 0.5)
+	} else if data.LatencyAvg != 2000 {
+		t.Fatalf("Latency %f does not correspond to expected one %d", data.LatencyAvg, 2000)
+	} else if len(data.ServiceDomains["Netflix"]) != 1 || data.ServiceDomains["Netflix"][0] != "api-global.netflix.com" {
+		t.Fatalf("Resolved domains for Netflix are incorrect: %v", data.ServiceDomains)
+	} else if len(data.ClientResolvers["192.168.1.3"]) != 1 || data.ClientResolvers["192.168.1.3"][0] != "1.1.1.1" {
+		t.Fatalf("Resolvers for 192.168.1.3 are incorrect: %v", data.ClientResolvers)
+	}
+}
+
+func TestDNSStatsPrivacy(t *testing.T) {
+	smap, err := servicemap.NewServiceMap(10*time.Minute, 5*time.Minute, 1000, 4)
+	if err != nil {
+		t.Fatalf("Fatal error in creating service map %s", err)
+	}
+	smap.ConfigServiceMap([]servicemap.Service{
+		{
+			Name: "Netflix",
+			Code: 0,
+			ServiceFilter: servicemap.Filter{
+				DomainsString: []string{"netflix.com"},
+			},
+		},
+	})
+	policy, err := flowstats.NewPrivacyPolicy(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.LocalIP = flowstats.FieldPolicy{Action: flowstats.PolicyTruncate}
+	policy.ServiceIP = flowstats.FieldPolicy{Action: flowstats.PolicyTruncate, PrefixV4: 16}
+	policy.DomainName = flowstats.FieldPolicy{Action: flowstats.PolicyTruncate}
+
+	ds := NewDNSStats(smap)
+	ds.SetPrivacyPolicy(policy)
+	ds.Init()
+	question := []layers.DNSQuestion{{Name: []byte("api-global.netflix.com")}}
+	for i, addrs := range [][2]string{{"192.168.1.2", "8.8.8.8"}, {"192.168.1.3", "8.8.4.4"}} {
+		ds.ProcessDNS(&network.DNSMessage{
+			Dns:      &layers.DNS{ID: uint16(i), QR: true, Questions: question},
+			TStamp:   1000,
+			Client:   addrs[0],
+			Resolver: addrs[1],
+			Services: []servicemap.ServiceID{0},
+		})
+	}
+
+	out := OutJson{}
+	if err := json.Unmarshal(ds.Run(), &out); err != nil {
+		t.Fatalf("Can not unmarshal the collector output: %s", err)
+	}
+	data := DNSStatsOut{}
+	if err := json.Unmarshal(out.Data, &data); err != nil {
+		t.Fatalf("Can not unmarshal the DNS stats: %s", err)
+	}
+	if len(data.ServiceDomains["Netflix"]) != 1 || data.ServiceDomains["Netflix"][0] != "netflix.com" {
+		t.Fatalf("Resolved domains for Netflix are not truncated: %v", data.ServiceDomains)
+	}
+	if len(data.ClientResolvers) != 1 || len(data.ClientResolvers["192.168.1.0"]) != 1 || data.ClientResolvers["192.168.1.0"][0] != "8.8.0.0" {
+		t.Fatalf("Resolvers are not truncated: %v", data.ClientResolvers)
+	}
+}
+
+func TestDNSStatsMaxPending(t *testing.T) {
+	smap, err := servicemap.NewServiceMap(10*time.Minute, 5*time.Minute, 1000, 4)
+	if err != nil {
+		t.Fatalf("Fatal error in creating service map %s", err)
+	}
+	ds := NewDNSStats(smap)
+	ds.Init()
+	query := func(id uint16, ts int64, resolver string) {
+		ds.ProcessDNS(&network.DNSMessage{
+			Dns:      &layers.DNS{ID: id, QR: false},
+			TStamp:   ts,
+			Client:   "192.168.1.2",
+			Resolver: resolver,
+		})
+	}
+	for i := 0; i < DNSMaxPending; i++ {
+		query(uint16(i), int64(i+1), "8.8.8.8")
+	}
+	query(0, DNSMaxPending+1, "1.1.1.1")
+	if len(ds.pending) != DNSMaxPending {
+		t.Fatalf("Expected %d pending queries, found %d", DNSMaxPending, len(ds.pending))
+	}
+	// The oldest query was evicted, its response is not matched
+	ds.ProcessDNS(&network.DNSMessage{
+		Dns:      &layers.DNS{ID: 0, QR: true},
+		TStamp:   int64(DNSQueryTimeout),
+		Client:   "192.168.1.2",
+		Resolver: "8.8.8.8",
+	})
+	// A late response times the queries out but the last one
+	ds.ProcessDNS(&network.DNSMessage{
+		Dns:      &layers.DNS{ID: 1, QR: true},
+		TStamp:   int64(DNSQueryTimeout) + DNSMaxPending + 1,
+		Client:   "192.168.1.3",
+		Resolver: "8.8.8.8",
+	})
+
+	out := OutJson{}
+	if err := json.Unmarshal(ds.Run(), &out); err != nil {
+		t.Fatalf("Can not unmarshal the collector output: %s", err)
+	}
+	data := DNSStatsOut{}
+	if err := json.Unmarshal(out.Data, &data); err != nil {
+		t.Fatalf("Can not unmarshal the DNS stats: %s", err)
+	}
+	if data.EvictedQueries != 1 || data.LatencyAvg != 0 {
+		t.Fatalf("Expected 1 evicted query and no latency, found %d and %f", data.EvictedQueries, data.LatencyAvg)
+	}
+	if data.Unanswered != DNSMaxPending-1 || len(ds.pending) != 1 {
+		t.Fatalf("Expected %d unanswered queries and 1 pending, found %d and %d", DNSMaxPending-1, data.Unanswered, len(ds.pending))
+	}
+}
@@ -0,0 +1,50 @@
+// Package stats implements different methods to print various statistics
+package stats
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/flowstats"
+)
+
+// FlowCacheStats prints the usage counters of the flow cache
+type FlowCacheStats struct {
+	Fc       *flowstats.FlowCache
+	lastTime int64
+}
+
+func NewFlowCacheStats(fc *flowstats.FlowCache) *FlowCacheStats {
+	cp := new(FlowCacheStats)
+	cp.Fc = fc
+	return cp
+}
+
+func (cp *FlowCacheStats) Type() string {
+	return "FlowCacheStats"
+}
+
+func (cp *FlowCacheStats) Init() error {
+	cp.lastTime = time.Now().Unix()
+	return nil
+}
+
+func (cp *FlowCacheStats) Run() []byte {
+	endTime := time.Now().Unix()
+
+	data, _ := json.Marshal(cp.Fc.Stats())
+
+	outJson := OutJson{
+		Version: "3.0",
+		Conf:    "--",
+		Type:    cp.Type(),
+		TsStart: cp.lastTime,
+		TsEnd:   endTime,
+		Data:    data,
+	}
+
+	cp.lastTime = endTime
+
+	b, _ := json.Marshal(outJson)
+	return b
+}
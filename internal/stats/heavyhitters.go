@@ -0,0 +1,52 @@
+// Package stats implements different methods to print various statistics
+package stats
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/flowstats"
+)
+
+// HeavyHittersStats prints the top destinations, domains and clients seen
+// by the flow cache since the previous print
+type HeavyHittersStats struct {
+	Fc       *flowstats.FlowCache
+	lastTime int64
+}
+
+func NewHeavyHittersStats(fc *flowstats.FlowCache) *HeavyHittersStats {
+	cp := new(HeavyHittersStats)
+	cp.Fc = fc
+	return cp
+}
+
+func (cp *HeavyHittersStats) Type() string {
+	return "HeavyHitters"
+}
+
+func (cp *HeavyHittersStats) Init() error {
+	cp.lastTime = time.Now().Unix()
+	return nil
+}
+
+func (cp *HeavyHittersStats) Run() []byte {
+	endTime := time.Now().Unix()
+
+	out, _ := cp.Fc.DumpHeavyHitters()
+	data, _ := json.Marshal(out)
+
+	outJson := OutJson{
+		Version: "3.0",
+		Conf:    "--",
+		Type:    cp.Type(),
+		TsStart: cp.lastTime,
+		TsEnd:   endTime,
+		Data:    data,
+	}
+
+	cp.lastTime = endTime
+
+	b, _ := json.Marshal(outJson)
+	return b
+}
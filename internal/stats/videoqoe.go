@@ -0,0 +1,52 @@
+// Package stats implements different methods to print various statistics
+package stats
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/traffic-refinery/traffic-refinery/internal/flowstats"
+)
+
+// VideoQoEStats prints the QoE inferred for the video sessions ended since
+// the previous print
+type VideoQoEStats struct {
+	Fc       *flowstats.FlowCache
+	lastTime int64
+}
+
+func NewVideoQoEStats(fc *flowstats.FlowCache) *VideoQoEStats {
+	cp := new(VideoQoEStats)
+	cp.Fc = fc
+	return cp
+}
+
+func (cp *VideoQoEStats) Type() string {
+	return "VideoQoE"
+}
+
+func (cp *VideoQoEStats) Init() error {
+	cp.lastTime = time.Now().Unix()
+	return nil
+}
+
+func (cp *VideoQoEStats) Run() []byte {
+	endTime := time.Now().Unix()
+
+	out, _ := cp.Fc.DumpVideoSessions()
+	data, _ := json.Marshal(out)
+
+	outJson := OutJson{
+		Version: "3.0",
+		Conf:    "--",
+		Type:    cp.Type(),
+		TsStart: cp.lastTime,
+		TsEnd:   endTime,
+		Data:    data,
+	}
+
+	cp.lastTime = endTime
+
+	b, _ := json.Marshal(outJson)
+	return b
+}
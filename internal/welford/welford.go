@@ -3,6 +3,8 @@
 package welford
 
 import (
+	"encoding/binary"
+	"errors"
 	"math"
 )
 
@@ -67,3 +69,24 @@ func (wf *Welford) CheckAndAddValue(val, maxStdDev, maxVal float64) bool {
 	}
 	return true
 }
+
+
+// GobEncode serializes the welford computation, including its internal state
+func (wf Welford) GobEncode() ([]byte, error) {
+	b := make([]byte, 0, 5*8)
+	for _, v := range []float64{wf.N, wf.Avg, wf.m2, wf.StdDev, wf.Var} {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	return b, nil
+}
+
+// GobDecode restores a welford computation serialized by GobEncode
+func (wf *Welford) GobDecode(b []byte) error {
+	if len(b) != 5*8 {
+		return errors.New("wrong welford encoding length")
+	}
+	for i, v := range []*float64{&wf.N, &wf.Avg, &wf.m2, &wf.StdDev, &wf.Var} {
+		*v = math.Float64frombits(binary.LittleEndian.Uint64(b[i*8:]))
+	}
+	return nil
+}
@@ -237,3 +237,27 @@ func BenchmarkWelfordCheckAndAddValue(b *testing.B) {
 func biggerThan(first float64, second float64) bool {
 	return first > second
 }
+
+func TestWelfordGob(t *testing.T) {
+	w := Welford{}
+	for i := 0; i < 10; i++ {
+		w.AddValue(float64(i))
+	}
+	b, err := w.GobEncode()
+	if err != nil {
+		t.Fatalf("Can not encode: %s", err)
+	}
+	d := Welford{}
+	if err := d.GobDecode(b); err != nil {
+		t.Fatalf("Can not decode: %s", err)
+	}
+	if d != w {
+		t.Fatalf("Decoded %+v differs from the original %+v", d, w)
+	}
+	// The internal state must be restored to continue the computation
+	w.AddValue(10)
+	d.AddValue(10)
+	if d != w {
+		t.Fatalf("Decoded %+v differs from the original %+v after adding a value", d, w)
+	}
+}
@@ -1,47 +1,145 @@
+// create_counters generates internal/counters/init_counters.go, registering
+// the counters defined in the counters package. A counter is a type with the
+// methods of the Counter interface. The description of a counter is the first
+// sentence of its doc comment and its output is the type named after the
+// counter with the "Out" suffix, if any, or the counter itself.
+// Run from the root of the repository
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
 	"os"
+	"sort"
+	"strings"
+)
 
-	"golang.org/x/tools/go/packages"
+const (
+	counterDir = "internal/counters"
+	outFile    = "internal/counters/init_counters.go"
 )
 
-func main() {
-	cfg := &packages.Config{
-		Mode: packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo,
+// counterMethods are the methods of the Counter interface with their number
+// of results
+var counterMethods = map[string]int{
+	"AddPacket": 1,
+	"Reset":     1,
+	"Clear":     1,
+	"Type":      1,
+	"Collect":   1,
+}
+
+// receiverType returns the name of the type of the receiver of a method
+func receiverType(fd *ast.FuncDecl) string {
+	t := fd.Recv.List[0].Type
+	if star, ok := t.(*ast.StarExpr); ok {
+		t = star.X
 	}
-	pkgs, err := packages.Load(cfg, "github.com/traffic-refinery/traffic-refinery/internal/counters")
-	if err != nil {
-		panic(err)
+	if id, ok := t.(*ast.Ident); ok {
+		return id.Name
 	}
+	return ""
+}
 
-	f, err := os.Create("internal/counters/init_counters.go")
+// description returns the first sentence of the doc comment of a counter
+func description(name, doc string) string {
+	doc = strings.Join(strings.Fields(doc), " ")
+	doc = strings.TrimPrefix(doc, name+" ")
+	if i := strings.Index(doc, ". "); i >= 0 {
+		doc = doc[:i]
+	}
+	doc = strings.TrimSuffix(doc, ".")
+	if doc == "" {
+		return ""
+	}
+	return strings.ToUpper(doc[:1]) + doc[1:]
+}
+
+func main() {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, counterDir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, parser.ParseComments)
 	if err != nil {
 		panic(err)
 	}
-	defer f.Close()
-	w := bufio.NewWriter(f)
-	_, _ = w.WriteString("package counters\n\nfunc init() {\n")
-
-	for _, pkg := range pkgs {
-		fmt.Printf("Package %s\n", pkg.ID)
-		fmt.Printf("Syntax %d\n", len(pkg.Syntax))
-		for _, s := range pkg.Syntax {
-			fmt.Printf("Syntax %d\n", s.Package)
-			fmt.Printf("Object %d\n", len(s.Scope.Objects))
-			for _, o := range s.Scope.Objects {
-				fmt.Printf("Object %s\n", o.Kind.String())
-				if o.Kind.String() == "type" {
-					fmt.Printf("Object %s\n", o.Name)
-					fmt.Printf("Object %s\n", fmt.Sprintf("\tregisterType((*%s)(nil))", o.Name))
-					w.WriteString(fmt.Sprintf("\tregisterType((*%s)(nil))\n", o.Name))
+	pkg, ok := pkgs["counters"]
+	if !ok {
+		panic("package counters not found")
+	}
+
+	types := make(map[string]string)
+	methods := make(map[string]map[string]bool)
+	for _, f := range pkg.Files {
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.GenDecl:
+				if d.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range d.Specs {
+					ts := spec.(*ast.TypeSpec)
+					if _, ok := ts.Type.(*ast.StructType); !ok {
+						continue
+					}
+					doc := ts.Doc
+					if doc == nil {
+						doc = d.Doc
+					}
+					types[ts.Name.Name] = doc.Text()
 				}
+			case *ast.FuncDecl:
+				if d.Recv == nil || len(d.Recv.List) == 0 {
+					continue
+				}
+				results, ok := counterMethods[d.Name.Name]
+				if !ok || d.Type.Results == nil || d.Type.Results.NumFields() != results {
+					continue
+				}
+				name := receiverType(d)
+				if methods[name] == nil {
+					methods[name] = make(map[string]bool)
+				}
+				methods[name][d.Name.Name] = true
 			}
 		}
 	}
-	_, _ = w.WriteString("}\n")
 
-	w.Flush()
+	counters := []string{}
+	for name := range types {
+		if len(methods[name]) == len(counterMethods) {
+			counters = append(counters, name)
+		}
+	}
+	sort.Strings(counters)
+
+	var b bytes.Buffer
+	b.WriteString("// Code generated by scripts/create_counters.go. DO NOT EDIT.\n\n")
+	b.WriteString("package counters\n\nfunc init() {\n")
+	for _, name := range counters {
+		output := name
+		if _, ok := types[name+"Out"]; ok {
+			output = name + "Out"
+		}
+		fmt.Printf("Registering counter %s\n", name)
+		fmt.Fprintf(&b, "\tMustRegister(CounterInfo{\n")
+		fmt.Fprintf(&b, "\t\tName: %q,\n", name)
+		fmt.Fprintf(&b, "\t\tDescription: %q,\n", description(name, types[name]))
+		fmt.Fprintf(&b, "\t\tOutput: %s{},\n", output)
+		fmt.Fprintf(&b, "\t\tNew: func() Counter { return &%s{} },\n", name)
+		fmt.Fprintf(&b, "\t})\n")
+	}
+	b.WriteString("}\n")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(outFile, src, 0644); err != nil {
+		panic(err)
+	}
 }